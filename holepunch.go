@@ -6,6 +6,7 @@ import (
     "math/rand"
     "os"
     "os/signal"
+    "syscall"
     "time"
 
     "github.com/andrew-d/holepunch/holepunch"
@@ -29,7 +30,7 @@ func main() {
     // Check subcommand.
     if len(os.Args) < 2 {
         fmt.Println("Usage:")
-        fmt.Println("  holepunch (server|client) [options]")
+        fmt.Println("  holepunch (server|client|pt|keygen) [options]")
         fmt.Println("")
         os.Exit(1)
     }
@@ -44,17 +45,33 @@ func main() {
         holepunch.RunServer(os.Args[2:])
         which = SERVER
 
+    case "keygen":
+        holepunch.RunKeygen(os.Args[2:])
+        return
+
+    case "pt":
+        // Run as a Tor pluggable transport - there's nothing to clean up.
+        holepunch.RunPT(os.Args[2:])
+
     default:
         fmt.Fprintf(os.Stderr, "Usage:\n")
-        fmt.Fprintf(os.Stderr, "  holepunch (server|client) [options]\n\n")
+        fmt.Fprintf(os.Stderr, "  holepunch (server|client|pt|keygen) [options]\n\n")
         os.Exit(1)
     }
 
     // Deal with signals.
     sig_ch := make(chan os.Signal, 1)
-    signal.Notify(sig_ch, os.Interrupt, os.Kill)
-
-    <-sig_ch
+    signal.Notify(sig_ch, os.Interrupt, os.Kill, syscall.SIGHUP)
+
+    // SIGHUP reloads the server, and is otherwise ignored.
+    for sig := range sig_ch {
+        if sig != syscall.SIGHUP {
+            break
+        }
+        if which == SERVER {
+            holepunch.ReloadServer()
+        }
+    }
 
     switch which {
     case UNKNOWN:
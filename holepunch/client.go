@@ -1,73 +1,419 @@
 package holepunch
 
 import (
-    "bytes"
-    "crypto/hmac"
     "crypto/sha256"
     "encoding/hex"
     "fmt"
     flag "github.com/ogier/pflag"
     "log"
+    "net"
     "os"
-    "strings"
+    "path/filepath"
+    "strconv"
+    "sync"
     "time"
 
     "github.com/andrew-d/holepunch/transports"
     "github.com/andrew-d/holepunch/tuntap"
 )
 
+// How long to wait after knocking before connecting.
+const knockDelay = 250 * time.Millisecond
+
 // Client options
 var method string
 var server_addr string
+var server_file string
+var state_file string
+var select_mode string
+var idle_timeout time.Duration
+var knock_with string
+var dtls_pin string
+var signal_url string
+var turn_opts transports.TURNOptions
+var pt_args string
+var pt_port int
+var tls_sni string
+var server_key string
+var rekey_interval time.Duration
+var rekey_bytes uint64
+var user_name string
+var user_secret string
+var key_file string
+var client_key *transports.StaticKey
+var server_kdf_arg string
+
+// The server's KDF parameters, if we were given them.  Knocking, TLS mimicry
+// and DTLS can't work without them.
+var pinned_kdf *transports.KDFParams
+
+// Deriving the TLS mimicry key is slow, so it's done once, at startup.
+var tls_mimicry *transports.TLSMimicry
+
+// The pluggable transport is started the first time it's needed, and shared
+// by all connections.
+var pt_client *transports.ManagedPT
+var pt_lock sync.Mutex
 
 func RunClient(args []string) {
     flags := flag.NewFlagSet("client", flag.ExitOnError)
     addCommonOptions(flags)
 
-    flags.StringVar(&method, "m", "all", "methods to try, as comma-seperated list (tcp/udp/icmp/dns/all)")
+    flags.StringVar(&method, "m", "all", "methods to try, as comma-seperated list (tcp/udp/dtls/webrtc/turn/mqtt/dir/pt/icmp/dns/all)")
     flags.StringVar(&server_addr, "server", "10.93.0.1", "ip address of the server")
+    flags.StringVar(&server_file, "servers", "", "file containing a list of servers to try")
+    flags.StringVar(&state_file, "state", defaultStateFile(), "file to remember working servers in (empty to disable)")
+    flags.StringVar(&select_mode, "select", "order", "how to pick a server: try in order, or race all servers of the same priority (order/race)")
+    flags.DurationVar(&idle_timeout, "idle-timeout", 0, "fail over if nothing is received from the server for this long (0 to disable)")
+    flags.StringVar(&knock_with, "knock", "", "knock on the server before connecting (udp/icmp)")
+    flags.StringVar(&signal_url, "signal-url", "", "URL of the server's WebRTC signaling endpoint (default: http://server:44464/signal)")
+    flags.StringVar(&turn_opts.Server, "turn-server", "", "TURN server to relay through, for the turn method (host[:port])")
+    flags.StringVar(&turn_opts.Protocol, "turn-proto", "udp", "protocol to use to talk to the TURN server (udp/tcp/tls)")
+    flags.StringVar(&turn_opts.Username, "turn-user", "", "username for the TURN server")
+    flags.StringVar(&turn_opts.Password, "turn-pass", "", "password for the TURN server")
+    flags.StringVar(&turn_opts.Realm, "turn-realm", "", "realm of the TURN server")
+    flags.StringVar(&tls_sni, "tls-sni", "", "server name to send when mimicking TLS (default: none)")
+    flags.StringVar(&pt_args, "pt-args", "", "arguments for the pluggable transport, as in a bridge line (e.g. cert=...;iat-mode=0)")
+    flags.IntVar(&pt_port, "pt-port", transports.PT_PORT, "port the server's pluggable transport listens on")
+    flags.StringVar(&user_name, "user", "", "user name to give the server, if it has a secret for each user")
+    flags.StringVar(&user_secret, "user-secret", "", "this user's own secret (default: --pass)")
+    flags.StringVar(&user_secret_from, "user-secret-from", "", "read this user's secret from file:PATH, env:NAME, stdin or cmd:COMMAND instead of --user-secret")
+    flags.StringVar(&key_file, "key", "", "file holding our private key (from 'holepunch keygen'), to use instead of a password")
+    flags.StringVar(&server_key, "server-key", "", "the server's static public key, as hex (required with --key; otherwise, if not given, only the password is checked)")
+    flags.DurationVar(&rekey_interval, "rekey-interval", transports.DefaultRekeyInterval, "how often to replace the session keys")
+    flags.Uint64Var(&rekey_bytes, "rekey-bytes", transports.DefaultRekeyBytes, "replace the session keys after this many bytes")
+    flags.StringVar(&server_kdf_arg, "server-kdf", "", "the server's KDF parameters, as it logs them (needed for --knock, --tls-mimic, and DTLS without --dtls-pin)")
+    flags.StringVar(&dtls_pin, "dtls-pin", "", "SHA-256 fingerprint of the server's DTLS certificate (if not given, use a pre-shared key)")
 
     flags.Parse(args)
 
-    cmd_args := flags.Args()
-    if len(cmd_args) < 1 {
+    if err := loadSecrets(flags, "client"); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n\n", err)
+        os.Exit(1)
+    }
+
+    if len(dtls_pin) > 0 {
+        if pin, err := hex.DecodeString(dtls_pin); err != nil || len(pin) != sha256.Size {
+            fmt.Fprintf(os.Stderr, "Invalid DTLS certificate fingerprint: %s\n\n", dtls_pin)
+            os.Exit(1)
+        }
+    }
+
+    if len(server_key) > 0 {
+        if key, err := hex.DecodeString(server_key); err != nil || len(key) != 32 {
+            fmt.Fprintf(os.Stderr, "Invalid server key: %s\n\n", server_key)
+            os.Exit(1)
+        }
+    }
+
+    if len(key_file) > 0 {
+        var err error
+        client_key, err = transports.LoadPrivateKey(key_file)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error loading key: %s\n\n", err)
+            os.Exit(1)
+        }
+
+        // Without a password, nothing else shows that the server is real.
+        if len(server_key) == 0 {
+            fmt.Fprintf(os.Stderr, "--key needs --server-key\n\n")
+            os.Exit(1)
+        }
+    }
+
+    if len(server_kdf_arg) > 0 {
+        var err error
+        pinned_kdf, err = transports.ParseKDFParams(server_kdf_arg)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Invalid server KDF parameters: %s\n\n", err)
+            os.Exit(1)
+        }
+    }
+    if (len(knock_with) > 0 || tls_mimic) && pinned_kdf == nil {
+        fmt.Fprintf(os.Stderr, "--knock and --tls-mimic need --server-kdf\n\n")
+        os.Exit(1)
+    }
+
+    if err := parseShapingOptions(); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n\n", err)
+        os.Exit(1)
+    }
+
+    if tls_mimic {
+        var err error
+        tls_mimicry, err = transports.NewTLSMimicry(password, pinned_kdf, tls_sni)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error deriving TLS mimicry key: %s\n\n", err)
+            os.Exit(1)
+        }
+    }
+
+    if select_mode != "order" && select_mode != "race" {
+        fmt.Fprintf(os.Stderr, "Invalid selection mode: %s\n\n", select_mode)
+        os.Exit(1)
+    }
+
+    // Servers given on the command line are tried in the order given,
+    // followed by any servers from the server file.
+    methods := parseMethods(method)
+    var servers []*serverEntry
+    for i, addr := range flags.Args() {
+        servers = append(servers, &serverEntry{addr: addr, priority: i, weight: 1, methods: methods})
+    }
+
+    if len(server_file) > 0 {
+        from_file, err := loadServerFile(server_file, methods)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error loading server list: %s\n", err)
+            os.Exit(1)
+        }
+
+        // Move the file's priorities past ours, keeping their order.
+        if len(from_file) > 0 {
+            lowest := from_file[0].priority
+            for _, s := range from_file {
+                if s.priority < lowest {
+                    lowest = s.priority
+                }
+            }
+            for _, s := range from_file {
+                s.priority += len(servers) - lowest
+            }
+        }
+        servers = append(servers, from_file...)
+    }
+
+    if len(servers) < 1 {
         fmt.Fprintf(os.Stderr, "No server address given!\n\n")
         fmt.Fprintf(os.Stderr, "Usage:\n")
-        fmt.Fprintf(os.Stderr, "  holepunch client [options] server_addr\n\n")
+        fmt.Fprintf(os.Stderr, "  holepunch client [options] server_addr [server_addr...]\n")
+        fmt.Fprintf(os.Stderr, "  holepunch client [options] --servers server_list\n\n")
         os.Exit(1)
     } else {
         // Use a different goroutine, so the main routine can wait for signals.
         tt := getTuntap(true)
-        go startClient(tt, cmd_args[0])
+        go startClient(tt, newServerList(servers, state_file, pinned_kdf))
+    }
+}
+
+// The secret for the handshake.  Everything outside it (knocking, TLS
+// mimicry, DTLS and so on) uses the server's password.
+func handshakeSecret() string {
+    if len(user_secret) > 0 {
+        return user_secret
     }
+    return password
 }
 
 func StopClient() {
     // TODO: fill me in!
+    pt_lock.Lock()
+    if pt_client != nil {
+        pt_client.Close()
+    }
+    pt_lock.Unlock()
+}
+
+// Returns the pluggable transport, starting it if necessary.
+func getPTClient() (*transports.ManagedPT, error) {
+    pt_lock.Lock()
+    defer pt_lock.Unlock()
+
+    if pt_client == nil {
+        pt, err := transports.StartPTClient(pt_bin, pt_name, pt_state)
+        if err != nil {
+            return nil, err
+        }
+        pt_client = pt
+    }
+    return pt_client, nil
+}
+
+func defaultStateFile() string {
+    home := os.Getenv("HOME")
+    if len(home) == 0 {
+        return ""
+    }
+    return filepath.Join(home, ".holepunch_servers")
 }
 
-func startClient(tt tuntap.Device, hpserver string) {
+// Options for TCP connections to the server.
+func tcpClientOptions() *transports.TCPOptions {
+    return &transports.TCPOptions{Mimic: tls_mimicry}
+}
+
+func startClient(tt tuntap.Device, servers *serverList) {
     defer tt.Close()
-    log.Printf("Holepunching with server %s...\n", hpserver)
 
-    methods := strings.Split(method, ",")
-    if len(methods) == 1 && methods[0] == "all" {
-        methods = []string{"tcp", "udp", "icmp", "dns"}
+    for {
+        conn, server := connectToAny(servers)
+        if conn == nil {
+            log.Printf("Could not connect to any server, retrying in %s...\n", minServerBackoff)
+            <-time.After(minServerBackoff)
+            continue
+        }
+        servers.markGood(server)
+        log.Printf("Connected to server %s (reliable = %t)\n", server.addr, conn.IsReliable())
+
+        if !forwardPackets(tt, conn, server) {
+            // The TUN/TAP device is gone, so there's nothing left to do.
+            return
+        }
+
+        log.Printf("Lost connection to server %s, failing over...\n", server.addr)
+        servers.markFailed(server)
+    }
+}
+
+// Try each group of servers in turn, returning the first connection that
+// succeeds.
+func connectToAny(servers *serverList) (transports.PacketClient, *serverEntry) {
+    for _, group := range servers.ordered() {
+        if select_mode == "race" {
+            conn, server := raceServers(servers, group)
+            if conn != nil {
+                return conn, server
+            }
+            continue
+        }
+
+        for _, server := range group {
+            conn := connectToServer(server)
+            if conn != nil {
+                return conn, server
+            }
+            servers.markFailed(server)
+        }
+    }
+
+    return nil, nil
+}
+
+// Connect to every server in the group at the same time, and keep whichever
+// connection succeeds first.
+func raceServers(servers *serverList, group []*serverEntry) (transports.PacketClient, *serverEntry) {
+    type result struct {
+        conn   transports.PacketClient
+        server *serverEntry
+    }
+
+    results := make(chan result, len(group))
+    for _, server := range group {
+        go func(server *serverEntry) {
+            results <- result{connectToServer(server), server}
+        }(server)
+    }
+
+    var winner result
+    for i := 0; i < len(group); i++ {
+        res := <-results
+        if res.conn == nil {
+            servers.markFailed(res.server)
+        } else if winner.conn == nil {
+            winner = res
+
+            // Close the losers as they come in, in the background.  They
+            // still count towards each server's health.
+            remaining := len(group) - i - 1
+            go func() {
+                for j := 0; j < remaining; j++ {
+                    res := <-results
+                    if res.conn == nil {
+                        servers.markFailed(res.server)
+                        continue
+                    }
+                    servers.markGood(res.server)
+                    res.conn.Close()
+                }
+            }()
+            break
+        }
     }
 
-    var conn transports.PacketClient
-    var err error
+    return winner.conn, winner.server
+}
+
+// Try each of the server's methods in turn, returning the first one that
+// connects and authenticates.
+func connectToServer(server *serverEntry) transports.PacketClient {
+    log.Printf("Holepunching with server %s...\n", server.addr)
+
+    if len(knock_with) > 0 {
+        err := transports.SendKnock(server.addr, knock_with, password, pinned_kdf)
+        if err != nil {
+            log.Printf("Error knocking on %s: %s\n", server.addr, err)
+            return nil
+        }
+
+        // Give the server a moment to let us in.
+        <-time.After(knockDelay)
+    }
 
-    for _, m := range methods {
+    tcp_opts := tcpClientOptions()
+    for _, m := range server.methods {
         var curr_conn transports.PacketClient
+        var err error
 
-        err = nil
         switch m {
         case "tcp":
-            curr_conn, err = transports.NewTCPPacketClient(hpserver)
+            curr_conn, err = transports.NewTCPPacketClient(server.addr, tcp_opts)
 
         case "udp":
-            curr_conn, err = transports.NewUDPPacketClient(hpserver)
+            curr_conn, err = transports.NewUDPPacketClient(server.addr)
+
+        case "dtls":
+            opts := transports.DTLSOptions{Secret: password, KDF: pinned_kdf}
+            if len(dtls_pin) > 0 {
+                opts.PinnedCert, _ = hex.DecodeString(dtls_pin)
+            } else if pinned_kdf == nil {
+                log.Printf("No --dtls-pin or --server-kdf given, skipping method 'dtls'\n")
+                continue
+            }
+            curr_conn, err = transports.NewDTLSPacketClient(server.addr, &opts)
+
+        case "webrtc":
+            opts := transports.WebRTCOptions{
+                Secret:      password,
+                STUNServers: splitList(stun_servers),
+                SignalURL:   signal_url,
+            }
+            curr_conn, err = transports.NewWebRTCPacketClient(server.addr, &opts)
+
+        case "turn":
+            if len(turn_opts.Server) == 0 {
+                log.Printf("No TURN server given, skipping method 'turn'\n")
+                continue
+            }
+            curr_conn, err = transports.NewTURNPacketClient(server.addr, &turn_opts)
+
+        case "mqtt":
+            // The broker is the meeting point, so the server's address isn't
+            // needed.
+            if len(mqtt_opts.Broker) == 0 {
+                log.Printf("No MQTT broker given, skipping method 'mqtt'\n")
+                continue
+            }
+            curr_conn, err = transports.NewMQTTPacketClient(&mqtt_opts)
+
+        case "dir":
+            if len(drop_opts.Dir) == 0 {
+                log.Printf("No shared directory given, skipping method 'dir'\n")
+                continue
+            }
+            curr_conn, err = transports.NewDeadDropPacketClient(&drop_opts)
+
+        case "pt":
+            if len(pt_bin) == 0 {
+                log.Printf("No pluggable transport given, skipping method 'pt'\n")
+                continue
+            }
+
+            var pt *transports.ManagedPT
+            pt, err = getPTClient()
+            if err == nil {
+                target := net.JoinHostPort(server.addr, strconv.Itoa(pt_port))
+                curr_conn, err = pt.Dial(target, pt_args, tcp_opts)
+            }
 
         default:
             log.Printf("Unknown method: %s\n", m)
@@ -75,101 +421,116 @@ func startClient(tt tuntap.Device, hpserver string) {
         }
 
         if err != nil {
-            log.Printf("Error creating transport '%s': %s\n", m, err)
+            log.Printf("Error creating transport '%s' to %s: %s\n", m, server.addr, err)
             continue
         }
 
         // Set up encryption.
-        enc_conn, err := transports.NewEncryptedPacketClient(curr_conn, "foobar")
+        enc_opts := transports.EncryptionOptions{
+            Secret:        handshakeSecret(),
+            Identity:      user_name,
+            ClientKey:     client_key,
+            IsClient:      true,
+            RekeyInterval: rekey_interval,
+            RekeyBytes:    rekey_bytes,
+            KDF:           server.getKDF(),
+        }
+        enc_opts.ServerKey, _ = hex.DecodeString(server_key)
+        if ticket := server.takeTicket(); ticket != nil {
+            enc_opts.Ticket = []byte(ticket.ticket)
+            enc_opts.TicketSecret = []byte(ticket.secret)
+        }
+        enc_conn, err := transports.NewEncryptedPacketClient(curr_conn, &enc_opts)
+        server.setKDF(enc_opts.KDF)
         if err != nil {
-            log.Printf("Could not initialize encryption: %s\n", err)
+            log.Printf("Could not initialize encryption with %s: %s\n", server.addr, err)
             curr_conn.Close()
             continue
         }
 
         // Encryption is valid, which means that we're authenticated.
-        conn = enc_conn
-    }
+        var conn transports.PacketClient = enc_conn
+        if shape_opts.Enabled() {
+            conn, err = transports.NewShapedPacketClient(enc_conn, &shape_opts)
+            if err != nil {
+                log.Printf("Could not set up traffic shaping with %s: %s\n", server.addr, err)
+                continue
+            }
+        }
 
-    if conn == nil {
-        log.Printf("Could not create connection to server, exiting...\n")
-        return
+        // A resumed session has nothing to negotiate.
+        if enc_conn.Resumed() != nil {
+            log.Printf("Resumed session with %s\n", server.addr)
+            return conn
+        }
+
+        if err = negotiateClient(conn, enc_conn.ChannelBinding()); err != nil {
+            log.Printf("Could not negotiate with %s: %s\n", server.addr, err)
+            conn.Close()
+            continue
+        }
+        return conn
     }
-    log.Printf("Connected to server (reliable = %t)\n", conn.IsReliable())
 
+    return nil
+}
+
+// Forward packets between the TUN/TAP device and the server until one of them
+// goes away.  Returns false if the TUN/TAP device has closed, and true if the
+// server connection has been lost.
+func forwardPackets(tt tuntap.Device, conn transports.PacketClient, server *serverEntry) bool {
     recv_ch := conn.RecvChannel()
     send_ch := conn.SendChannel()
 
     defer conn.Close()
 
+    // A nil channel blocks forever, so this disables the timeout.
+    var idle_ch <-chan time.Time
+    var idle_timer *time.Timer
+    if idle_timeout > 0 {
+        idle_timer = time.NewTimer(idle_timeout)
+        idle_ch = idle_timer.C
+        defer idle_timer.Stop()
+    }
+
     for {
         // TODO: some way of stopping this
         select {
-        case from_server := <-recv_ch:
-            log.Printf("server --> tuntap (%d bytes)\n", len(from_server))
-            tt.Write(from_server)
+        case from_server, ok := <-recv_ch:
+            if !ok {
+                log.Println("Connection to server closed")
+                return true
+            }
+            if idle_timer != nil {
+                idle_timer.Reset(idle_timeout)
+            }
+
+            // Keep the latest ticket, for when we next connect.  Anything
+            // else is left over from the negotiation.
+            if len(from_server) > 0 && from_server[0] == msgSessionTicket {
+                if ticket, err := parseSessionTicket(from_server); err == nil {
+                    server.setTicket(ticket)
+                }
+                continue
+            }
+            if len(from_server) < 1 || from_server[0] != msgData {
+                continue
+            }
+
+            log.Printf("server --> tuntap (%d bytes)\n", len(from_server)-1)
+            tt.Write(from_server[1:])
 
         case from_tuntap := <-tt.RecvChannel():
             log.Printf("tuntap --> server (%d bytes)\n", len(from_tuntap))
-            send_ch <- from_tuntap
+            send_ch <- frameData(from_tuntap)
+
+        case <-idle_ch:
+            log.Printf("Nothing received from server in %s\n", idle_timeout)
+            return true
 
         case <-tt.EOFChannel():
             log.Println("EOF received from TUN/TAP device, exiting...")
-            return
+            return false
         }
     }
 }
-
-func doAuth(conn transports.PacketClient) bool {
-    // Authentication times out after 10 seconds.
-    timeout_ch := time.After(10 * time.Second)
-    send_ch := conn.SendChannel()
-    recv_ch := conn.RecvChannel()
-
-    // Receive the nonce from the server.
-    var nonce []byte
-    select {
-    case nonce = <-recv_ch:
-        // fallthrough
-    case <-timeout_ch:
-        log.Printf("Client authentication timed out: receiving nonce\n")
-        return false
-    }
-
-    hm := hmac.New(sha256.New, []byte(password))
-    _, err := hm.Write(nonce)
-    if err != nil {
-        log.Printf("Error computing HMAC: %s\n", err)
-        return false
-    }
-
-    resp := make([]byte, 64)
-    hex.Encode(resp, hm.Sum(nil))
-
-    select {
-    case send_ch <- resp:
-        // fallthrough
-    case <-timeout_ch:
-        log.Printf("Client authentication timed out: sending respond\n")
-        return false
-    }
-
-    // Wait for a response from the server.
-    var serv_resp []byte
-    select {
-    case serv_resp = <-recv_ch:
-        // fallthrough
-    case <-timeout_ch:
-        log.Printf("Client authentication timed out: waiting for confirmation\n")
-        return false
-    }
-
-    // Check response.
-    if bytes.Equal(serv_resp, []byte("success")) {
-        log.Printf("Authentication success\n")
-        return true
-    } else {
-        log.Printf("Authentication failure: %s\n", serv_resp)
-        return false
-    }
-}
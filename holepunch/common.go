@@ -1,7 +1,15 @@
 package holepunch
 
 import (
+    "fmt"
     flag "github.com/ogier/pflag"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/andrew-d/holepunch/transports"
 )
 
 const MAJOR_VER = 1
@@ -10,8 +18,15 @@ const MINOR_VER = 0
 // Message that the client sends to the server to see if the server is
 // responding, and, if so, start the authentication procedure.
 type ClientInitialRequest struct {
+    // Client version
+    majorVer int
+    minorVer int
+
     // Client's hostname
     hostname string
+
+    // Challenge for the server
+    challenge string
 }
 
 // Message the server sends to the client to check version and start the
@@ -23,6 +38,9 @@ type ServerInitialResponse struct {
 
     // Challenge for the client
     challenge string
+
+    // Response to the client's challenge
+    challengeResp string
 }
 
 // Message the client sends to the server to complete authentication.
@@ -35,6 +53,20 @@ type ClientChallengeResponse struct {
 type ServerAuthenticationResult struct {
     // Success or failure.
     authenticationSuccess bool
+
+    // Why, on failure.
+    reason string
+}
+
+// A ticket the server gives the client, so that it can resume the session
+// later (see transports/ticket.go).
+type SessionTicket struct {
+    // How long the ticket is good for, in seconds.
+    lifetime int
+
+    // The ticket, and the secret that goes with it.
+    ticket string
+    secret string
 }
 
 /* The protocol for communication is simple:
@@ -42,36 +74,129 @@ type ServerAuthenticationResult struct {
  *    to the server to verify connectivity, check versions, and authenticate.
  *          Client                 Server
  *      check_version   -->          *
+ *            +
+ *        challenge
  *            *         <--     server_version
  *                                   +
+ *                               response
+ *                                   +
  *                               challenge
  *         response     -->          *
  *            *         <--        result
  *
+ *    Each side proves that it's the other end of the encrypted session (and
+ *    so that it knows the secret or key), and the client checks the server's
+ *    proof before answering, so it won't talk to a server that isn't ours.
+ *
  *    The messages can be distinguished by the first byte, as follows:
  *          0x00    data
  *          0x01    check_version
  *          0x02    server_challenge
  *          0x03    client_challenge_response
  *          0x04    server_auth_result
+ *          0x05    session_ticket
  *
  *    Note: if the challenge response is not received within 10 seconds, then
- *    the server will close the connection without sending a result.
+ *    the server will close the connection without sending a result.  If the
+ *    versions are incompatible (i.e. the major versions differ), the server
+ *    sends its version and then a failed result, so that both sides can say
+ *    what went wrong.  See negotiate.go for how the messages are serialized.
  *
- *  - After authentication succeeds, all further messages are just binary blobs
- *    that contain packets to be forwarded.  Note that the underlying transport
- *    may impose some overhead (e.g. the TCP transport will prefix packets with
- *    the length, since TCP is a stream-oriented protocol, and UDP might need
- *    to include a header for reliable delivery).
+ *  - After authentication succeeds, all further messages are data messages
+ *    (i.e. 0x00, followed by the packet to be forwarded), apart from the
+ *    session tickets that the server sends now and then.  Note that the
+ *    underlying transport may impose some overhead (e.g. the TCP transport
+ *    will prefix packets with the length, since TCP is a stream-oriented
+ *    protocol, and UDP might need to include a header for reliable delivery).
+ *
+ *  - A client that resumes a session with a ticket has already proved who it
+ *    is in the encryption handshake, and the server already knows its
+ *    version, so the negotiation phase is skipped.
  */
 
 // Global options
 var ipaddr string
 var netmask string
 var password string
+var stun_servers string
+var mqtt_opts transports.MQTTOptions
+var drop_opts transports.DeadDropOptions
+var pt_bin string
+var pt_name string
+var pt_state string
+var pad_to string
+var shape_opts transports.ShapingOptions
+var tls_mimic bool
 
 func addCommonOptions(f *flag.FlagSet) {
     f.StringVar(&ipaddr, "ip", "", "the IP address of the TUN/TAP device")
     f.StringVar(&netmask, "netmask", "255.255.0.0", "the netmask of the TUN/TAP device")
     f.StringVar(&password, "pass", "insecure", "password for authentication")
+    f.StringVar(&pass_from, "pass-from", "", "read the password from file:PATH, env:NAME, stdin or cmd:COMMAND instead of --pass")
+    f.StringVar(&secrets_config, "secrets-config", defaultSecretsConfig(), "file recording where secrets were read from (with --pass-from or --user-secret-from), to use when they aren't given (empty to disable)")
+    f.StringVar(&stun_servers, "stun", "",
+        "STUN servers for the WebRTC transport, as comma-seperated list of URLs (e.g. stun:stun.l.google.com:19302; none by default)")
+    f.StringVar(&mqtt_opts.Broker, "mqtt-broker", "", "MQTT broker to exchange packets through (e.g. ssl://broker:8883)")
+    f.StringVar(&mqtt_opts.Username, "mqtt-user", "", "username for the MQTT broker")
+    f.StringVar(&mqtt_opts.Password, "mqtt-pass", "", "password for the MQTT broker")
+    f.StringVar(&mqtt_opts.TopicPrefix, "mqtt-prefix", "holepunch", "prefix for MQTT topics")
+    f.StringVar(&drop_opts.Dir, "drop-dir", "", "shared directory to exchange packets through")
+    f.DurationVar(&drop_opts.PollInterval, "drop-poll", 1*time.Second, "how often to check the shared directory for new packets")
+    f.DurationVar(&drop_opts.IdleTimeout, "drop-idle", 10*time.Minute, "close dead drop sessions after this long without any packets (the client sends keepalives at half this)")
+    f.StringVar(&pt_bin, "pt-bin", "", "pluggable transport binary to use as an outer transport (e.g. obfs4proxy)")
+    f.StringVar(&pt_name, "pt-name", "obfs4", "name of the pluggable transport to ask the binary for")
+    f.BoolVar(&tls_mimic, "tls-mimic", false, "make the TCP transport look like TLS")
+    f.StringVar(&pad_to, "pad-to", "", "pad packets up to these sizes, as comma-seperated list (e.g. 256,512,1024,1500)")
+    f.IntVar(&shape_opts.RandomPad, "pad-random", 0, "add up to this many bytes of random padding to each packet")
+    f.DurationVar(&shape_opts.Jitter, "jitter", 0, "delay each packet by a random amount up to this long")
+    f.DurationVar(&shape_opts.ChaffInterval, "chaff", 0, "send a dummy packet this often, on average (0 to disable)")
+    f.IntVar(&shape_opts.CoverRate, "cover-rate", 0, "send this many fixed-size packets a second, whether or not there's traffic (0 to disable)")
+    f.IntVar(&shape_opts.CoverSize, "cover-size", 1024, "size of packets in cover traffic mode")
+    f.IntVar(&shape_opts.CoverQueue, "cover-queue", 64, "how many packets to queue in cover traffic mode before dropping them")
+    f.StringVar(&pt_state, "pt-state", defaultPTState(), "state directory for the pluggable transport (must only be accessible by us)")
+}
+
+// Fill in the parts of the shaping options that can't be parsed directly.
+func parseShapingOptions() error {
+    shape_opts.Buckets = nil
+    for _, item := range splitList(pad_to) {
+        size, err := strconv.Atoi(item)
+        if err != nil || size < 1 || size > transports.MaxShapeFrame {
+            return fmt.Errorf("invalid padding size: %s", item)
+        }
+        shape_opts.Buckets = append(shape_opts.Buckets, size)
+    }
+
+    if shape_opts.RandomPad < 0 || shape_opts.RandomPad > 0xFFFF {
+        return fmt.Errorf("invalid random padding: %d", shape_opts.RandomPad)
+    }
+    if shape_opts.CoverRate > 0xFFFF {
+        return fmt.Errorf("cover traffic rate too high: %d", shape_opts.CoverRate)
+    }
+    if shape_opts.CoverSize < transports.MinCoverSize || shape_opts.CoverSize > transports.MaxShapeFrame {
+        return fmt.Errorf("invalid cover traffic packet size: %d", shape_opts.CoverSize)
+    }
+    return nil
+}
+
+// The pluggable transport keeps its keys in its state directory, so this is
+// somewhere only we can get at, rather than somewhere shared like /tmp.
+func defaultPTState() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "holepunch", "pt-state")
+}
+
+// Split a comma-seperated list, ignoring empty entries.
+func splitList(s string) []string {
+    var ret []string
+    for _, item := range strings.Split(s, ",") {
+        item = strings.TrimSpace(item)
+        if len(item) > 0 {
+            ret = append(ret, item)
+        }
+    }
+    return ret
 }
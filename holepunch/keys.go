@@ -0,0 +1,233 @@
+package holepunch
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/hex"
+    "fmt"
+    flag "github.com/ogier/pflag"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/andrew-d/holepunch/transports"
+)
+
+// Rather than a password, clients can have their own key pairs, made with
+// `holepunch keygen`.  The server is given a file of the public keys it
+// accepts, much like ssh's authorized_keys:
+//
+//      # key                                                             options
+//      8c9e4f0c1b...e1d0c3   ip=10.93.0.5 methods=tcp,udp   # alice's laptop
+//      2f77a8be30...94a1b2                                  # build server
+//
+// The options are:
+//
+//      ip          The tunnel IP this client must use.  Packets from any other
+//                  source address are dropped, and the IP is always routed to
+//                  this client.
+//      methods     The transports this client may connect with.
+//
+// Anything after a '#' is a comment.  As with the users file, the file is
+// read again whenever it changes.
+
+type authorizedKey struct {
+    key     []byte
+    ip      net.IP
+    methods string
+    comment string
+}
+
+type keyStore struct {
+    path     string
+    keys     []*authorizedKey
+    mod_time time.Time
+    lock     sync.Mutex
+}
+
+// Parse a single key, as found in an authorized keys file.
+func parseAuthorizedKey(line string) (*authorizedKey, error) {
+    entry := &authorizedKey{}
+    if i := strings.Index(line, "#"); i >= 0 {
+        entry.comment = strings.TrimSpace(line[i+1:])
+        line = line[:i]
+    }
+
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("empty key entry")
+    }
+
+    key, err := hex.DecodeString(fields[0])
+    if err != nil || len(key) != 32 {
+        return nil, fmt.Errorf("invalid key: %s", fields[0])
+    }
+    entry.key = key
+
+    for _, opt := range fields[1:] {
+        parts := strings.SplitN(opt, "=", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid option '%s' for key %s", opt, fields[0])
+        }
+
+        var err error
+        switch parts[0] {
+        case "ip":
+            entry.ip = net.ParseIP(parts[1])
+            if entry.ip == nil {
+                err = fmt.Errorf("invalid IP address")
+            }
+
+        case "methods":
+            entry.methods = parts[1]
+
+        default:
+            err = fmt.Errorf("unknown option")
+        }
+
+        if err != nil {
+            return nil, fmt.Errorf("bad option '%s' for key %s: %s", opt, fields[0], err)
+        }
+    }
+
+    return entry, nil
+}
+
+// Load an authorized keys file.  Blank lines and lines starting with '#' are
+// ignored.
+func loadAuthorizedKeys(path string) ([]*authorizedKey, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var ret []*authorizedKey
+    ips := make(map[string]bool)
+    scanner := bufio.NewScanner(f)
+    lineno := 0
+    for scanner.Scan() {
+        lineno++
+
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) == 0 || line[0] == '#' {
+            continue
+        }
+
+        entry, err := parseAuthorizedKey(line)
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %s", path, lineno, err)
+        }
+        if entry.ip != nil {
+            if ips[entry.ip.String()] {
+                return nil, fmt.Errorf("%s:%d: IP %s given to more than one key", path, lineno, entry.ip)
+            }
+            ips[entry.ip.String()] = true
+        }
+        ret = append(ret, entry)
+    }
+
+    if err = scanner.Err(); err != nil {
+        return nil, err
+    }
+    return ret, nil
+}
+
+func newKeyStore(path string) (*keyStore, error) {
+    s := &keyStore{path: path}
+    if err := s.reload(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Reads the file again if it's changed since we last read it.  If the new
+// file is broken, we keep using the old one.
+func (s *keyStore) reload() error {
+    info, err := os.Stat(s.path)
+    if err != nil {
+        return err
+    }
+    if s.keys != nil && info.ModTime().Equal(s.mod_time) {
+        return nil
+    }
+
+    keys, err := loadAuthorizedKeys(s.path)
+    if err != nil {
+        return err
+    }
+
+    if s.keys != nil {
+        log.Printf("Reloaded authorized keys from %s (%d keys)\n", s.path, len(keys))
+    }
+    s.keys = keys
+    s.mod_time = info.ModTime()
+    return nil
+}
+
+// Returns the entry for a key, or nil if it isn't authorized.
+func (s *keyStore) Find(key []byte) *authorizedKey {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if err := s.reload(); err != nil {
+        log.Printf("Error reloading authorized keys: %s\n", err)
+    }
+
+    for _, entry := range s.keys {
+        if bytes.Equal(entry.key, key) {
+            return entry
+        }
+    }
+    return nil
+}
+
+// Returns a function that checks whether a key may connect with the given
+// method.
+func (s *keyStore) checker(method string) func([]byte) error {
+    return func(key []byte) error {
+        entry := s.Find(key)
+        if entry == nil {
+            return fmt.Errorf("unknown key %x", key)
+        }
+        if len(entry.methods) > 0 && !listContains(entry.methods, method) {
+            return fmt.Errorf("key %x may not connect with %s", key, method)
+        }
+        return nil
+    }
+}
+
+// --------------------------------------------------------------------------------
+
+func RunKeygen(args []string) {
+    flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+
+    var out_file string
+    flags.StringVar(&out_file, "out", "holepunch.key", "file to write the private key to")
+    flags.Parse(args)
+
+    if _, err := os.Stat(out_file); err == nil {
+        fmt.Fprintf(os.Stderr, "%s already exists, not overwriting it\n", out_file)
+        os.Exit(1)
+    }
+
+    key, err := transports.GenerateStaticKey()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error generating key: %s\n", err)
+        os.Exit(1)
+    }
+
+    err = ioutil.WriteFile(out_file, []byte(hex.EncodeToString(key.Private)+"\n"), 0600)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error writing key: %s\n", err)
+        os.Exit(1)
+    }
+
+    fmt.Printf("Private key written to %s (use it with --key)\n", out_file)
+    fmt.Printf("Public key, for the server's authorized keys file:\n")
+    fmt.Printf("%x\n", key.Public)
+}
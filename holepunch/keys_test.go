@@ -0,0 +1,112 @@
+package holepunch
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+var testKey = strings.Repeat("ab", 32)
+
+func TestParseAuthorizedKey(t *testing.T) {
+    key := bytes.Repeat([]byte{0xab}, 32)
+    tests := []struct {
+        line     string
+        expected authorizedKey
+    }{
+        {testKey, authorizedKey{key: key}},
+        {testKey + " ip=10.93.0.5 methods=tcp,udp # alice's laptop",
+            authorizedKey{key: key, ip: net.ParseIP("10.93.0.5"), methods: "tcp,udp", comment: "alice's laptop"}},
+        {testKey + " ip=fd00::5", authorizedKey{key: key, ip: net.ParseIP("fd00::5")}},
+        {testKey + "   #build server", authorizedKey{key: key, comment: "build server"}},
+    }
+    for _, test := range tests {
+        entry, err := parseAuthorizedKey(test.line)
+        if err != nil {
+            t.Errorf("%s: %s", test.line, err)
+            continue
+        }
+        if !bytes.Equal(entry.key, test.expected.key) || !entry.ip.Equal(test.expected.ip) ||
+            entry.methods != test.expected.methods || entry.comment != test.expected.comment {
+            t.Errorf("%s: got %+v, expected %+v", test.line, *entry, test.expected)
+        }
+    }
+
+    bad := []string{
+        "",
+        "# just a comment",
+        "abcd",
+        testKey + "ab",
+        strings.Repeat("zz", 32),
+        testKey + " ip=10.93.0",
+        testKey + " ip",
+        testKey + " expires=2025-01-01",
+    }
+    for _, line := range bad {
+        if _, err := parseAuthorizedKey(line); err == nil {
+            t.Errorf("%q: no error", line)
+        }
+    }
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "keys")
+    other := strings.Repeat("cd", 32)
+
+    tests := []struct {
+        contents string
+        count    int
+        err      string
+    }{
+        {"# keys\n\n" + testKey + " ip=10.93.0.5\n" + other + " ip=10.93.0.6\n", 2, ""},
+        {testKey + " ip=10.93.0.5\n" + other + " ip=10.93.0.5\n", 0, ":2: IP 10.93.0.5 given to more than one key"},
+        {testKey + "\n\nnot-a-key\n", 0, ":3: invalid key"},
+    }
+    for _, test := range tests {
+        if err := ioutil.WriteFile(path, []byte(test.contents), 0600); err != nil {
+            t.Fatal(err)
+        }
+        keys, err := loadAuthorizedKeys(path)
+        if test.err != "" {
+            if err == nil || !strings.Contains(err.Error(), test.err) {
+                t.Errorf("%q: got %v, expected %s", test.contents, err, test.err)
+            }
+        } else if err != nil || len(keys) != test.count {
+            t.Errorf("%q: got %d keys, %v", test.contents, len(keys), err)
+        }
+    }
+}
+
+func TestKeyChecker(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "keys")
+    anywhere := strings.Repeat("cd", 32)
+    contents := testKey + " methods=tcp,udp\n" + anywhere + "\n"
+    if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+        t.Fatal(err)
+    }
+    store, err := newKeyStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    key := bytes.Repeat([]byte{0xab}, 32)
+    tests := []struct {
+        key     []byte
+        method  string
+        allowed bool
+    }{
+        {key, "tcp", true},
+        {key, "udp", true},
+        {key, "icmp", false},
+        {bytes.Repeat([]byte{0xcd}, 32), "icmp", true},
+        {bytes.Repeat([]byte{0xef}, 32), "tcp", false},
+    }
+    for _, test := range tests {
+        if err := store.checker(test.method)(test.key); (err == nil) != test.allowed {
+            t.Errorf("%x with %s: got %v", test.key[:2], test.method, err)
+        }
+    }
+}
@@ -0,0 +1,451 @@
+package holepunch
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "log"
+    "os"
+    "time"
+
+    "github.com/andrew-d/holepunch/transports"
+)
+
+// The negotiation phase described in common.go.  It runs on top of the
+// encryption layer, so nothing here is visible on the wire.  Messages are
+// serialized as the type byte, followed by each field in order: integers
+// as 2-byte big-endian numbers, booleans as a single byte, and strings as a
+// 2-byte length followed by the bytes.
+//
+// Over unreliable transports, any of the messages can go missing, so the
+// client sends its latest message again every negotiateResend until it gets
+// an answer, and the server answers a repeated message by repeating its last
+// reply.
+//
+// Challenges are random nonces, and the response to a challenge is an HMAC
+// of both nonces, keyed with the encryption layer's channel binding (which is
+// derived from the session keys).  Only someone who completed the handshake
+// with us - which means knowing the secret, having an authorized key, or
+// (for the server) having the key the client pinned - can compute it, and
+// since the binding is different for every session, responses can't be
+// reused.
+
+const (
+    msgData                    = 0x00
+    msgCheckVersion            = 0x01
+    msgServerChallenge         = 0x02
+    msgClientChallengeResponse = 0x03
+    msgServerAuthResult        = 0x04
+    msgSessionTicket           = 0x05
+)
+
+// How long to wait for each step of the negotiation.
+const negotiateTimeout = 10 * time.Second
+
+const negotiateResend = 1 * time.Second
+
+const challengeLen = 32
+
+// Computes the response to a challenge.  The role stops either side's
+// response being reflected back as the other's.
+func challengeResponse(binding []byte, role, client_nonce, server_nonce string) string {
+    hm := hmac.New(sha256.New, binding)
+    hm.Write([]byte("holepunch " + role))
+    hm.Write([]byte(client_nonce))
+    hm.Write([]byte(server_nonce))
+    return string(hm.Sum(nil))
+}
+
+func checkResponse(resp, expected string) bool {
+    return hmac.Equal([]byte(resp), []byte(expected))
+}
+
+// Serializing and parsing messages.
+type messageWriter struct {
+    buf []byte
+}
+
+func newMessage(kind byte) *messageWriter {
+    return &messageWriter{[]byte{kind}}
+}
+
+func (w *messageWriter) int(n int) {
+    var b [2]byte
+    binary.BigEndian.PutUint16(b[:], uint16(n))
+    w.buf = append(w.buf, b[:]...)
+}
+
+func (w *messageWriter) bool(b bool) {
+    if b {
+        w.buf = append(w.buf, 1)
+    } else {
+        w.buf = append(w.buf, 0)
+    }
+}
+
+func (w *messageWriter) string(s string) {
+    if len(s) > 0xFFFF {
+        s = s[:0xFFFF]
+    }
+    w.int(len(s))
+    w.buf = append(w.buf, s...)
+}
+
+type messageReader struct {
+    buf []byte
+    err error
+}
+
+// Returns a reader for the fields of a message, after checking its type.
+func readMessage(pkt []byte, kind byte) *messageReader {
+    if len(pkt) < 1 || pkt[0] != kind {
+        return &messageReader{err: fmt.Errorf("expected message type %d", kind)}
+    }
+    return &messageReader{buf: pkt[1:]}
+}
+
+func (r *messageReader) int() int {
+    if r.err != nil {
+        return 0
+    }
+    if len(r.buf) < 2 {
+        r.err = fmt.Errorf("message truncated")
+        return 0
+    }
+    n := binary.BigEndian.Uint16(r.buf)
+    r.buf = r.buf[2:]
+    return int(n)
+}
+
+func (r *messageReader) bool() bool {
+    if r.err != nil {
+        return false
+    }
+    if len(r.buf) < 1 {
+        r.err = fmt.Errorf("message truncated")
+        return false
+    }
+    b := r.buf[0]
+    r.buf = r.buf[1:]
+    return b != 0
+}
+
+func (r *messageReader) string() string {
+    n := r.int()
+    if r.err != nil {
+        return ""
+    }
+    if len(r.buf) < n {
+        r.err = fmt.Errorf("message truncated")
+        return ""
+    }
+    s := string(r.buf[:n])
+    r.buf = r.buf[n:]
+    return s
+}
+
+func (m *ClientInitialRequest) marshal() []byte {
+    w := newMessage(msgCheckVersion)
+    w.int(m.majorVer)
+    w.int(m.minorVer)
+    w.string(m.hostname)
+    w.string(m.challenge)
+    return w.buf
+}
+
+func parseClientInitialRequest(pkt []byte) (*ClientInitialRequest, error) {
+    r := readMessage(pkt, msgCheckVersion)
+    m := &ClientInitialRequest{}
+    m.majorVer = r.int()
+    m.minorVer = r.int()
+    m.hostname = r.string()
+    m.challenge = r.string()
+    return m, r.err
+}
+
+func (m *ServerInitialResponse) marshal() []byte {
+    w := newMessage(msgServerChallenge)
+    w.int(m.majorVer)
+    w.int(m.minorVer)
+    w.string(m.challengeResp)
+    w.string(m.challenge)
+    return w.buf
+}
+
+func parseServerInitialResponse(pkt []byte) (*ServerInitialResponse, error) {
+    r := readMessage(pkt, msgServerChallenge)
+    m := &ServerInitialResponse{}
+    m.majorVer = r.int()
+    m.minorVer = r.int()
+    m.challengeResp = r.string()
+    m.challenge = r.string()
+    return m, r.err
+}
+
+func (m *ClientChallengeResponse) marshal() []byte {
+    w := newMessage(msgClientChallengeResponse)
+    w.string(m.challengeResp)
+    return w.buf
+}
+
+func parseClientChallengeResponse(pkt []byte) (*ClientChallengeResponse, error) {
+    r := readMessage(pkt, msgClientChallengeResponse)
+    m := &ClientChallengeResponse{}
+    m.challengeResp = r.string()
+    return m, r.err
+}
+
+func (m *ServerAuthenticationResult) marshal() []byte {
+    w := newMessage(msgServerAuthResult)
+    w.bool(m.authenticationSuccess)
+    w.string(m.reason)
+    return w.buf
+}
+
+func parseServerAuthenticationResult(pkt []byte) (*ServerAuthenticationResult, error) {
+    r := readMessage(pkt, msgServerAuthResult)
+    m := &ServerAuthenticationResult{}
+    m.authenticationSuccess = r.bool()
+    m.reason = r.string()
+    return m, r.err
+}
+
+func (m *SessionTicket) marshal() []byte {
+    w := newMessage(msgSessionTicket)
+    w.int(m.lifetime)
+    w.string(m.ticket)
+    w.string(m.secret)
+    return w.buf
+}
+
+func parseSessionTicket(pkt []byte) (*SessionTicket, error) {
+    r := readMessage(pkt, msgSessionTicket)
+    m := &SessionTicket{}
+    m.lifetime = r.int()
+    m.ticket = r.string()
+    m.secret = r.string()
+    return m, r.err
+}
+
+// Data packets, once negotiation is done.
+func frameData(pkt []byte) []byte {
+    return append([]byte{msgData}, pkt...)
+}
+
+// --------------------------------------------------------------------------------
+
+// Sends a message until a reply of the given type arrives.
+func exchangeMessage(conn transports.PacketClient, msg []byte, reply_kind byte, stage string) ([]byte, error) {
+    timeout := time.After(negotiateTimeout)
+    resend := time.NewTicker(negotiateResend)
+    defer resend.Stop()
+
+    send_ch := conn.SendChannel()
+    recv_ch := conn.RecvChannel()
+    send_ch <- msg
+
+    for {
+        select {
+        case pkt, ok := <-recv_ch:
+            if !ok {
+                return nil, fmt.Errorf("connection closed while %s", stage)
+            }
+            if len(pkt) > 0 && pkt[0] == reply_kind {
+                return pkt, nil
+            }
+            if len(pkt) > 0 && pkt[0] == msgServerAuthResult {
+                // The server has given up on us.
+                if result, err := parseServerAuthenticationResult(pkt); err == nil && !result.authenticationSuccess {
+                    return nil, fmt.Errorf("server refused us: %s", result.reason)
+                }
+            }
+
+        case <-resend.C:
+            send_ch <- msg
+
+        case <-timeout:
+            return nil, fmt.Errorf("timed out while %s", stage)
+        }
+    }
+}
+
+// The client's side of the negotiation.
+func negotiateClient(conn transports.PacketClient, binding []byte) error {
+    hostname, err := os.Hostname()
+    if err != nil {
+        hostname = "unknown"
+    }
+
+    nonce, err := randomBytes(challengeLen)
+    if err != nil {
+        return fmt.Errorf("error generating challenge: %s", err)
+    }
+
+    req := &ClientInitialRequest{
+        majorVer:  MAJOR_VER,
+        minorVer:  MINOR_VER,
+        hostname:  hostname,
+        challenge: string(nonce),
+    }
+    pkt, err := exchangeMessage(conn, req.marshal(), msgServerChallenge, "checking version")
+    if err != nil {
+        return err
+    }
+
+    server, err := parseServerInitialResponse(pkt)
+    if err != nil {
+        return fmt.Errorf("invalid version from server: %s", err)
+    }
+    if server.majorVer != MAJOR_VER {
+        return fmt.Errorf("server is running protocol version %d.%d, which is incompatible with ours (%d.%d)",
+            server.majorVer, server.minorVer, MAJOR_VER, MINOR_VER)
+    }
+    if server.minorVer != MINOR_VER {
+        log.Printf("Server is running protocol version %d.%d (we are %d.%d)\n",
+            server.majorVer, server.minorVer, MAJOR_VER, MINOR_VER)
+    }
+
+    // Check that the server really is the other end of our session before
+    // we prove anything ourselves.
+    if len(server.challenge) != challengeLen {
+        return fmt.Errorf("server sent an invalid challenge")
+    }
+    expected := challengeResponse(binding, "server", req.challenge, server.challenge)
+    if !checkResponse(server.challengeResp, expected) {
+        return fmt.Errorf("server failed our challenge - it may not be who it claims to be")
+    }
+
+    resp := &ClientChallengeResponse{
+        challengeResp: challengeResponse(binding, "client", req.challenge, server.challenge),
+    }
+    pkt, err = exchangeMessage(conn, resp.marshal(), msgServerAuthResult, "waiting for authentication")
+    if err != nil {
+        return err
+    }
+
+    result, err := parseServerAuthenticationResult(pkt)
+    if err != nil {
+        return fmt.Errorf("invalid authentication result from server: %s", err)
+    }
+    if !result.authenticationSuccess {
+        return fmt.Errorf("server refused us: %s", result.reason)
+    }
+    return nil
+}
+
+// The server's side of the negotiation.  Once it's done, the negotiation
+// should be kept around, so that it can answer the client if our last reply
+// went missing.
+type serverNegotiation struct {
+    conn       transports.PacketClient
+    client     *ClientInitialRequest
+    last_kind  byte
+    last_reply []byte
+}
+
+// Sends a reply, and remembers it in case the client asks again.
+func (n *serverNegotiation) reply(kind byte, reply []byte) {
+    n.last_kind = kind
+    n.last_reply = reply
+    n.conn.SendChannel() <- reply
+}
+
+// Answers a repeated message with our last reply.  Returns false if it
+// wasn't a repeat.
+func (n *serverNegotiation) repeat(pkt []byte) bool {
+    if n.last_reply == nil || len(pkt) < 1 || pkt[0] != n.last_kind {
+        return false
+    }
+    n.conn.SendChannel() <- n.last_reply
+    return true
+}
+
+// Refuses the client, telling it why.
+func (n *serverNegotiation) fail(reason string) error {
+    result := &ServerAuthenticationResult{authenticationSuccess: false, reason: reason}
+    n.conn.SendChannel() <- result.marshal()
+    return fmt.Errorf("%s", reason)
+}
+
+func negotiateServer(conn transports.PacketClient, binding []byte) (*serverNegotiation, error) {
+    n := &serverNegotiation{conn: conn}
+    recv_ch := conn.RecvChannel()
+
+    // Wait for a message of the given type, answering any repeats.
+    wait := func(kind byte, stage string) ([]byte, error) {
+        timeout := time.After(negotiateTimeout)
+        for {
+            select {
+            case pkt, ok := <-recv_ch:
+                if !ok {
+                    return nil, fmt.Errorf("connection closed while %s", stage)
+                }
+                if len(pkt) > 0 && pkt[0] == kind {
+                    return pkt, nil
+                }
+                n.repeat(pkt)
+
+            case <-timeout:
+                return nil, fmt.Errorf("timed out while %s", stage)
+            }
+        }
+    }
+
+    pkt, err := wait(msgCheckVersion, "waiting for version")
+    if err != nil {
+        return nil, err
+    }
+    n.client, err = parseClientInitialRequest(pkt)
+    if err != nil {
+        return nil, n.fail(fmt.Sprintf("invalid version message: %s", err))
+    }
+
+    if n.client.majorVer != MAJOR_VER {
+        resp := &ServerInitialResponse{majorVer: MAJOR_VER, minorVer: MINOR_VER}
+        n.reply(msgCheckVersion, resp.marshal())
+        return nil, n.fail(fmt.Sprintf("client is running protocol version %d.%d, which is incompatible with ours (%d.%d)",
+            n.client.majorVer, n.client.minorVer, MAJOR_VER, MINOR_VER))
+    }
+    if len(n.client.challenge) != challengeLen {
+        return nil, n.fail("invalid challenge")
+    }
+
+    nonce, err := randomBytes(challengeLen)
+    if err != nil {
+        return nil, n.fail(fmt.Sprintf("error generating challenge: %s", err))
+    }
+
+    resp := &ServerInitialResponse{
+        majorVer:      MAJOR_VER,
+        minorVer:      MINOR_VER,
+        challenge:     string(nonce),
+        challengeResp: challengeResponse(binding, "server", n.client.challenge, string(nonce)),
+    }
+    n.reply(msgCheckVersion, resp.marshal())
+
+    pkt, err = wait(msgClientChallengeResponse, "waiting for challenge response")
+    if err != nil {
+        return nil, err
+    }
+    client_resp, err := parseClientChallengeResponse(pkt)
+    if err != nil {
+        return nil, n.fail(fmt.Sprintf("invalid challenge response: %s", err))
+    }
+
+    expected := challengeResponse(binding, "client", n.client.challenge, resp.challenge)
+    if !checkResponse(client_resp.challengeResp, expected) {
+        return nil, n.fail("wrong challenge response")
+    }
+
+    result := &ServerAuthenticationResult{authenticationSuccess: true}
+    n.reply(msgClientChallengeResponse, result.marshal())
+    return n, nil
+}
+
+// A resumed session skips the negotiation, since we already know about the
+// client.
+func resumedNegotiation(conn transports.PacketClient, state *transports.SessionState) *serverNegotiation {
+    client := &ClientInitialRequest{majorVer: MAJOR_VER, minorVer: MINOR_VER, hostname: state.Hostname}
+    return &serverNegotiation{conn: conn, client: client}
+}
@@ -0,0 +1,176 @@
+package holepunch
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// One end of an in-memory connection.
+type testConn struct {
+    send_ch chan []byte
+    recv_ch chan []byte
+}
+
+func (c *testConn) SendChannel() chan []byte { return c.send_ch }
+func (c *testConn) RecvChannel() chan []byte { return c.recv_ch }
+func (c *testConn) Close()                   {}
+func (c *testConn) IsReliable() bool         { return true }
+func (c *testConn) Describe() string         { return "testConn" }
+
+func newTestConns() (*testConn, *testConn) {
+    up, down := make(chan []byte, 16), make(chan []byte, 16)
+    return &testConn{up, down}, &testConn{down, up}
+}
+
+// Runs both sides of the negotiation, with the given bindings.  The server's
+// result arrives on the channel.
+func negotiatePair(client_binding, server_binding []byte) (error, chan error) {
+    client, server := newTestConns()
+
+    server_err := make(chan error, 1)
+    go func() {
+        _, err := negotiateServer(server, server_binding)
+        server_err <- err
+    }()
+    return negotiateClient(client, client_binding), server_err
+}
+
+func TestNegotiateMessages(t *testing.T) {
+    long := strings.Repeat("x", 300)
+    tests := []struct {
+        name  string
+        msg   interface{ marshal() []byte }
+        parse func([]byte) (interface{}, error)
+    }{
+        {
+            "client initial request",
+            &ClientInitialRequest{majorVer: 1, minorVer: 2, hostname: "laptop", challenge: long},
+            func(pkt []byte) (interface{}, error) { return parseClientInitialRequest(pkt) },
+        },
+        {
+            "server initial response",
+            &ServerInitialResponse{majorVer: 1, minorVer: 0xFFFF, challenge: "abc", challengeResp: long},
+            func(pkt []byte) (interface{}, error) { return parseServerInitialResponse(pkt) },
+        },
+        {
+            "client challenge response",
+            &ClientChallengeResponse{challengeResp: "\x00\x01\x02"},
+            func(pkt []byte) (interface{}, error) { return parseClientChallengeResponse(pkt) },
+        },
+        {
+            "authentication success",
+            &ServerAuthenticationResult{authenticationSuccess: true},
+            func(pkt []byte) (interface{}, error) { return parseServerAuthenticationResult(pkt) },
+        },
+        {
+            "authentication failure",
+            &ServerAuthenticationResult{authenticationSuccess: false, reason: "wrong challenge response"},
+            func(pkt []byte) (interface{}, error) { return parseServerAuthenticationResult(pkt) },
+        },
+        {
+            "session ticket",
+            &SessionTicket{lifetime: 3600, ticket: long, secret: "secret"},
+            func(pkt []byte) (interface{}, error) { return parseSessionTicket(pkt) },
+        },
+        {
+            "empty strings",
+            &SessionTicket{},
+            func(pkt []byte) (interface{}, error) { return parseSessionTicket(pkt) },
+        },
+    }
+
+    for _, test := range tests {
+        pkt := test.msg.marshal()
+        parsed, err := test.parse(pkt)
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err)
+            continue
+        }
+        if !reflect.DeepEqual(parsed, test.msg) {
+            t.Errorf("%s: got %+v, expected %+v", test.name, parsed, test.msg)
+        }
+
+        // Every truncated message is an error.
+        for i := 0; i < len(pkt); i++ {
+            if _, err := test.parse(pkt[:i]); err == nil {
+                t.Errorf("%s: no error when truncated to %d bytes", test.name, i)
+            }
+        }
+    }
+}
+
+func TestNegotiateWrongType(t *testing.T) {
+    pkt := (&ClientChallengeResponse{challengeResp: "resp"}).marshal()
+    if _, err := parseServerAuthenticationResult(pkt); err == nil {
+        t.Error("parsed a challenge response as an authentication result")
+    }
+    if _, err := parseSessionTicket(frameData([]byte("data"))); err == nil {
+        t.Error("parsed a data packet as a ticket")
+    }
+}
+
+// Strings longer than the length field can hold are cut short, rather than
+// corrupting the rest of the message.
+func TestNegotiateLongString(t *testing.T) {
+    msg := &SessionTicket{lifetime: 60, ticket: strings.Repeat("t", 0x10005), secret: "secret"}
+    parsed, err := parseSessionTicket(msg.marshal())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(parsed.ticket) != 0xFFFF || parsed.secret != "secret" || parsed.lifetime != 60 {
+        t.Errorf("got a %d byte ticket, secret %q and lifetime %d", len(parsed.ticket), parsed.secret, parsed.lifetime)
+    }
+}
+
+func TestNegotiateIntegers(t *testing.T) {
+    w := newMessage(msgCheckVersion)
+    w.int(0)
+    w.int(0x1234)
+    w.int(0xFFFF)
+    w.bool(true)
+    w.bool(false)
+
+    r := readMessage(w.buf, msgCheckVersion)
+    if n := r.int(); n != 0 {
+        t.Errorf("got %d, expected 0", n)
+    }
+    if n := r.int(); n != 0x1234 {
+        t.Errorf("got %#x, expected 0x1234", n)
+    }
+    if n := r.int(); n != 0xFFFF {
+        t.Errorf("got %#x, expected 0xffff", n)
+    }
+    if !r.bool() || r.bool() {
+        t.Error("booleans didn't survive")
+    }
+    if r.err != nil {
+        t.Fatal(r.err)
+    }
+
+    // Reading past the end is an error, and stays one.
+    r.int()
+    if r.err == nil {
+        t.Fatal("no error reading past the end")
+    }
+    if s := r.string(); s != "" {
+        t.Errorf("got %q after an error", s)
+    }
+}
+
+func TestNegotiate(t *testing.T) {
+    binding := []byte("binding")
+    client_err, server_ch := negotiatePair(binding, binding)
+    if server_err := <-server_ch; client_err != nil || server_err != nil {
+        t.Fatalf("client: %v, server: %v", client_err, server_err)
+    }
+}
+
+// Someone who isn't the other end of the session can't answer the challenge.
+// (The server is left waiting for an answer that never comes.)
+func TestNegotiateWrongBinding(t *testing.T) {
+    client_err, _ := negotiatePair([]byte("ours"), []byte("theirs"))
+    if client_err == nil {
+        t.Error("client accepted a server with a different binding")
+    }
+}
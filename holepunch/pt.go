@@ -0,0 +1,220 @@
+package holepunch
+
+import (
+    "fmt"
+    flag "github.com/ogier/pflag"
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "strings"
+
+    "github.com/andrew-d/holepunch/transports"
+)
+
+// Runs holepunch as a Tor pluggable transport, called "holepunch".  Tor (or
+// anything else that speaks the managed proxy protocol) starts us with its
+// configuration in environment variables, and we tell it what we're doing on
+// stdout.  Whatever the parent sends through us is carried over our TCP
+// framing, encrypted with the shared secret.
+//
+// The secret comes from the "secret" transport argument (in the bridge line
+// for clients, or ServerTransportOptions for servers), falling back to --pass
+// (or --pass-from).
+//
+// See: https://gitweb.torproject.org/torspec.git/tree/pt-spec.txt
+
+const ptName = "holepunch"
+
+func RunPT(args []string) {
+    flags := flag.NewFlagSet("pt", flag.ExitOnError)
+    addCommonOptions(flags)
+    flags.Parse(args)
+
+    // Our parent owns stdin.
+    if pass_from == "stdin" {
+        fmt.Fprintf(os.Stderr, "Can't read the password from stdin as a pluggable transport\n\n")
+        os.Exit(1)
+    }
+    if err := loadSecrets(flags, "pt"); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n\n", err)
+        os.Exit(1)
+    }
+
+    versions := os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER")
+    if !listContains(versions, "1") {
+        ptMessage("VERSION-ERROR no-version")
+        os.Exit(1)
+    }
+    ptMessage("VERSION 1")
+
+    if len(os.Getenv("TOR_PT_PROXY")) > 0 {
+        ptMessage("PROXY-ERROR proxies are not supported")
+        os.Exit(1)
+    }
+
+    // If asked to, exit when our parent closes stdin.
+    if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
+        go func() {
+            io.Copy(ioutil.Discard, os.Stdin)
+            log.Printf("Stdin closed, exiting\n")
+            os.Exit(0)
+        }()
+    }
+
+    if client := os.Getenv("TOR_PT_CLIENT_TRANSPORTS"); len(client) > 0 {
+        runPTClient(client)
+    } else if server := os.Getenv("TOR_PT_SERVER_TRANSPORTS"); len(server) > 0 {
+        runPTServer(server)
+    } else {
+        ptMessage("ENV-ERROR no TOR_PT_CLIENT_TRANSPORTS or TOR_PT_SERVER_TRANSPORTS")
+        os.Exit(1)
+    }
+}
+
+// Messages to our parent go to stdout.  (Logging goes to stderr.)
+func ptMessage(format string, args ...interface{}) {
+    fmt.Fprintf(os.Stdout, format+"\n", args...)
+}
+
+// Checks if a comma-seperated list contains the given item, or "*".
+func listContains(list, item string) bool {
+    for _, x := range splitList(list) {
+        if x == item || x == "*" {
+            return true
+        }
+    }
+    return false
+}
+
+func runPTClient(names string) {
+    if !listContains(names, ptName) {
+        ptMessage("CMETHODS DONE")
+        return
+    }
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        ptMessage("CMETHOD-ERROR %s %s", ptName, err)
+        ptMessage("CMETHODS DONE")
+        return
+    }
+
+    ptMessage("CMETHOD %s socks5 %s", ptName, listener.Addr())
+    ptMessage("CMETHODS DONE")
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                log.Printf("Error accepting SOCKS connection: %s\n", err)
+                return
+            }
+            go handlePTClient(conn)
+        }
+    }()
+}
+
+func handlePTClient(conn net.Conn) {
+    target, args, err := transports.AcceptSOCKS5(conn)
+    if err != nil {
+        log.Printf("Error in SOCKS handshake: %s\n", err)
+        conn.Close()
+        return
+    }
+
+    secret := password
+    if s, found := transports.ParsePTArgs(args, ';')["secret"]; found {
+        secret = s
+    }
+
+    client, err := transports.DialTCPPacketClient(target, nil)
+    if err != nil {
+        transports.SOCKS5Reply(conn, false)
+        conn.Close()
+        return
+    }
+
+    enc_opts := transports.EncryptionOptions{Secret: secret, IsClient: true}
+    enc_client, err := transports.NewEncryptedPacketClient(client, &enc_opts)
+    if err != nil {
+        log.Printf("Could not initialize encryption with %s: %s\n", target, err)
+        transports.SOCKS5Reply(conn, false)
+        client.Close()
+        conn.Close()
+        return
+    }
+
+    if err = transports.SOCKS5Reply(conn, true); err != nil {
+        enc_client.Close()
+        conn.Close()
+        return
+    }
+
+    log.Printf("Connected to %s\n", target)
+    transports.SpliceStream(conn, enc_client)
+}
+
+func runPTServer(names string) {
+    if !listContains(names, ptName) {
+        ptMessage("SMETHODS DONE")
+        return
+    }
+
+    orport := os.Getenv("TOR_PT_ORPORT")
+    if len(orport) == 0 {
+        ptMessage("ENV-ERROR no TOR_PT_ORPORT")
+        os.Exit(1)
+    }
+
+    // The bind address is given as "name-addr,name-addr".
+    bind := fmt.Sprintf("0.0.0.0:%d", transports.TCP_PORT)
+    for _, item := range splitList(os.Getenv("TOR_PT_SERVER_BINDADDR")) {
+        if strings.HasPrefix(item, ptName+"-") {
+            bind = strings.TrimPrefix(item, ptName+"-")
+        }
+    }
+
+    // Options are given as "name:k=v;name:k=v".
+    secret := password
+    opts := transports.ParsePTArgs(os.Getenv("TOR_PT_SERVER_TRANSPORT_OPTIONS"), ';')
+    if s, found := opts[ptName+":secret"]; found {
+        secret = s
+    }
+
+    trans, err := transports.NewTCPTransportOn(bind, &transports.TCPOptions{})
+    if err != nil {
+        ptMessage("SMETHOD-ERROR %s %s", ptName, err)
+        ptMessage("SMETHODS DONE")
+        return
+    }
+
+    ptMessage("SMETHOD %s %s", ptName, trans.Addr())
+    ptMessage("SMETHODS DONE")
+
+    go func() {
+        for client := range trans.AcceptChannel() {
+            go handlePTServer(client, orport, secret)
+        }
+    }()
+}
+
+func handlePTServer(client transports.PacketClient, orport, secret string) {
+    enc_opts := transports.EncryptionOptions{Secret: secret}
+    enc_client, err := transports.NewEncryptedPacketClient(client, &enc_opts)
+    if err != nil {
+        log.Printf("Could not initialize encryption: %s\n", err)
+        client.Close()
+        return
+    }
+
+    conn, err := net.Dial("tcp", orport)
+    if err != nil {
+        log.Printf("Error connecting to ORPort %s: %s\n", orport, err)
+        enc_client.Close()
+        return
+    }
+
+    transports.SpliceStream(conn, enc_client)
+}
@@ -0,0 +1,186 @@
+package holepunch
+
+import (
+    "bytes"
+    "crypto/rand"
+    "log"
+    "net"
+    "sync"
+
+    "github.com/andrew-d/holepunch/tuntap"
+)
+
+// With more than one client connected, packets from the TUN/TAP device need
+// to go to the right one.  Each client has a route, and we remember which
+// tunnel addresses belong to which route: clients with a fixed IP (from the
+// authorized keys file) own that address from the start, and other clients
+// own the first source address they send packets from, as long as nobody
+// else has it.  A client can't send packets from any other address, or from
+// an address that belongs to another client, until that client disconnects.
+//
+// The one exception is a client resuming its session with a ticket, which
+// gets its old address back even if the old connection hasn't gone away yet.
+// Each route has a lease, a random value that goes in the tickets it's given
+// (and is passed on to the sessions resumed from them), and an address can
+// only be taken back by a route with the same lease.
+
+// How many packets to queue for a client before dropping them.
+const routeQueueLen = 64
+
+type tunnelRoute struct {
+    ch    chan []byte
+    fixed net.IP
+    lease []byte
+
+    // The address the client has claimed, if it doesn't have a fixed one.
+    // The router's lock protects this.
+    learned net.IP
+}
+
+const routeLeaseLen = 16
+
+type tunnelRouter struct {
+    tt     tuntap.Device
+    routes map[string]*tunnelRoute
+    done   chan bool
+    lock   sync.Mutex
+}
+
+func newTunnelRouter(tt tuntap.Device) *tunnelRouter {
+    r := &tunnelRouter{
+        tt:     tt,
+        routes: make(map[string]*tunnelRoute),
+        done:   make(chan bool),
+    }
+    go r.run()
+    return r
+}
+
+// Returns the source and destination addresses of an IPv4 or IPv6 packet.
+func packetAddrs(pkt []byte) (net.IP, net.IP, bool) {
+    if len(pkt) < 1 {
+        return nil, nil, false
+    }
+
+    switch pkt[0] >> 4 {
+    case 4:
+        if len(pkt) < 20 {
+            return nil, nil, false
+        }
+        return net.IP(pkt[12:16]), net.IP(pkt[16:20]), true
+
+    case 6:
+        if len(pkt) < 40 {
+            return nil, nil, false
+        }
+        return net.IP(pkt[8:24]), net.IP(pkt[24:40]), true
+    }
+    return nil, nil, false
+}
+
+func routeKey(ip net.IP) string {
+    return string(ip.To16())
+}
+
+func (r *tunnelRouter) run() {
+    for {
+        select {
+        case pkt := <-r.tt.RecvChannel():
+            _, dst, ok := packetAddrs(pkt)
+            if !ok {
+                log.Printf("Unknown packet from TUN/TAP device, dropping\n")
+                continue
+            }
+
+            r.lock.Lock()
+            route, found := r.routes[routeKey(dst)]
+            r.lock.Unlock()
+            if !found {
+                log.Printf("No client for %s, dropping packet\n", dst)
+                continue
+            }
+
+            select {
+            case route.ch <- pkt:
+            default:
+                log.Printf("Queue for %s is full, dropping packet\n", dst)
+            }
+
+        case <-r.tt.EOFChannel():
+            log.Println("EOF received from TUN/TAP device, exiting...")
+            close(r.done)
+            return
+        }
+    }
+}
+
+// Adds a route for a new client.  A fixed IP is taken from whoever had it
+// before (e.g. an old connection from the same client that hasn't timed out
+// yet).  A resumed session keeps its lease; otherwise, lease is nil, and the
+// route gets a new one.
+func (r *tunnelRouter) add(fixed net.IP, lease []byte) (*tunnelRoute, error) {
+    if len(lease) == 0 {
+        lease = make([]byte, routeLeaseLen)
+        if _, err := rand.Read(lease); err != nil {
+            return nil, err
+        }
+    }
+
+    route := &tunnelRoute{ch: make(chan []byte, routeQueueLen), fixed: fixed, lease: lease}
+    if fixed != nil {
+        r.lock.Lock()
+        r.routes[routeKey(fixed)] = route
+        r.lock.Unlock()
+    }
+    return route, nil
+}
+
+func (r *tunnelRouter) remove(route *tunnelRoute) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    for key, other := range r.routes {
+        if other == route {
+            delete(r.routes, key)
+        }
+    }
+}
+
+// Checks a packet from a client, and learns its source address.  Returns
+// false if the client isn't allowed to send it.
+func (r *tunnelRouter) learn(route *tunnelRoute, pkt []byte) bool {
+    src, _, ok := packetAddrs(pkt)
+    if !ok {
+        return false
+    }
+    if route.fixed != nil {
+        return src.Equal(route.fixed)
+    }
+    return r.claim(route, src, false)
+}
+
+// Gives an address to a client, unless it belongs to another client, or the
+// client already has a different one.  With take_over, the address is taken
+// from another client with the same lease, as long as it isn't fixed to them.
+func (r *tunnelRouter) claim(route *tunnelRoute, src net.IP, take_over bool) bool {
+    if src == nil {
+        return false
+    }
+
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    if route.learned != nil && !route.learned.Equal(src) {
+        return false
+    }
+
+    key := routeKey(src)
+    if other, found := r.routes[key]; found && other != route {
+        if other.fixed != nil || !take_over || !bytes.Equal(other.lease, route.lease) {
+            return false
+        }
+    }
+    r.routes[key] = route
+    route.learned = append(net.IP{}, src...)
+    return true
+}
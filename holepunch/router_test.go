@@ -0,0 +1,106 @@
+package holepunch
+
+import (
+    "net"
+    "testing"
+)
+
+// An IPv4 packet from src.
+func packetFrom(src string) []byte {
+    pkt := make([]byte, 20)
+    pkt[0] = 0x45
+    copy(pkt[12:16], net.ParseIP(src).To4())
+    copy(pkt[16:20], net.ParseIP("10.93.0.1").To4())
+    return pkt
+}
+
+func newTestRouter() *tunnelRouter {
+    return &tunnelRouter{routes: make(map[string]*tunnelRoute), done: make(chan bool)}
+}
+
+func addRoute(t *testing.T, r *tunnelRouter, fixed net.IP, lease []byte) *tunnelRoute {
+    route, err := r.add(fixed, lease)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return route
+}
+
+func TestRouterLearn(t *testing.T) {
+    r := newTestRouter()
+    a := addRoute(t, r, nil, nil)
+    b := addRoute(t, r, nil, nil)
+    fixed := addRoute(t, r, net.ParseIP("10.93.0.5"), nil)
+
+    tests := []struct {
+        name    string
+        route   *tunnelRoute
+        src     string
+        allowed bool
+    }{
+        {"first address", a, "10.93.0.2", true},
+        {"same address", a, "10.93.0.2", true},
+        {"second address", a, "10.93.0.3", false},
+        {"someone else's", b, "10.93.0.2", false},
+        {"its own", b, "10.93.0.3", true},
+        {"a fixed address", b, "10.93.0.5", false},
+        {"the fixed address", fixed, "10.93.0.5", true},
+        {"not the fixed address", fixed, "10.93.0.6", false},
+    }
+    for _, test := range tests {
+        if r.learn(test.route, packetFrom(test.src)) != test.allowed {
+            t.Errorf("%s: allowed != %v", test.name, test.allowed)
+        }
+    }
+
+    if r.learn(a, []byte{0x45, 0}) {
+        t.Error("learned from a truncated packet")
+    }
+
+    // Once a client's gone, its address is free.
+    r.remove(a)
+    c := addRoute(t, r, nil, nil)
+    if !r.learn(c, packetFrom("10.93.0.2")) {
+        t.Error("address wasn't freed")
+    }
+}
+
+// A resumed session can only take its address back from the connection it
+// was resumed from.
+func TestRouterResume(t *testing.T) {
+    r := newTestRouter()
+    old := addRoute(t, r, nil, nil)
+    other := addRoute(t, r, nil, nil)
+    if !r.learn(old, packetFrom("10.93.0.2")) || !r.learn(other, packetFrom("10.93.0.3")) {
+        t.Fatal("clients couldn't claim their addresses")
+    }
+
+    resumed := addRoute(t, r, nil, old.lease)
+    if r.claim(resumed, net.ParseIP("10.93.0.3"), true) {
+        t.Error("resumed session took another client's address")
+    }
+    if !r.claim(resumed, net.ParseIP("10.93.0.2"), true) {
+        t.Fatal("resumed session didn't get its address back")
+    }
+    if r.routes[routeKey(net.ParseIP("10.93.0.2"))] != resumed {
+        t.Error("address isn't routed to the resumed session")
+    }
+
+    // The old connection can't take it back just by sending.
+    if r.learn(old, packetFrom("10.93.0.2")) {
+        t.Error("old connection took the address back")
+    }
+
+    // A made-up lease gets nowhere either.
+    forged := addRoute(t, r, nil, []byte("forged lease...."))
+    if r.claim(forged, net.ParseIP("10.93.0.3"), true) {
+        t.Error("forged lease took an address")
+    }
+
+    // Fixed addresses stay fixed.
+    fixed := addRoute(t, r, net.ParseIP("10.93.0.5"), nil)
+    thief := addRoute(t, r, nil, fixed.lease)
+    if r.claim(thief, net.ParseIP("10.93.0.5"), true) {
+        t.Error("resumed session took a fixed address")
+    }
+}
@@ -0,0 +1,369 @@
+package holepunch
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    flag "github.com/ogier/pflag"
+    "io/ioutil"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Secrets given with --pass show up in `ps` and shell history, so they can
+// also be read from somewhere else.  The source is given as one of:
+//
+//      file:PATH       The first line of a file, which (like a client key)
+//                      must not be readable by anyone else.
+//      env:NAME        An environment variable.  It's removed once read, so
+//                      that programs we start (e.g. pluggable transports)
+//                      don't see it.
+//      stdin           The first line of standard input.
+//      cmd:COMMAND     The first line a command prints, e.g.
+//                      'cmd:pass show holepunch' or
+//                      'cmd:vault kv get -field=password secret/holepunch'.
+//                      The command is run with the shell, and is killed
+//                      if it takes longer than secretCommandTimeout.
+//
+// The server reads the source again when it's reloaded (on SIGHUP), so the
+// password can be changed without restarting it.  Environment variables and
+// stdin can only be read once, so those keep the value they had.  Sessions
+// (and tickets) from before the password changed are dropped, unless the
+// client authenticated some other way.
+//
+// The source chosen is recorded in the secrets config file (--secrets-config),
+// one per line as "mode option source", e.g.
+//
+//      server pass-from file:/etc/holepunch/pass
+//
+// and used next time, if neither the secret nor its source is given.  Giving
+// the secret itself on the command line removes the record.  Stdin isn't
+// recorded, since it's only there when something is piped in.
+
+const secretCommandTimeout = 30 * time.Second
+
+type secretSource struct {
+    kind string
+    arg  string
+
+    // The value, for sources that can only be read once.
+    value  string
+    loaded bool
+}
+
+// Where the password (and the client's user secret) come from, if not the
+// command line.
+var pass_from string
+var user_secret_from string
+
+var pass_source *secretSource
+var user_secret_source *secretSource
+
+// Where the sources are recorded (see above).
+var secrets_config string
+
+// Protects the password, which can change when the server is reloaded.  Each
+// change bumps the generation, and closes password_changed (replacing it with
+// a new one).
+var password_lock sync.Mutex
+var password_gen uint64
+var password_changed = make(chan bool)
+
+// Set while the password is being reloaded.
+var reloading bool
+var reloading_lock sync.Mutex
+
+func parseSecretSource(spec string) (*secretSource, error) {
+    if spec == "stdin" {
+        return &secretSource{kind: "stdin"}, nil
+    }
+
+    parts := strings.SplitN(spec, ":", 2)
+    if len(parts) != 2 || len(parts[1]) == 0 {
+        return nil, fmt.Errorf("invalid secret source: %s", spec)
+    }
+
+    switch parts[0] {
+    case "file", "env", "cmd":
+        return &secretSource{kind: parts[0], arg: parts[1]}, nil
+    }
+    return nil, fmt.Errorf("unknown secret source: %s", parts[0])
+}
+
+func (s *secretSource) String() string {
+    if s.kind == "stdin" {
+        return "stdin"
+    }
+    return s.kind + ":" + s.arg
+}
+
+// Reads the secret.
+func (s *secretSource) load() (string, error) {
+    if s.loaded {
+        return s.value, nil
+    }
+
+    var data []byte
+    var err error
+    switch s.kind {
+    case "file":
+        var info os.FileInfo
+        info, err = os.Stat(s.arg)
+        if err != nil {
+            return "", err
+        }
+        if info.Mode().Perm()&0077 != 0 {
+            return "", fmt.Errorf("permissions %#o for %s are too open", info.Mode().Perm(), s.arg)
+        }
+        data, err = ioutil.ReadFile(s.arg)
+        if err != nil {
+            return "", err
+        }
+
+    case "env":
+        value, found := os.LookupEnv(s.arg)
+        if !found {
+            return "", fmt.Errorf("environment variable %s is not set", s.arg)
+        }
+        os.Unsetenv(s.arg)
+        data = []byte(value)
+
+    case "stdin":
+        data, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+        if err != nil && len(data) == 0 {
+            return "", fmt.Errorf("error reading from stdin: %s", err)
+        }
+
+    case "cmd":
+        ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+        defer cancel()
+
+        // Anything the shell started could keep its output open after it's
+        // killed, so don't wait for that for long.
+        cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.arg)
+        cmd.Stderr = os.Stderr
+        cmd.WaitDelay = time.Second
+        data, err = cmd.Output()
+        if ctx.Err() == context.DeadlineExceeded {
+            return "", fmt.Errorf("'%s' took longer than %s", s.arg, secretCommandTimeout)
+        }
+        if err != nil {
+            return "", fmt.Errorf("error running '%s': %s", s.arg, err)
+        }
+    }
+
+    if i := bytes.IndexByte(data, '\n'); i >= 0 {
+        data = data[:i]
+    }
+    secret := strings.TrimRight(string(data), "\r")
+    if len(secret) == 0 {
+        return "", fmt.Errorf("empty secret from %s", s)
+    }
+
+    if s.kind == "env" || s.kind == "stdin" {
+        s.value = secret
+        s.loaded = true
+    }
+    return secret, nil
+}
+
+// Reads any secrets that weren't given on the command line, and records
+// where they came from.  They can't be given both ways.
+func loadSecrets(flags *flag.FlagSet, mode string) error {
+    given := make(map[string]bool)
+    flags.Visit(func(f *flag.Flag) {
+        given[f.Name] = true
+    })
+
+    config := readSecretsConfig()
+    var err error
+    if pass_source, err = chooseSecretSource(config, mode, given, "pass", pass_from); err != nil {
+        return err
+    }
+    if user_secret_source, err = chooseSecretSource(config, mode, given, "user-secret", user_secret_from); err != nil {
+        return err
+    }
+    if pass_source != nil && user_secret_source != nil &&
+        pass_source.kind == "stdin" && user_secret_source.kind == "stdin" {
+        return fmt.Errorf("only one secret can be read from stdin")
+    }
+
+    if pass_source != nil {
+        if password, err = pass_source.load(); err != nil {
+            return fmt.Errorf("error reading password: %s", err)
+        }
+        log.Printf("Read password from %s\n", pass_source)
+    }
+    if user_secret_source != nil {
+        if user_secret, err = user_secret_source.load(); err != nil {
+            return fmt.Errorf("error reading user secret: %s", err)
+        }
+        log.Printf("Read user secret from %s\n", user_secret_source)
+    }
+
+    writeSecretsConfig(config)
+    return nil
+}
+
+// Works out where the secret for an option comes from: the --NAME-from
+// option, or failing that, the secrets config.  The config is updated to
+// match.  Returns nil if the secret is given directly (or not at all).
+func chooseSecretSource(config map[string]string, mode string, given map[string]bool,
+    name, from string) (*secretSource, error) {
+
+    key := mode + " " + name + "-from"
+    if given[name] {
+        if len(from) > 0 {
+            return nil, fmt.Errorf("only one of --%s and --%s-from can be given", name, name)
+        }
+        delete(config, key)
+        return nil, nil
+    }
+
+    if len(from) == 0 {
+        from = config[key]
+        if len(from) == 0 {
+            return nil, nil
+        }
+        log.Printf("Using --%s-from %s, from %s\n", name, from, secrets_config)
+    }
+
+    source, err := parseSecretSource(from)
+    if err != nil {
+        return nil, err
+    }
+    if source.kind != "stdin" {
+        config[key] = from
+    }
+    return source, nil
+}
+
+// Returns the recorded sources, by "mode option".
+func readSecretsConfig() map[string]string {
+    config := make(map[string]string)
+    if len(secrets_config) == 0 {
+        return config
+    }
+
+    data, err := ioutil.ReadFile(secrets_config)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            log.Printf("Error reading secrets config: %s\n", err)
+        }
+        return config
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+        if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        config[fields[0]+" "+fields[1]] = fields[2]
+    }
+    return config
+}
+
+func writeSecretsConfig(config map[string]string) {
+    if len(secrets_config) == 0 {
+        return
+    }
+
+    var lines []string
+    for key, source := range config {
+        lines = append(lines, key+" "+source)
+    }
+    sort.Strings(lines)
+    data := []byte(strings.Join(lines, "\n") + "\n")
+
+    // Nothing to record, and nothing recorded before.
+    old, err := ioutil.ReadFile(secrets_config)
+    if os.IsNotExist(err) && len(lines) == 0 {
+        return
+    }
+    if err == nil && bytes.Equal(old, data) {
+        return
+    }
+
+    if err := os.MkdirAll(filepath.Dir(secrets_config), 0700); err != nil {
+        log.Printf("Error saving secrets config: %s\n", err)
+        return
+    }
+    if err := ioutil.WriteFile(secrets_config, data, 0600); err != nil {
+        log.Printf("Error saving secrets config: %s\n", err)
+    }
+}
+
+func defaultSecretsConfig() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "holepunch", "secrets")
+}
+
+// Returns the current password.
+func getPassword() string {
+    password_lock.Lock()
+    defer password_lock.Unlock()
+    return password
+}
+
+// Returns the current password, its generation, and a channel that's closed
+// when it changes.
+func getPasswordGeneration() (string, uint64, chan bool) {
+    password_lock.Lock()
+    defer password_lock.Unlock()
+    return password, password_gen, password_changed
+}
+
+// Reads the password again from wherever it came from, in the background,
+// since a command could take a while.  If that fails, we keep using the old
+// one.
+func reloadPassword() {
+    if pass_source == nil {
+        return
+    }
+
+    reloading_lock.Lock()
+    defer reloading_lock.Unlock()
+    if reloading {
+        log.Printf("Still reloading the password, ignoring\n")
+        return
+    }
+    reloading = true
+
+    go func() {
+        defer func() {
+            reloading_lock.Lock()
+            reloading = false
+            reloading_lock.Unlock()
+        }()
+
+        secret, err := pass_source.load()
+        if err != nil {
+            log.Printf("Error reloading password from %s: %s\n", pass_source, err)
+            return
+        }
+
+        password_lock.Lock()
+        changed := secret != password
+        if changed {
+            password = secret
+            password_gen++
+            close(password_changed)
+            password_changed = make(chan bool)
+        }
+        password_lock.Unlock()
+
+        if changed {
+            log.Printf("Reloaded password from %s\n", pass_source)
+        }
+    }()
+}
@@ -0,0 +1,139 @@
+package holepunch
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestParseSecretSource(t *testing.T) {
+    for _, spec := range []string{"stdin", "file:/etc/holepunch/pass", "env:HOLEPUNCH_PASS", "cmd:pass show holepunch"} {
+        source, err := parseSecretSource(spec)
+        if err != nil {
+            t.Errorf("%s: %s", spec, err)
+            continue
+        }
+        if source.String() != spec {
+            t.Errorf("%s came back as %s", spec, source)
+        }
+    }
+
+    for _, spec := range []string{"", "file:", "env", "vault:secret/holepunch"} {
+        if _, err := parseSecretSource(spec); err == nil {
+            t.Errorf("%q: no error", spec)
+        }
+    }
+}
+
+func TestSecretSourceLoad(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "pass")
+    if err := ioutil.WriteFile(path, []byte("from a file\nsecond line\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    os.Setenv("HOLEPUNCH_TEST_PASS", "from the environment")
+    tests := []struct {
+        spec     string
+        expected string
+    }{
+        {"file:" + path, "from a file"},
+        {"env:HOLEPUNCH_TEST_PASS", "from the environment"},
+        {"cmd:printf 'from a command\\r\\nignored'", "from a command"},
+    }
+    for _, test := range tests {
+        source, _ := parseSecretSource(test.spec)
+        secret, err := source.load()
+        if err != nil {
+            t.Errorf("%s: %s", test.spec, err)
+        } else if secret != test.expected {
+            t.Errorf("%s: got %q, expected %q", test.spec, secret, test.expected)
+        }
+    }
+
+    // The environment variable is gone, but the source still has it.
+    if _, found := os.LookupEnv("HOLEPUNCH_TEST_PASS"); found {
+        t.Error("environment variable wasn't removed")
+    }
+    source, _ := parseSecretSource("env:HOLEPUNCH_TEST_PASS")
+    if _, err := source.load(); err == nil {
+        t.Error("read a removed environment variable")
+    }
+
+    os.Chmod(path, 0644)
+    bad := []string{"file:" + path, "file:" + filepath.Join(dir, "missing"), "cmd:exit 1", "cmd:true"}
+    for _, spec := range bad {
+        source, _ := parseSecretSource(spec)
+        if _, err := source.load(); err == nil {
+            t.Errorf("%s: no error", spec)
+        }
+    }
+}
+
+func TestChooseSecretSource(t *testing.T) {
+    config := map[string]string{"client pass-from": "env:OLD"}
+
+    // Given on the command line, and recorded.
+    source, err := chooseSecretSource(config, "server", nil, "pass", "file:/etc/holepunch/pass")
+    if err != nil || source == nil || source.String() != "file:/etc/holepunch/pass" {
+        t.Fatalf("got %v, %v", source, err)
+    }
+
+    // Used next time.
+    source, err = chooseSecretSource(config, "server", nil, "pass", "")
+    if err != nil || source == nil || source.String() != "file:/etc/holepunch/pass" {
+        t.Fatalf("recorded source not used: got %v, %v", source, err)
+    }
+
+    // Stdin isn't recorded.
+    if _, err = chooseSecretSource(config, "client", nil, "user-secret", "stdin"); err != nil {
+        t.Fatal(err)
+    }
+
+    // Giving the secret directly forgets the source.
+    source, err = chooseSecretSource(config, "client", map[string]bool{"pass": true}, "pass", "")
+    if err != nil || source != nil {
+        t.Fatalf("got %v, %v", source, err)
+    }
+    if _, err = chooseSecretSource(config, "client", map[string]bool{"pass": true}, "pass", "env:PASS"); err == nil {
+        t.Error("accepted both --pass and --pass-from")
+    }
+
+    expected := map[string]string{"server pass-from": "file:/etc/holepunch/pass"}
+    if !reflect.DeepEqual(config, expected) {
+        t.Errorf("got %v, expected %v", config, expected)
+    }
+}
+
+func TestSecretsConfig(t *testing.T) {
+    old := secrets_config
+    defer func() { secrets_config = old }()
+    secrets_config = filepath.Join(t.TempDir(), "holepunch", "secrets")
+
+    if config := readSecretsConfig(); len(config) != 0 {
+        t.Fatalf("got %v from a missing file", config)
+    }
+    writeSecretsConfig(map[string]string{})
+    if _, err := os.Stat(secrets_config); !os.IsNotExist(err) {
+        t.Fatalf("wrote an empty config: %v", err)
+    }
+
+    config := map[string]string{
+        "server pass-from":        "cmd:vault kv get -field=password secret/holepunch",
+        "client user-secret-from": "file:/home/me/.holepunch-secret",
+    }
+    writeSecretsConfig(config)
+
+    info, err := os.Stat(secrets_config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("config has permissions %#o", info.Mode().Perm())
+    }
+    if got := readSecretsConfig(); !reflect.DeepEqual(got, config) {
+        t.Errorf("got %v, expected %v", got, config)
+    }
+}
@@ -2,18 +2,88 @@ package holepunch
 
 import (
     flag "github.com/ogier/pflag"
-    //"fmt"
+    "fmt"
     "log"
+    "net"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "time"
 
     "github.com/andrew-d/holepunch/transports"
     "github.com/andrew-d/holepunch/tuntap"
 )
 
+// Server options
+var knock_method string
+var knock_window time.Duration
+var knock_firewall bool
+var proxy_from string
+var dtls_cert string
+var dtls_key string
+var no_dtls bool
+var no_webrtc bool
+var pt_bind string
+var static_key_file string
+var users_file string
+var keys_file string
+var ticket_lifetime time.Duration
+var kdf_name string
+var kdf_costs string
+var kdf_salt_file string
+
+var knock_guard *transports.KnockGuard
+var pt_server *transports.ManagedPT
+var static_key *transports.StaticKey
+var users *userStore
+var authorized_keys *keyStore
+var tickets *transports.TicketIssuer
+var server_kdf *transports.KDFParams
+
+// How often to check that a connected client is still allowed to be.
+const accessCheckInterval = time.Minute
+
 func RunServer(args []string) {
     flags := flag.NewFlagSet("server", flag.ExitOnError)
     addCommonOptions(flags)
+
+    flags.StringVar(&knock_method, "knock", "", "require clients to knock before connecting (udp/icmp)")
+    flags.DurationVar(&knock_window, "knock-window", 30*time.Second, "how long a knock allows a client to connect for")
+    flags.BoolVar(&knock_firewall, "knock-firewall", runtime.GOOS == "linux", "also block clients that haven't knocked in the system firewall (on by default on Linux)")
+    flags.StringVar(&static_key_file, "static-key", "", "file holding the server's static key, which clients can pin (created if it doesn't exist)")
+    flags.StringVar(&users_file, "users", "", "file of users, each with their own secret (if given, --pass is no longer accepted for the handshake)")
+    flags.StringVar(&keys_file, "authorized-keys", "", "file of client public keys that may connect without a password (needs --static-key)")
+    flags.StringVar(&kdf_name, "kdf", "scrypt", "KDF for deriving keys from passwords (pbkdf2 or scrypt)")
+    flags.StringVar(&kdf_costs, "kdf-params", "", "costs for the KDF, e.g. 'n=32768,r=8,p=1' for scrypt or 'i=65536' for pbkdf2")
+    flags.StringVar(&kdf_salt_file, "kdf-salt", defaultKDFSalt(), "file holding the salt for the KDF (created if it doesn't exist; empty for a new salt each time, which can't be used with knocking, TLS mimicry or the DTLS pre-shared key)")
+    flags.DurationVar(&ticket_lifetime, "ticket-lifetime", transports.DefaultTicketLifetime, "how long clients can resume sessions for after disconnecting (0 to disable)")
+    flags.StringVar(&dtls_cert, "dtls-cert", "", "certificate file for the DTLS transport (if not given, use a pre-shared key)")
+    flags.StringVar(&dtls_key, "dtls-key", "", "private key file for the DTLS transport")
+    flags.BoolVar(&no_dtls, "no-dtls", false, "don't listen for DTLS clients")
+    flags.BoolVar(&no_webrtc, "no-webrtc", false, "don't listen for WebRTC clients (or signaling requests)")
+    flags.StringVar(&pt_bind, "pt-bind", fmt.Sprintf("0.0.0.0:%d", transports.PT_PORT), "address for the pluggable transport (given with --pt-bin) to listen on")
+    flags.StringVar(&proxy_from, "proxy-from", "", "accept PROXY protocol headers from these addresses, as comma-seperated list of IPs or CIDR ranges")
+
     flags.Parse(args)
 
+    if err := loadSecrets(flags, "server"); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n\n", err)
+        os.Exit(1)
+    }
+
+    if err := parseShapingOptions(); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n\n", err)
+        os.Exit(1)
+    }
+
+    var err error
+    server_kdf, err = transports.ParseKDF(kdf_name, kdf_costs)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n\n", err)
+        os.Exit(1)
+    }
+
     // We start the transports in another goroutine, so our main routine can
     // return (and wait for signals).
     // Note: The startTransports function takes ownership (and closes) the
@@ -22,73 +92,477 @@ func RunServer(args []string) {
     go startTransports(tt)
 }
 
+// Called on SIGHUP.  Once the new password is read, the handshake, knocking,
+// TLS mimicry, DTLS and WebRTC all switch to it (see rekeyOuter).  Clients
+// that used the old password are disconnected, and their tickets stop
+// working.  The users and authorized keys files are read again whenever
+// they change anyway.
+func ReloadServer() {
+    log.Printf("Reloading\n")
+    reloadPassword()
+}
+
 func StopServer() {
     // TODO: fill me in!
+    if knock_guard != nil {
+        knock_guard.Close()
+    }
+    if pt_server != nil {
+        pt_server.Close()
+    }
+}
+
+// The salt has to survive restarts (see startTransports), so by default it's
+// kept with our other state.
+func defaultKDFSalt() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "holepunch", "kdf-salt")
+}
+
+// The outer layers that derive their own keys from the password.
+type outerKeyed interface {
+    SetSecret(secret string) error
+}
+
+// Rebuilds the outer layers' keys each time the password changes.  If a key
+// can't be derived, that layer keeps the old one, and we say so.
+func rekeyOuter(outer []outerKeyed, password_changed chan bool) {
+    for {
+        <-password_changed
+        var secret string
+        secret, _, password_changed = getPasswordGeneration()
+        for _, layer := range outer {
+            if err := layer.SetSecret(secret); err != nil {
+                log.Printf("Error deriving a new key for %T, it keeps the old password: %s\n", layer, err)
+            }
+        }
+        log.Printf("Outer layers now use the new password\n")
+    }
 }
 
 func startTransports(tt tuntap.Device) {
     defer tt.Close()
 
-    tcpt, err := transports.NewTCPTransport("0.0.0.0")
+    // Knocking, TLS mimicry and the DTLS pre-shared key derive their keys
+    // with these too, so they need the salt first.  Their clients are given
+    // the salt (with --server-kdf), so it mustn't change when we restart.
+    var err error
+    psk_dtls := !no_dtls && len(dtls_cert) == 0
+    if len(kdf_salt_file) == 0 && (tls_mimic || len(knock_method) > 0 || psk_dtls) {
+        log.Printf("Knocking, TLS mimicry and DTLS need a --kdf-salt file, so that clients can still connect after a restart (use --no-dtls or --dtls-cert if you don't need the DTLS pre-shared key)\n")
+        return
+    }
+    if len(kdf_salt_file) > 0 {
+        server_kdf.Salt, err = transports.LoadKDFSalt(kdf_salt_file)
+    } else {
+        server_kdf.Salt, err = transports.NewKDFSalt()
+    }
+    if err != nil {
+        log.Printf("Error loading KDF salt: %s\n", err)
+        return
+    }
+
+    log.Printf("KDF parameters (for --server-kdf): %s\n", server_kdf)
+
+    // Everything that derives a key from the password, so it can be rebuilt
+    // when the password changes.
+    secret, _, password_changed := getPasswordGeneration()
+    var outer []outerKeyed
+
+    var tcp_opts transports.TCPOptions
+    trusted, err := transports.ParseTrustedProxies(proxy_from)
+    if err != nil {
+        log.Printf("Invalid trusted proxy list: %s\n", err)
+        return
+    }
+    tcp_opts.TrustedProxies = trusted
+    if tls_mimic {
+        tcp_opts.Mimic, err = transports.NewTLSMimicry(secret, server_kdf, "")
+        if err != nil {
+            log.Printf("Error deriving TLS mimicry key: %s\n", err)
+            return
+        }
+        outer = append(outer, tcp_opts.Mimic)
+    }
+
+    var knock_filter func(addr net.Addr) bool
+    if len(knock_method) > 0 {
+        guard, err := transports.NewKnockGuard(secret, server_kdf, knock_method, knock_window,
+            knock_firewall, []uint16{transports.TCP_PORT, transports.WEBRTC_SIGNAL_PORT},
+            []uint16{transports.UDP_PORT, transports.DTLS_PORT})
+        if err != nil {
+            log.Printf("Error starting knock listener: %s\n", err)
+            return
+        }
+        knock_guard = guard
+        outer = append(outer, guard)
+        knock_filter = guard.Allows
+        tcp_opts.Filter = guard.Allows
+
+        // Connections from the pluggable transport come from localhost, and
+        // it can't knock for its clients.
+        if len(pt_bin) > 0 {
+            tcp_opts.Filter = func(addr net.Addr) bool {
+                if tcp_addr, ok := addr.(*net.TCPAddr); ok && tcp_addr.IP.IsLoopback() {
+                    return true
+                }
+                return guard.Allows(addr)
+            }
+        }
+    }
+
+    if len(static_key_file) > 0 {
+        static_key, err = transports.LoadStaticKey(static_key_file)
+        if err != nil {
+            log.Printf("Error loading static key: %s\n", err)
+            return
+        }
+        log.Printf("Static public key (for --server-key): %x\n", static_key.Public)
+    }
+
+    if len(users_file) > 0 {
+        users, err = newUserStore(users_file)
+        if err != nil {
+            log.Printf("Error loading users: %s\n", err)
+            return
+        }
+    }
+
+    if len(keys_file) > 0 {
+        // Clients with keys have to pin ours.
+        if static_key == nil {
+            log.Printf("--authorized-keys needs --static-key\n")
+            return
+        }
+        authorized_keys, err = newKeyStore(keys_file)
+        if err != nil {
+            log.Printf("Error loading authorized keys: %s\n", err)
+            return
+        }
+    }
+
+    if ticket_lifetime > 0 {
+        tickets, err = transports.NewTicketIssuer(ticket_lifetime)
+        if err != nil {
+            log.Printf("Error setting up session tickets: %s\n", err)
+            return
+        }
+    }
+
+    tcpt, err := transports.NewTCPTransport("0.0.0.0", &tcp_opts)
     if err != nil {
         log.Printf("Error starting TCP transport: %s\n", err)
         return
     }
 
-    udpt, err := transports.NewUDPTransport("0.0.0.0")
+    // The pluggable transport forwards its connections to our TCP port.
+    if len(pt_bin) > 0 {
+        orport := fmt.Sprintf("127.0.0.1:%d", transports.TCP_PORT)
+        pt, err := transports.StartPTServer(pt_bin, pt_name, pt_bind, orport, pt_state)
+        if err != nil {
+            log.Printf("Error starting pluggable transport: %s\n", err)
+            return
+        }
+        pt_server = pt
+
+        if len(pt.Args) > 0 {
+            log.Printf("Clients should use --pt-args '%s'\n", strings.Replace(pt.Args, ",", ";", -1))
+        }
+    }
+
+    udpt, err := transports.NewUDPTransport("0.0.0.0", knock_filter)
     if err != nil {
         log.Printf("Error starting UDP transport: %s\n", err)
         return
     }
 
+    var dtls_ch chan transports.PacketClient
+    if !no_dtls {
+        dtls_opts := transports.DTLSOptions{Secret: secret, KDF: server_kdf, Filter: knock_filter}
+        if len(dtls_cert) > 0 {
+            dtls_opts.Certificate, err = transports.LoadDTLSCertificate(dtls_cert, dtls_key)
+            if err != nil {
+                log.Printf("Error loading DTLS certificate: %s\n", err)
+                return
+            }
+        }
+
+        dtlst, err := transports.NewDTLSTransport("0.0.0.0", &dtls_opts)
+        if err != nil {
+            log.Printf("Error starting DTLS transport: %s\n", err)
+            return
+        }
+        dtls_ch = dtlst.AcceptChannel()
+        outer = append(outer, dtlst)
+    }
+
+    var webrtc_ch chan transports.PacketClient
+    if !no_webrtc {
+        webrtc_opts := transports.WebRTCOptions{
+            Secret:      secret,
+            STUNServers: splitList(stun_servers),
+            Filter:      knock_filter,
+        }
+        webrtct, err := transports.NewWebRTCTransport("0.0.0.0", &webrtc_opts)
+        if err != nil {
+            log.Printf("Error starting WebRTC transport: %s\n", err)
+            return
+        }
+        webrtc_ch = webrtct.AcceptChannel()
+        outer = append(outer, webrtct)
+    }
+
+    // The MQTT transport is only started if we've been given a broker.  A
+    // nil channel never receives, so it's safe to select on (as with DTLS
+    // and WebRTC, if they're turned off).
+    var mqtt_ch chan transports.PacketClient
+    if len(mqtt_opts.Broker) > 0 {
+        mqttt, err := transports.NewMQTTTransport(&mqtt_opts)
+        if err != nil {
+            log.Printf("Error starting MQTT transport: %s\n", err)
+            return
+        }
+        mqtt_ch = mqttt.AcceptChannel()
+    }
+
+    var drop_ch chan transports.PacketClient
+    if len(drop_opts.Dir) > 0 {
+        dropt, err := transports.NewDeadDropTransport(&drop_opts)
+        if err != nil {
+            log.Printf("Error starting dead drop transport: %s\n", err)
+            return
+        }
+        drop_ch = dropt.AcceptChannel()
+    }
+
+    if len(outer) > 0 {
+        go rekeyOuter(outer, password_changed)
+    }
+
     // Repeatedly accept clients.
     tcp_ch := tcpt.AcceptChannel()
     udp_ch := udpt.AcceptChannel()
 
+    router := newTunnelRouter(tt)
+
     var client transports.PacketClient
+    var method string
     for {
         // TODO: have some way of stopping this
         select {
         case client = <-tcp_ch:
+            method = "tcp"
         case client = <-udp_ch:
+            method = "udp"
+        case client = <-dtls_ch:
+            method = "dtls"
+        case client = <-webrtc_ch:
+            method = "webrtc"
+        case client = <-mqtt_ch:
+            method = "mqtt"
+        case client = <-drop_ch:
+            method = "dir"
+        case <-router.done:
+            return
         }
 
-        go handleNewClient(tt, client)
+        go handleNewClient(router, client, method)
     }
 }
 
 // Authenticate and then handle the client.
-func handleNewClient(tt tuntap.Device, client transports.PacketClient) {
-    log.Printf("Accepted new client (reliable = %t)\n", client.IsReliable())
+func handleNewClient(router *tunnelRouter, client transports.PacketClient, method string) {
+    log.Printf("Accepted new client %s (reliable = %t)\n", client.Describe(), client.IsReliable())
 
-    // Set up encryption.
-    enc_client, err := transports.NewEncryptedPacketClient(client, "foobar")
+    // Set up encryption.  We remember which version of the password (or of
+    // the user's secret) the client used, so that it loses access if that
+    // changes.
+    secret, secret_gen, password_changed := getPasswordGeneration()
+    enc_opts := transports.EncryptionOptions{Secret: secret, StaticKey: static_key}
+    if users != nil {
+        enc_opts.Lookup = func(name string) (string, error) {
+            user_secret, err := users.Lookup(name)
+            secret_gen = userSecretGeneration(user_secret)
+            return user_secret, err
+        }
+    }
+    if authorized_keys != nil {
+        enc_opts.LookupKey = authorized_keys.checker(method)
+    }
+    enc_opts.Tickets = tickets
+    enc_opts.KDF = server_kdf
+    enc_client, err := transports.NewEncryptedPacketClient(client, &enc_opts)
     if err != nil {
         log.Printf("Could not initialize encryption: %s\n", err)
         client.Close()
         return
     }
-    defer enc_client.Close()
 
-    recv_ch := enc_client.RecvChannel()
-    send_ch := enc_client.SendChannel()
+    // Clients that ask for traffic shaping get it, and our own settings are
+    // added to theirs.
+    shaped_client := transports.AcceptShapedPacketClient(enc_client, &shape_opts)
+    defer shaped_client.Close()
+
+    // Clients with keys may have a fixed tunnel IP.
+    var fixed net.IP
+    if key := enc_client.PeerKey(); key != nil {
+        if entry := authorized_keys.Find(key); entry != nil {
+            log.Printf("Client key %x (%s)\n", key, entry.comment)
+            fixed = entry.ip
+        }
+    }
+
+    var negotiation *serverNegotiation
+    resumed := enc_client.Resumed()
+    if resumed != nil {
+        secret_gen = resumed.Generation
+        if err = checkAccess(enc_client, method, secret_gen); err != nil {
+            log.Printf("Refusing to resume session: %s\n", err)
+            return
+        }
+        negotiation = resumedNegotiation(shaped_client, resumed)
+        log.Printf("Client %s resumed its session\n", resumed.Hostname)
+    } else {
+        negotiation, err = negotiateServer(shaped_client, enc_client.ChannelBinding())
+        if err != nil {
+            log.Printf("Negotiation with client failed: %s\n", err)
+            return
+        }
+        log.Printf("Client %s connected (version %d.%d)\n", negotiation.client.hostname,
+            negotiation.client.majorVer, negotiation.client.minorVer)
+    }
+
+    var lease []byte
+    if resumed != nil {
+        lease = resumed.Lease
+    }
+    route, err := router.add(fixed, lease)
+    if err != nil {
+        log.Printf("Error adding route for client: %s\n", err)
+        return
+    }
+    defer router.remove(route)
+
+    // A resumed client gets its old address back straight away, even if its
+    // old connection is still around (see router.go).
+    if resumed != nil && fixed == nil && len(resumed.TunnelIP) > 0 {
+        router.claim(route, net.ParseIP(resumed.TunnelIP), true)
+    }
+
+    // Once we know the client's address, we give it a ticket so that it can
+    // come back to it.
+    ticket_sent := false
+
+    recv_ch := shaped_client.RecvChannel()
+    send_ch := shaped_client.SendChannel()
+
+    // Users who are disabled or expire, and keys that are removed, lose their
+    // sessions too.
+    access_check := time.NewTicker(accessCheckInterval)
+    defer access_check.Stop()
 
     for {
         select {
-        case from_client := <-recv_ch:
+        case from_client, ok := <-recv_ch:
+            if !ok {
+                log.Println("Client connection closed")
+                return
+            }
+
+            if len(from_client) < 1 || from_client[0] != msgData {
+                negotiation.repeat(from_client)
+                continue
+            }
+            from_client = from_client[1:]
+
+            if !router.learn(route, from_client) {
+                log.Printf("Packet from client has the wrong source address, dropping\n")
+                continue
+            }
+            if tickets != nil && !ticket_sent {
+                src, _, _ := packetAddrs(from_client)
+                sendTicket(send_ch, enc_client, negotiation.client.hostname, src, route.lease, secret_gen)
+                ticket_sent = true
+            }
+
             log.Printf("client --> tuntap (%d bytes)\n", len(from_client))
-            err = tt.Write(from_client)
+            err = router.tt.Write(from_client)
             if err != nil {
                 log.Printf("Error writing: %s\n", err)
             }
 
-        case from_tuntap := <-tt.RecvChannel():
+        case from_tuntap := <-route.ch:
             log.Printf("tuntap --> client (%d bytes)\n", len(from_tuntap))
-            send_ch <- from_tuntap
+            send_ch <- frameData(from_tuntap)
+
+        case <-access_check.C:
+            if err = checkAccess(enc_client, method, secret_gen); err != nil {
+                log.Printf("Disconnecting client: %s\n", err)
+                return
+            }
 
-        case <-tt.EOFChannel():
-            log.Println("EOF received from TUN/TAP device, exiting...")
+        case <-password_changed:
+            if err = checkAccess(enc_client, method, secret_gen); err != nil {
+                log.Printf("Disconnecting client: %s\n", err)
+                return
+            }
+            _, _, password_changed = getPasswordGeneration()
+
+        case <-router.done:
             return
         }
     }
 }
+
+// The client may have lost access since it got its ticket, or since it
+// connected.  Clients that used the password or a user's secret lose access
+// when it changes; secret_gen says which version they used.
+func checkAccess(enc_client *transports.EncryptedPacketClient, method string, secret_gen uint64) error {
+    if key := enc_client.PeerKey(); key != nil {
+        if authorized_keys == nil {
+            return fmt.Errorf("client keys are no longer accepted")
+        }
+        return authorized_keys.checker(method)(key)
+    }
+    if users != nil {
+        user_secret, err := users.Lookup(enc_client.Identity())
+        if err != nil {
+            return err
+        }
+        if userSecretGeneration(user_secret) != secret_gen {
+            return fmt.Errorf("the secret for user %s has changed", enc_client.Identity())
+        }
+        return nil
+    }
+    if _, gen, _ := getPasswordGeneration(); gen != secret_gen {
+        return fmt.Errorf("the password has changed")
+    }
+    return nil
+}
+
+func sendTicket(send_ch chan []byte, enc_client *transports.EncryptedPacketClient, hostname string, addr net.IP, lease []byte, secret_gen uint64) {
+    state := &transports.SessionState{
+        Identity:   enc_client.Identity(),
+        PeerKey:    enc_client.PeerKey(),
+        Hostname:   hostname,
+        TunnelIP:   addr.String(),
+        Lease:      lease,
+        Generation: secret_gen,
+    }
+
+    ticket, secret, err := tickets.Issue(state)
+    if err != nil {
+        log.Printf("Error issuing session ticket: %s\n", err)
+        return
+    }
+
+    lifetime := int(tickets.Lifetime() / time.Second)
+    if lifetime > 0xFFFF {
+        lifetime = 0xFFFF
+    }
+    msg := &SessionTicket{lifetime: lifetime, ticket: string(ticket), secret: string(secret)}
+    send_ch <- msg.marshal()
+}
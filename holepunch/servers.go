@@ -0,0 +1,386 @@
+package holepunch
+
+import (
+    "bufio"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math/rand"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/andrew-d/holepunch/transports"
+)
+
+// The client can be given a list of servers to try, rather than just one.
+// Servers are grouped by priority (lower numbers are tried first, as with DNS
+// SRV records), and servers with the same priority are ordered randomly, with
+// the chance of going first being proportional to the server's weight.
+//
+// On top of this, we keep track of how each server has behaved recently: a
+// server that we've successfully connected to is tried first, and a server
+// that has recently failed is pushed to the back of the list until its
+// backoff has expired.
+//
+// A server list file looks like this:
+//
+//      # address        options
+//      eu.example.com   priority=10 weight=2 methods=tcp,udp
+//      us.example.com   priority=10 weight=1
+//      backup.example   priority=20 methods=tcp
+//
+// Any options that aren't given fall back to the defaults (priority 0, weight
+// 1, and the methods given on the command line).
+
+// How long a successful connection makes a server "preferred" for.
+const preferGoodFor = 24 * time.Hour
+
+// Backoff for failed servers.  This doubles with each consecutive failure, up
+// to the maximum.
+const minServerBackoff = 5 * time.Second
+const maxServerBackoff = 5 * time.Minute
+
+type serverEntry struct {
+    addr     string
+    priority int
+    weight   int
+    methods  []string
+
+    // Health information - protected by the serverList's lock.
+    failures  int
+    last_fail time.Time
+    last_good time.Time
+
+    // The last session ticket the server gave us, if any.  Tickets can only
+    // be used once, so it's taken away when we use it.
+    ticket         *SessionTicket
+    ticket_expires time.Time
+    ticket_lock    sync.Mutex
+
+    // The KDF parameters the server last completed a handshake with.  These
+    // are pinned: they're saved in the state file, and a server that asks for
+    // weaker ones later is refused.
+    kdf      *transports.KDFParams
+    kdf_lock sync.Mutex
+}
+
+type serverList struct {
+    servers    []*serverEntry
+    state_file string
+    lock       sync.Mutex
+}
+
+// Parse a single server specification, as found in a server list file.
+func parseServerEntry(line string, default_methods []string) (*serverEntry, error) {
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("empty server entry")
+    }
+
+    entry := &serverEntry{
+        addr:     fields[0],
+        priority: 0,
+        weight:   1,
+        methods:  default_methods,
+    }
+
+    for _, opt := range fields[1:] {
+        parts := strings.SplitN(opt, "=", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid option '%s' for server %s", opt, entry.addr)
+        }
+
+        var err error
+        switch parts[0] {
+        case "priority":
+            entry.priority, err = strconv.Atoi(parts[1])
+
+        case "weight":
+            entry.weight, err = strconv.Atoi(parts[1])
+            if err == nil && entry.weight < 1 {
+                err = fmt.Errorf("weight must be at least 1")
+            }
+
+        case "methods":
+            entry.methods = parseMethods(parts[1])
+
+        default:
+            err = fmt.Errorf("unknown option")
+        }
+
+        if err != nil {
+            return nil, fmt.Errorf("bad option '%s' for server %s: %s", opt, entry.addr, err)
+        }
+    }
+
+    return entry, nil
+}
+
+// Split a comma-seperated list of methods, expanding "all".
+func parseMethods(s string) []string {
+    methods := strings.Split(s, ",")
+    if len(methods) == 1 && methods[0] == "all" {
+        methods = []string{"tcp", "udp", "dtls", "webrtc", "turn", "mqtt", "dir", "pt", "icmp", "dns"}
+    }
+    return methods
+}
+
+// Load a server list from a file.  Blank lines and lines starting with '#'
+// are ignored.
+func loadServerFile(path string, default_methods []string) ([]*serverEntry, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var ret []*serverEntry
+    scanner := bufio.NewScanner(f)
+    lineno := 0
+    for scanner.Scan() {
+        lineno++
+
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) == 0 || line[0] == '#' {
+            continue
+        }
+
+        entry, err := parseServerEntry(line, default_methods)
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %s", path, lineno, err)
+        }
+        ret = append(ret, entry)
+    }
+
+    if err = scanner.Err(); err != nil {
+        return nil, err
+    }
+    return ret, nil
+}
+
+// Any KDF parameters we were given are used for every server, unless the
+// state file has newer ones.
+func newServerList(servers []*serverEntry, state_file string, kdf *transports.KDFParams) *serverList {
+    l := &serverList{servers: servers, state_file: state_file}
+    for _, s := range servers {
+        s.kdf = kdf
+    }
+    l.loadState()
+    return l
+}
+
+// Returns the servers in the order in which they should be tried, grouped by
+// priority.
+func (l *serverList) ordered() [][]*serverEntry {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    now := time.Now()
+
+    // Group by priority.
+    groups := make(map[int][]*serverEntry)
+    var priorities []int
+    for _, s := range l.servers {
+        if _, found := groups[s.priority]; !found {
+            priorities = append(priorities, s.priority)
+        }
+        groups[s.priority] = append(groups[s.priority], s)
+    }
+    sort.Ints(priorities)
+
+    var ret [][]*serverEntry
+    var backing_off []*serverEntry
+    for _, prio := range priorities {
+        var healthy []*serverEntry
+        for _, s := range weightedShuffle(groups[prio]) {
+            if s.failures > 0 && now.Before(s.last_fail.Add(s.backoff())) {
+                backing_off = append(backing_off, s)
+            } else {
+                healthy = append(healthy, s)
+            }
+        }
+
+        // The server that worked most recently goes first.
+        sort.SliceStable(healthy, func(i, j int) bool {
+            return healthy[i].isPreferred(now) && !healthy[j].isPreferred(now)
+        })
+
+        if len(healthy) > 0 {
+            ret = append(ret, healthy)
+        }
+    }
+
+    // Servers that failed recently are still tried, but only once everything
+    // else has been.
+    if len(backing_off) > 0 {
+        ret = append(ret, backing_off)
+    }
+    return ret
+}
+
+// Order servers randomly, weighted by their weight.
+func weightedShuffle(servers []*serverEntry) []*serverEntry {
+    remaining := append([]*serverEntry{}, servers...)
+    ret := make([]*serverEntry, 0, len(servers))
+
+    for len(remaining) > 0 {
+        total := 0
+        for _, s := range remaining {
+            total += s.weight
+        }
+
+        pick := rand.Intn(total)
+        for i, s := range remaining {
+            pick -= s.weight
+            if pick < 0 {
+                ret = append(ret, s)
+                remaining = append(remaining[:i], remaining[i+1:]...)
+                break
+            }
+        }
+    }
+
+    return ret
+}
+
+func (s *serverEntry) isPreferred(now time.Time) bool {
+    return !s.last_good.IsZero() && now.Before(s.last_good.Add(preferGoodFor)) &&
+        s.last_good.After(s.last_fail)
+}
+
+func (s *serverEntry) backoff() time.Duration {
+    backoff := minServerBackoff
+    for i := 1; i < s.failures && backoff < maxServerBackoff; i++ {
+        backoff *= 2
+    }
+    if backoff > maxServerBackoff {
+        backoff = maxServerBackoff
+    }
+    return backoff
+}
+
+func (l *serverList) markGood(s *serverEntry) {
+    l.lock.Lock()
+    s.failures = 0
+    s.last_good = time.Now()
+    l.lock.Unlock()
+
+    l.saveState()
+}
+
+func (l *serverList) markFailed(s *serverEntry) {
+    l.lock.Lock()
+    s.failures++
+    s.last_fail = time.Now()
+    failures, backoff := s.failures, s.backoff()
+    l.lock.Unlock()
+
+    log.Printf("Server %s has failed %d time(s), backing off for %s\n",
+        s.addr, failures, backoff)
+}
+
+// The state file simply records when we last connected successfully to each
+// server, one per line, as "address unix_timestamp [kdf_params]".
+func (l *serverList) loadState() {
+    if len(l.state_file) == 0 {
+        return
+    }
+
+    data, err := ioutil.ReadFile(l.state_file)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            log.Printf("Error reading server state: %s\n", err)
+        }
+        return
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) != 2 && len(fields) != 3 {
+            continue
+        }
+
+        ts, err := strconv.ParseInt(fields[1], 10, 64)
+        if err != nil {
+            continue
+        }
+
+        var kdf *transports.KDFParams
+        if len(fields) == 3 {
+            if kdf, err = transports.ParseKDFParams(fields[2]); err != nil {
+                log.Printf("Ignoring saved KDF parameters for %s: %s\n", fields[0], err)
+            }
+        }
+
+        for _, s := range l.servers {
+            if s.addr == fields[0] {
+                s.last_good = time.Unix(ts, 0)
+                if kdf != nil {
+                    s.setKDF(kdf)
+                }
+            }
+        }
+    }
+}
+
+func (l *serverList) saveState() {
+    if len(l.state_file) == 0 {
+        return
+    }
+
+    l.lock.Lock()
+    var lines []string
+    for _, s := range l.servers {
+        if s.last_good.IsZero() {
+            continue
+        }
+        line := fmt.Sprintf("%s %d", s.addr, s.last_good.Unix())
+        if kdf := s.getKDF(); kdf != nil {
+            line += " " + kdf.String()
+        }
+        lines = append(lines, line)
+    }
+    l.lock.Unlock()
+
+    data := []byte(strings.Join(lines, "\n") + "\n")
+    if err := ioutil.WriteFile(l.state_file, data, 0600); err != nil {
+        log.Printf("Error saving server state: %s\n", err)
+    }
+}
+
+func (s *serverEntry) setTicket(ticket *SessionTicket) {
+    s.ticket_lock.Lock()
+    defer s.ticket_lock.Unlock()
+
+    s.ticket = ticket
+    s.ticket_expires = time.Now().Add(time.Duration(ticket.lifetime) * time.Second)
+}
+
+// Returns the ticket to resume with, if there's one that hasn't expired.
+func (s *serverEntry) takeTicket() *SessionTicket {
+    s.ticket_lock.Lock()
+    defer s.ticket_lock.Unlock()
+
+    ticket := s.ticket
+    s.ticket = nil
+    if ticket == nil || time.Now().After(s.ticket_expires) {
+        return nil
+    }
+    return ticket
+}
+
+func (s *serverEntry) getKDF() *transports.KDFParams {
+    s.kdf_lock.Lock()
+    defer s.kdf_lock.Unlock()
+    return s.kdf
+}
+
+func (s *serverEntry) setKDF(kdf *transports.KDFParams) {
+    s.kdf_lock.Lock()
+    defer s.kdf_lock.Unlock()
+    s.kdf = kdf
+}
@@ -0,0 +1,202 @@
+package holepunch
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The server can be given a file of users (or devices), each with their own
+// secret, rather than having everyone share the one password.  Clients say
+// who they are with --user, and the server uses that user's secret for the
+// handshake.  Taking one device away is then just a matter of disabling it,
+// or letting it expire, without changing anyone else's secret.
+//
+// A users file looks like this:
+//
+//      # name      options
+//      laptop      secret=correct-horse-battery-staple
+//      phone       secret=hunter2 expires=2025-06-30
+//      old-laptop  secret=swordfish disabled
+//
+// Expiry dates can be given as a date (in which case the user expires at the
+// start of that day, UTC) or as a full RFC 3339 time.  The file is read again
+// whenever it changes, so there's no need to restart the server, and clients
+// whose users are disabled or expire, or whose secrets change, are
+// disconnected within a minute (and can't resume their sessions).
+//
+// Note that the user name is sent in the clear, before the handshake.
+
+type userEntry struct {
+    name     string
+    secret   string
+    disabled bool
+    expires  time.Time
+}
+
+type userStore struct {
+    path     string
+    users    map[string]*userEntry
+    mod_time time.Time
+    lock     sync.Mutex
+}
+
+// Parse a single user, as found in a users file.
+func parseUserEntry(line string) (*userEntry, error) {
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("empty user entry")
+    }
+
+    entry := &userEntry{name: fields[0]}
+    if len(entry.name) > 255 {
+        return nil, fmt.Errorf("user name too long: %s", entry.name)
+    }
+
+    for _, opt := range fields[1:] {
+        switch opt {
+        case "disabled":
+            entry.disabled = true
+            continue
+        case "enabled":
+            entry.disabled = false
+            continue
+        }
+
+        parts := strings.SplitN(opt, "=", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid option '%s' for user %s", opt, entry.name)
+        }
+
+        var err error
+        switch parts[0] {
+        case "secret":
+            entry.secret = parts[1]
+
+        case "expires":
+            entry.expires, err = time.Parse("2006-01-02", parts[1])
+            if err != nil {
+                entry.expires, err = time.Parse(time.RFC3339, parts[1])
+            }
+
+        default:
+            err = fmt.Errorf("unknown option")
+        }
+
+        if err != nil {
+            return nil, fmt.Errorf("bad option '%s' for user %s: %s", opt, entry.name, err)
+        }
+    }
+
+    if len(entry.secret) == 0 {
+        return nil, fmt.Errorf("no secret for user %s", entry.name)
+    }
+    return entry, nil
+}
+
+// Load a users file.  Blank lines and lines starting with '#' are ignored.
+func loadUserFile(path string) (map[string]*userEntry, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    ret := make(map[string]*userEntry)
+    scanner := bufio.NewScanner(f)
+    lineno := 0
+    for scanner.Scan() {
+        lineno++
+
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) == 0 || line[0] == '#' {
+            continue
+        }
+
+        entry, err := parseUserEntry(line)
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %s", path, lineno, err)
+        }
+        if _, found := ret[entry.name]; found {
+            return nil, fmt.Errorf("%s:%d: duplicate user %s", path, lineno, entry.name)
+        }
+        ret[entry.name] = entry
+    }
+
+    if err = scanner.Err(); err != nil {
+        return nil, err
+    }
+    return ret, nil
+}
+
+func newUserStore(path string) (*userStore, error) {
+    s := &userStore{path: path}
+    if err := s.reload(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Reads the file again if it's changed since we last read it.  If the new
+// file is broken, we keep using the old one.
+func (s *userStore) reload() error {
+    info, err := os.Stat(s.path)
+    if err != nil {
+        return err
+    }
+    if s.users != nil && info.ModTime().Equal(s.mod_time) {
+        return nil
+    }
+
+    users, err := loadUserFile(s.path)
+    if err != nil {
+        return err
+    }
+
+    if s.users != nil {
+        log.Printf("Reloaded users from %s (%d users)\n", s.path, len(users))
+    }
+    s.users = users
+    s.mod_time = info.ModTime()
+    return nil
+}
+
+// Returns the secret for a user, if they're allowed to connect.
+func (s *userStore) Lookup(name string) (string, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if err := s.reload(); err != nil {
+        log.Printf("Error reloading users: %s\n", err)
+    }
+
+    if len(name) == 0 {
+        return "", fmt.Errorf("client didn't give a user name")
+    }
+
+    entry, found := s.users[name]
+    if !found {
+        return "", fmt.Errorf("unknown user %s", name)
+    }
+    if entry.disabled {
+        return "", fmt.Errorf("user %s is disabled", name)
+    }
+    if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+        return "", fmt.Errorf("user %s expired on %s", name, entry.expires.Format(time.RFC3339))
+    }
+    return entry.secret, nil
+}
+
+// Identifies a version of a user's secret, so that sessions (and tickets)
+// from before it changed can be refused.  It's only kept in tickets, which
+// are encrypted, so it never leaves the server.
+func userSecretGeneration(secret string) uint64 {
+    sum := sha256.Sum256([]byte("holepunch user secret\x00" + secret))
+    return binary.BigEndian.Uint64(sum[:])
+}
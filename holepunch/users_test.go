@@ -0,0 +1,142 @@
+package holepunch
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseUserEntry(t *testing.T) {
+    tests := []struct {
+        line     string
+        expected userEntry
+    }{
+        {"laptop secret=hunter2", userEntry{name: "laptop", secret: "hunter2"}},
+        {"phone  secret=a=b  expires=2025-06-30",
+            userEntry{name: "phone", secret: "a=b", expires: time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)}},
+        {"phone secret=x expires=2025-06-30T12:00:00+02:00",
+            userEntry{name: "phone", secret: "x", expires: time.Date(2025, 6, 30, 10, 0, 0, 0, time.UTC)}},
+        {"old secret=x disabled", userEntry{name: "old", secret: "x", disabled: true}},
+        {"old disabled enabled secret=x", userEntry{name: "old", secret: "x"}},
+    }
+    for _, test := range tests {
+        entry, err := parseUserEntry(test.line)
+        if err != nil {
+            t.Errorf("%s: %s", test.line, err)
+            continue
+        }
+        if entry.name != test.expected.name || entry.secret != test.expected.secret ||
+            entry.disabled != test.expected.disabled || !entry.expires.Equal(test.expected.expires) {
+            t.Errorf("%s: got %+v, expected %+v", test.line, *entry, test.expected)
+        }
+    }
+
+    bad := []string{
+        "",
+        "laptop",
+        "laptop disabled",
+        "laptop secret=",
+        "laptop secret=x expires=tomorrow",
+        "laptop secret=x expires=2025-13-01",
+        "laptop secret=x ip=10.0.0.1",
+        "laptop secret=x bogus",
+        strings.Repeat("x", 256) + " secret=x",
+    }
+    for _, line := range bad {
+        if _, err := parseUserEntry(line); err == nil {
+            t.Errorf("%q: no error", line)
+        }
+    }
+}
+
+func writeUsers(t *testing.T, path, contents string, mod_time time.Time) {
+    if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+        t.Fatal(err)
+    }
+    os.Chtimes(path, mod_time, mod_time)
+}
+
+func TestLoadUserFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "users")
+    writeUsers(t, path, "# name  options\n\nlaptop secret=a\n  # indented comment\nphone secret=b disabled\n", time.Now())
+
+    users, err := loadUserFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(users) != 2 || users["laptop"].secret != "a" || !users["phone"].disabled {
+        t.Errorf("got %v", users)
+    }
+
+    tests := []struct {
+        contents string
+        err      string
+    }{
+        {"laptop secret=a\nlaptop secret=b\n", ":2: duplicate user laptop"},
+        {"laptop secret=a\n\nphone\n", ":3: no secret"},
+    }
+    for _, test := range tests {
+        writeUsers(t, path, test.contents, time.Now())
+        if _, err := loadUserFile(path); err == nil || !strings.Contains(err.Error(), test.err) {
+            t.Errorf("%q: got %v, expected %s", test.contents, err, test.err)
+        }
+    }
+}
+
+func TestUserStoreLookup(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "users")
+    yesterday := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+    tomorrow := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+    start := time.Now().Add(-time.Hour)
+    writeUsers(t, path, "laptop secret=a expires="+tomorrow+"\nphone secret=b disabled\nold secret=c expires="+yesterday+"\n", start)
+
+    store, err := newUserStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name   string
+        secret string // "" if they aren't allowed in
+    }{
+        {"laptop", "a"},
+        {"phone", ""},
+        {"old", ""},
+        {"nobody", ""},
+        {"", ""},
+    }
+    for _, test := range tests {
+        secret, err := store.Lookup(test.name)
+        if test.secret == "" {
+            if err == nil {
+                t.Errorf("%q: let in", test.name)
+            }
+        } else if err != nil || secret != test.secret {
+            t.Errorf("%q: got %q, %v", test.name, secret, err)
+        }
+    }
+
+    // Changes are picked up, but a broken file is ignored.
+    writeUsers(t, path, "laptop secret=new\n", start.Add(time.Minute))
+    if secret, err := store.Lookup("laptop"); err != nil || secret != "new" {
+        t.Errorf("after the change: got %q, %v", secret, err)
+    }
+    writeUsers(t, path, "laptop\n", start.Add(2*time.Minute))
+    if secret, err := store.Lookup("laptop"); err != nil || secret != "new" {
+        t.Errorf("after breaking the file: got %q, %v", secret, err)
+    }
+}
+
+// Sessions are tied to a version of the user's secret, and end when it
+// changes.
+func TestUserSecretGeneration(t *testing.T) {
+    if userSecretGeneration("a") != userSecretGeneration("a") {
+        t.Error("the same secret has different generations")
+    }
+    if userSecretGeneration("a") == userSecretGeneration("b") {
+        t.Error("different secrets have the same generation")
+    }
+}
@@ -1,18 +1,14 @@
 package holepunch
 
 import (
-    "math/rand"
+    "crypto/rand"
 )
 
-const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-func randomBytes(l int) []byte {
+// Returns l bytes from the system's secure random number generator.
+func randomBytes(l int) ([]byte, error) {
     bytes := make([]byte, l)
-    for i := 0; i < l; i++ {
-        bytes[i] = charset[rand.Intn(len(charset))]
+    if _, err := rand.Read(bytes); err != nil {
+        return nil, err
     }
-
-    // XXX: REMOVE ME, OR THIS IS VERY USELESS!
-    return []byte{'a', 'b', 'c', 'd'}
-    return bytes
+    return bytes, nil
 }
@@ -1,6 +1,7 @@
 package transports
 
-// This interface represents a single connected client.
+// This interface represents a single connected client.  When the connection
+// is lost, the client closes its receive channel.
 type PacketClient interface {
     SendChannel() chan []byte
     RecvChannel() chan []byte
@@ -9,6 +10,27 @@ type PacketClient interface {
     Describe() string
 }
 
+// Packet clients whose peer can change address in the middle of a session
+// implement this interface.  Every packet is tagged with the session ID, and
+// the encryption layer must include the session ID in what it authenticates,
+// and provide a function that verifies whether a packet is genuine.  The
+// session is only moved to a new address once a packet from that address has
+// been verified.
+type RoamingPacketClient interface {
+    PacketClient
+    SessionID() []byte
+    SetRoamVerifier(verify func(pkt []byte) bool)
+}
+
 type Transport interface {
     AcceptChannel() chan PacketClient
 }
+
+// Once a client's connection has failed, nothing will read from its send
+// channel any more.  Rather than leaving anyone who writes to it blocked
+// forever, we just throw away everything that is sent.
+func drainPackets(ch chan []byte) {
+    // TODO: some way to stop this
+    for _ = range ch {
+    }
+}
@@ -0,0 +1,237 @@
+package transports
+
+import (
+    "encoding/binary"
+    "fmt"
+    "log"
+    "sync/atomic"
+    "time"
+)
+
+// Constant-rate cover traffic.  In this mode, each end of the connection
+// sends packets of exactly the same size, at exactly the same rate, all the
+// time.  If there's a real packet waiting, it goes in the next slot (split
+// across several slots if it doesn't fit in one), and otherwise we send
+// chaff.  To an observer, an idle tunnel looks just like a busy one.
+//
+// The cost is that the tunnel uses its full bandwidth all the time, and can
+// never use more than that: packets that arrive faster than we can send them
+// are queued, and dropped once the queue is full.
+//
+// The encryption layer's rekeying messages are padded to the same size, but
+// are sent when they're needed rather than in a slot, so there are a few
+// extra packets each time the keys change.
+//
+// Fragments are framed as:
+//
+//      [type (1 byte)] [length (2 bytes)] [packet ID (2 bytes)] [index (1 byte)] [data] [padding]
+//
+// where the type is shapeFrameLastFragment for the last fragment of a packet.
+// If a fragment goes missing, the whole packet is dropped.
+
+const coverFragHeaderLen = 3
+
+// The smallest packets we'll send in cover mode.
+const MinCoverSize = 64
+
+const defaultCoverQueue = 64
+
+// How often to log how much bandwidth is going to cover traffic.
+const coverStatsInterval = 5 * time.Minute
+
+// Accounting for cover traffic.  All counts are of bytes before encryption.
+// The fields are updated atomically, so they must stay 64-bit aligned: keep
+// them as the only fields, and put this first in anything that contains it.
+type CoverStats struct {
+    // Bytes of real packets sent.
+    RealBytes uint64
+
+    // Bytes of padding and chaff sent.
+    CoverBytes uint64
+
+    // Packets dropped because the queue was full.
+    Dropped uint64
+}
+
+func (o *ShapingOptions) coverMode() bool {
+    return o.CoverRate > 0 && o.CoverSize >= MinCoverSize
+}
+
+func coverQueueLen(opts *ShapingOptions) int {
+    if opts.CoverQueue > 0 {
+        return opts.CoverQueue
+    }
+    return defaultCoverQueue
+}
+
+// Returns a snapshot of the cover traffic accounting.
+func (c *ShapedPacketClient) Stats() CoverStats {
+    return CoverStats{
+        RealBytes:  atomic.LoadUint64(&c.stats.RealBytes),
+        CoverBytes: atomic.LoadUint64(&c.stats.CoverBytes),
+        Dropped:    atomic.LoadUint64(&c.stats.Dropped),
+    }
+}
+
+func (s CoverStats) String() string {
+    total := s.RealBytes + s.CoverBytes
+    percent := 0.0
+    if total > 0 {
+        percent = float64(s.CoverBytes) * 100 / float64(total)
+    }
+    return fmt.Sprintf("%d bytes real, %d bytes cover (%.1f%%), %d packets dropped",
+        s.RealBytes, s.CoverBytes, percent, s.Dropped)
+}
+
+func (c *ShapedPacketClient) queueCover(pkt []byte, opts *ShapingOptions) {
+    // Fragments are numbered with a single byte.
+    space := opts.CoverSize - shapeHeaderLen - coverFragHeaderLen
+    if (len(pkt)+space-1)/space > 256 {
+        log.Printf("Packet too large for cover traffic (%d bytes), dropping\n", len(pkt))
+        atomic.AddUint64(&c.stats.Dropped, 1)
+        return
+    }
+
+    select {
+    case c.cover_queue <- pkt:
+    default:
+        atomic.AddUint64(&c.stats.Dropped, 1)
+    }
+}
+
+func (c *ShapedPacketClient) doCover() {
+    opts, _ := c.current()
+    underlying := c.underlying.SendChannel()
+
+    ticker := time.NewTicker(time.Second / time.Duration(opts.CoverRate))
+    defer ticker.Stop()
+    stats_ticker := time.NewTicker(coverStatsInterval)
+    defer stats_ticker.Stop()
+
+    // The packet currently being sent in pieces, if any.
+    var pending []byte
+    var packet_id uint16
+    var index byte
+
+    for {
+        select {
+        case <-ticker.C:
+        case <-stats_ticker.C:
+            log.Printf("Cover traffic for %s: %s\n", c.Describe(), c.Stats())
+            continue
+        case <-c.closed:
+            log.Printf("Cover traffic for %s: %s\n", c.Describe(), c.Stats())
+            return
+        }
+
+        if pending == nil {
+            select {
+            case pending = <-c.cover_queue:
+                packet_id++
+                index = 0
+            default:
+            }
+        }
+
+        var frame []byte
+        if pending == nil {
+            frame = makeCoverFrame(shapeFrameChaff, nil, opts.CoverSize)
+            atomic.AddUint64(&c.stats.CoverBytes, uint64(len(frame)))
+        } else if len(pending)+shapeHeaderLen <= opts.CoverSize && index == 0 {
+            // It fits in one.
+            frame = makeCoverFrame(shapeFrameData, pending, opts.CoverSize)
+            atomic.AddUint64(&c.stats.RealBytes, uint64(len(pending)))
+            atomic.AddUint64(&c.stats.CoverBytes, uint64(len(frame)-len(pending)))
+            pending = nil
+        } else {
+            space := opts.CoverSize - shapeHeaderLen - coverFragHeaderLen
+            kind := byte(shapeFrameFragment)
+            if len(pending) <= space {
+                space = len(pending)
+                kind = shapeFrameLastFragment
+            }
+
+            payload := make([]byte, coverFragHeaderLen+space)
+            binary.BigEndian.PutUint16(payload, packet_id)
+            payload[2] = index
+            copy(payload[coverFragHeaderLen:], pending[:space])
+
+            frame = makeCoverFrame(kind, payload, opts.CoverSize)
+            atomic.AddUint64(&c.stats.RealBytes, uint64(space))
+            atomic.AddUint64(&c.stats.CoverBytes, uint64(len(frame)-space))
+
+            pending = pending[space:]
+            index++
+            if kind == shapeFrameLastFragment {
+                pending = nil
+            }
+        }
+
+        select {
+        case underlying <- frame:
+        case <-c.closed:
+            return
+        }
+    }
+}
+
+// Like makeShapeFrame, but always exactly size bytes.
+func makeCoverFrame(kind byte, payload []byte, size int) []byte {
+    frame := make([]byte, size)
+    frame[0] = kind
+    binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+    copy(frame[shapeHeaderLen:], payload)
+    return frame
+}
+
+// --------------------------------------------------------------------------------
+
+// Reassembles fragmented packets.  This is only used from the receiving
+// goroutine.
+type fragmentState struct {
+    id     uint16
+    next   byte
+    buf    []byte
+    broken bool
+    active bool
+}
+
+// Adds a fragment, returning the whole packet once it's complete.
+func (f *fragmentState) add(kind byte, payload []byte) ([]byte, bool) {
+    if len(payload) < coverFragHeaderLen {
+        log.Printf("Fragment too short (%d bytes), dropping\n", len(payload))
+        return nil, false
+    }
+
+    id := binary.BigEndian.Uint16(payload)
+    index := payload[2]
+    data := payload[coverFragHeaderLen:]
+
+    // A new packet means that we've given up on the last one.
+    if !f.active || id != f.id {
+        f.id = id
+        f.next = 0
+        f.buf = nil
+        f.broken = false
+        f.active = true
+    }
+
+    if index != f.next {
+        f.broken = true
+    }
+    f.next = index + 1
+    if !f.broken {
+        f.buf = append(f.buf, data...)
+    }
+
+    if kind != shapeFrameLastFragment {
+        return nil, false
+    }
+
+    f.active = false
+    if f.broken {
+        log.Printf("Lost part of fragmented packet %d, dropping\n", id)
+        return nil, false
+    }
+    return f.buf, true
+}
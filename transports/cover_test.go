@@ -0,0 +1,155 @@
+package transports
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+    "time"
+)
+
+func coverFragment(id uint16, index byte, data string) []byte {
+    payload := make([]byte, coverFragHeaderLen, coverFragHeaderLen+len(data))
+    binary.BigEndian.PutUint16(payload, id)
+    payload[2] = index
+    return append(payload, data...)
+}
+
+func TestFragmentReassembly(t *testing.T) {
+    type fragment struct {
+        kind  byte
+        id    uint16
+        index byte
+        data  string
+    }
+    tests := []struct {
+        name      string
+        fragments []fragment
+        expected  string // "" if the last fragment shouldn't complete a packet
+    }{
+        {"in order", []fragment{
+            {shapeFrameFragment, 1, 0, "ab"},
+            {shapeFrameFragment, 1, 1, "cd"},
+            {shapeFrameLastFragment, 1, 2, "e"},
+        }, "abcde"},
+        {"single", []fragment{
+            {shapeFrameLastFragment, 9, 0, "whole"},
+        }, "whole"},
+        {"missing fragment", []fragment{
+            {shapeFrameFragment, 1, 0, "ab"},
+            {shapeFrameLastFragment, 1, 2, "e"},
+        }, ""},
+        {"duplicate fragment", []fragment{
+            {shapeFrameFragment, 1, 0, "ab"},
+            {shapeFrameFragment, 1, 0, "ab"},
+            {shapeFrameLastFragment, 1, 1, "cd"},
+        }, ""},
+        {"missing start", []fragment{
+            {shapeFrameLastFragment, 1, 1, "cd"},
+        }, ""},
+        {"new packet abandons the last", []fragment{
+            {shapeFrameFragment, 1, 0, "ab"},
+            {shapeFrameFragment, 2, 0, "xy"},
+            {shapeFrameLastFragment, 2, 1, "z"},
+        }, "xyz"},
+        {"same ID after a complete packet", []fragment{
+            {shapeFrameLastFragment, 1, 0, "one"},
+            {shapeFrameFragment, 1, 0, "tw"},
+            {shapeFrameLastFragment, 1, 1, "o"},
+        }, "two"},
+    }
+
+    for _, test := range tests {
+        var state fragmentState
+        var pkt []byte
+        var done bool
+        for _, frag := range test.fragments {
+            pkt, done = state.add(frag.kind, coverFragment(frag.id, frag.index, frag.data))
+        }
+        if test.expected == "" {
+            if done {
+                t.Errorf("%s: got %q", test.name, pkt)
+            }
+        } else if !done || string(pkt) != test.expected {
+            t.Errorf("%s: got %q, %v, expected %q", test.name, pkt, done, test.expected)
+        }
+    }
+
+    var state fragmentState
+    if _, done := state.add(shapeFrameLastFragment, []byte{0, 1}); done {
+        t.Error("accepted a fragment without a header")
+    }
+}
+
+// Reads n cover frames, checking that they're all the right size.
+func coverFrames(t *testing.T, end *testEnd, size, n int) [][]byte {
+    var frames [][]byte
+    for i := 0; i < n; i++ {
+        frame := nextFrame(t, end)
+        if len(frame) != size {
+            t.Fatalf("got a %d-byte frame in %d-byte cover traffic", len(frame), size)
+        }
+        frames = append(frames, frame)
+    }
+    return frames
+}
+
+func TestCoverTraffic(t *testing.T) {
+    opts := &ShapingOptions{CoverRate: 1000, CoverSize: 64}
+    sender, sent := newShapedEnd(t, opts)
+    receiver, received := newShapedEnd(t, opts)
+
+    // With nothing to send, it's all chaff.
+    for _, frame := range coverFrames(t, sent, 64, 5) {
+        checkFrame(t, frame, shapeFrameChaff, nil)
+    }
+
+    // Small packets go in one frame, and bigger ones are split.
+    small := []byte("small")
+    big := bytes.Repeat([]byte("0123456789"), 15)
+    sender.SendChannel() <- small
+    sender.SendChannel() <- big
+
+    go func() {
+        for {
+            select {
+            case frame := <-sent.send_ch:
+                if len(frame) != 64 {
+                    t.Errorf("got a %d-byte frame in 64-byte cover traffic", len(frame))
+                }
+                select {
+                case received.recv_ch <- frame:
+                case <-received.closed:
+                    return
+                }
+            case <-sent.closed:
+                return
+            }
+        }
+    }()
+
+    for _, expected := range [][]byte{small, big} {
+        if pkt := recvWithin(t, receiver, 5*time.Second); !bytes.Equal(pkt, expected) {
+            t.Errorf("got %q, expected %q", pkt, expected)
+        }
+    }
+
+    stats := sender.Stats()
+    if stats.RealBytes != uint64(len(small)+len(big)) || stats.CoverBytes == 0 || stats.Dropped != 0 {
+        t.Errorf("stats: %s", stats)
+    }
+}
+
+func TestCoverDrops(t *testing.T) {
+    // One packet a second, so nothing leaves the queue while we fill it.
+    opts := &ShapingOptions{CoverRate: 1, CoverSize: 64, CoverQueue: 2}
+    c, _ := newShapedEnd(t, opts)
+
+    // Too big to number its fragments.
+    c.SendChannel() <- make([]byte, 256*(64-shapeHeaderLen-coverFragHeaderLen)+1)
+
+    // Two fit in the queue, and the rest are dropped.
+    for i := 0; i < 5; i++ {
+        c.SendChannel() <- []byte("queued")
+    }
+    waitFor(t, "packets to be dropped", func() bool { return c.Stats().Dropped == 4 })
+}
@@ -0,0 +1,416 @@
+package transports
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// This transport exchanges packets through a shared directory, for when the
+// only link between the client and the server is a folder that's synced
+// somehow (an NFS or SMB mount, or a file syncing tool).  It's slow, but it
+// works.
+//
+// The directory is laid out like this:
+//
+//      <dir>/<session>/up/<name>       client --> server
+//      <dir>/<session>/down/<name>     server --> client
+//
+// where the session ID is chosen at random by the client.  Each file holds a
+// batch of packets, each prefixed with its length as a big-endian uint16.
+// Files are named so that they sort in the order they were written, and are
+// written under a temporary name (starting with '.') and then renamed, so
+// the reader never sees a partly-written file.  The reader deletes each file
+// once it has read it.
+//
+// We poll the directory rather than using inotify or similar, since those
+// don't work on network filesystems anyway.
+//
+// The server closes sessions it hasn't heard from in a while, and removes
+// them, which also tells the client that the session is over.  So that an
+// idle tunnel isn't closed, the client writes an empty file every so often
+// if it has nothing else to send.
+
+// Packets are batched for this long (or until the batch is this big) before
+// being written out.
+const dropBatchDelay = 50 * time.Millisecond
+const dropMaxBatch = 256 * 1024
+
+// Sessions that haven't been touched in this long are removed by the server,
+// unless the options say otherwise.
+const dropStaleAfter = 10 * time.Minute
+
+type DeadDropOptions struct {
+    // The shared directory.
+    Dir string
+
+    // How often to check for new files.
+    PollInterval time.Duration
+
+    // How long a session can go without any files arriving before the server
+    // closes it.  The client sends keepalives at half this interval, so it
+    // should be the same on both sides.  If this is zero, dropStaleAfter is
+    // used.
+    IdleTimeout time.Duration
+}
+
+func (o *DeadDropOptions) idleTimeout() time.Duration {
+    if o.IdleTimeout > 0 {
+        return o.IdleTimeout
+    }
+    return dropStaleAfter
+}
+
+type DeadDropPacketClient struct {
+    session  string
+    send_dir string
+    recv_dir string
+    poll     time.Duration
+
+    send_ch chan []byte
+    recv_ch chan []byte
+    seq     uint64
+
+    // Client: how often to write an empty file if there's nothing else to
+    // send.  Server: how long to wait for a file before giving up on the
+    // client.  Zero to disable.
+    keepalive time.Duration
+    idle      time.Duration
+
+    // The client side removes the whole session when it's closed.
+    session_dir string
+    onClose     func()
+
+    closed     chan bool
+    close_once sync.Once
+}
+
+func NewDeadDropPacketClient(opts *DeadDropOptions) (*DeadDropPacketClient, error) {
+    id := make([]byte, SESSION_ID_LEN)
+    if _, err := io.ReadFull(rand.Reader, id); err != nil {
+        return nil, err
+    }
+    session := hex.EncodeToString(id)
+
+    // The server notices the new session once the "up" directory exists, so
+    // create "down" first.
+    session_dir := filepath.Join(opts.Dir, session)
+    for _, dir := range []string{"down", "up"} {
+        if err := os.MkdirAll(filepath.Join(session_dir, dir), 0700); err != nil {
+            os.RemoveAll(session_dir)
+            return nil, err
+        }
+    }
+
+    client := newDeadDropClient(opts, session, "up", "down")
+    client.session_dir = session_dir
+    client.keepalive = opts.idleTimeout() / 2
+    client.start()
+
+    return client, nil
+}
+
+func newDeadDropClient(opts *DeadDropOptions, session, send, recv string) *DeadDropPacketClient {
+    return &DeadDropPacketClient{
+        session:  session,
+        send_dir: filepath.Join(opts.Dir, session, send),
+        recv_dir: filepath.Join(opts.Dir, session, recv),
+        poll:     opts.PollInterval,
+        send_ch:  make(chan []byte),
+        recv_ch:  make(chan []byte),
+        closed:   make(chan bool),
+    }
+}
+
+func (c *DeadDropPacketClient) start() {
+    go c.doSend()
+    go c.doRecv()
+}
+
+func (c *DeadDropPacketClient) doSend() {
+    var batch []byte
+    var flush <-chan time.Time
+
+    var keepalive <-chan time.Time
+    if c.keepalive > 0 {
+        ticker := time.NewTicker(c.keepalive)
+        defer ticker.Stop()
+        keepalive = ticker.C
+    }
+    last_write := time.Now()
+
+    for {
+        select {
+        case pkt := <-c.send_ch:
+            if len(pkt) > 0xFFFF {
+                log.Printf("Packet too large for dead drop (%d bytes), dropping\n", len(pkt))
+                continue
+            }
+
+            var length [2]byte
+            binary.BigEndian.PutUint16(length[:], uint16(len(pkt)))
+            batch = append(batch, length[:]...)
+            batch = append(batch, pkt...)
+
+            if len(batch) >= dropMaxBatch {
+                c.writeBatch(batch)
+                batch = nil
+                flush = nil
+                last_write = time.Now()
+            } else if flush == nil {
+                flush = time.After(dropBatchDelay)
+            }
+
+        case <-flush:
+            c.writeBatch(batch)
+            batch = nil
+            flush = nil
+            last_write = time.Now()
+
+        case <-keepalive:
+            // An empty file holds no packets, but shows we're still here.
+            if flush == nil && time.Since(last_write) >= c.keepalive {
+                c.writeBatch(nil)
+                last_write = time.Now()
+            }
+
+        case <-c.closed:
+            drainPackets(c.send_ch)
+            return
+        }
+    }
+}
+
+func (c *DeadDropPacketClient) writeBatch(batch []byte) {
+    c.seq++
+    name := fmt.Sprintf("%020d-%010d", time.Now().UnixNano(), c.seq)
+    tmp := filepath.Join(c.send_dir, "."+name)
+
+    err := ioutil.WriteFile(tmp, batch, 0600)
+    if err == nil {
+        err = os.Rename(tmp, filepath.Join(c.send_dir, name))
+    }
+    if err != nil {
+        log.Printf("Error writing to dead drop: %s\n", err)
+        os.Remove(tmp)
+    }
+}
+
+func (c *DeadDropPacketClient) doRecv() {
+    defer close(c.recv_ch)
+
+    last_active := time.Now()
+    for {
+        names, err := readDropDir(c.recv_dir)
+        if err != nil {
+            // If our session has been removed, there's no point carrying on.
+            log.Printf("Error reading dead drop: %s\n", err)
+            if os.IsNotExist(err) {
+                c.Close()
+                return
+            }
+        }
+
+        if len(names) > 0 {
+            last_active = time.Now()
+        } else if c.idle > 0 && time.Since(last_active) > c.idle {
+            log.Printf("Nothing from dead drop session %s in %s, closing it\n", c.session, c.idle)
+            c.Close()
+            return
+        }
+
+        for _, name := range names {
+            path := filepath.Join(c.recv_dir, name)
+            data, err := ioutil.ReadFile(path)
+            if err != nil {
+                log.Printf("Error reading dead drop file: %s\n", err)
+                continue
+            }
+            os.Remove(path)
+
+            for len(data) >= 2 {
+                length := int(binary.BigEndian.Uint16(data))
+                if len(data) < 2+length {
+                    log.Printf("Truncated packet in dead drop file %s\n", name)
+                    break
+                }
+
+                select {
+                case c.recv_ch <- data[2 : 2+length]:
+                case <-c.closed:
+                    return
+                }
+                data = data[2+length:]
+            }
+        }
+
+        select {
+        case <-time.After(c.poll):
+        case <-c.closed:
+            return
+        }
+    }
+}
+
+// Returns the names of all complete files in a directory, in order.
+func readDropDir(dir string) ([]string, error) {
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var names []string
+    for _, info := range infos {
+        if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+            names = append(names, info.Name())
+        }
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+func (c *DeadDropPacketClient) SendChannel() chan []byte {
+    return c.send_ch
+}
+
+func (c *DeadDropPacketClient) RecvChannel() chan []byte {
+    return c.recv_ch
+}
+
+func (c *DeadDropPacketClient) Close() {
+    c.close_once.Do(func() {
+        close(c.closed)
+
+        if len(c.session_dir) > 0 {
+            os.RemoveAll(c.session_dir)
+        }
+        if c.onClose != nil {
+            c.onClose()
+        }
+    })
+}
+
+func (c *DeadDropPacketClient) IsReliable() bool {
+    return false
+}
+
+func (c *DeadDropPacketClient) Describe() string {
+    return fmt.Sprintf("DeadDropPacketClient(%s)", c.session)
+}
+
+// --------------------------------------------------------------------------------
+
+type DeadDropTransport struct {
+    opts      DeadDropOptions
+    accept_ch chan PacketClient
+
+    clients map[string]*DeadDropPacketClient
+    lock    sync.Mutex
+}
+
+func NewDeadDropTransport(opts *DeadDropOptions) (*DeadDropTransport, error) {
+    if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+        return nil, err
+    }
+
+    trans := &DeadDropTransport{
+        opts:      *opts,
+        accept_ch: make(chan PacketClient),
+        clients:   make(map[string]*DeadDropPacketClient),
+    }
+    go trans.acceptConnections()
+
+    return trans, nil
+}
+
+func (t *DeadDropTransport) acceptConnections() {
+    log.Printf("Started accepting clients in %s\n", t.opts.Dir)
+
+    // TODO: some way to stop this
+    for {
+        infos, err := ioutil.ReadDir(t.opts.Dir)
+        if err != nil {
+            log.Printf("Error reading dead drop directory: %s\n", err)
+        }
+
+        for _, info := range infos {
+            session := info.Name()
+            if !info.IsDir() || strings.HasPrefix(session, ".") {
+                continue
+            }
+
+            t.lock.Lock()
+            _, found := t.clients[session]
+            t.lock.Unlock()
+            if found {
+                continue
+            }
+
+            // Clean up sessions that have been abandoned.
+            session_dir := filepath.Join(t.opts.Dir, session)
+            if time.Since(info.ModTime()) > t.opts.idleTimeout() && t.isStale(session_dir) {
+                log.Printf("Removing stale dead drop session %s\n", session)
+                os.RemoveAll(session_dir)
+                continue
+            }
+
+            // Wait until the client has created both directories.
+            if _, err := os.Stat(filepath.Join(session_dir, "up")); err != nil {
+                continue
+            }
+
+            t.accept(session)
+        }
+
+        <-time.After(t.opts.PollInterval)
+    }
+}
+
+// A session is stale if nothing in it has changed recently.
+func (t *DeadDropTransport) isStale(session_dir string) bool {
+    stale := true
+    filepath.Walk(session_dir, func(path string, info os.FileInfo, err error) error {
+        if err == nil && time.Since(info.ModTime()) < t.opts.idleTimeout() {
+            stale = false
+        }
+        return nil
+    })
+    return stale
+}
+
+func (t *DeadDropTransport) accept(session string) {
+    log.Printf("Got new client: %s\n", session)
+
+    // When we're done with a session, we remove it entirely - this also tells
+    // the client that the session is over.
+    client := newDeadDropClient(&t.opts, session, "down", "up")
+    client.idle = t.opts.idleTimeout()
+    client.onClose = func() {
+        os.RemoveAll(filepath.Join(t.opts.Dir, session))
+
+        t.lock.Lock()
+        delete(t.clients, session)
+        t.lock.Unlock()
+    }
+
+    t.lock.Lock()
+    t.clients[session] = client
+    t.lock.Unlock()
+
+    client.start()
+    t.accept_ch <- client
+}
+
+func (t *DeadDropTransport) AcceptChannel() chan PacketClient {
+    return t.accept_ch
+}
@@ -0,0 +1,173 @@
+package transports
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func testDropOptions(t *testing.T, idle time.Duration) *DeadDropOptions {
+    return &DeadDropOptions{
+        Dir:          t.TempDir(),
+        PollInterval: 10 * time.Millisecond,
+        IdleTimeout:  idle,
+    }
+}
+
+func acceptWithin(t *testing.T, trans interface{ AcceptChannel() chan PacketClient }) PacketClient {
+    select {
+    case client := <-trans.AcceptChannel():
+        return client
+    case <-time.After(5 * time.Second):
+        t.Fatal("server didn't accept the client")
+    }
+    return nil
+}
+
+// Waits for a client's receive channel to be closed.
+func waitClosed(t *testing.T, client PacketClient, d time.Duration) {
+    deadline := time.After(d)
+    for {
+        select {
+        case _, ok := <-client.RecvChannel():
+            if !ok {
+                return
+            }
+        case <-deadline:
+            t.Fatalf("%s wasn't closed", client.Describe())
+        }
+    }
+}
+
+func TestDeadDropExchange(t *testing.T) {
+    opts := testDropOptions(t, time.Minute)
+
+    trans, err := NewDeadDropTransport(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client, err := NewDeadDropPacketClient(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    server_client := acceptWithin(t, trans)
+
+    client.SendChannel() <- []byte("up")
+    if pkt := recvWithin(t, server_client, 5*time.Second); string(pkt) != "up" {
+        t.Errorf("got %q, expected up", pkt)
+    }
+
+    server_client.SendChannel() <- []byte("down")
+    if pkt := recvWithin(t, client, 5*time.Second); string(pkt) != "down" {
+        t.Errorf("got %q, expected down", pkt)
+    }
+
+    // Closing the session on the server removes it, which closes the client
+    // too.
+    server_client.Close()
+    waitClosed(t, client, 5*time.Second)
+    if _, err := os.Stat(filepath.Join(opts.Dir, client.session)); !os.IsNotExist(err) {
+        t.Errorf("session directory wasn't removed: %v", err)
+    }
+}
+
+// A client that goes away without cleaning up is reaped by the server.
+func TestDeadDropIdleReaped(t *testing.T) {
+    idle := 200 * time.Millisecond
+    opts := testDropOptions(t, idle)
+
+    trans, err := NewDeadDropTransport(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    session_dir := filepath.Join(opts.Dir, "0123456789abcdef")
+    for _, dir := range []string{"down", "up"} {
+        if err := os.MkdirAll(filepath.Join(session_dir, dir), 0700); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    server_client := acceptWithin(t, trans)
+    waitClosed(t, server_client, 10*idle)
+
+    if _, err := os.Stat(session_dir); !os.IsNotExist(err) {
+        t.Errorf("idle session wasn't removed: %v", err)
+    }
+
+    trans.lock.Lock()
+    remaining := len(trans.clients)
+    trans.lock.Unlock()
+    if remaining != 0 {
+        t.Errorf("%d clients left after reaping", remaining)
+    }
+}
+
+// A client that's still there, but has nothing to send, keeps its session.
+func TestDeadDropKeepalive(t *testing.T) {
+    idle := 200 * time.Millisecond
+    opts := testDropOptions(t, idle)
+
+    trans, err := NewDeadDropTransport(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client, err := NewDeadDropPacketClient(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    server_client := acceptWithin(t, trans)
+    defer server_client.Close()
+
+    select {
+    case pkt, ok := <-server_client.RecvChannel():
+        if !ok {
+            t.Fatal("idle session was closed despite keepalives")
+        }
+        t.Fatalf("keepalive delivered a packet: %q", pkt)
+    case <-time.After(5 * idle):
+    }
+
+    client.SendChannel() <- []byte("still here")
+    if pkt := recvWithin(t, server_client, 5*time.Second); string(pkt) != "still here" {
+        t.Errorf("got %q, expected still here", pkt)
+    }
+}
+
+// Sessions that were abandoned before the server accepted them are removed.
+func TestDeadDropStaleRemoved(t *testing.T) {
+    opts := testDropOptions(t, time.Minute)
+
+    // No "up" directory, so this is never accepted.
+    session_dir := filepath.Join(opts.Dir, "fedcba9876543210")
+    down := filepath.Join(session_dir, "down")
+    if err := os.MkdirAll(down, 0700); err != nil {
+        t.Fatal(err)
+    }
+    old := time.Now().Add(-2 * time.Minute)
+    for _, path := range []string{down, session_dir} {
+        if err := os.Chtimes(path, old, old); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if _, err := NewDeadDropTransport(opts); err != nil {
+        t.Fatal(err)
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if _, err := os.Stat(session_dir); os.IsNotExist(err) {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatal("stale session wasn't removed")
+}
@@ -0,0 +1,288 @@
+package transports
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "sync"
+
+    "github.com/pion/dtls/v2"
+)
+
+// This transport sends packets over DTLS, on top of UDP.  Plain UDP packets
+// full of random-looking bytes stand out; DTLS is used by many VPNs and by
+// WebRTC, so it blends in.
+//
+// There are two ways of authenticating the DTLS session:
+//      - With a pre-shared key, derived from the shared secret with the
+//        server's KDF parameters.  This is the default.
+//      - With a certificate on the server, which the client pins by its
+//        SHA-256 fingerprint.
+//
+// Note that the usual encryption layer still runs on top of DTLS - DTLS is
+// here for disguise, not security.
+
+const DTLS_PORT = 44463
+
+var dtlsClientMap = make(map[string]*genericPacketClient)
+var dtlsClientMapLock sync.RWMutex
+
+type DTLSOptions struct {
+    // Shared secret, and the server's KDF parameters, used to derive the
+    // pre-shared key.
+    Secret string
+    KDF    *KDFParams
+
+    // Server: the certificate to use.  If this is nil, we use a pre-shared
+    // key instead.
+    Certificate *tls.Certificate
+
+    // Client: the SHA-256 fingerprint of the server's certificate (32 bytes).
+    // If this is nil, we use a pre-shared key instead.
+    PinnedCert []byte
+
+    // Server: if set, packets from addresses this rejects are dropped.
+    Filter func(addr net.Addr) bool
+}
+
+type DTLSPacketClient struct {
+    conn    net.Conn
+    send_ch chan []byte
+    recv_ch chan []byte
+}
+
+// Returns the SHA-256 fingerprint of a certificate, for pinning.
+func CertFingerprint(cert *tls.Certificate) string {
+    sum := sha256.Sum256(cert.Certificate[0])
+    return hex.EncodeToString(sum[:])
+}
+
+// Loads the server's certificate from the given files, and logs its
+// fingerprint so that it can be given to clients.  Note that the certificate
+// must use an ECDSA key.
+func LoadDTLSCertificate(cert_file, key_file string) (*tls.Certificate, error) {
+    cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+    if err != nil {
+        return nil, err
+    }
+
+    log.Printf("DTLS certificate fingerprint: %s\n", CertFingerprint(&cert))
+    return &cert, nil
+}
+
+// Also returns the pre-shared key, if there is one, so the server can replace
+// it.
+func dtlsConfig(opts *DTLSOptions, is_client bool) (*dtls.Config, *outerKey, error) {
+    config := &dtls.Config{
+        ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+    }
+    var psk *outerKey
+
+    switch {
+    case opts.Certificate != nil:
+        config.Certificates = []tls.Certificate{*opts.Certificate}
+        config.CipherSuites = []dtls.CipherSuiteID{dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+
+    case opts.PinnedCert != nil:
+        // We don't care about the certificate chain, just that it's the
+        // certificate we're expecting.
+        pinned := opts.PinnedCert
+        config.CipherSuites = []dtls.CipherSuiteID{dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+        config.InsecureSkipVerify = true
+        config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+            if len(raw) == 0 {
+                return fmt.Errorf("server sent no certificate")
+            }
+
+            sum := sha256.Sum256(raw[0])
+            if !bytes.Equal(sum[:], pinned) {
+                return fmt.Errorf("server certificate does not match pinned fingerprint")
+            }
+            return nil
+        }
+
+    default:
+        var err error
+        psk, err = newOuterKey(opts.Secret, opts.KDF, "dtls")
+        if err != nil {
+            return nil, nil, err
+        }
+        config.PSK = func(hint []byte) ([]byte, error) {
+            return psk.get(), nil
+        }
+
+        // The server doesn't send a hint (so it leaves out the
+        // ServerKeyExchange, as most PSK servers do), and the client's
+        // identity is empty, so there's nothing in the clear to match on.
+        if is_client {
+            config.PSKIdentityHint = []byte{}
+        }
+        config.CipherSuites = []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256}
+    }
+
+    return config, psk, nil
+}
+
+func NewDTLSPacketClient(server string, opts *DTLSOptions) (*DTLSPacketClient, error) {
+    return dialDTLSPacketClient(net.JoinHostPort(server, strconv.Itoa(DTLS_PORT)), opts)
+}
+
+func dialDTLSPacketClient(host string, opts *DTLSOptions) (*DTLSPacketClient, error) {
+    if opts.PinnedCert != nil && len(opts.PinnedCert) != sha256.Size {
+        return nil, fmt.Errorf("pinned certificate fingerprint must be %d bytes", sha256.Size)
+    }
+
+    config, _, err := dtlsConfig(opts, true)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, err := net.Dial("udp", host)
+    if err != nil {
+        return nil, err
+    }
+
+    dconn, err := dtls.Client(conn, config)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    return newDTLSClientFromConn(dconn), nil
+}
+
+func newDTLSClientFromConn(conn net.Conn) *DTLSPacketClient {
+    ret := &DTLSPacketClient{conn, make(chan []byte), make(chan []byte)}
+
+    go ret.doSend()
+    go ret.doRecv()
+
+    return ret
+}
+
+func (c *DTLSPacketClient) doSend() {
+    // TODO: select on "stop" channel
+    for {
+        pkt := <-c.send_ch
+
+        _, err := c.conn.Write(pkt)
+        if err != nil {
+            log.Printf("Error writing DTLS packet: %s\n", err)
+            break
+        }
+    }
+
+    c.conn.Close()
+    drainPackets(c.send_ch)
+}
+
+func (c *DTLSPacketClient) doRecv() {
+    var pkt [65535]byte
+
+    for {
+        // Each read returns the contents of a single record, which is a
+        // single packet.
+        n, err := c.conn.Read(pkt[:])
+        if err != nil {
+            log.Printf("Error reading DTLS packet: %s\n", err)
+            break
+        }
+
+        c.recv_ch <- append([]byte{}, pkt[:n]...)
+    }
+
+    close(c.recv_ch)
+}
+
+func (c *DTLSPacketClient) SendChannel() chan []byte {
+    return c.send_ch
+}
+
+func (c *DTLSPacketClient) RecvChannel() chan []byte {
+    return c.recv_ch
+}
+
+func (c *DTLSPacketClient) Close() {
+    c.conn.Close()
+}
+
+func (c *DTLSPacketClient) IsReliable() bool {
+    return false
+}
+
+func (c *DTLSPacketClient) Describe() string {
+    return fmt.Sprintf("DTLSPacketClient(%s)", c.conn.RemoteAddr())
+}
+
+// --------------------------------------------------------------------------------
+
+type DTLSTransport struct {
+    underlying *genericPacketTransport
+    accept_ch  chan PacketClient
+    config     *dtls.Config
+    psk        *outerKey
+}
+
+func NewDTLSTransport(bindTo string, opts *DTLSOptions) (*DTLSTransport, error) {
+    return newDTLSTransportOn(bindTo, DTLS_PORT, opts)
+}
+
+func newDTLSTransportOn(bindTo string, port uint16, opts *DTLSOptions) (*DTLSTransport, error) {
+    config, psk, err := dtlsConfig(opts, false)
+    if err != nil {
+        return nil, err
+    }
+
+    // Clients are told apart by their address, since DTLS doesn't have
+    // anywhere for us to put a session ID.
+    underlying, err := newGenericPacketTransport("udp", bindTo, port, false,
+        opts.Filter, dtlsClientMap, &dtlsClientMapLock)
+    if err != nil {
+        return nil, err
+    }
+
+    trans := &DTLSTransport{underlying, make(chan PacketClient), config, psk}
+    go trans.acceptConnections()
+
+    return trans, nil
+}
+
+// Derives the pre-shared key from a new secret.  With a certificate, there's
+// nothing to do.
+func (t *DTLSTransport) SetSecret(secret string) error {
+    if t.psk == nil {
+        return nil
+    }
+    return t.psk.set(secret)
+}
+
+func (t *DTLSTransport) acceptConnections() {
+    // TODO: some way to stop this
+    for {
+        client := <-t.underlying.AcceptChannel()
+        go t.handshake(client.(*genericPacketClient))
+    }
+}
+
+func (t *DTLSTransport) handshake(client *genericPacketClient) {
+    conn := newPacketClientConn(client, t.underlying.conn.LocalAddr(), client.currentAddr())
+
+    dconn, err := dtls.Server(conn, t.config)
+    if err != nil {
+        log.Printf("DTLS handshake with %s failed: %s\n", client.currentAddr(), err)
+        client.Close()
+        return
+    }
+
+    t.accept_ch <- newDTLSClientFromConn(dconn)
+}
+
+func (t *DTLSTransport) AcceptChannel() chan PacketClient {
+    return t.accept_ch
+}
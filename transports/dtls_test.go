@@ -0,0 +1,112 @@
+package transports
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "testing"
+    "time"
+)
+
+func testDTLSCertificate(t *testing.T) *tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "test"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Starts a DTLS server on a free port, and connects a client to it.
+func dtlsPair(t *testing.T, server_opts, client_opts *DTLSOptions) (PacketClient, PacketClient, error) {
+    trans, err := newDTLSTransportOn("127.0.0.1", 0, server_opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client, err := dialDTLSPacketClient(trans.underlying.conn.LocalAddr().String(), client_opts)
+    if err != nil {
+        return nil, nil, err
+    }
+    t.Cleanup(client.Close)
+    return client, acceptWithin(t, trans), nil
+}
+
+func checkDTLSExchange(t *testing.T, client, server PacketClient) {
+    client.SendChannel() <- []byte("up")
+    if pkt := recvWithin(t, server, 5*time.Second); string(pkt) != "up" {
+        t.Errorf("got %q, expected up", pkt)
+    }
+    server.SendChannel() <- []byte("down")
+    if pkt := recvWithin(t, client, 5*time.Second); string(pkt) != "down" {
+        t.Errorf("got %q, expected down", pkt)
+    }
+}
+
+func TestDTLSPSK(t *testing.T) {
+    params := &KDFParams{KDFPBKDF2, minPBKDF2Iterations, 0, 0, []byte("salt")}
+    opts := &DTLSOptions{Secret: "secret", KDF: params}
+
+    client, server, err := dtlsPair(t, opts, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkDTLSExchange(t, client, server)
+}
+
+// Nothing identifies us in the clear: the server sends no hint, and the
+// client's identity is empty.
+func TestDTLSPSKIdentity(t *testing.T) {
+    opts := &DTLSOptions{Secret: "secret", KDF: &KDFParams{KDFPBKDF2, minPBKDF2Iterations, 0, 0, nil}}
+
+    server, _, err := dtlsConfig(opts, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if server.PSKIdentityHint != nil {
+        t.Errorf("server sends the hint %q", server.PSKIdentityHint)
+    }
+
+    client, _, err := dtlsConfig(opts, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if client.PSKIdentityHint == nil || len(client.PSKIdentityHint) != 0 {
+        t.Errorf("client sends the identity %q", client.PSKIdentityHint)
+    }
+}
+
+func TestDTLSPinnedCertificate(t *testing.T) {
+    cert := testDTLSCertificate(t)
+    sum := sha256.Sum256(cert.Certificate[0])
+
+    client, server, err := dtlsPair(t, &DTLSOptions{Certificate: cert}, &DTLSOptions{PinnedCert: sum[:]})
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkDTLSExchange(t, client, server)
+
+    // Someone else's certificate is refused.
+    other := testDTLSCertificate(t)
+    if _, _, err := dtlsPair(t, &DTLSOptions{Certificate: other}, &DTLSOptions{PinnedCert: sum[:]}); err == nil {
+        t.Error("client accepted a certificate that doesn't match its pin")
+    }
+
+    if _, err := dialDTLSPacketClient("127.0.0.1:1", &DTLSOptions{PinnedCert: sum[:16]}); err == nil {
+        t.Error("client accepted a short pin")
+    }
+}
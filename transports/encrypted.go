@@ -1,156 +1,295 @@
 package transports
 
 import (
+    "bytes"
     "crypto/aes"
     "crypto/cipher"
     "crypto/hmac"
-    "crypto/rand"
     "crypto/sha256"
     "crypto/subtle"
+    "encoding/binary"
     "fmt"
-    "hash"
-    "io"
     "log"
+    "sync"
     "time"
 
     "code.google.com/p/go.crypto/nacl/secretbox"
-    "code.google.com/p/go.crypto/pbkdf2"
 )
 
 // This package implements a simple encrypted transport on top of an existing
 // transport.  In general, there's two modes of operation:
-//      - For reliable transports (e.g. TCP), it runs AES in CTR mode over all
-//        the data that's being sent and received, maintaining one cipher
-//        context for each direction of transport.  The message is
-//        authenticated using HMAC.
+//      - For reliable transports (e.g. TCP), each packet is encrypted and
+//        authenticated with AES-256-GCM.  The nonce is a counter, which
+//        starts at zero and goes up by one for each packet, so it doesn't
+//        need to be sent: each side just counts.  Since every packet must
+//        arrive, in order, a packet that's been dropped, reordered, replayed
+//        or truncated fails to decrypt - and since we can't recover from
+//        that, we close the connection.  The overhead is the 16-byte GCM
+//        tag on each packet.
 //
 //      - For unreliable transports, we can't assume anything about the context
-//        of an individual packet, so we use go.crypto's secretbox package and
-//        random nonces (that are included with the packet itself).  Note that
-//        this package both encrypts and authenticates, we do not HMAC.
+//        of an individual packet, so we use go.crypto's secretbox package.
+//        Each packet is prefixed with its counter, which is used as the
+//        nonce, so it's authenticated too.  Packets can arrive late or out
+//        of order, so rather than insisting on the next counter, we keep a
+//        sliding window of the counters we've seen, and reject replays (see
+//        replay.go).  Note that this package both encrypts and
+//        authenticates, we do not HMAC.  The overhead is 24 bytes: the
+//        8-byte counter and a 16-byte tag.
 //
-// Encryption keys are generated from a shared secret that must be provided.
-// Note that this doesn't (necessarily) need to be the same as the
-// authentication secret, just that it must be equal on both side of the
-// connection.
+// Each session's keys come from a Noise handshake (see noise.go), which is
+// authenticated with a shared secret that must be provided.  Note that this
+// doesn't (necessarily) need to be the same as the authentication secret,
+// just that it must be equal on both side of the connection.
 //
 // Since the underlying machinery is mostly the same, we implement the basic
 // functionality as a structure, and provide the modes of operation as functions
 // that are somewhat black boxes.
+//
+// Keys are replaced every so often (see rekey.go), so every packet starts
+// with a byte saying which key it was encrypted with.  Inside the
+// encryption, each packet is:
+//
+//      [session ID (if any)] [type (1 byte)] [payload]
+//
+// where the type is msgData for packets we pass on, or one of the rekeying
+// messages.  Together, these add two bytes to the overhead above.
+
+// More than the encryption layer ever adds to a packet, for the layers above
+// that need to leave room for it.
+const maxEncryptionOverhead = 64
 
 type encryptionMode interface {
     Encrypt(data []byte) []byte
     Decrypt(data []byte) ([]byte, bool)
+
+    // Like Decrypt, but doesn't change any state.  This can be called from
+    // another goroutine.
+    Verify(data []byte) ([]byte, bool)
 }
 
-type aesMode struct {
-    stream cipher.Stream
-    mac    hash.Hash
+type aeadMode struct {
+    aead    cipher.AEAD
+    counter uint64
 }
 
 type secretboxMode struct {
-    key [32]byte
+    key     [32]byte
+    counter uint64
+    window  replayWindow
+}
+
+type EncryptionOptions struct {
+    // The shared secret.
+    Secret string
+
+    // Client only: who we are, if the server has a secret for each user.
+    Identity string
+
+    // Server only: returns the secret for the identity the client gives.  If
+    // this isn't set, everyone uses Secret.
+    Lookup func(identity string) (string, error)
+
+    // True on the client side of the connection, which starts the handshake.
+    IsClient bool
+
+    // Client only: the server's static public key, if we want to check it.
+    ServerKey []byte
+
+    // Server only: our static key, if we have one.
+    StaticKey *StaticKey
+
+    // Client only: our own key, if we use one instead of a secret.
+    ClientKey *StaticKey
+
+    // Server only: checks whether a client's key is allowed.  If this isn't
+    // set, clients can't use keys.
+    LookupKey func(public []byte) error
+
+    // Client only: a ticket from the server, and its secret, to resume a
+    // session with.
+    Ticket       []byte
+    TicketSecret []byte
+
+    // How the pre-shared key is derived from the secret (see kdf.go).  On
+    // the server, these are the parameters clients must use; if they aren't
+    // set, the old ones are used.  On the client, these are the parameters
+    // we last had a handshake with (or were given), if any.  They're updated
+    // if the server gives us different ones and the handshake works, but
+    // never to cheaper ones.
+    KDF *KDFParams
+
+    // Server only: lets clients resume sessions.  If this isn't set, they
+    // can't.
+    Tickets *TicketIssuer
+
+    // Client only: how often to replace the session keys, and after how many
+    // bytes.  Zero means use the default.
+    RekeyInterval time.Duration
+    RekeyBytes    uint64
 }
 
 type EncryptedPacketClient struct {
     underlying PacketClient
-    send_mode  encryptionMode
-    recv_mode  encryptionMode
     send_ch    chan []byte
     recv_ch    chan []byte
-    key        []byte
-}
+    opts       EncryptionOptions
 
-const TEST_STRING = "this is a test string"
+    // The current keys, each with its epoch (which goes up by one each time
+    // we rekey).  The previous receive key is kept after rekeying, for
+    // packets that were already on their way: until the other end starts
+    // using the new key (while prev_open is set), and then until prev_until.
+    // The lock protects these, and the rekeying state below.
+    send_mode  encryptionMode
+    send_epoch byte
+    recv_mode  encryptionMode
+    recv_epoch byte
+    prev_recv  encryptionMode
+    prev_epoch byte
+    prev_open  bool
+    prev_until time.Time
+    lock       sync.Mutex
+
+    rekey rekeyState
+
+    // Control messages for doSend to send, and how to pad them (see
+    // SetControlPadding).  The lock protects ctrl_pad.
+    ctrl_ch  chan ctrlMessage
+    ctrl_pad func(size int) int
+
+    // If the underlying transport uses session IDs, we include the session ID
+    // in every packet we encrypt, and check it in every packet we decrypt.
+    // This stops someone from taking a packet from one session and using it
+    // to move another session to a different address.
+    session []byte
+
+    // Who the other end says they are - on the server, this is only set once
+    // the handshake proves it.  For clients with keys, this is the key (in
+    // hex), and peer_key is the key itself.
+    identity string
+    peer_key []byte
+
+    // Derived from the session's first keys, so only the two ends know it.
+    // (The handshake hash itself isn't secret: without a pre-shared key,
+    // anyone who sees the handshake can work it out.)
+    binding []byte
+
+    // The handshake messages, until the other end has shown that it has
+    // finished the handshake (by sending us a good packet), and packets that
+    // arrived before the handshake was done.
+    hs_first []byte
+    hs_reply []byte
+    early    [][]byte
+
+    resumed *SessionState
+}
 
 // --------------------------------------------------------------------------------
 
-func (m *aesMode) Encrypt(input []byte) []byte {
-    output := make([]byte, len(input))
-    m.stream.XORKeyStream(output, input)
-
-    // Start from reset each time.
-    m.mac.Reset()
-    m.mac.Write(output)
+// The nonce is the counter, as a big-endian number, padded out with zeros.
+func (m *aeadMode) nonce() []byte {
+    nonce := make([]byte, m.aead.NonceSize())
+    binary.BigEndian.PutUint64(nonce[len(nonce)-8:], m.counter)
+    return nonce
+}
 
-    output = m.mac.Sum(output)
+func (m *aeadMode) Encrypt(input []byte) []byte {
+    output := m.aead.Seal(nil, m.nonce(), input, nil)
+    m.counter++
     return output
 }
 
-func (m *aesMode) Decrypt(encrypted []byte) ([]byte, bool) {
-    if len(encrypted) < 32 {
-        log.Printf("AES: Not good: len (%d) < 32\n", len(encrypted))
+func (m *aeadMode) Decrypt(encrypted []byte) ([]byte, bool) {
+    if len(encrypted) < m.aead.Overhead() {
+        log.Printf("AEAD: Not good: len (%d) < %d\n", len(encrypted), m.aead.Overhead())
         return nil, false
     }
-    output := make([]byte, len(encrypted)-32)
-
-    // Short forms!
-    data := encrypted[0 : len(encrypted)-32]
-    mac := encrypted[len(encrypted)-32:]
-
-    // Validate HMAC.
-    m.mac.Reset()
-    m.mac.Write(data)
-    expected := m.mac.Sum(nil)
 
-    if subtle.ConstantTimeCompare(expected, mac) != 1 {
-        log.Printf("AES: Not good: MAC is bad\n")
+    output, err := m.aead.Open(nil, m.nonce(), encrypted, nil)
+    if err != nil {
+        log.Printf("AEAD: Not good: packet %d failed authentication\n", m.counter)
         return nil, false
     }
 
-    m.stream.XORKeyStream(output, data)
+    // Only count packets that were genuine - anything else is fatal anyway.
+    m.counter++
     return output, true
 }
 
-func NewAesMode(key []byte) (*aesMode, error) {
-    // IV is defined as all 0s - it doesn't need to be secret.
-    iv := make([]byte, aes.BlockSize)
+// Reliable transports never roam, so there's nothing to verify.
+func (m *aeadMode) Verify(encrypted []byte) ([]byte, bool) {
+    return nil, false
+}
+
+// Each direction needs its own key, since the counters both start at zero.
+func NewAeadMode(key []byte) (*aeadMode, error) {
     block, err := aes.NewCipher(key)
     if err != nil {
         return nil, err
     }
-    stream := cipher.NewCTR(block, iv)
-    hm := hmac.New(sha256.New, key)
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
 
-    return &aesMode{stream, hm}, nil
+    return &aeadMode{aead: aead}, nil
 }
 
 // --------------------------------------------------------------------------------
 
-func (m *secretboxMode) Encrypt(input []byte) []byte {
-    var out []byte
+// The nonce is the counter, as a big-endian number, padded out with zeros.
+func secretboxNonce(counter uint64) *[24]byte {
     var nonce [24]byte
+    binary.BigEndian.PutUint64(nonce[:], counter)
+    return &nonce
+}
+
+func (m *secretboxMode) Encrypt(input []byte) []byte {
+    // Counters start at 1 - see replay.go.
+    m.counter++
 
-    n, err := io.ReadFull(rand.Reader, nonce[:])
-    if n != len(nonce) || err != nil {
-        panic("could not read from random number generator")
+    out := make([]byte, 8, 8+len(input)+secretbox.Overhead)
+    binary.BigEndian.PutUint64(out, m.counter)
+    return secretbox.Seal(out, input, secretboxNonce(m.counter), &m.key)
+}
+
+// Opens a packet, returning its contents and counter.
+func (m *secretboxMode) open(encrypted []byte) ([]byte, uint64, bool) {
+    if len(encrypted) < 8+secretbox.Overhead {
+        log.Printf("secretbox: Not good: len (%d) < %d\n", len(encrypted), 8+secretbox.Overhead)
+        return nil, 0, false
+    }
+
+    counter := binary.BigEndian.Uint64(encrypted)
+    opened, ok := secretbox.Open(nil, encrypted[8:], secretboxNonce(counter), &m.key)
+    if !ok {
+        log.Printf("secretbox: Not good: Open() returned false\n")
     }
 
-    out = secretbox.Seal(out[:0], input, &nonce, &m.key)
-    out = append(out, nonce[:]...)
-    return out
+    return opened, counter, ok
 }
 
 func (m *secretboxMode) Decrypt(encrypted []byte) ([]byte, bool) {
-    var opened []byte
-    var nonce [24]byte
-
-    if len(encrypted) < 24 {
-        log.Printf("secretbox: Not good: len (%d) < 24\n", len(encrypted))
+    opened, counter, ok := m.open(encrypted)
+    if !ok {
         return nil, false
     }
 
-    for i := 0; i < 24; i++ {
-        nonce[i] = encrypted[len(encrypted)-24+i]
+    // Only genuine packets get as far as the replay window, so an attacker
+    // can't use fake counters to move it.
+    if !m.window.accept(counter) {
+        log.Printf("secretbox: Not good: packet %d is a replay\n", counter)
+        return nil, false
     }
+    return opened, true
+}
 
-    data := encrypted[:len(encrypted)-24]
-    opened, ok := secretbox.Open(opened[:0], data, &nonce, &m.key)
-    if !ok {
-        log.Printf("secretbox: Not good: Open() returned false\n")
+func (m *secretboxMode) Verify(encrypted []byte) ([]byte, bool) {
+    opened, counter, ok := m.open(encrypted)
+    if !ok || !m.window.check(counter) {
+        return nil, false
     }
-
-    return opened, ok
+    return opened, true
 }
 
 func NewSecretBoxMode(key []byte) (*secretboxMode, error) {
@@ -163,121 +302,366 @@ func NewSecretBoxMode(key []byte) (*secretboxMode, error) {
     for i := 0; i < 32; i++ {
         key_arr[i] = key[i]
     }
-    return &secretboxMode{key_arr}, nil
+    return &secretboxMode{key: key_arr}, nil
 }
 
 // --------------------------------------------------------------------------------
 
-func NewEncryptedPacketClient(underlying PacketClient, secret string) (*EncryptedPacketClient, error) {
-    var err error
+func NewEncryptedPacketClient(underlying PacketClient, opts *EncryptionOptions) (*EncryptedPacketClient, error) {
+    var session []byte
+    roaming, can_roam := underlying.(RoamingPacketClient)
+    if can_roam && len(roaming.SessionID()) > 0 {
+        session = roaming.SessionID()
+    }
 
-    // PBKDF2 the key to the appropriate size of 32 bytes (both for secretbox
-    // and for AES).
-    key := pbkdf2.Key([]byte(secret), []byte{}, 16384, 32, sha256.New)
+    // If the server can't use our ticket, or wants us to use a different
+    // KDF, we try again.
+    attempt := *opts
+    keys, err := noiseHandshake(underlying, &attempt, session)
+    if err == errTicketRejected {
+        log.Printf("Session ticket rejected, doing a full handshake\n")
+        attempt.Ticket = nil
+        attempt.TicketSecret = nil
+        keys, err = noiseHandshake(underlying, &attempt, session)
+    }
+    if mismatch, ok := err.(*kdfMismatch); ok {
+        if err = checkNewKDF(opts.KDF, mismatch.params); err == nil {
+            log.Printf("Server uses different KDF parameters, trying again\n")
+            attempt.KDF = mismatch.params
+            keys, err = noiseHandshake(underlying, &attempt, session)
+        }
+    }
+    if err != nil {
+        log.Printf("Handshake failed: %s\n", err)
+        return nil, err
+    }
 
-    // Depending on whether the underlying transport is reliable or not, we
-    // create a different mode.  We also do this twice, since we need one for
-    // each direction.
-    var send_mode encryptionMode
-    var recv_mode encryptionMode
+    // Only parameters that worked are worth remembering.
+    opts.KDF = attempt.KDF
 
-    if underlying.IsReliable() {
-        send_mode, err = NewAesMode(key)
-        if err != nil {
-            return nil, err
-        }
+    ret, err := newEncryptedClient(underlying, opts, keys, session)
+    if err != nil {
+        return nil, err
+    }
 
-        recv_mode, err = NewAesMode(key)
-        if err != nil {
-            return nil, err
-        }
+    // The handshake authenticates both sides: it only succeeds if the other
+    // end knows the secret (and, if we pinned it, has the server's key).
+    // Bad packets after this will error on decryption, which means they
+    // don't get forwarded, and replayed packets are rejected.
+    if len(keys.identity) > 0 {
+        log.Printf("Authentication success (user %s)\n", keys.identity)
     } else {
-        send_mode, err = NewSecretBoxMode(key)
-        if err != nil {
-            return nil, err
-        }
+        log.Printf("Authentication success\n")
+    }
+    return ret, nil
+}
 
-        recv_mode, err = NewSecretBoxMode(key)
-        if err != nil {
-            return nil, err
-        }
+// Starts a client with the keys from a handshake.
+func newEncryptedClient(underlying PacketClient, opts *EncryptionOptions, keys *sessionKeys, session []byte) (*EncryptedPacketClient, error) {
+    send_mode, recv_mode, err := makeModes(underlying.IsReliable(), keys)
+    if err != nil {
+        return nil, err
     }
 
     ret := &EncryptedPacketClient{
-        underlying, send_mode, recv_mode,
-        make(chan []byte), make(chan []byte),
-        key,
+        underlying: underlying,
+        send_ch:    make(chan []byte),
+        recv_ch:    make(chan []byte),
+        opts:       *opts,
+        send_mode:  send_mode,
+        recv_mode:  recv_mode,
+        ctrl_ch:    make(chan ctrlMessage),
+        session:    session,
+        identity:   keys.identity,
+        peer_key:   keys.peer_key,
+        binding:    channelBinding(keys, opts.IsClient),
+        hs_first:   keys.first,
+        hs_reply:   keys.reply,
+        early:      keys.early,
+        resumed:    keys.resumed,
+    }
+    ret.rekey.reset(keys.base)
+
+    // If the underlying transport can roam, we vouch for packets that arrive
+    // from a new address.
+    if session != nil {
+        underlying.(RoamingPacketClient).SetRoamVerifier(ret.verifyPacket)
     }
 
     go ret.doSend()
     go ret.doRecv()
+    return ret, nil
+}
+
+// The user the other end authenticated as, if any.
+func (c *EncryptedPacketClient) Identity() string {
+    return c.identity
+}
+
+// A value that's unique to this session, and only known to the two ends of
+// it, for binding other authentication to the session.
+func (c *EncryptedPacketClient) ChannelBinding() []byte {
+    return c.binding
+}
+
+// If the session was resumed from a ticket, returns what the server knew
+// about it (on the client, this is empty).  Otherwise, returns nil.
+func (c *EncryptedPacketClient) Resumed() *SessionState {
+    return c.resumed
+}
+
+// The key the other end authenticated with, if any.
+func (c *EncryptedPacketClient) PeerKey() []byte {
+    return c.peer_key
+}
+
+// Mixes the handshake hash with both of the session's keys, client to server
+// first, so that both ends get the same value.
+func channelBinding(keys *sessionKeys, is_client bool) []byte {
+    up, down := keys.send, keys.recv
+    if !is_client {
+        up, down = keys.recv, keys.send
+    }
+
+    hm := hmac.New(sha256.New, append(up[:], down[:]...))
+    hm.Write([]byte("holepunch channel binding"))
+    hm.Write(keys.base)
+    return hm.Sum(nil)
+}
 
-    // This will time out the entire authentication operation
-    timeout := time.After(10 * time.Second)
-
-    // TODO: Send some sort of authentication.  We can't simply assume that
-    // sending a nonce will work, as it might fail on an unreliable transport.
-    // For now, we just do nothing: any bad packets will error on decryption,
-    // which means they don't get forwarded.  This doesn't stop spoofed
-    // packets or replay attacks though, so we need to consider this in future.
-
-    // Force authentication by sending a known-constant string, and retrieving
-    // it from the other end.  Note that this isn't really "authentication",
-    // but rather just causes the other side of the connection to attempt to
-    // decrypt this packet, which might then fail.
-    var test_bytes = []byte(TEST_STRING)
-    ret.SendChannel() <- test_bytes
-
-    select {
-    case msg := <-ret.RecvChannel():
-        // Verify it matches.
-        if len(msg) != len(test_bytes) || subtle.ConstantTimeCompare(msg, test_bytes) != 1 {
-            log.Printf("Received invalid message\n")
-            return nil, fmt.Errorf("invalid message from remote end")
+// Depending on whether the underlying transport is reliable or not, we create
+// a different mode, with a different key for each direction.
+func makeModes(reliable bool, keys *sessionKeys) (encryptionMode, encryptionMode, error) {
+    if reliable {
+        send_mode, err := NewAeadMode(keys.send[:])
+        if err != nil {
+            return nil, nil, err
         }
 
-        // Fall through to success
-    case <-timeout:
-        // Nope, errored!
-        log.Printf("Authentication timed out\n")
-        ret.Close()
-        return nil, fmt.Errorf("authentication timed out")
+        recv_mode, err := NewAeadMode(keys.recv[:])
+        if err != nil {
+            return nil, nil, err
+        }
+        return send_mode, recv_mode, nil
     }
 
-    log.Printf("Authentication success\n")
-    return ret, nil
+    send_mode, err := NewSecretBoxMode(keys.send[:])
+    if err != nil {
+        return nil, nil, err
+    }
+
+    recv_mode, err := NewSecretBoxMode(keys.recv[:])
+    if err != nil {
+        return nil, nil, err
+    }
+    return send_mode, recv_mode, nil
 }
 
 func (c *EncryptedPacketClient) doSend() {
-    mode := c.send_mode
     ch := c.send_ch
     underlying := c.underlying.SendChannel()
 
+    // Only the client decides when to rekey.
+    var check_ch <-chan time.Time
+    if c.opts.IsClient {
+        ticker := time.NewTicker(rekeyCheckInterval)
+        defer ticker.Stop()
+        check_ch = ticker.C
+    }
+
     // TODO: have some way of stopping this
     for {
-        unenc := <-ch
-        enc := mode.Encrypt(unenc)
-        underlying <- enc
+        select {
+        case unenc := <-ch:
+            underlying <- c.encrypt(msgData, unenc, false)
+
+        case msg := <-c.ctrl_ch:
+            if msg.raw {
+                underlying <- msg.payload
+                continue
+            }
+            underlying <- c.encrypt(msg.kind, c.padControl(msg.payload), msg.use_prev)
+
+        case <-check_ch:
+            if init := c.checkRekey(); init != nil {
+                underlying <- c.encrypt(msgRekeyInit, c.padControl(init), false)
+            }
+        }
     }
 }
 
+// Encrypts a message with the current send key (or the previous one, when
+// we're repeating a rekey ack).
+func (c *EncryptedPacketClient) encrypt(kind byte, payload []byte, use_prev bool) []byte {
+    unenc := make([]byte, 0, len(c.session)+1+len(payload))
+    unenc = append(unenc, c.session...)
+    unenc = append(unenc, kind)
+    unenc = append(unenc, payload...)
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    mode, epoch := c.send_mode, c.send_epoch
+    if use_prev && c.rekey.prev_send != nil {
+        mode, epoch = c.rekey.prev_send, c.send_epoch-1
+    }
+    c.rekey.bytes += uint64(len(payload))
+
+    return append([]byte{epoch}, mode.Encrypt(unenc)...)
+}
+
+// Returns the receive key for the given epoch, if we still have it.
+func (c *EncryptedPacketClient) recvModeFor(epoch byte) encryptionMode {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if epoch == c.recv_epoch {
+        return c.recv_mode
+    }
+    if c.prev_recv != nil && epoch == c.prev_epoch && (c.prev_open || time.Now().Before(c.prev_until)) {
+        return c.prev_recv
+    }
+    return nil
+}
+
+// Decrypts a packet, and strips the session ID.  Returns the plaintext, and
+// the epoch of the key that decrypted it.
+func (c *EncryptedPacketClient) decrypt(enc []byte, verify_only bool) ([]byte, byte, bool) {
+    if len(enc) < 1 {
+        return nil, 0, false
+    }
+
+    mode := c.recvModeFor(enc[0])
+    if mode == nil {
+        log.Printf("Packet uses unknown key %d\n", enc[0])
+        return nil, 0, false
+    }
+
+    var unenc []byte
+    var good bool
+    if verify_only {
+        unenc, good = mode.Verify(enc[1:])
+    } else {
+        unenc, good = mode.Decrypt(enc[1:])
+    }
+    if !good {
+        return nil, 0, false
+    }
+
+    unenc, good = c.checkSession(unenc)
+    if !good {
+        log.Printf("Packet has the wrong session ID, skipping...\n")
+        return nil, 0, false
+    }
+    if len(unenc) < 1 {
+        return nil, 0, false
+    }
+    return unenc, enc[0], true
+}
+
+// Deals with a repeated handshake message.  Returns false if it isn't one.
+func (c *EncryptedPacketClient) repeatHandshake(enc []byte) bool {
+    if c.opts.IsClient {
+        // The server sent its reply more than once.
+        return bytes.Equal(enc, c.hs_reply)
+    }
+
+    // The client didn't get our reply.
+    if !bytes.Equal(enc, c.hs_first) {
+        return false
+    }
+    log.Printf("Client repeated its handshake, sending reply again\n")
+    c.ctrl_ch <- ctrlMessage{payload: c.hs_reply, raw: true}
+    return true
+}
+
 func (c *EncryptedPacketClient) doRecv() {
-    stream := c.recv_mode
     ch := c.recv_ch
     underlying := c.underlying.RecvChannel()
 
     // TODO: have some way of stopping this
     for {
-        enc := <-underlying
-        unenc, good := stream.Decrypt(enc)
-        if !good {
+        var enc []byte
+        if len(c.early) > 0 {
+            enc, c.early = c.early[0], c.early[1:]
+        } else {
+            var ok bool
+            enc, ok = <-underlying
+            if !ok {
+                close(ch)
+                return
+            }
+        }
+
+        if c.hs_first != nil && c.repeatHandshake(enc) {
+            continue
+        }
+
+        unenc, epoch, good := c.decrypt(enc, false)
+        if !good && c.underlying.IsReliable() {
+            // Every later packet would fail too.
+            log.Printf("Error decrypting packet, closing connection\n")
+            c.Close()
+            close(ch)
+            return
+        } else if !good {
             log.Printf("Error decrypting packet, skipping...\n")
             continue
         }
-        ch <- unenc
+
+        // The other end has its keys, so it won't repeat the handshake.
+        c.hs_first = nil
+        c.hs_reply = nil
+
+        c.lock.Lock()
+        if epoch == c.recv_epoch {
+            c.newEpochSeen()
+        }
+        c.lock.Unlock()
+
+        switch unenc[0] {
+        case msgData:
+            c.lock.Lock()
+            c.rekey.bytes += uint64(len(unenc) - 1)
+            c.lock.Unlock()
+            ch <- unenc[1:]
+
+        case msgRekeyInit:
+            c.handleRekeyInit(rekeyKey(unenc[1:]), epoch)
+
+        case msgRekeyAck:
+            c.handleRekeyAck(rekeyKey(unenc[1:]), epoch)
+
+        case msgRekeyDone:
+            // Seeing it under the new key was all it was for.
+
+        default:
+            log.Printf("Unknown message type %d, skipping...\n", unenc[0])
+        }
     }
 }
 
+// Check and strip the session ID from a decrypted packet.
+func (c *EncryptedPacketClient) checkSession(unenc []byte) ([]byte, bool) {
+    if c.session == nil {
+        return unenc, true
+    }
+
+    if len(unenc) < len(c.session) ||
+        subtle.ConstantTimeCompare(unenc[:len(c.session)], c.session) != 1 {
+        return nil, false
+    }
+    return unenc[len(c.session):], true
+}
+
+// Returns whether a packet is genuine, without passing it on.  Note that this
+// can be called from the underlying transport's goroutine.  A replayed packet
+// isn't genuine, so it can't be used to move the session.
+func (c *EncryptedPacketClient) verifyPacket(enc []byte) bool {
+    _, _, good := c.decrypt(enc, true)
+    return good
+}
+
 func (c *EncryptedPacketClient) SendChannel() chan []byte {
     return c.send_ch
 }
@@ -301,7 +685,7 @@ func (c *EncryptedPacketClient) Describe() string {
 type EncryptedTransport struct {
     accept_ch  chan PacketClient
     underlying chan PacketClient
-    secret     string
+    opts       EncryptionOptions
 }
 
 func (t *EncryptedTransport) AcceptChannel() chan PacketClient {
@@ -313,7 +697,7 @@ func (t *EncryptedTransport) start() {
     // TODO: have some way of stopping this
     for {
         client := <-t.underlying
-        new_client, err := NewEncryptedPacketClient(client, t.secret)
+        new_client, err := NewEncryptedPacketClient(client, &t.opts)
         if err != nil {
             log.Printf("Error starting new encrypted client: %s\n", err)
             continue
@@ -322,9 +706,9 @@ func (t *EncryptedTransport) start() {
     }
 }
 
-func NewEncryptedTransport(underlying Transport, secret string) (*EncryptedTransport, error) {
+func NewEncryptedTransport(underlying Transport, opts *EncryptionOptions) (*EncryptedTransport, error) {
     ch := make(chan PacketClient)
-    tr := &EncryptedTransport{underlying.AcceptChannel(), ch, secret}
+    tr := &EncryptedTransport{ch, underlying.AcceptChannel(), *opts}
 
     go tr.start()
     return tr, nil
@@ -0,0 +1,96 @@
+package transports
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+// Both ends get the same binding, which isn't just the (public) handshake
+// hash, and is different for each session.
+func TestChannelBinding(t *testing.T) {
+    link := newTestLink(false)
+    defer link.client.Close()
+    defer link.server.Close()
+    client, server := newTestEncryptedPair(t, link)
+
+    binding := client.ChannelBinding()
+    if !bytes.Equal(binding, server.ChannelBinding()) {
+        t.Fatal("the two ends have different bindings")
+    }
+    if bytes.Equal(binding, client.rekey.base) {
+        t.Fatal("binding is the handshake hash")
+    }
+
+    other_link := newTestLink(false)
+    defer other_link.client.Close()
+    defer other_link.server.Close()
+    other, _ := newTestEncryptedPair(t, other_link)
+    if bytes.Equal(binding, other.ChannelBinding()) {
+        t.Fatal("two sessions have the same binding")
+    }
+}
+
+// Reliable transports deliver everything in order, so the receiver only
+// accepts the next packet: anything dropped, reordered, replayed or altered
+// fails to decrypt.
+func TestAeadModeOrder(t *testing.T) {
+    tests := []struct {
+        name     string
+        order    []int // the packets the receiver gets, in order
+        accepted []bool
+    }{
+        {"in order", []int{0, 1, 2, 3}, []bool{true, true, true, true}},
+        {"swapped", []int{0, 2, 1}, []bool{true, false, true}},
+        {"dropped", []int{0, 2, 3}, []bool{true, false, false}},
+        {"replayed", []int{0, 1, 1, 2}, []bool{true, true, false, true}},
+        {"replayed first", []int{0, 0}, []bool{true, false}},
+    }
+
+    for _, test := range tests {
+        key := randomKey(t)
+        sender, _ := NewAeadMode(key[:])
+        receiver, _ := NewAeadMode(key[:])
+
+        var packets [][]byte
+        for i := 0; i < 4; i++ {
+            packets = append(packets, sender.Encrypt([]byte(fmt.Sprintf("packet %d", i))))
+        }
+
+        for i, index := range test.order {
+            pkt, ok := receiver.Decrypt(packets[index])
+            if ok != test.accepted[i] {
+                t.Errorf("%s: packet %d accepted = %v", test.name, index, ok)
+            } else if ok && string(pkt) != fmt.Sprintf("packet %d", index) {
+                t.Errorf("%s: got %q for packet %d", test.name, pkt, index)
+            }
+        }
+    }
+}
+
+func TestAeadModeTampering(t *testing.T) {
+    key := randomKey(t)
+    sender, _ := NewAeadMode(key[:])
+    receiver, _ := NewAeadMode(key[:])
+    pkt := sender.Encrypt([]byte("hello"))
+
+    flipped := append([]byte{}, pkt...)
+    flipped[0] ^= 1
+    other_key := randomKey(t)
+    other, _ := NewAeadMode(other_key[:])
+
+    for _, bad := range [][]byte{nil, pkt[:len(pkt)-1], flipped, other.Encrypt([]byte("hello"))} {
+        if _, ok := receiver.Decrypt(bad); ok {
+            t.Errorf("accepted %x", bad)
+        }
+    }
+
+    // None of that moved the counter.
+    if got, ok := receiver.Decrypt(pkt); !ok || string(got) != "hello" {
+        t.Errorf("got %q, %v", got, ok)
+    }
+
+    if _, err := NewAeadMode(key[:5]); err == nil {
+        t.Error("accepted a 5-byte key")
+    }
+}
@@ -0,0 +1,26 @@
+// +build darwin
+
+package transports
+
+// This file contains the (missing) Darwin firewall integration for knocking.
+// Without it, connections from addresses that haven't knocked are still
+// dropped by the transports themselves.
+
+import (
+    "fmt"
+)
+
+func firewallInit(tcp_ports, udp_ports []uint16) error {
+    return fmt.Errorf("firewall integration is not supported on this platform")
+}
+
+func firewallAllow(ip string) error {
+    return nil
+}
+
+func firewallRevoke(ip string) error {
+    return nil
+}
+
+func firewallCleanup() {
+}
@@ -0,0 +1,82 @@
+// +build linux
+
+package transports
+
+// This file contains the Linux firewall integration for knocking.  We create
+// our own chain, and send all packets to the guarded TCP and UDP ports through
+// it.  The chain accepts established connections and addresses that have
+// knocked, and drops everything else.
+
+import (
+    "fmt"
+    "os/exec"
+    "strconv"
+    "strings"
+)
+
+const firewallChain = "holepunch-knock"
+
+var firewallTCPPorts []uint16
+var firewallUDPPorts []uint16
+
+func iptables(args ...string) error {
+    out, err := exec.Command("iptables", args...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("iptables %s: %s (%s)", strings.Join(args, " "),
+            err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+func firewallInit(tcp_ports, udp_ports []uint16) error {
+    // Start from scratch, in case we didn't clean up last time.
+    firewallTCPPorts = tcp_ports
+    firewallUDPPorts = udp_ports
+    firewallCleanup()
+
+    if err := iptables("-N", firewallChain); err != nil {
+        return err
+    }
+
+    rules := [][]string{
+        {"-A", firewallChain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+        {"-A", firewallChain, "-j", "DROP"},
+    }
+    for _, port := range tcp_ports {
+        rules = append(rules, []string{"-I", "INPUT", "-p", "tcp",
+            "--dport", strconv.Itoa(int(port)), "-j", firewallChain})
+    }
+    for _, port := range udp_ports {
+        rules = append(rules, []string{"-I", "INPUT", "-p", "udp",
+            "--dport", strconv.Itoa(int(port)), "-j", firewallChain})
+    }
+
+    for _, rule := range rules {
+        if err := iptables(rule...); err != nil {
+            firewallCleanup()
+            return err
+        }
+    }
+    return nil
+}
+
+// TODO: support IPv6 (with ip6tables)
+func firewallAllow(ip string) error {
+    return iptables("-I", firewallChain, "1", "-s", ip, "-j", "ACCEPT")
+}
+
+func firewallRevoke(ip string) error {
+    return iptables("-D", firewallChain, "-s", ip, "-j", "ACCEPT")
+}
+
+func firewallCleanup() {
+    // These can fail if the rules don't exist, which is fine.
+    for _, port := range firewallTCPPorts {
+        iptables("-D", "INPUT", "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", firewallChain)
+    }
+    for _, port := range firewallUDPPorts {
+        iptables("-D", "INPUT", "-p", "udp", "--dport", strconv.Itoa(int(port)), "-j", firewallChain)
+    }
+    iptables("-F", firewallChain)
+    iptables("-X", firewallChain)
+}
@@ -0,0 +1,371 @@
+package transports
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+
+    "code.google.com/p/go.crypto/pbkdf2"
+    "code.google.com/p/go.crypto/scrypt"
+)
+
+// The pre-shared key for the handshake is derived from the secret with a
+// slow KDF, so that guessing passwords is expensive.  The server decides
+// which KDF to use, how expensive it should be, and the salt, which is
+// random for each server (so nothing can be precomputed across different
+// deployments).  The client learns these from the server, and remembers
+// them: in the first handshake message, it says which parameters it used
+// (as an 8-byte ID, with noiseHasKDF set in the pattern byte):
+//
+//      [pattern] [identity, if any] [KDF ID (8 bytes)] [-> psk, e]
+//
+// If the ID doesn't match the server's parameters, the server replies with
+// them instead of finishing the handshake:
+//
+//      [noiseKDFParams] [params]
+//
+// and the client starts again with the right key.  A client that doesn't
+// know the parameters yet sends an ID of all zeroes, and nothing after it,
+// rather than deriving a key it can't use.  Since anyone could send
+// this reply, the client won't use parameters that are weaker than the
+// minimums below - otherwise, someone could make it use a cheap KDF, and
+// then guess the password from its first message.  (Nor will it use ones
+// that are absurdly expensive.)  Once a handshake has worked with some
+// parameters, the client sticks to them: it warns if the server asks for
+// different ones, and won't use any that are cheaper.
+//
+// Knocking, TLS mimicry and DTLS also need keys derived from the password,
+// but they happen before the handshake, so the client can't ask the server
+// for its parameters.  Instead, the server logs them when it starts, and the
+// client is given them with --server-kdf (see deriveOuterKey).
+//
+// The parameters are encoded as:
+//
+//      [algorithm (1 byte)] [cost 1 (4 bytes)] [cost 2 (4 bytes)] [cost 3 (1 byte)] [salt length (1 byte)] [salt]
+//
+// where the costs are the number of iterations for PBKDF2 (with the other
+// two costs zero), and N, r and p for scrypt.
+//
+// Keys are expensive to derive, so both sides cache them.  A server that
+// isn't given any parameters uses the old ones: 16384 rounds of PBKDF2, with
+// no salt.
+
+const (
+    KDFPBKDF2 = 0x00
+    KDFScrypt = 0x01
+)
+
+const kdfSaltLen = 16
+const kdfIDLen = 8
+
+var legacyKDF = &KDFParams{KDFPBKDF2, 16384, 0, 0, nil}
+
+type KDFParams struct {
+    Algorithm byte
+    Cost1     uint32
+    Cost2     uint32
+    Cost3     byte
+    Salt      []byte
+}
+
+// The weakest parameters the client will accept, and the most expensive
+// (so that a fake server can't make it run out of memory).
+const (
+    minPBKDF2Iterations = 16384
+    maxPBKDF2Iterations = 10000000
+    minScryptN          = 1 << 14
+    maxScryptMemory     = 1 << 30
+    maxScryptP          = 16
+)
+
+// Parses a KDF and its costs, as given on the command line (e.g. "scrypt" and
+// "n=32768,r=8,p=1").  Costs that aren't given are set to their defaults.
+// The salt is left empty.
+func ParseKDF(name, costs string) (*KDFParams, error) {
+    var params *KDFParams
+    var keys []string
+
+    switch name {
+    case "pbkdf2":
+        params = &KDFParams{KDFPBKDF2, 65536, 0, 0, nil}
+        keys = []string{"i"}
+    case "scrypt":
+        params = &KDFParams{KDFScrypt, 32768, 8, 1, nil}
+        keys = []string{"n", "r", "p"}
+    default:
+        return nil, fmt.Errorf("unknown KDF: %s", name)
+    }
+
+    for _, item := range strings.Split(costs, ",") {
+        item = strings.TrimSpace(item)
+        if len(item) == 0 {
+            continue
+        }
+
+        parts := strings.SplitN(item, "=", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid KDF cost: %s", item)
+        }
+        value, err := strconv.ParseUint(parts[1], 10, 32)
+        if err != nil {
+            return nil, fmt.Errorf("invalid KDF cost: %s", item)
+        }
+
+        switch {
+        case len(keys) > 0 && parts[0] == keys[0]:
+            params.Cost1 = uint32(value)
+        case len(keys) > 1 && parts[0] == keys[1]:
+            params.Cost2 = uint32(value)
+        case len(keys) > 2 && parts[0] == keys[2]:
+            if value > 0xFF {
+                return nil, fmt.Errorf("invalid KDF cost: %s", item)
+            }
+            params.Cost3 = byte(value)
+        default:
+            return nil, fmt.Errorf("unknown cost '%s' for %s", parts[0], name)
+        }
+    }
+
+    if !params.acceptable() {
+        return nil, fmt.Errorf("KDF costs for %s are out of range", name)
+    }
+    return params, nil
+}
+
+// Loads the server's salt from a file, creating it (and its directory) if it
+// doesn't exist.
+func LoadKDFSalt(path string) ([]byte, error) {
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        salt, err := NewKDFSalt()
+        if err != nil {
+            return nil, err
+        }
+
+        log.Printf("Generating new KDF salt in %s\n", path)
+        if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+            return nil, err
+        }
+        err = ioutil.WriteFile(path, []byte(hex.EncodeToString(salt)+"\n"), 0600)
+        if err != nil {
+            return nil, err
+        }
+        return salt, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    salt, err := hex.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(salt) < 8 || len(salt) > 255 {
+        return nil, fmt.Errorf("invalid KDF salt in %s", path)
+    }
+    return salt, nil
+}
+
+func NewKDFSalt() ([]byte, error) {
+    salt := make([]byte, kdfSaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    return salt, nil
+}
+
+func (p *KDFParams) acceptable() bool {
+    switch p.Algorithm {
+    case KDFPBKDF2:
+        return p.Cost1 >= minPBKDF2Iterations && p.Cost1 <= maxPBKDF2Iterations && p.Cost2 == 0 && p.Cost3 == 0
+    case KDFScrypt:
+        // N must be a power of two, and scrypt needs 128 * N * r bytes.
+        if p.Cost1 < minScryptN || p.Cost1&(p.Cost1-1) != 0 || p.Cost2 == 0 {
+            return false
+        }
+        return 128*uint64(p.Cost1)*uint64(p.Cost2) <= maxScryptMemory && p.Cost3 > 0 && p.Cost3 <= maxScryptP
+    }
+    return false
+}
+
+// Whether these parameters cost at least as much to attack as the others.
+// The salt doesn't matter.
+func (p *KDFParams) atLeast(other *KDFParams) bool {
+    return p.Algorithm == other.Algorithm && p.Cost1 >= other.Cost1 && p.Cost2 >= other.Cost2 && p.Cost3 >= other.Cost3
+}
+
+// The parameters as the server logs them, for --server-kdf.
+func (p *KDFParams) String() string {
+    return hex.EncodeToString(p.encode())
+}
+
+// Parses parameters as given by String.
+func ParseKDFParams(s string) (*KDFParams, error) {
+    buf, err := hex.DecodeString(s)
+    if err != nil {
+        return nil, fmt.Errorf("invalid KDF parameters: %s", s)
+    }
+    params, err := decodeKDFParams(buf)
+    if err != nil {
+        return nil, err
+    }
+    if !params.acceptable() {
+        return nil, fmt.Errorf("KDF parameters are out of range")
+    }
+    return params, nil
+}
+
+// The parameters the server wants clients to use.
+func serverKDF(opts *EncryptionOptions) *KDFParams {
+    if opts.KDF != nil {
+        return opts.KDF
+    }
+    return legacyKDF
+}
+
+func (p *KDFParams) encode() []byte {
+    buf := make([]byte, 11, 11+len(p.Salt))
+    buf[0] = p.Algorithm
+    binary.BigEndian.PutUint32(buf[1:], p.Cost1)
+    binary.BigEndian.PutUint32(buf[5:], p.Cost2)
+    buf[9] = p.Cost3
+    buf[10] = byte(len(p.Salt))
+    return append(buf, p.Salt...)
+}
+
+func decodeKDFParams(buf []byte) (*KDFParams, error) {
+    if len(buf) < 11 || len(buf) != 11+int(buf[10]) {
+        return nil, fmt.Errorf("invalid KDF parameters")
+    }
+    return &KDFParams{
+        Algorithm: buf[0],
+        Cost1:     binary.BigEndian.Uint32(buf[1:]),
+        Cost2:     binary.BigEndian.Uint32(buf[5:]),
+        Cost3:     buf[9],
+        Salt:      append([]byte{}, buf[11:]...),
+    }, nil
+}
+
+// A short ID for a set of parameters.
+func (p *KDFParams) id() []byte {
+    sum := sha256.Sum256(p.encode())
+    return sum[:kdfIDLen]
+}
+
+// The server's parameters, if they aren't the ones the client used.
+var errKDFMismatch = fmt.Errorf("client used the wrong KDF parameters")
+
+type kdfMismatch struct {
+    params *KDFParams
+}
+
+func (e *kdfMismatch) Error() string {
+    return "server uses different KDF parameters"
+}
+
+// --------------------------------------------------------------------------------
+
+var kdf_cache = make(map[string][]byte)
+var kdf_cache_lock sync.Mutex
+
+// Derives the pre-shared key for a secret.
+func derivePSK(secret string, params *KDFParams) ([]byte, error) {
+    secret_hash := sha256.Sum256([]byte(secret))
+    cache_key := string(params.id()) + string(secret_hash[:])
+
+    kdf_cache_lock.Lock()
+    key, found := kdf_cache[cache_key]
+    kdf_cache_lock.Unlock()
+    if found {
+        return key, nil
+    }
+
+    var err error
+    switch params.Algorithm {
+    case KDFPBKDF2:
+        key = pbkdf2.Key([]byte(secret), params.Salt, int(params.Cost1), 32, sha256.New)
+    case KDFScrypt:
+        key, err = scrypt.Key([]byte(secret), params.Salt, int(params.Cost1), int(params.Cost2), int(params.Cost3), 32)
+    default:
+        err = fmt.Errorf("unknown KDF %d", params.Algorithm)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    kdf_cache_lock.Lock()
+    kdf_cache[cache_key] = key
+    kdf_cache_lock.Unlock()
+    return key, nil
+}
+
+// Derives the key for something outside the handshake (e.g. "knock"), using
+// the server's parameters.  The label keeps the keys for each one separate,
+// and separate from the handshake's pre-shared key.
+func deriveOuterKey(secret string, params *KDFParams, label string) ([]byte, error) {
+    key, err := derivePSK(secret, params)
+    if err != nil {
+        return nil, err
+    }
+
+    hm := hmac.New(sha256.New, key)
+    hm.Write([]byte("holepunch-" + label))
+    return hm.Sum(nil), nil
+}
+
+// An outer key that can be replaced while it's in use, for when the server's
+// password changes.
+type outerKey struct {
+    params *KDFParams
+    label  string
+    key    []byte
+    lock   sync.RWMutex
+}
+
+func newOuterKey(secret string, params *KDFParams, label string) (*outerKey, error) {
+    k := &outerKey{params: params, label: label}
+    if err := k.set(secret); err != nil {
+        return nil, err
+    }
+    return k, nil
+}
+
+func (k *outerKey) get() []byte {
+    k.lock.RLock()
+    defer k.lock.RUnlock()
+    return k.key
+}
+
+// Derives the key again from a new secret.
+func (k *outerKey) set(secret string) error {
+    key, err := deriveOuterKey(secret, k.params, k.label)
+    if err != nil {
+        return err
+    }
+
+    k.lock.Lock()
+    k.key = key
+    k.lock.Unlock()
+    return nil
+}
+
+// The server is only meant to change its parameters when it's set up
+// differently (or, without a fixed salt, when it restarts), so once we've had
+// a handshake work with some, we won't switch to cheaper ones.
+func checkNewKDF(old, params *KDFParams) error {
+    if old == nil {
+        return nil
+    }
+
+    log.Printf("Warning: the server's KDF parameters have changed since we last connected\n")
+    if !params.atLeast(old) {
+        return fmt.Errorf("server's new KDF parameters are weaker than the ones it used before")
+    }
+    return nil
+}
@@ -0,0 +1,192 @@
+package transports
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestParseKDF(t *testing.T) {
+    tests := []struct {
+        name     string
+        costs    string
+        expected *KDFParams
+    }{
+        {"pbkdf2", "", &KDFParams{KDFPBKDF2, 65536, 0, 0, nil}},
+        {"pbkdf2", "i=100000", &KDFParams{KDFPBKDF2, 100000, 0, 0, nil}},
+        {"scrypt", "", &KDFParams{KDFScrypt, 32768, 8, 1, nil}},
+        {"scrypt", "n=65536, r=4", &KDFParams{KDFScrypt, 65536, 4, 1, nil}},
+        {"scrypt", "p=2,", &KDFParams{KDFScrypt, 32768, 8, 2, nil}},
+    }
+    for _, test := range tests {
+        params, err := ParseKDF(test.name, test.costs)
+        if err != nil {
+            t.Errorf("%s %q: %s", test.name, test.costs, err)
+            continue
+        }
+        if !reflect.DeepEqual(params, test.expected) {
+            t.Errorf("%s %q: got %+v, expected %+v", test.name, test.costs, params, test.expected)
+        }
+    }
+
+    bad := []struct {
+        name  string
+        costs string
+    }{
+        {"argon2id", ""},
+        {"md5", ""},
+        {"pbkdf2", "n=65536"},
+        {"pbkdf2", "i"},
+        {"pbkdf2", "i=lots"},
+        {"pbkdf2", "i=1000"},
+        {"scrypt", "n=30000"},
+        {"scrypt", "n=1024"},
+        {"scrypt", "p=256"},
+        {"scrypt", "n=1048576,r=16"},
+    }
+    for _, test := range bad {
+        if _, err := ParseKDF(test.name, test.costs); err == nil {
+            t.Errorf("%s %q: no error", test.name, test.costs)
+        }
+    }
+}
+
+func TestKDFAcceptable(t *testing.T) {
+    tests := []struct {
+        params     KDFParams
+        acceptable bool
+    }{
+        {KDFParams{KDFPBKDF2, minPBKDF2Iterations, 0, 0, nil}, true},
+        {KDFParams{KDFPBKDF2, minPBKDF2Iterations - 1, 0, 0, nil}, false},
+        {KDFParams{KDFPBKDF2, maxPBKDF2Iterations + 1, 0, 0, nil}, false},
+        {KDFParams{KDFPBKDF2, 65536, 1, 0, nil}, false},
+        {KDFParams{KDFScrypt, minScryptN, 8, 1, nil}, true},
+        {KDFParams{KDFScrypt, minScryptN / 2, 8, 1, nil}, false},
+        {KDFParams{KDFScrypt, minScryptN + 1, 8, 1, nil}, false},
+        {KDFParams{KDFScrypt, minScryptN, 0, 1, nil}, false},
+        {KDFParams{KDFScrypt, minScryptN, 8, 0, nil}, false},
+        {KDFParams{KDFScrypt, minScryptN, 8, maxScryptP + 1, nil}, false},
+        {KDFParams{KDFScrypt, maxScryptMemory / 128 / 8, 8, 1, nil}, true},
+        {KDFParams{KDFScrypt, maxScryptMemory / 128 / 8, 16, 1, nil}, false},
+        {KDFParams{0x02, 3, 65536, 4, nil}, false},
+    }
+    for _, test := range tests {
+        if test.params.acceptable() != test.acceptable {
+            t.Errorf("%+v: acceptable() != %v", test.params, test.acceptable)
+        }
+    }
+}
+
+func TestKDFParamsString(t *testing.T) {
+    params := &KDFParams{KDFScrypt, 32768, 8, 1, []byte("0123456789abcdef")}
+    parsed, err := ParseKDFParams(params.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(parsed, params) {
+        t.Errorf("got %+v, expected %+v", parsed, params)
+    }
+
+    weak := &KDFParams{KDFPBKDF2, 1000, 0, 0, nil}
+    for _, s := range []string{"", "zz", params.String()[2:], weak.String()} {
+        if _, err := ParseKDFParams(s); err == nil {
+            t.Errorf("parsed %q", s)
+        }
+    }
+}
+
+func TestCheckNewKDF(t *testing.T) {
+    old := &KDFParams{KDFScrypt, 32768, 8, 1, []byte("old salt")}
+
+    if err := checkNewKDF(nil, old); err != nil {
+        t.Errorf("first parameters refused: %s", err)
+    }
+
+    // The salt can change (e.g. when the server restarts), and the costs can
+    // go up.
+    ok := []*KDFParams{
+        {KDFScrypt, 32768, 8, 1, []byte("new salt")},
+        {KDFScrypt, 65536, 8, 2, nil},
+    }
+    for _, params := range ok {
+        if err := checkNewKDF(old, params); err != nil {
+            t.Errorf("%+v: %s", params, err)
+        }
+    }
+
+    weaker := []*KDFParams{
+        {KDFScrypt, 16384, 8, 1, nil},
+        {KDFScrypt, 65536, 4, 1, nil},
+        {KDFPBKDF2, 10000000, 0, 0, nil},
+    }
+    for _, params := range weaker {
+        if err := checkNewKDF(old, params); err == nil {
+            t.Errorf("%+v: accepted in place of %+v", params, old)
+        }
+    }
+}
+
+func TestDeriveOuterKey(t *testing.T) {
+    params := &KDFParams{KDFPBKDF2, minPBKDF2Iterations, 0, 0, []byte("salt")}
+
+    knock, err := deriveOuterKey("secret", params, "knock")
+    if err != nil {
+        t.Fatal(err)
+    }
+    again, _ := deriveOuterKey("secret", params, "knock")
+    if !bytes.Equal(knock, again) {
+        t.Error("the same inputs gave different keys")
+    }
+
+    tls, _ := deriveOuterKey("secret", params, "tls")
+    psk, _ := derivePSK("secret", params)
+    if bytes.Equal(knock, tls) || bytes.Equal(knock, psk) {
+        t.Error("keys for different uses are the same")
+    }
+
+    other := &KDFParams{KDFPBKDF2, minPBKDF2Iterations, 0, 0, []byte("other salt")}
+    salted, _ := deriveOuterKey("secret", other, "knock")
+    if bytes.Equal(knock, salted) {
+        t.Error("the salt made no difference")
+    }
+
+    wrong, _ := deriveOuterKey("guess", params, "knock")
+    if bytes.Equal(knock, wrong) {
+        t.Error("the secret made no difference")
+    }
+}
+
+// The salt is created once, and then the same one is used every time.
+func TestLoadKDFSalt(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "holepunch", "kdf-salt")
+    salt, err := LoadKDFSalt(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(salt) != kdfSaltLen {
+        t.Errorf("%d-byte salt", len(salt))
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("salt file has permissions %#o", info.Mode().Perm())
+    }
+
+    again, err := LoadKDFSalt(path)
+    if err != nil || !bytes.Equal(again, salt) {
+        t.Errorf("got %x, %v the second time, expected %x", again, err, salt)
+    }
+
+    for _, contents := range []string{"not hex\n", "0102\n"} {
+        ioutil.WriteFile(path, []byte(contents), 0600)
+        if _, err := LoadKDFSalt(path); err == nil {
+            t.Errorf("%q: no error", contents)
+        }
+    }
+}
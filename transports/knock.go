@@ -0,0 +1,330 @@
+package transports
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// This file implements single-packet authorization ("knocking").  When it's
+// enabled, the server won't talk to a client until the client has sent a
+// single, authenticated packet to the knock port.  The client's IP address is
+// then allowed to connect for a short window.  Until then, the server's
+// listeners drop packets and connections from the client.
+//
+// Note that without firewall integration, the kernel completes the TCP
+// handshake before we can see who's connecting, so a port scanner still sees
+// the TCP port as open (we just close the connection straight away).  UDP
+// packets (for the UDP and DTLS transports) get no answer, so those ports
+// look filtered.  With firewall integration, which is the default on Linux,
+// packets from addresses that haven't knocked are dropped by the system
+// firewall, so they never even reach us, and a port scanner can't tell that
+// there's anything there.
+//
+// A knock packet looks like this:
+//
+//      timestamp   8 bytes, big-endian Unix time
+//      nonce       16 random bytes
+//      mac         32 bytes, HMAC-SHA256 of the above
+//
+// The key for the HMAC is derived from the shared secret, with the server's
+// KDF parameters (see kdf.go).  Knocks must have a timestamp within
+// knockMaxSkew of the server's clock, and each nonce is only accepted once,
+// so a knock can't be replayed.  Knocks can be sent either as a UDP datagram
+// to the knock port, or as the payload of an ICMP echo request.
+
+const KNOCK_PORT = 44462
+
+const knockMaxSkew = 30 * time.Second
+
+const knockNonceLen = 16
+const knockLen = 8 + knockNonceLen + sha256.Size
+
+func makeKnock(key []byte) ([]byte, error) {
+    pkt := make([]byte, 8+knockNonceLen, knockLen)
+    binary.BigEndian.PutUint64(pkt, uint64(time.Now().Unix()))
+    if _, err := io.ReadFull(rand.Reader, pkt[8:]); err != nil {
+        return nil, err
+    }
+
+    mac := hmac.New(sha256.New, key)
+    mac.Write(pkt)
+    return mac.Sum(pkt), nil
+}
+
+// Sends a knock to the given server, using the given method ("udp" or
+// "icmp").  The key comes from the secret and the server's KDF parameters.
+// Note that sending an ICMP knock requires root.
+func SendKnock(server, method, secret string, params *KDFParams) error {
+    key, err := deriveOuterKey(secret, params, "knock")
+    if err != nil {
+        return err
+    }
+    pkt, err := makeKnock(key)
+    if err != nil {
+        return err
+    }
+
+    var conn net.Conn
+    switch method {
+    case "udp":
+        conn, err = net.Dial("udp", net.JoinHostPort(server, strconv.Itoa(KNOCK_PORT)))
+
+    case "icmp":
+        conn, err = net.Dial("ip4:icmp", server)
+        if err == nil {
+            pkt, err = serializeICMP(pkt)
+        }
+
+    default:
+        err = fmt.Errorf("unknown knock method: %s", method)
+    }
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    _, err = conn.Write(pkt)
+    return err
+}
+
+// --------------------------------------------------------------------------------
+
+type KnockGuard struct {
+    conn      net.PacketConn
+    method    string
+    key       *outerKey
+    allow_for time.Duration
+    firewall  bool
+
+    // IP address --> when the address stops being allowed.
+    allowed map[string]time.Time
+
+    // Nonces we've seen --> when they can be forgotten.
+    seen map[string]time.Time
+    lock sync.Mutex
+}
+
+// Starts listening for knocks using the given method ("udp" or "icmp").  Each
+// valid knock allows the sender to connect for allow_for.  If firewall is
+// true, we also configure the system firewall to drop packets to the given
+// TCP and UDP ports from addresses that haven't knocked.
+func NewKnockGuard(secret string, params *KDFParams, method string, allow_for time.Duration,
+    firewall bool, tcp_ports, udp_ports []uint16) (*KnockGuard, error) {
+
+    key, err := newOuterKey(secret, params, "knock")
+    if err != nil {
+        return nil, err
+    }
+
+    var conn net.PacketConn
+
+    switch method {
+    case "udp":
+        conn, err = net.ListenPacket("udp", fmt.Sprintf("0.0.0.0:%d", KNOCK_PORT))
+
+    case "icmp":
+        conn, err = net.ListenPacket("ip4:icmp", "0.0.0.0")
+
+    default:
+        err = fmt.Errorf("unknown knock method: %s", method)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    g := &KnockGuard{
+        conn:      conn,
+        method:    method,
+        key:       key,
+        allow_for: allow_for,
+        allowed:   make(map[string]time.Time),
+        seen:      make(map[string]time.Time),
+    }
+
+    if firewall {
+        if err = firewallInit(tcp_ports, udp_ports); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("could not configure firewall: %s", err)
+        }
+        g.firewall = true
+    }
+
+    go g.receiveKnocks()
+    go g.expire()
+
+    return g, nil
+}
+
+// Returns whether the given address has knocked recently.  This is suitable
+// for use as TCPOptions.Filter, DTLSOptions.Filter, or the UDP transport's
+// filter.
+func (g *KnockGuard) Allows(addr net.Addr) bool {
+    var ip net.IP
+    switch a := addr.(type) {
+    case *net.TCPAddr:
+        ip = a.IP
+    case *net.UDPAddr:
+        ip = a.IP
+    case *net.IPAddr:
+        ip = a.IP
+    default:
+        return false
+    }
+
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    until, found := g.allowed[ip.String()]
+    return found && time.Now().Before(until)
+}
+
+// Derives the key from a new secret.  Addresses that have already knocked
+// stay allowed until their time runs out.
+func (g *KnockGuard) SetSecret(secret string) error {
+    return g.key.set(secret)
+}
+
+// Stops listening for knocks, and removes any firewall rules we've added.
+func (g *KnockGuard) Close() {
+    g.conn.Close()
+
+    if g.firewall {
+        g.lock.Lock()
+        for ip, _ := range g.allowed {
+            firewallRevoke(ip)
+        }
+        g.allowed = make(map[string]time.Time)
+        g.lock.Unlock()
+
+        firewallCleanup()
+    }
+}
+
+func (g *KnockGuard) receiveKnocks() {
+    var pkt [65535]byte
+
+    for {
+        n, addr, err := g.conn.ReadFrom(pkt[:])
+        if err != nil {
+            log.Printf("Error reading knock: %s\n", err)
+            break
+        }
+
+        data := pkt[0:n]
+        if g.method == "icmp" {
+            // Skip over the ICMP header, and ignore anything that isn't an
+            // echo request.
+            if n < 8 || data[0] != 8 {
+                continue
+            }
+            data = data[8:]
+        }
+
+        if !g.checkKnock(data) {
+            // Don't log the details, since anyone can send us junk.
+            log.Printf("Invalid knock from %s\n", addr)
+            continue
+        }
+
+        var ip string
+        switch a := addr.(type) {
+        case *net.UDPAddr:
+            ip = a.IP.String()
+        case *net.IPAddr:
+            ip = a.IP.String()
+        }
+
+        log.Printf("Valid knock from %s, allowing for %s\n", ip, g.allow_for)
+
+        g.lock.Lock()
+        _, already := g.allowed[ip]
+        g.allowed[ip] = time.Now().Add(g.allow_for)
+        g.lock.Unlock()
+
+        if g.firewall && !already {
+            if err = firewallAllow(ip); err != nil {
+                log.Printf("Error allowing %s through firewall: %s\n", ip, err)
+            }
+        }
+    }
+}
+
+func (g *KnockGuard) checkKnock(pkt []byte) bool {
+    if len(pkt) != knockLen {
+        return false
+    }
+
+    data := pkt[:8+knockNonceLen]
+    mac := hmac.New(sha256.New, g.key.get())
+    mac.Write(data)
+    if !hmac.Equal(mac.Sum(nil), pkt[8+knockNonceLen:]) {
+        return false
+    }
+
+    // Check the timestamp.
+    ts := time.Unix(int64(binary.BigEndian.Uint64(pkt)), 0)
+    now := time.Now()
+    if ts.Before(now.Add(-knockMaxSkew)) || ts.After(now.Add(knockMaxSkew)) {
+        log.Printf("Knock timestamp is out of range: %s\n", ts)
+        return false
+    }
+
+    // Check that this isn't a replay.  We only need to remember nonces for
+    // as long as the timestamp would be accepted.
+    nonce := string(pkt[8 : 8+knockNonceLen])
+
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    if _, found := g.seen[nonce]; found {
+        log.Printf("Knock has been replayed\n")
+        return false
+    }
+    g.seen[nonce] = ts.Add(knockMaxSkew)
+
+    return true
+}
+
+// Periodically forgets old nonces and closes the window for addresses that
+// haven't knocked recently.
+func (g *KnockGuard) expire() {
+    // TODO: some way to stop this
+    for {
+        <-time.After(1 * time.Second)
+        now := time.Now()
+
+        var revoked []string
+
+        g.lock.Lock()
+        for nonce, until := range g.seen {
+            if now.After(until) {
+                delete(g.seen, nonce)
+            }
+        }
+        for ip, until := range g.allowed {
+            if now.After(until) {
+                delete(g.allowed, ip)
+                revoked = append(revoked, ip)
+            }
+        }
+        g.lock.Unlock()
+
+        for _, ip := range revoked {
+            log.Printf("Knock window for %s has expired\n", ip)
+            if g.firewall {
+                if err := firewallRevoke(ip); err != nil {
+                    log.Printf("Error removing %s from firewall: %s\n", ip, err)
+                }
+            }
+        }
+    }
+}
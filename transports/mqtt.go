@@ -0,0 +1,325 @@
+package transports
+
+import (
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// This transport exchanges packets through an MQTT broker, for networks where
+// the only thing that's allowed out is MQTT.  Both the client and the server
+// connect to the broker as ordinary MQTT clients.  Each session gets its own
+// pair of topics:
+//
+//      <prefix>/<session>/up       client --> server
+//      <prefix>/<session>/down     server --> client
+//
+// where the session ID is chosen at random by the client.  The server
+// subscribes to "<prefix>/+/up", and treats each new session ID as a new
+// client.  Packets are published with QoS 0 - we don't need the broker to
+// make any delivery guarantees, since we don't make any either.
+//
+// Anyone who can use the broker can see and publish to our topics, so as
+// usual, the encryption layer is what keeps things secure.
+
+const mqttConnectTimeout = 15 * time.Second
+
+// Packets are queued for each client, up to this many, so that paho's message
+// handler never has to wait for us.
+const mqttIncomingBuffer = 64
+
+type MQTTOptions struct {
+    // Broker URL, e.g. "tcp://broker:1883" or "ssl://broker:8883".
+    Broker string
+
+    // Credentials for the broker, if it needs them.
+    Username string
+    Password string
+
+    // Prefix for our topics.
+    TopicPrefix string
+}
+
+type MQTTPacketClient struct {
+    conn       mqtt.Client
+    session    string
+    send_topic string
+    send_ch    chan []byte
+    recv_ch    chan []byte
+    incoming   chan []byte
+
+    // True if this client owns the MQTT connection (i.e. it's on the client
+    // side), and should disconnect it when closed.
+    owns_conn bool
+    onClose   func()
+
+    closed     chan bool
+    close_once sync.Once
+}
+
+func mqttConnect(opts *MQTTOptions, on_connect func(mqtt.Client)) (mqtt.Client, error) {
+    id := make([]byte, 8)
+    if _, err := io.ReadFull(rand.Reader, id); err != nil {
+        return nil, err
+    }
+
+    copts := mqtt.NewClientOptions()
+    copts.AddBroker(opts.Broker)
+    copts.SetClientID("holepunch-" + hex.EncodeToString(id))
+    copts.SetUsername(opts.Username)
+    copts.SetPassword(opts.Password)
+    copts.SetCleanSession(true)
+    copts.SetAutoReconnect(true)
+    copts.SetConnectTimeout(mqttConnectTimeout)
+
+    if strings.HasPrefix(opts.Broker, "ssl://") || strings.HasPrefix(opts.Broker, "tls://") {
+        copts.SetTLSConfig(&tls.Config{})
+    }
+
+    // Subscriptions don't survive reconnecting with a clean session, so we
+    // make them every time we connect.
+    copts.SetOnConnectHandler(on_connect)
+    copts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+        log.Printf("Lost connection to MQTT broker: %s\n", err)
+    })
+
+    conn := mqtt.NewClient(copts)
+    token := conn.Connect()
+    if !token.WaitTimeout(mqttConnectTimeout) {
+        conn.Disconnect(0)
+        return nil, fmt.Errorf("timed out connecting to MQTT broker")
+    }
+    if token.Error() != nil {
+        return nil, token.Error()
+    }
+
+    return conn, nil
+}
+
+func mqttTopic(opts *MQTTOptions, session, direction string) string {
+    return fmt.Sprintf("%s/%s/%s", opts.TopicPrefix, session, direction)
+}
+
+func NewMQTTPacketClient(opts *MQTTOptions) (*MQTTPacketClient, error) {
+    id := make([]byte, SESSION_ID_LEN)
+    if _, err := io.ReadFull(rand.Reader, id); err != nil {
+        return nil, err
+    }
+    session := hex.EncodeToString(id)
+
+    client := newMQTTClient(nil, session, mqttTopic(opts, session, "up"), nil)
+    client.owns_conn = true
+
+    recv_topic := mqttTopic(opts, session, "down")
+    subscribed := make(chan error, 1)
+    on_connect := func(c mqtt.Client) {
+        token := c.Subscribe(recv_topic, 0, func(c mqtt.Client, msg mqtt.Message) {
+            client.deliver(msg.Payload())
+        })
+        token.Wait()
+
+        // Only the first result matters - we just log later ones.
+        select {
+        case subscribed <- token.Error():
+        default:
+            if token.Error() != nil {
+                log.Printf("Error resubscribing to %s: %s\n", recv_topic, token.Error())
+            }
+        }
+    }
+
+    conn, err := mqttConnect(opts, on_connect)
+    if err != nil {
+        return nil, err
+    }
+    client.conn = conn
+
+    select {
+    case err = <-subscribed:
+    case <-time.After(mqttConnectTimeout):
+        err = fmt.Errorf("timed out subscribing to %s", recv_topic)
+    }
+    if err != nil {
+        conn.Disconnect(0)
+        return nil, err
+    }
+
+    client.start()
+    return client, nil
+}
+
+func newMQTTClient(conn mqtt.Client, session, send_topic string, onClose func()) *MQTTPacketClient {
+    return &MQTTPacketClient{
+        conn:       conn,
+        session:    session,
+        send_topic: send_topic,
+        send_ch:    make(chan []byte),
+        recv_ch:    make(chan []byte),
+        incoming:   make(chan []byte, mqttIncomingBuffer),
+        onClose:    onClose,
+        closed:     make(chan bool),
+    }
+}
+
+func (c *MQTTPacketClient) start() {
+    go c.doSend()
+    go c.doRecv()
+}
+
+// Called from paho's message handler, which handles messages one at a time,
+// so this mustn't block.  If the queue is full, the packet is dropped.
+func (c *MQTTPacketClient) deliver(pkt []byte) {
+    select {
+    case c.incoming <- pkt:
+    default:
+    }
+}
+
+func (c *MQTTPacketClient) doRecv() {
+    for {
+        select {
+        case pkt := <-c.incoming:
+            select {
+            case c.recv_ch <- pkt:
+            case <-c.closed:
+                close(c.recv_ch)
+                return
+            }
+
+        case <-c.closed:
+            close(c.recv_ch)
+            return
+        }
+    }
+}
+
+func (c *MQTTPacketClient) doSend() {
+    for {
+        select {
+        case pkt := <-c.send_ch:
+            // With QoS 0, there's nothing to wait for.
+            c.conn.Publish(c.send_topic, 0, false, pkt)
+
+        case <-c.closed:
+            drainPackets(c.send_ch)
+            return
+        }
+    }
+}
+
+func (c *MQTTPacketClient) SendChannel() chan []byte {
+    return c.send_ch
+}
+
+func (c *MQTTPacketClient) RecvChannel() chan []byte {
+    return c.recv_ch
+}
+
+func (c *MQTTPacketClient) Close() {
+    c.close_once.Do(func() {
+        close(c.closed)
+
+        if c.owns_conn {
+            c.conn.Disconnect(250)
+        }
+        if c.onClose != nil {
+            c.onClose()
+        }
+    })
+}
+
+func (c *MQTTPacketClient) IsReliable() bool {
+    return false
+}
+
+func (c *MQTTPacketClient) Describe() string {
+    return fmt.Sprintf("MQTTPacketClient(%s)", c.session)
+}
+
+// --------------------------------------------------------------------------------
+
+type MQTTTransport struct {
+    opts      MQTTOptions
+    accept_ch chan PacketClient
+
+    clients map[string]*MQTTPacketClient
+    lock    sync.Mutex
+}
+
+func NewMQTTTransport(opts *MQTTOptions) (*MQTTTransport, error) {
+    trans := &MQTTTransport{
+        opts:      *opts,
+        accept_ch: make(chan PacketClient),
+        clients:   make(map[string]*MQTTPacketClient),
+    }
+
+    topic := mqttTopic(opts, "+", "up")
+    on_connect := func(c mqtt.Client) {
+        token := c.Subscribe(topic, 0, trans.handleMessage)
+        token.Wait()
+        if token.Error() != nil {
+            log.Printf("Error subscribing to %s: %s\n", topic, token.Error())
+        }
+    }
+
+    // Messages can arrive as soon as we've subscribed, before this returns,
+    // so the handler uses the connection it's given rather than this one.
+    if _, err := mqttConnect(opts, on_connect); err != nil {
+        return nil, err
+    }
+
+    log.Printf("Started accepting clients on %s\n", topic)
+    return trans, nil
+}
+
+func (t *MQTTTransport) handleMessage(c mqtt.Client, msg mqtt.Message) {
+    // The topic is "<prefix>/<session>/up".
+    parts := strings.Split(strings.TrimPrefix(msg.Topic(), t.opts.TopicPrefix+"/"), "/")
+    if len(parts) != 2 {
+        log.Printf("Ignoring message on unexpected topic %s\n", msg.Topic())
+        return
+    }
+    session := parts[0]
+
+    t.lock.Lock()
+    client, found := t.clients[session]
+    if !found {
+        onClose := func() {
+            t.lock.Lock()
+            delete(t.clients, session)
+            t.lock.Unlock()
+        }
+
+        client = newMQTTClient(c, session, mqttTopic(&t.opts, session, "down"), onClose)
+        client.start()
+        t.clients[session] = client
+    }
+    t.lock.Unlock()
+
+    client.deliver(msg.Payload())
+
+    if !found {
+        log.Printf("Got new client: %s\n", session)
+        go t.accept(client)
+    }
+}
+
+// Hands a new client to the server, unless it's closed first.
+func (t *MQTTTransport) accept(client *MQTTPacketClient) {
+    select {
+    case t.accept_ch <- client:
+    case <-client.closed:
+    }
+}
+
+func (t *MQTTTransport) AcceptChannel() chan PacketClient {
+    return t.accept_ch
+}
@@ -0,0 +1,333 @@
+package transports
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// A broker that supports just enough of MQTT 3.1.1 for our transport:
+// connecting, subscribing (with wildcards), and publishing with QoS 0.
+type testBroker struct {
+    listener net.Listener
+
+    subs map[*testSubscriber]bool
+    lock sync.Mutex
+}
+
+type testSubscriber struct {
+    conn    net.Conn
+    filters []string
+
+    // Packets for this connection can come from any other connection.
+    write_lock sync.Mutex
+}
+
+func (s *testSubscriber) write(header byte, body []byte) {
+    s.write_lock.Lock()
+    defer s.write_lock.Unlock()
+    writeMQTTPacket(s.conn, header, body)
+}
+
+func startTestBroker(t *testing.T) string {
+    listener, err := net.Listen("tcp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    broker := &testBroker{listener: listener, subs: make(map[*testSubscriber]bool)}
+    go broker.serve()
+    t.Cleanup(func() { broker.close() })
+
+    return "tcp://" + listener.Addr().String()
+}
+
+func (b *testBroker) serve() {
+    for {
+        conn, err := b.listener.Accept()
+        if err != nil {
+            return
+        }
+        go b.handle(conn)
+    }
+}
+
+func (b *testBroker) close() {
+    b.listener.Close()
+
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    for sub := range b.subs {
+        sub.conn.Close()
+    }
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+    header, err := r.ReadByte()
+    if err != nil {
+        return 0, nil, err
+    }
+
+    // The remaining length is a varint.
+    length, shift := 0, uint(0)
+    for {
+        b, err := r.ReadByte()
+        if err != nil {
+            return 0, nil, err
+        }
+        length |= int(b&0x7F) << shift
+        if b&0x80 == 0 {
+            break
+        }
+        shift += 7
+        if shift > 21 {
+            return 0, nil, fmt.Errorf("invalid length")
+        }
+    }
+
+    body := make([]byte, length)
+    _, err = io.ReadFull(r, body)
+    return header, body, err
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+    pkt := []byte{header}
+    length := len(body)
+    for {
+        b := byte(length & 0x7F)
+        length >>= 7
+        if length > 0 {
+            b |= 0x80
+        }
+        pkt = append(pkt, b)
+        if length == 0 {
+            break
+        }
+    }
+    _, err := w.Write(append(pkt, body...))
+    return err
+}
+
+func mqttString(buf []byte) (string, []byte) {
+    if len(buf) < 2 {
+        return "", nil
+    }
+    n := int(binary.BigEndian.Uint16(buf))
+    if len(buf) < 2+n {
+        return "", nil
+    }
+    return string(buf[2 : 2+n]), buf[2+n:]
+}
+
+func topicMatches(filter, topic string) bool {
+    f := strings.Split(filter, "/")
+    parts := strings.Split(topic, "/")
+    for i, level := range f {
+        if level == "#" {
+            return true
+        }
+        if i >= len(parts) || (level != "+" && level != parts[i]) {
+            return false
+        }
+    }
+    return len(f) == len(parts)
+}
+
+func (b *testBroker) handle(conn net.Conn) {
+    sub := &testSubscriber{conn: conn}
+
+    b.lock.Lock()
+    b.subs[sub] = true
+    b.lock.Unlock()
+    defer func() {
+        b.lock.Lock()
+        delete(b.subs, sub)
+        b.lock.Unlock()
+        conn.Close()
+    }()
+
+    r := bufio.NewReader(conn)
+    for {
+        header, body, err := readMQTTPacket(r)
+        if err != nil {
+            return
+        }
+
+        switch header >> 4 {
+        case 1: // CONNECT
+            sub.write(0x20, []byte{0, 0})
+
+        case 3: // PUBLISH (QoS 0 only)
+            topic, _ := mqttString(body)
+            b.lock.Lock()
+            var targets []*testSubscriber
+            for other := range b.subs {
+                for _, filter := range other.filters {
+                    if topicMatches(filter, topic) {
+                        targets = append(targets, other)
+                        break
+                    }
+                }
+            }
+            b.lock.Unlock()
+
+            for _, other := range targets {
+                other.write(0x30, body)
+            }
+
+        case 8: // SUBSCRIBE
+            if len(body) < 2 {
+                return
+            }
+            ack := append([]byte{}, body[:2]...)
+            rest := body[2:]
+            for len(rest) > 0 {
+                var filter string
+                filter, rest = mqttString(rest)
+                if len(rest) == 0 {
+                    return
+                }
+                rest = rest[1:]
+
+                b.lock.Lock()
+                sub.filters = append(sub.filters, filter)
+                b.lock.Unlock()
+                ack = append(ack, 0)
+            }
+            sub.write(0x90, ack)
+
+        case 12: // PINGREQ
+            sub.write(0xD0, nil)
+
+        case 14: // DISCONNECT
+            return
+        }
+    }
+}
+
+// --------------------------------------------------------------------------------
+
+func recvWithin(t *testing.T, client PacketClient, d time.Duration) []byte {
+    select {
+    case pkt, ok := <-client.RecvChannel():
+        if !ok {
+            t.Fatalf("%s was closed", client.Describe())
+        }
+        return pkt
+    case <-time.After(d):
+        t.Fatalf("nothing arrived on %s", client.Describe())
+    }
+    return nil
+}
+
+func TestMQTTExchange(t *testing.T) {
+    opts := &MQTTOptions{Broker: startTestBroker(t), TopicPrefix: "test"}
+
+    trans, err := NewMQTTTransport(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client, err := NewMQTTPacketClient(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    // Send a few packets before the server has accepted the client: they
+    // should be queued rather than lost, and shouldn't hold up the broker
+    // connection.
+    for i := 0; i < 3; i++ {
+        client.SendChannel() <- []byte(fmt.Sprintf("packet %d", i))
+    }
+
+    var server_client PacketClient
+    select {
+    case server_client = <-trans.AcceptChannel():
+    case <-time.After(5 * time.Second):
+        t.Fatal("server didn't accept the client")
+    }
+    defer server_client.Close()
+
+    for i := 0; i < 3; i++ {
+        pkt := recvWithin(t, server_client, 5*time.Second)
+        if string(pkt) != fmt.Sprintf("packet %d", i) {
+            t.Errorf("got %q, expected packet %d", pkt, i)
+        }
+    }
+
+    server_client.SendChannel() <- []byte("reply")
+    if pkt := recvWithin(t, client, 5*time.Second); string(pkt) != "reply" {
+        t.Errorf("got %q, expected reply", pkt)
+    }
+}
+
+// A client that nobody reads from mustn't stop packets getting to anyone
+// else.
+func TestMQTTSlowClient(t *testing.T) {
+    opts := &MQTTOptions{Broker: startTestBroker(t), TopicPrefix: "test"}
+
+    trans, err := NewMQTTTransport(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    slow, err := NewMQTTPacketClient(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer slow.Close()
+
+    for i := 0; i < 2*mqttIncomingBuffer; i++ {
+        slow.SendChannel() <- []byte("ignored")
+    }
+
+    // Accept the slow client, but never read from it.
+    slow_server := <-trans.AcceptChannel()
+    defer slow_server.Close()
+
+    fast, err := NewMQTTPacketClient(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fast.Close()
+
+    fast.SendChannel() <- []byte("hello")
+    var fast_server PacketClient
+    select {
+    case fast_server = <-trans.AcceptChannel():
+    case <-time.After(5 * time.Second):
+        t.Fatal("server didn't accept the second client")
+    }
+    defer fast_server.Close()
+
+    if pkt := recvWithin(t, fast_server, 5*time.Second); string(pkt) != "hello" {
+        t.Errorf("got %q, expected hello", pkt)
+    }
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+    tests := []struct {
+        filter string
+        topic  string
+        match  bool
+    }{
+        {"a/+/up", "a/123/up", true},
+        {"a/+/up", "a/123/down", false},
+        {"a/+/up", "a/1/2/up", false},
+        {"a/#", "a/1/2", true},
+        {"a/b", "a/b", true},
+        {"a/b", "a/b/c", false},
+    }
+    for _, test := range tests {
+        if topicMatches(test.filter, test.topic) != test.match {
+            t.Errorf("topicMatches(%q, %q) != %v", test.filter, test.topic, test.match)
+        }
+    }
+}
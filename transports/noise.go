@@ -0,0 +1,659 @@
+package transports
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/flynn/noise"
+)
+
+// Every encrypted session starts with a Noise handshake, which gives us fresh
+// keys for each session (so recorded traffic can't be decrypted even if the
+// password later leaks), and separate keys for each direction.  We use one
+// of these handshakes:
+//
+//      Noise_NNpsk0_25519_ChaChaPoly_SHA256
+//          Both sides only have the shared secret.
+//
+//      Noise_NKpsk0_25519_ChaChaPoly_SHA256
+//          The server also has a static key, which the client knows (pins)
+//          in advance.  Someone who knows the password still can't pretend
+//          to be the server.
+//
+//      Noise_KK_25519_ChaChaPoly_SHA256
+//          The client has its own static key, which is in the server's list
+//          of authorized keys, and there's no password at all.  With no
+//          password, only the server's key shows that it's really the
+//          server, so the client must pin it.  (The KN handshake, where it
+//          doesn't, is refused.)
+//
+// With a password, the pre-shared key is derived from it.  The prologue
+// includes the transport's session ID (if any).  Each handshake message is
+// sent as a single packet, prefixed with a byte saying which handshake is in
+// use:
+//
+//          Client                     Server
+//      [pattern] [-> psk, e]   -->
+//                              <--     [pattern] [<- e, ee(, es)]
+//
+// Once the second message arrives, both sides have their keys.
+//
+// If the server has a secret for each user, the client also says who it is,
+// so the server knows which secret to use.  The user name goes in the clear
+// at the start of the first message, and the pattern byte has noiseHasIdentity
+// set:
+//
+//      [pattern] [name length (1 byte)] [name] [-> psk, e]
+//
+// The name is also part of the prologue, so it can't be changed in transit.
+// A client with its own key sends its public key instead of a name.  A
+// client resuming a session sends a ticket instead (see ticket.go).  A client
+// using a password also says which KDF parameters it derived the pre-shared
+// key with (see kdf.go).
+
+const (
+    noisePatternNN = 0x01
+    noisePatternNK = 0x02
+    noisePatternKN = 0x03
+    noisePatternKK = 0x04
+
+    noiseHasIdentity = 0x80
+    noiseHasTicket   = 0x40
+    noiseHasKDF      = 0x20
+
+    // The server's whole reply, if it can't use a ticket.
+    noiseTicketRejected = 0x7F
+
+    // The start of the server's reply, if the client used the wrong KDF
+    // parameters.
+    noiseKDFParams = 0x7E
+)
+
+const noiseHandshakeTimeout = 10 * time.Second
+
+// How long to wait for the server's reply before sending the first message
+// again.  This doubles each time, up to the maximum.
+const noiseResendInitial = 500 * time.Millisecond
+const noiseResendMax = 4 * time.Second
+
+// How many packets from the server to keep if they overtake its reply.
+const noiseMaxEarly = 16
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// Stands in for the secret of a user the server won't let in.
+var noiseDummySecret = func() string {
+    buf := make([]byte, 32)
+    rand.Read(buf)
+    return string(buf)
+}()
+
+// A server's static Noise key.
+type StaticKey struct {
+    Private []byte
+    Public  []byte
+}
+
+func GenerateStaticKey() (*StaticKey, error) {
+    kp, err := noiseCipherSuite.GenerateKeypair(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    return &StaticKey{kp.Private, kp.Public}, nil
+}
+
+// Loads a static key from a file, which holds the hex-encoded private key.  If
+// the file doesn't exist, a new key is generated and saved there.
+func LoadStaticKey(path string) (*StaticKey, error) {
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        key, err := GenerateStaticKey()
+        if err != nil {
+            return nil, err
+        }
+
+        log.Printf("Generating new static key in %s\n", path)
+        err = ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Private)+"\n"), 0600)
+        if err != nil {
+            return nil, err
+        }
+        return key, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return parseStaticKey(data, path)
+}
+
+// Loads a client's key from a file, in the same format.  Like ssh, we won't
+// use a key that anyone else can read.
+func LoadPrivateKey(path string) (*StaticKey, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+    if info.Mode().Perm()&0077 != 0 {
+        return nil, fmt.Errorf("permissions %#o for %s are too open", info.Mode().Perm(), path)
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return parseStaticKey(data, path)
+}
+
+func parseStaticKey(data []byte, path string) (*StaticKey, error) {
+    private, err := hex.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(private) != 32 {
+        return nil, fmt.Errorf("invalid static key in %s", path)
+    }
+
+    // The public key is derived from the private key.
+    kp, err := noise.DH25519.GenerateKeypair(&fixedReader{private})
+    if err != nil {
+        return nil, err
+    }
+    return &StaticKey{kp.Private, kp.Public}, nil
+}
+
+// Hands out the given bytes, so that GenerateKeypair turns a private key into
+// a full keypair.
+type fixedReader struct {
+    data []byte
+}
+
+func (r *fixedReader) Read(buf []byte) (int, error) {
+    n := copy(buf, r.data)
+    r.data = r.data[n:]
+    return n, nil
+}
+
+// --------------------------------------------------------------------------------
+
+// The result of a handshake: a key for each direction, the handshake hash
+// that later rekeys build on (see rekey.go), (on the server) who the client is,
+// and the handshake messages themselves, along with any packets that arrived
+// early.
+type sessionKeys struct {
+    send     [32]byte
+    recv     [32]byte
+    base     []byte
+    identity string
+    peer_key []byte
+    first    []byte
+    reply    []byte
+    early    [][]byte
+
+    // Set if the session was resumed from a ticket.  On the client, this is
+    // empty.
+    resumed *SessionState
+}
+
+// The hint is the identity or ticket the client sent, if any, and the KDF ID
+// is the one it sent, if any.
+func noiseConfig(pattern byte, opts *EncryptionOptions, psk, session []byte, hint string, kdf_id []byte) (noise.Config, error) {
+    prologue := append([]byte("holepunch"), session...)
+    prologue = append(prologue, hint...)
+    prologue = append(prologue, kdf_id...)
+
+    config := noise.Config{
+        CipherSuite:           noiseCipherSuite,
+        Random:                rand.Reader,
+        Initiator:             opts.IsClient,
+        Prologue:              prologue,
+        PresharedKey:          psk,
+        PresharedKeyPlacement: 0,
+    }
+
+    switch pattern {
+    case noisePatternNN:
+        config.Pattern = noise.HandshakeNN
+    case noisePatternNK:
+        config.Pattern = noise.HandshakeNK
+    case noisePatternKN:
+        config.Pattern = noise.HandshakeKN
+    case noisePatternKK:
+        config.Pattern = noise.HandshakeKK
+    default:
+        return config, fmt.Errorf("unknown handshake pattern %d", pattern)
+    }
+
+    // The server's key.
+    if pattern == noisePatternNK || pattern == noisePatternKK {
+        if opts.IsClient {
+            config.PeerStatic = opts.ServerKey
+        } else if opts.StaticKey != nil {
+            config.StaticKeypair = noise.DHKey{Private: opts.StaticKey.Private, Public: opts.StaticKey.Public}
+        } else {
+            return config, fmt.Errorf("client expects a static key, but we don't have one")
+        }
+    }
+
+    // The client's key, which the server is told in the clear.
+    if pattern == noisePatternKN || pattern == noisePatternKK {
+        if opts.IsClient {
+            config.StaticKeypair = noise.DHKey{Private: opts.ClientKey.Private, Public: opts.ClientKey.Public}
+        } else {
+            config.PeerStatic = []byte(hint)
+        }
+    }
+
+    return config, nil
+}
+
+// Does the handshake over the given (not yet encrypted) client.
+//
+// Over unreliable transports, either message can go missing, so the client
+// sends its message again (backing off each time) until the reply arrives.
+// The server may already have sent its reply and be using the session by
+// then, so the encryption layer answers a repeat of the first message with
+// the same reply (see NewEncryptedPacketClient).  Packets from the server
+// that overtake its reply are kept, and handled once the handshake is done.
+func noiseHandshake(underlying PacketClient, opts *EncryptionOptions, session []byte) (*sessionKeys, error) {
+    timeout := time.After(noiseHandshakeTimeout)
+
+    recv := func(resend <-chan time.Time) ([]byte, bool, error) {
+        select {
+        case pkt, ok := <-underlying.RecvChannel():
+            if !ok {
+                return nil, false, fmt.Errorf("connection closed during handshake")
+            }
+            if len(pkt) < 1 {
+                return nil, false, fmt.Errorf("empty handshake message")
+            }
+            return pkt, false, nil
+        case <-resend:
+            return nil, true, nil
+        case <-timeout:
+            return nil, false, fmt.Errorf("handshake timed out")
+        }
+    }
+    send := func(pkt []byte) error {
+        select {
+        case underlying.SendChannel() <- pkt:
+            return nil
+        case <-timeout:
+            return fmt.Errorf("handshake timed out")
+        }
+    }
+
+    if !opts.IsClient {
+        // A bad message might just be a stray packet, so over unreliable
+        // transports we keep waiting for a good one.
+        for {
+            msg, _, err := recv(nil)
+            if err != nil {
+                return nil, err
+            }
+
+            keys, err := noiseRespond(msg, opts, session)
+            if err == nil {
+                if err = send(keys.reply); err != nil {
+                    return nil, err
+                }
+                return keys, nil
+            }
+
+            // The client will try again without the ticket.
+            if err == errTicketRejected {
+                log.Printf("Rejected session ticket from client\n")
+                if err = send([]byte{noiseTicketRejected}); err != nil {
+                    return nil, err
+                }
+                continue
+            }
+
+            // As is this one, once it knows which KDF to use.
+            if err == errKDFMismatch {
+                if err = send(append([]byte{noiseKDFParams}, serverKDF(opts).encode()...)); err != nil {
+                    return nil, err
+                }
+                continue
+            }
+            if underlying.IsReliable() {
+                return nil, err
+            }
+            log.Printf("Ignoring handshake message: %s\n", err)
+        }
+    }
+
+    pattern := byte(noisePatternNN)
+    identity := opts.Identity
+    var psk, kdf_id []byte
+    if opts.ClientKey != nil {
+        if len(opts.ServerKey) == 0 {
+            return nil, fmt.Errorf("using a client key needs the server's key")
+        }
+        pattern = noisePatternKN
+        identity = string(opts.ClientKey.Public)
+    }
+    if len(opts.Ticket) > 0 {
+        pattern = noisePatternNN
+        identity = string(opts.Ticket)
+        psk = opts.TicketSecret
+    }
+
+    // With a password, if we don't know which KDF the server uses yet, we
+    // just ask.
+    probe := false
+    if opts.ClientKey == nil && len(opts.Ticket) == 0 {
+        if opts.KDF != nil {
+            var err error
+            kdf_id = opts.KDF.id()
+            if psk, err = derivePSK(opts.Secret, opts.KDF); err != nil {
+                return nil, err
+            }
+        } else {
+            kdf_id = make([]byte, kdfIDLen)
+            probe = true
+        }
+    }
+    if len(opts.ServerKey) > 0 {
+        pattern++
+    }
+
+    header := []byte{pattern}
+    if len(opts.Ticket) > 0 {
+        if len(opts.Ticket) > 0xFFFF {
+            return nil, fmt.Errorf("session ticket too long")
+        }
+        header = []byte{pattern | noiseHasTicket, 0, 0}
+        binary.BigEndian.PutUint16(header[1:], uint16(len(opts.Ticket)))
+        header = append(header, opts.Ticket...)
+    } else if len(identity) > 0 {
+        if len(identity) > 255 {
+            return nil, fmt.Errorf("user name too long")
+        }
+        header = []byte{pattern | noiseHasIdentity, byte(len(identity))}
+        header = append(header, identity...)
+    }
+    if kdf_id != nil {
+        header[0] |= noiseHasKDF
+        header = append(header, kdf_id...)
+    }
+
+    // Each reply is checked with a fresh handshake state, started again with
+    // the same ephemeral key, so that a bad reply doesn't spoil the state for
+    // the real one.
+    var config noise.Config
+    ephemeral := make([]byte, 32)
+    start := func() (*noise.HandshakeState, []byte, error) {
+        config.Random = &fixedReader{ephemeral}
+        hs, err := noise.NewHandshakeState(config)
+        if err != nil {
+            return nil, nil, err
+        }
+        msg, _, _, err := hs.WriteMessage(append([]byte{}, header...), nil)
+        return hs, msg, err
+    }
+
+    msg := header
+    if !probe {
+        var err error
+        config, err = noiseConfig(pattern, opts, psk, session, identity, kdf_id)
+        if err != nil {
+            return nil, err
+        }
+        if _, err = rand.Read(ephemeral); err != nil {
+            return nil, err
+        }
+        if _, msg, err = start(); err != nil {
+            return nil, err
+        }
+    }
+    if err := send(msg); err != nil {
+        return nil, err
+    }
+
+    var keys *sessionKeys
+    var early [][]byte
+    var rejected <-chan time.Time
+    backoff := noiseResendInitial
+    for keys == nil {
+        var resend <-chan time.Time
+        if rejected != nil {
+            resend = rejected
+        } else if !underlying.IsReliable() {
+            resend = time.After(backoff)
+        }
+
+        pkt, timed_out, err := recv(resend)
+        if err != nil {
+            return nil, err
+        }
+
+        if timed_out && rejected != nil {
+            return nil, errTicketRejected
+        } else if timed_out {
+            log.Printf("No handshake reply after %s, trying again\n", backoff)
+            if err = send(msg); err != nil {
+                return nil, err
+            }
+            backoff *= 2
+            if backoff > noiseResendMax {
+                backoff = noiseResendMax
+            }
+        } else if pkt[0] == header[0] && !probe {
+            hs, _, err := start()
+            if err != nil {
+                return nil, err
+            }
+
+            // Over unreliable transports, a bad reply might just be a stray
+            // packet, so we keep waiting for a good one.
+            _, cs1, cs2, err := hs.ReadMessage(nil, pkt[1:])
+            if err == nil {
+                keys = &sessionKeys{
+                    send:  cs1.UnsafeKey(),
+                    recv:  cs2.UnsafeKey(),
+                    base:  hs.ChannelBinding(),
+                    first: msg,
+                    reply: pkt,
+                }
+            } else if underlying.IsReliable() {
+                return nil, fmt.Errorf("invalid handshake from server: %s", err)
+            } else {
+                log.Printf("Ignoring handshake reply: %s\n", err)
+            }
+        } else if len(pkt) == 1 && pkt[0] == noiseTicketRejected && len(opts.Ticket) > 0 {
+            // Anyone could have sent this, so over unreliable transports, we
+            // give the real reply a chance to arrive first (see ticket.go).
+            if underlying.IsReliable() {
+                return nil, errTicketRejected
+            }
+            if rejected == nil {
+                rejected = time.After(backoff)
+            }
+        } else if pkt[0] == noiseKDFParams && kdf_id != nil {
+            params, err := decodeKDFParams(pkt[1:])
+            if err == nil && bytes.Equal(params.id(), kdf_id) {
+                // A late reply to an earlier attempt.
+                continue
+            }
+            if err == nil && !params.acceptable() {
+                err = fmt.Errorf("server's KDF parameters are out of range")
+            }
+            if err != nil {
+                return nil, err
+            }
+            return nil, &kdfMismatch{params}
+        } else if underlying.IsReliable() {
+            return nil, fmt.Errorf("server replied with the wrong handshake")
+        } else if len(early) < noiseMaxEarly {
+            early = append(early, pkt)
+        }
+    }
+
+    keys.early = early
+    if len(opts.Ticket) > 0 {
+        keys.resumed = &SessionState{}
+    }
+    return keys, nil
+}
+
+// The server's side: checks the client's message, and works out the reply.
+func noiseRespond(msg []byte, opts *EncryptionOptions, session []byte) (*sessionKeys, error) {
+    var err, lookup_err error
+
+    pattern, body := msg[0], msg[1:]
+    if pattern&noiseHasTicket != 0 {
+        return noiseResume(msg, opts, session)
+    }
+
+    identity := ""
+    if pattern&noiseHasIdentity != 0 {
+        if len(body) < 1 || len(body) < 1+int(body[0]) {
+            return nil, fmt.Errorf("truncated handshake from client")
+        }
+        identity = string(body[1 : 1+body[0]])
+        body = body[1+body[0]:]
+    }
+
+    var kdf_id []byte
+    if pattern&noiseHasKDF != 0 {
+        if len(body) < kdfIDLen {
+            return nil, fmt.Errorf("truncated handshake from client")
+        }
+        kdf_id = body[:kdfIDLen]
+        body = body[kdfIDLen:]
+    }
+
+    pattern &^= noiseHasIdentity | noiseHasKDF
+
+    var psk, peer_key []byte
+    if pattern == noisePatternKN {
+        return nil, fmt.Errorf("client with a key didn't pin our key")
+    }
+    if pattern == noisePatternKK {
+        // The identity is the client's public key.
+        if len(identity) != 32 {
+            return nil, fmt.Errorf("invalid client key")
+        }
+        if opts.LookupKey == nil {
+            return nil, fmt.Errorf("client wants to use a key, but we have no authorized keys")
+        }
+        peer_key = []byte(identity)
+        if err = opts.LookupKey(peer_key); err != nil {
+            return nil, err
+        }
+    } else {
+        // Older clients don't say, and use the old parameters.
+        params := serverKDF(opts)
+        used := kdf_id
+        if used == nil {
+            used = legacyKDF.id()
+        }
+        if !bytes.Equal(used, params.id()) {
+            return nil, errKDFMismatch
+        }
+
+        // A user we won't let in still gets a key (which can't work), so that
+        // they're turned away no faster than someone with the wrong secret.
+        secret := opts.Secret
+        if opts.Lookup != nil {
+            if secret, lookup_err = opts.Lookup(identity); lookup_err != nil {
+                secret = noiseDummySecret
+            }
+        }
+        if psk, err = derivePSK(secret, params); err != nil {
+            return nil, err
+        }
+    }
+
+    config, err := noiseConfig(pattern, opts, psk, session, identity, kdf_id)
+    if err != nil {
+        return nil, err
+    }
+    hs, err := noise.NewHandshakeState(config)
+    if err != nil {
+        return nil, err
+    }
+
+    _, _, _, err = hs.ReadMessage(nil, body)
+    if lookup_err != nil {
+        return nil, lookup_err
+    }
+    if err != nil {
+        return nil, fmt.Errorf("invalid handshake from client: %s", err)
+    }
+
+    reply, cs1, cs2, err := hs.WriteMessage([]byte{msg[0]}, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    // The first cipher state is for the client --> server direction.
+    if peer_key != nil {
+        identity = hex.EncodeToString(peer_key)
+    }
+    return &sessionKeys{
+        send:     cs2.UnsafeKey(),
+        recv:     cs1.UnsafeKey(),
+        base:     hs.ChannelBinding(),
+        identity: identity,
+        peer_key: peer_key,
+        first:    msg,
+        reply:    reply,
+    }, nil
+}
+
+// Like noiseRespond, but for a client that's resuming a session.
+func noiseResume(msg []byte, opts *EncryptionOptions, session []byte) (*sessionKeys, error) {
+    pattern, body := msg[0]&^noiseHasTicket, msg[1:]
+    if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+        return nil, fmt.Errorf("truncated handshake from client")
+    }
+    ticket := body[2 : 2+binary.BigEndian.Uint16(body)]
+    body = body[2+len(ticket):]
+
+    if pattern != noisePatternNN && pattern != noisePatternNK {
+        return nil, fmt.Errorf("invalid handshake pattern %d for resumption", pattern)
+    }
+    if opts.Tickets == nil {
+        return nil, errTicketRejected
+    }
+
+    var hs *noise.HandshakeState
+    state, err := opts.Tickets.redeem(ticket, func(secret []byte) error {
+        config, err := noiseConfig(pattern, opts, secret, session, string(ticket), nil)
+        if err != nil {
+            return err
+        }
+        hs, err = noise.NewHandshakeState(config)
+        if err != nil {
+            return err
+        }
+
+        if _, _, _, err = hs.ReadMessage(nil, body); err != nil {
+            return fmt.Errorf("invalid handshake from client: %s", err)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    reply, cs1, cs2, err := hs.WriteMessage([]byte{msg[0]}, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    return &sessionKeys{
+        send:     cs2.UnsafeKey(),
+        recv:     cs1.UnsafeKey(),
+        base:     hs.ChannelBinding(),
+        identity: state.Identity,
+        peer_key: state.PeerKey,
+        first:    msg,
+        reply:    reply,
+        resumed:  state,
+    }, nil
+}
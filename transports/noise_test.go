@@ -0,0 +1,190 @@
+package transports
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// Plays the server's side of a handshake by hand, so that the test can decide
+// what the client gets.  Returns the client's end and the first message.
+func startClientHandshake(t *testing.T, opts *EncryptionOptions) (*testEnd, chan *sessionKeys, chan error, []byte) {
+    end := &testEnd{make(chan []byte, 16), make(chan []byte, 16), false, make(chan bool), sync.Once{}}
+
+    keys_ch := make(chan *sessionKeys, 1)
+    err_ch := make(chan error, 1)
+    go func() {
+        keys, err := noiseHandshake(end, opts, nil)
+        keys_ch <- keys
+        err_ch <- err
+    }()
+
+    select {
+    case msg := <-end.send_ch:
+        return end, keys_ch, err_ch, msg
+    case <-time.After(5 * time.Second):
+        t.Fatal("client didn't start the handshake")
+    }
+    return nil, nil, nil, nil
+}
+
+func TestNoiseHandshakePatterns(t *testing.T) {
+    server_key, err := GenerateStaticKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    client_key, err := GenerateStaticKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name   string
+        client EncryptionOptions
+        server EncryptionOptions
+        ok     bool
+    }{
+        {
+            "password",
+            EncryptionOptions{Secret: "secret", KDF: legacyKDF},
+            EncryptionOptions{Secret: "secret"},
+            true,
+        },
+        {
+            "wrong password",
+            EncryptionOptions{Secret: "wrong", KDF: legacyKDF},
+            EncryptionOptions{Secret: "secret"},
+            false,
+        },
+        {
+            "pinned server key",
+            EncryptionOptions{Secret: "secret", KDF: legacyKDF, ServerKey: server_key.Public},
+            EncryptionOptions{Secret: "secret", StaticKey: server_key},
+            true,
+        },
+        {
+            "client key",
+            EncryptionOptions{ClientKey: client_key, ServerKey: server_key.Public},
+            EncryptionOptions{StaticKey: server_key, LookupKey: func([]byte) error { return nil }},
+            true,
+        },
+    }
+
+    for _, test := range tests {
+        test.client.IsClient = true
+        end, keys_ch, err_ch, msg := startClientHandshake(t, &test.client)
+
+        server_keys, err := noiseRespond(msg, &test.server, nil)
+        if !test.ok {
+            if err == nil {
+                t.Errorf("%s: server accepted the handshake", test.name)
+            }
+            end.recv_ch <- []byte{}
+            <-keys_ch
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err)
+            continue
+        }
+
+        end.recv_ch <- server_keys.reply
+        client_keys := <-keys_ch
+        if err = <-err_ch; err != nil {
+            t.Errorf("%s: %s", test.name, err)
+            continue
+        }
+        if client_keys.send != server_keys.recv || client_keys.recv != server_keys.send {
+            t.Errorf("%s: the two ends have different keys", test.name)
+        }
+    }
+}
+
+// Without pinning the server's key, a client key would prove nothing about
+// the server, so neither side will do it.
+func TestNoiseClientKeyNeedsServerKey(t *testing.T) {
+    client_key, err := GenerateStaticKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    end := &testEnd{make(chan []byte, 1), make(chan []byte, 1), false, make(chan bool), sync.Once{}}
+    if _, err := noiseHandshake(end, &EncryptionOptions{IsClient: true, ClientKey: client_key}, nil); err == nil {
+        t.Error("client used its key without pinning the server's")
+    }
+
+    msg := append([]byte{noisePatternKN | noiseHasIdentity, 32}, client_key.Public...)
+    msg = append(msg, make([]byte, 32)...)
+    server := &EncryptionOptions{LookupKey: func([]byte) error { return nil }}
+    if _, err := noiseRespond(msg, server, nil); err == nil {
+        t.Error("server accepted a KN handshake")
+    }
+}
+
+// A reply that looks right, but isn't, mustn't stop the real one being used.
+func TestNoiseBadReplyIgnored(t *testing.T) {
+    client := &EncryptionOptions{IsClient: true, Secret: "secret", KDF: legacyKDF}
+    end, keys_ch, err_ch, msg := startClientHandshake(t, client)
+
+    server_keys, err := noiseRespond(msg, &EncryptionOptions{Secret: "secret"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    forged := append([]byte{}, server_keys.reply...)
+    forged[len(forged)-1] ^= 1
+    end.recv_ch <- forged
+    end.recv_ch <- []byte{msg[0]}
+    end.recv_ch <- server_keys.reply
+
+    client_keys := <-keys_ch
+    if err = <-err_ch; err != nil {
+        t.Fatal(err)
+    }
+    if client_keys.send != server_keys.recv {
+        t.Fatal("the two ends have different keys")
+    }
+}
+
+// Anyone could say that our ticket was rejected, so over unreliable
+// transports, the real reply wins if it turns up soon enough.
+func TestNoiseTicketRejectionUnauthenticated(t *testing.T) {
+    issuer, err := NewTicketIssuer(time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ticket, secret, err := issuer.Issue(&SessionState{Identity: "laptop"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client := &EncryptionOptions{IsClient: true, Ticket: ticket, TicketSecret: secret}
+    end, keys_ch, err_ch, msg := startClientHandshake(t, client)
+
+    server_keys, err := noiseRespond(msg, &EncryptionOptions{Tickets: issuer}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    end.recv_ch <- []byte{noiseTicketRejected}
+    end.recv_ch <- server_keys.reply
+
+    client_keys := <-keys_ch
+    if err = <-err_ch; err != nil {
+        t.Fatal(err)
+    }
+    if client_keys.send != server_keys.recv || client_keys.resumed == nil {
+        t.Fatal("client didn't resume the session")
+    }
+
+    // With no reply, the client gives up on the ticket.
+    start := time.Now()
+    end, keys_ch, err_ch, _ = startClientHandshake(t, client)
+    end.recv_ch <- []byte{noiseTicketRejected}
+    <-keys_ch
+    if err = <-err_ch; err != errTicketRejected {
+        t.Fatalf("got %v, expected the ticket to be rejected", err)
+    }
+    if time.Since(start) > noiseHandshakeTimeout/2 {
+        t.Fatalf("took %s to give up", time.Since(start))
+    }
+}
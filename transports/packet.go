@@ -1,12 +1,31 @@
 package transports
 
 import (
+    "bytes"
+    "crypto/rand"
     "fmt"
+    "io"
     "log"
     "net"
     "sync"
 )
 
+// Packet-based transports can optionally tag every packet with a session ID,
+// which is chosen at random by the client.  The server then identifies clients
+// by their session ID rather than by their address, which means that a client
+// whose address changes (e.g. because a NAT changed the source port) keeps its
+// session.
+//
+// Note that the client's socket is connected, so it keeps the local address it
+// started with.  If that address goes away (e.g. because the client moved to
+// a different network), sending fails and the client closes the connection;
+// it then connects again, resuming the session with a ticket if it has one.
+//
+// Since anyone can send a packet with a given session ID, the server only
+// moves a session to a new address once the packet has been verified by the
+// encryption layer - see RoamingPacketClient.
+const SESSION_ID_LEN = 8
+
 type genericPacketClient struct {
     send_ch chan []byte
     recv_ch chan []byte
@@ -17,6 +36,18 @@ type genericPacketClient struct {
     net  string
 
     onClose func()
+
+    // Session ID, or nil if this transport doesn't use them.
+    session []byte
+
+    // Server side only: verifies packets that arrive from a new address.
+    verify    func(pkt []byte) bool
+    addr_lock sync.Mutex
+
+    // Server side only: closed when the client is, so that the transport
+    // doesn't block trying to deliver packets to a client that's gone.
+    closed     chan bool
+    close_once sync.Once
 }
 
 type packetMessage struct {
@@ -24,10 +55,8 @@ type packetMessage struct {
     addr net.Addr
 }
 
-// TODO: lock?
-
 func newGenericPacketClient(network, server string, port uint16,
-    onClose func()) (*genericPacketClient, error) {
+    sessions bool, onClose func()) (*genericPacketClient, error) {
 
     host := fmt.Sprintf("%s:%d", server, port)
 
@@ -36,11 +65,38 @@ func newGenericPacketClient(network, server string, port uint16,
         return nil, err
     }
 
+    ret, err := newGenericPacketClientFromConn(conn, network, host, sessions, onClose)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return ret, nil
+}
+
+// Creates a client from an existing connection.  The connection must also
+// implement net.PacketConn.
+func newGenericPacketClientFromConn(conn net.Conn, network, host string,
+    sessions bool, onClose func()) (*genericPacketClient, error) {
+
+    var session []byte
+    if sessions {
+        session = make([]byte, SESSION_ID_LEN)
+        if _, err := io.ReadFull(rand.Reader, session); err != nil {
+            return nil, err
+        }
+    }
+
     addr := conn.RemoteAddr()
     send_ch := make(chan []byte)
     recv_ch := make(chan []byte)
 
-    ret := &genericPacketClient{send_ch, recv_ch, conn, addr, host, network, onClose}
+    ret := &genericPacketClient{
+        send_ch: send_ch, recv_ch: recv_ch,
+        conn: conn, addr: addr,
+        host: host, net: network,
+        onClose: onClose,
+        session: session,
+    }
     ret.startAsClientConn()
 
     return ret, nil
@@ -62,8 +118,8 @@ func (p *genericPacketClient) startForwardLoop(forward_to chan packetMessage) {
     // TODO: some way to stop this
     for {
         pkt = <-p.send_ch
-        msg.msg = pkt
-        msg.addr = p.addr
+        msg.msg = p.addSession(pkt)
+        msg.addr = p.currentAddr()
         forward_to <- msg
     }
 }
@@ -77,12 +133,15 @@ func (p *genericPacketClient) startSendLoop() {
         pkt = <-p.send_ch
 
         log.Printf("Writing packet of length %d...\n", len(pkt))
-        _, err = p.conn.Write(pkt)
+        _, err = p.conn.Write(p.addSession(pkt))
         if err != nil {
             log.Printf("Error writing packet: %s\n", err)
             break
         }
     }
+
+    p.conn.Close()
+    drainPackets(p.send_ch)
 }
 
 func (p *genericPacketClient) startRecvLoop() {
@@ -106,9 +165,69 @@ func (p *genericPacketClient) startRecvLoop() {
             continue
         }
 
-        log.Printf("Received packet of length %d\n", n)
-        p.recv_ch <- pkt[0:n]
+        data := pkt[0:n]
+        if p.session != nil {
+            if n < len(p.session) || !bytes.Equal(data[:len(p.session)], p.session) {
+                log.Printf("Received packet for a different session, skipping...\n")
+                continue
+            }
+            data = data[len(p.session):]
+        }
+
+        log.Printf("Received packet of length %d\n", len(data))
+        p.recv_ch <- data
+    }
+
+    close(p.recv_ch)
+}
+
+func (p *genericPacketClient) addSession(pkt []byte) []byte {
+    if p.session == nil {
+        return pkt
+    }
+
+    out := make([]byte, 0, len(p.session)+len(pkt))
+    out = append(out, p.session...)
+    return append(out, pkt...)
+}
+
+func (p *genericPacketClient) currentAddr() net.Addr {
+    p.addr_lock.Lock()
+    defer p.addr_lock.Unlock()
+    return p.addr
+}
+
+// Called on the server when a packet for this session arrives from an address
+// other than the one we know about.  We only move the session if the packet
+// is genuine - otherwise, anyone could hijack the session just by knowing the
+// session ID.
+func (p *genericPacketClient) roam(addr net.Addr, pkt []byte) bool {
+    p.addr_lock.Lock()
+    verify := p.verify
+    old_addr := p.addr
+    p.addr_lock.Unlock()
+
+    if verify == nil || !verify(pkt) {
+        log.Printf("Ignoring unverified packet for session %x from %s\n", p.session, addr)
+        return false
     }
+
+    log.Printf("Session %x moved from %s to %s\n", p.session, old_addr, addr)
+
+    p.addr_lock.Lock()
+    p.addr = addr
+    p.addr_lock.Unlock()
+    return true
+}
+
+func (p *genericPacketClient) SessionID() []byte {
+    return p.session
+}
+
+func (p *genericPacketClient) SetRoamVerifier(verify func(pkt []byte) bool) {
+    p.addr_lock.Lock()
+    p.verify = verify
+    p.addr_lock.Unlock()
 }
 
 func (p *genericPacketClient) SendChannel() chan []byte {
@@ -120,7 +239,12 @@ func (p *genericPacketClient) RecvChannel() chan []byte {
 }
 
 func (p *genericPacketClient) Close() {
-    p.conn.Close()
+    if p.conn != nil {
+        p.conn.Close()
+    }
+    if p.closed != nil {
+        p.close_once.Do(func() { close(p.closed) })
+    }
 
     if p.onClose != nil {
         p.onClose()
@@ -137,20 +261,48 @@ func (p *genericPacketClient) Describe() string {
 
 // --------------------------------------------------------------------------------
 
+// Wraps an unconnected net.PacketConn so that it looks like a connected one,
+// which always sends to the given address.  Reads still return packets from
+// anyone - genericPacketClient filters them by address.
+type packetConnTo struct {
+    net.PacketConn
+    remote net.Addr
+}
+
+func (c *packetConnTo) Read(b []byte) (int, error) {
+    n, _, err := c.ReadFrom(b)
+    return n, err
+}
+
+func (c *packetConnTo) Write(b []byte) (int, error) {
+    return c.WriteTo(b, c.remote)
+}
+
+func (c *packetConnTo) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+// --------------------------------------------------------------------------------
+
 type genericPacketTransport struct {
     conn      net.PacketConn
     accept_ch chan PacketClient
     send_ch   chan packetMessage
     network   string
+    sessions  bool
+
+    // If set, packets from addresses this rejects are dropped (e.g. because
+    // they haven't knocked).
+    filter func(addr net.Addr) bool
 }
 
 func (p *genericPacketTransport) AcceptChannel() chan PacketClient {
     return p.accept_ch
 }
 
-func newGenericPacketTransport(network, bindTo string, port uint16,
-    clientMap map[string]*genericPacketClient,
-    clientMapLock sync.RWMutex) (*genericPacketTransport, error) {
+func newGenericPacketTransport(network, bindTo string, port uint16, sessions bool,
+    filter func(addr net.Addr) bool, clientMap map[string]*genericPacketClient,
+    clientMapLock *sync.RWMutex) (*genericPacketTransport, error) {
 
     host := fmt.Sprintf("%s:%d", bindTo, port)
 
@@ -161,7 +313,7 @@ func newGenericPacketTransport(network, bindTo string, port uint16,
 
     accept_ch := make(chan PacketClient)
     send_ch := make(chan packetMessage)
-    ret := &genericPacketTransport{conn, accept_ch, send_ch, network}
+    ret := &genericPacketTransport{conn, accept_ch, send_ch, network, sessions, filter}
 
     go ret.sendPackets()
     go ret.acceptConnections(clientMap, clientMapLock)
@@ -187,7 +339,7 @@ func (p *genericPacketTransport) sendPackets() {
 }
 
 func (p *genericPacketTransport) acceptConnections(clientMap map[string]*genericPacketClient,
-    clientMapLock sync.RWMutex) {
+    clientMapLock *sync.RWMutex) {
 
     log.Println("Started accepting clients")
 
@@ -199,12 +351,35 @@ func (p *genericPacketTransport) acceptConnections(clientMap map[string]*generic
     for {
         n, addr, err = p.conn.ReadFrom(pkt[:])
         if err != nil {
-            log.Printf("Error reading new packet: %s\n")
+            log.Printf("Error reading new packet: %s\n", err)
+            continue
         }
         log.Printf("Got packet of length %d\n", n)
 
+        // Don't log these, since anyone can send us junk.
+        if p.filter != nil && !p.filter(addr) {
+            continue
+        }
+
+        // Clients are identified by their session ID if we're using them, and
+        // their address otherwise.
+        data := pkt[0:n]
+        var key string
+        var session []byte
+        if p.sessions {
+            if n < SESSION_ID_LEN {
+                log.Printf("Packet from %s is too short to have a session ID\n", addr)
+                continue
+            }
+            session = append([]byte{}, data[:SESSION_ID_LEN]...)
+            data = data[SESSION_ID_LEN:]
+            key = string(session)
+        } else {
+            key = addr.String()
+        }
+
         clientMapLock.RLock()
-        client, found := clientMap[addr.String()]
+        client, found := clientMap[key]
         clientMapLock.RUnlock()
 
         if !found {
@@ -216,27 +391,36 @@ func (p *genericPacketTransport) acceptConnections(clientMap map[string]*generic
             send_ch := make(chan []byte)
 
             // When the client is closed, it needs to remove itself from the map.
-            onClose := func () {
+            onClose := func() {
                 clientMapLock.Lock()
-                delete(clientMap, addr.String())
+                delete(clientMap, key)
                 clientMapLock.Unlock()
             }
 
             client = &genericPacketClient{
-                send_ch, recv_ch,
-                nil, addr,
-                "host", p.network,
-                onClose,
+                send_ch: send_ch, recv_ch: recv_ch,
+                addr: addr,
+                host: "host", net: p.network,
+                onClose: onClose,
+                session: session,
+                closed:  make(chan bool),
             }
             go client.startAsServerConn(p.send_ch)
 
             clientMapLock.Lock()
-            clientMap[addr.String()] = client
+            clientMap[key] = client
             clientMapLock.Unlock()
 
             p.accept_ch <- client
+        } else if p.sessions && addr.String() != client.currentAddr().String() {
+            if !client.roam(addr, data) {
+                continue
+            }
         }
 
-        client.RecvChannel() <- pkt[0:n]
+        select {
+        case client.RecvChannel() <- data:
+        case <-client.closed:
+        }
     }
 }
@@ -0,0 +1,181 @@
+package transports
+
+import (
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// A UDP server, and a client whose packets we send by hand, from whichever
+// address we like.
+type roamTest struct {
+    t         *testing.T
+    server    *net.UDPAddr
+    session   []byte
+    client    *EncryptedPacketClient
+    client_up *roamEnd
+
+    accepted      *genericPacketClient
+    server_client *EncryptedPacketClient
+    lock          sync.Mutex
+
+    // How many times the session has moved.
+    roams int32
+}
+
+// The client's end of the test, which has a session ID but never roams.
+type roamEnd struct {
+    *testEnd
+    session []byte
+}
+
+func (e *roamEnd) SessionID() []byte                           { return e.session }
+func (e *roamEnd) SetRoamVerifier(verify func(pkt []byte) bool) {}
+
+func newRoamTest(t *testing.T) *roamTest {
+    client_map := make(map[string]*genericPacketClient)
+    var client_map_lock sync.RWMutex
+    trans, err := newGenericPacketTransport("udp", "127.0.0.1", 0, true, nil, client_map, &client_map_lock)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    a, b := randomKey(t), randomKey(t)
+    base := randomKey(t)
+    session := []byte("session!")
+
+    up := &roamEnd{&testEnd{make(chan []byte, 16), make(chan []byte, 16), false, make(chan bool), sync.Once{}}, session}
+    client, err := newEncryptedClient(up, &EncryptionOptions{IsClient: true, RekeyInterval: time.Hour},
+        &sessionKeys{send: a, recv: b, base: base[:]}, session)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    r := &roamTest{
+        t:         t,
+        server:    trans.conn.LocalAddr().(*net.UDPAddr),
+        session:   session,
+        client:    client,
+        client_up: up,
+    }
+
+    // The server's side is set up when the first packet arrives, and vouches
+    // for packets from new addresses (which we count).
+    go func() {
+        accepted := (<-trans.AcceptChannel()).(*genericPacketClient)
+        server_client, err := newEncryptedClient(accepted, &EncryptionOptions{},
+            &sessionKeys{send: b, recv: a, base: base[:]}, session)
+        if err != nil {
+            t.Error(err)
+            return
+        }
+        accepted.SetRoamVerifier(func(pkt []byte) bool {
+            if !server_client.verifyPacket(pkt) {
+                return false
+            }
+            atomic.AddInt32(&r.roams, 1)
+            return true
+        })
+
+        r.lock.Lock()
+        r.accepted = accepted
+        r.server_client = server_client
+        r.lock.Unlock()
+    }()
+    return r
+}
+
+// Encrypts a packet as the client would send it.
+func (r *roamTest) seal(msg string) []byte {
+    r.client.SendChannel() <- []byte(msg)
+    return append(append([]byte{}, r.session...), <-r.client_up.send_ch...)
+}
+
+func (r *roamTest) socket() net.PacketConn {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        r.t.Fatal(err)
+    }
+    r.t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+func (r *roamTest) send(from net.PacketConn, pkt []byte) {
+    if _, err := from.WriteTo(pkt, r.server); err != nil {
+        r.t.Fatal(err)
+    }
+}
+
+func (r *roamTest) expect(msg string, from net.PacketConn) {
+    waitFor(r.t, "the server to accept the client", func() bool {
+        r.lock.Lock()
+        defer r.lock.Unlock()
+        return r.server_client != nil
+    })
+    if pkt := recvWithin(r.t, r.server_client, 5*time.Second); string(pkt) != msg {
+        r.t.Fatalf("got %q, expected %q", pkt, msg)
+    }
+    if addr := r.accepted.currentAddr().String(); addr != from.LocalAddr().String() {
+        r.t.Fatalf("session is at %s, expected %s", addr, from.LocalAddr())
+    }
+}
+
+func TestRoamValidPacket(t *testing.T) {
+    r := newRoamTest(t)
+    first, second := r.socket(), r.socket()
+
+    r.send(first, r.seal("from the first address"))
+    r.expect("from the first address", first)
+
+    r.send(second, r.seal("from the second address"))
+    r.expect("from the second address", second)
+    if roams := atomic.LoadInt32(&r.roams); roams != 1 {
+        t.Errorf("session moved %d times", roams)
+    }
+
+    // Replies go to the new address.
+    r.server_client.SendChannel() <- []byte("reply")
+    var buf [2048]byte
+    second.SetReadDeadline(time.Now().Add(5 * time.Second))
+    n, _, err := second.ReadFrom(buf[:])
+    if err != nil {
+        t.Fatalf("no reply at the new address: %s", err)
+    }
+    if n < len(r.session) || string(buf[:len(r.session)]) != string(r.session) {
+        t.Fatal("reply doesn't have the session ID")
+    }
+    r.client_up.recv_ch <- append([]byte{}, buf[len(r.session):n]...)
+    if pkt := recvWithin(t, r.client, 5*time.Second); string(pkt) != "reply" {
+        t.Errorf("got %q, expected reply", pkt)
+    }
+}
+
+// Knowing the session ID isn't enough to take the session, and neither is
+// replaying one of the client's packets.
+func TestRoamForgedOrReplayed(t *testing.T) {
+    r := newRoamTest(t)
+    client, attacker := r.socket(), r.socket()
+
+    r.send(client, r.seal("one"))
+    r.expect("one", client)
+
+    replayed := r.seal("two")
+    r.send(client, replayed)
+    r.expect("two", client)
+
+    forged := append(append([]byte{}, r.session...), make([]byte, 64)...)
+    for _, pkt := range [][]byte{forged, replayed} {
+        r.send(attacker, pkt)
+    }
+
+    // Nothing from the attacker got through, and the session never moved
+    // (the server handles packets in order, so it's seen the attacker's by
+    // the time this arrives).
+    r.send(client, r.seal("three"))
+    r.expect("three", client)
+    if roams := atomic.LoadInt32(&r.roams); roams != 0 {
+        t.Errorf("session moved %d times", roams)
+    }
+}
@@ -0,0 +1,125 @@
+package transports
+
+import (
+    "errors"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+// This adapts a PacketClient to the net.Conn interface, so that we can run
+// other protocols (e.g. DTLS) over one of our transports.  Each Read returns
+// a single packet, and each Write sends a single packet, so the packet
+// boundaries are preserved.
+
+var errDeadlineExceeded = errors.New("i/o timeout")
+
+type packetClientConn struct {
+    client PacketClient
+    local  net.Addr
+    remote net.Addr
+
+    // Whatever's left of a packet that didn't fit into the last Read.
+    pending []byte
+
+    deadline_lock  sync.Mutex
+    read_deadline  time.Time
+    write_deadline time.Time
+}
+
+func newPacketClientConn(client PacketClient, local, remote net.Addr) *packetClientConn {
+    return &packetClientConn{client: client, local: local, remote: remote}
+}
+
+// Returns a channel that fires when the given deadline passes, or nil (which
+// never fires) if there's no deadline.
+func deadlineChannel(deadline time.Time) (<-chan time.Time, *time.Timer) {
+    if deadline.IsZero() {
+        return nil, nil
+    }
+
+    timer := time.NewTimer(deadline.Sub(time.Now()))
+    return timer.C, timer
+}
+
+func (c *packetClientConn) Read(b []byte) (int, error) {
+    if len(c.pending) > 0 {
+        n := copy(b, c.pending)
+        c.pending = c.pending[n:]
+        return n, nil
+    }
+
+    c.deadline_lock.Lock()
+    timeout_ch, timer := deadlineChannel(c.read_deadline)
+    c.deadline_lock.Unlock()
+    if timer != nil {
+        defer timer.Stop()
+    }
+
+    select {
+    case pkt, ok := <-c.client.RecvChannel():
+        if !ok {
+            return 0, io.EOF
+        }
+
+        n := copy(b, pkt)
+        c.pending = pkt[n:]
+        return n, nil
+
+    case <-timeout_ch:
+        return 0, errDeadlineExceeded
+    }
+}
+
+func (c *packetClientConn) Write(b []byte) (int, error) {
+    c.deadline_lock.Lock()
+    timeout_ch, timer := deadlineChannel(c.write_deadline)
+    c.deadline_lock.Unlock()
+    if timer != nil {
+        defer timer.Stop()
+    }
+
+    // The packet might be held on to after we return, so copy it.
+    pkt := append([]byte{}, b...)
+
+    select {
+    case c.client.SendChannel() <- pkt:
+        return len(b), nil
+
+    case <-timeout_ch:
+        return 0, errDeadlineExceeded
+    }
+}
+
+func (c *packetClientConn) Close() error {
+    c.client.Close()
+    return nil
+}
+
+func (c *packetClientConn) LocalAddr() net.Addr {
+    return c.local
+}
+
+func (c *packetClientConn) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+func (c *packetClientConn) SetDeadline(t time.Time) error {
+    c.SetReadDeadline(t)
+    return c.SetWriteDeadline(t)
+}
+
+func (c *packetClientConn) SetReadDeadline(t time.Time) error {
+    c.deadline_lock.Lock()
+    c.read_deadline = t
+    c.deadline_lock.Unlock()
+    return nil
+}
+
+func (c *packetClientConn) SetWriteDeadline(t time.Time) error {
+    c.deadline_lock.Lock()
+    c.write_deadline = t
+    c.deadline_lock.Unlock()
+    return nil
+}
@@ -1,4 +1,5 @@
 // +build darwin
+
 package transports
 
 // This file contains Darwin-specific code.
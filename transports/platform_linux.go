@@ -1,4 +1,5 @@
 // +build linux
+
 package transports
 
 // This file contains Linux-specific code.
@@ -0,0 +1,237 @@
+package transports
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// This file implements the receiving side of the PROXY protocol (versions 1
+// and 2), as spoken by HAProxy and most cloud load balancers.  When a server
+// is behind a load balancer, every connection appears to come from the load
+// balancer - the PROXY protocol header, which the load balancer sends before
+// any other data, tells us who the real client is.
+//
+// We only look for a header on connections from trusted addresses, since
+// otherwise anyone could claim to be anyone else.  Connections from other
+// addresses are treated as direct connections.
+//
+// See: http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest possible v1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// How long the load balancer has to send the header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// A connection whose remote address has been replaced with the one given in
+// the PROXY header.
+type proxiedConn struct {
+    net.Conn
+    remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+// Parses a list of comma-seperated IP addresses or CIDR ranges.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+    var ret []*net.IPNet
+    for _, part := range strings.Split(s, ",") {
+        part = strings.TrimSpace(part)
+        if len(part) == 0 {
+            continue
+        }
+
+        if !strings.Contains(part, "/") {
+            ip := net.ParseIP(part)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid address: %s", part)
+            }
+
+            bits := 128
+            if ip.To4() != nil {
+                ip = ip.To4()
+                bits = 32
+            }
+            ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+
+        _, ipnet, err := net.ParseCIDR(part)
+        if err != nil {
+            return nil, err
+        }
+        ret = append(ret, ipnet)
+    }
+    return ret, nil
+}
+
+func isTrustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+    tcp_addr, ok := addr.(*net.TCPAddr)
+    if !ok {
+        return false
+    }
+
+    for _, ipnet := range trusted {
+        if ipnet.Contains(tcp_addr.IP) {
+            return true
+        }
+    }
+    return false
+}
+
+// If the connection comes from a trusted proxy, reads the PROXY header and
+// returns a connection that reports the real client's address.  Connections
+// from anywhere else are returned unchanged.
+func acceptProxied(conn net.Conn, trusted []*net.IPNet) (net.Conn, error) {
+    if !isTrustedProxy(conn.RemoteAddr(), trusted) {
+        return conn, nil
+    }
+
+    conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+    addr, err := readProxyHeader(conn)
+    conn.SetReadDeadline(time.Time{})
+    if err != nil {
+        return nil, fmt.Errorf("bad PROXY header from %s: %s", conn.RemoteAddr(), err)
+    }
+
+    // The proxy can tell us that the connection didn't come from a client
+    // (e.g. it's a health check), in which case we keep the proxy's address.
+    if addr == nil {
+        return conn, nil
+    }
+    return &proxiedConn{conn, addr}, nil
+}
+
+// Reads a v1 or v2 header, returning the source address, or nil if the header
+// doesn't contain one.  We're careful not to read past the end of the header,
+// so the connection can be used as-is afterwards.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+    // Both versions' headers are at least this long - the shortest possible
+    // v1 header is "PROXY UNKNOWN\r\n".
+    start := make([]byte, len(proxyV2Signature))
+    if _, err := io.ReadFull(r, start); err != nil {
+        return nil, err
+    }
+
+    if bytes.Equal(start, proxyV2Signature) {
+        return readProxyV2(r)
+    }
+    if bytes.HasPrefix(start, []byte("PROXY ")) {
+        return readProxyV1(r, start)
+    }
+    return nil, fmt.Errorf("no PROXY header found")
+}
+
+func readProxyV1(r io.Reader, start []byte) (net.Addr, error) {
+    line := start
+    var b [1]byte
+    for !bytes.HasSuffix(line, []byte("\r\n")) {
+        if len(line) >= proxyV1MaxLen {
+            return nil, fmt.Errorf("v1 header is too long")
+        }
+        if _, err := io.ReadFull(r, b[:]); err != nil {
+            return nil, err
+        }
+        line = append(line, b[0])
+    }
+
+    // PROXY TCP4 <src> <dst> <srcport> <dstport>
+    fields := strings.Split(string(line[:len(line)-2]), " ")
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return nil, nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, fmt.Errorf("malformed v1 header")
+    }
+
+    ip := net.ParseIP(fields[2])
+    port, err := strconv.ParseUint(fields[4], 10, 16)
+    if ip == nil || err != nil {
+        return nil, fmt.Errorf("malformed v1 source address")
+    }
+    if _, err = strconv.ParseUint(fields[5], 10, 16); err != nil {
+        return nil, fmt.Errorf("malformed v1 destination port")
+    }
+
+    // Both addresses must be of the family the header says.
+    for _, addr := range fields[2:4] {
+        if !proxyV1Family(fields[1], addr) {
+            return nil, fmt.Errorf("v1 address %s is not %s", addr, fields[1])
+        }
+    }
+    return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func proxyV1Family(family, addr string) bool {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false
+    }
+    if family == "TCP4" {
+        return ip.To4() != nil && !strings.Contains(addr, ":")
+    }
+    return strings.Contains(addr, ":")
+}
+
+func readProxyV2(r io.Reader) (net.Addr, error) {
+    var hdr [4]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return nil, err
+    }
+
+    ver_cmd := hdr[0]
+    family := hdr[1]
+    length := binary.BigEndian.Uint16(hdr[2:])
+
+    if ver_cmd>>4 != 2 {
+        return nil, fmt.Errorf("unknown v2 version %d", ver_cmd>>4)
+    }
+
+    // We always read the whole address block (which includes any TLVs),
+    // even if we don't use it.
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+
+    // LOCAL connections are health checks from the proxy itself.
+    switch ver_cmd & 0x0F {
+    case 0x0:
+        return nil, nil
+    case 0x1:
+    default:
+        return nil, fmt.Errorf("unknown v2 command %d", ver_cmd&0x0F)
+    }
+
+    switch family >> 4 {
+    case 0x1:
+        if len(body) < 12 {
+            return nil, fmt.Errorf("v2 IPv4 address block is too short")
+        }
+        ip := net.IP(append([]byte{}, body[0:4]...))
+        port := binary.BigEndian.Uint16(body[8:10])
+        return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+
+    case 0x2:
+        if len(body) < 36 {
+            return nil, fmt.Errorf("v2 IPv6 address block is too short")
+        }
+        ip := net.IP(append([]byte{}, body[0:16]...))
+        port := binary.BigEndian.Uint16(body[32:34])
+        return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+    }
+
+    // Unspecified or Unix socket addresses - there's nothing useful we can
+    // do with these, so keep the proxy's address.
+    return nil, nil
+}
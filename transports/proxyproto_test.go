@@ -0,0 +1,200 @@
+package transports
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "net"
+    "strings"
+    "testing"
+)
+
+// Builds a v2 header.
+func proxyV2(ver_cmd, family byte, body []byte) []byte {
+    hdr := append([]byte{}, proxyV2Signature...)
+    hdr = append(hdr, ver_cmd, family, 0, 0)
+    binary.BigEndian.PutUint16(hdr[len(hdr)-2:], uint16(len(body)))
+    return append(hdr, body...)
+}
+
+func proxyV2Addrs(src, dst net.IP, src_port, dst_port uint16) []byte {
+    body := append(append([]byte{}, src...), dst...)
+    var ports [4]byte
+    binary.BigEndian.PutUint16(ports[:], src_port)
+    binary.BigEndian.PutUint16(ports[2:], dst_port)
+    return append(body, ports[:]...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+    v4 := proxyV2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4(), 1234, 443)
+    v6 := proxyV2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 1234, 443)
+    tlv := append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0xFF)
+
+    tests := []struct {
+        name     string
+        header   string
+        expected string // the source address, or "" for none
+        err      bool
+    }{
+        {"v1 IPv4", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\n", "192.0.2.1:1234", false},
+        {"v1 IPv6", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", "[2001:db8::1]:1234", false},
+        {"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+        {"v1 unknown with addresses", "PROXY UNKNOWN ::1 ::1 1 2\r\n", "", false},
+        {"v1 IPv6 as TCP4", "PROXY TCP4 2001:db8::1 192.0.2.2 1234 443\r\n", "", true},
+        {"v1 IPv4 as TCP6", "PROXY TCP6 192.0.2.1 2001:db8::2 1234 443\r\n", "", true},
+        {"v1 mapped IPv4 as TCP4", "PROXY TCP4 ::ffff:192.0.2.1 192.0.2.2 1234 443\r\n", "", true},
+        {"v1 destination family", "PROXY TCP4 192.0.2.1 2001:db8::2 1234 443\r\n", "", true},
+        {"v1 unknown family", "PROXY UDP4 192.0.2.1 192.0.2.2 1234 443\r\n", "", true},
+        {"v1 missing port", "PROXY TCP4 192.0.2.1 192.0.2.2 1234\r\n", "", true},
+        {"v1 bad address", "PROXY TCP4 192.0.2 192.0.2.2 1234 443\r\n", "", true},
+        {"v1 bad source port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n", "", true},
+        {"v1 bad destination port", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 https\r\n", "", true},
+        {"v1 truncated", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443", "", true},
+        {"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+        {"v2 IPv4", string(proxyV2(0x21, 0x11, v4)), "192.0.2.1:1234", false},
+        {"v2 IPv6", string(proxyV2(0x21, 0x21, v6)), "[2001:db8::1]:1234", false},
+        {"v2 with TLVs", string(proxyV2(0x21, 0x11, tlv)), "192.0.2.1:1234", false},
+        {"v2 local", string(proxyV2(0x20, 0x00, nil)), "", false},
+        {"v2 local with addresses", string(proxyV2(0x20, 0x11, v4)), "", false},
+        {"v2 unspecified family", string(proxyV2(0x21, 0x00, nil)), "", false},
+        {"v2 unix", string(proxyV2(0x21, 0x31, make([]byte, 216))), "", false},
+        {"v2 short IPv4 block", string(proxyV2(0x21, 0x11, v4[:8])), "", true},
+        {"v2 short IPv6 block", string(proxyV2(0x21, 0x21, v6[:32])), "", true},
+        {"v2 IPv4 block as IPv6", string(proxyV2(0x21, 0x21, v4)), "", true},
+        {"v2 bad version", string(proxyV2(0x11, 0x11, v4)), "", true},
+        {"v2 bad command", string(proxyV2(0x22, 0x11, v4)), "", true},
+        {"v2 truncated header", string(proxyV2(0x21, 0x11, v4)[:14]), "", true},
+        {"v2 truncated body", string(proxyV2(0x21, 0x11, v4)[:20]), "", true},
+        {"no header", "GET / HTTP/1.1\r\n\r\n", "", true},
+        {"too short", "PROXY", "", true},
+    }
+
+    for _, test := range tests {
+        // Whatever follows the header must be left for the client.
+        r := bytes.NewReader([]byte(test.header + "data"))
+        addr, err := readProxyHeader(r)
+        if test.err {
+            if err == nil {
+                t.Errorf("%s: no error", test.name)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err)
+            continue
+        }
+
+        if test.expected == "" {
+            if addr != nil {
+                t.Errorf("%s: got %s, expected no address", test.name, addr)
+            }
+        } else if addr == nil || addr.String() != test.expected {
+            t.Errorf("%s: got %v, expected %s", test.name, addr, test.expected)
+        }
+
+        if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+            t.Errorf("%s: %q left after the header", test.name, rest)
+        }
+    }
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+    trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.5,,2001:db8::/32, ::1")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        ip      string
+        trusted bool
+    }{
+        {"10.1.2.3", true},
+        {"11.0.0.1", false},
+        {"192.168.1.5", true},
+        {"192.168.1.6", false},
+        {"2001:db8::7", true},
+        {"2001:db9::7", false},
+        {"::1", true},
+    }
+    for _, test := range tests {
+        addr := &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1}
+        if isTrustedProxy(addr, trusted) != test.trusted {
+            t.Errorf("%s: trusted != %v", test.ip, test.trusted)
+        }
+    }
+
+    if isTrustedProxy(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, trusted) {
+        t.Error("trusted a UDP address")
+    }
+
+    for _, bad := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+        if _, err := ParseTrustedProxies(bad); err == nil {
+            t.Errorf("%s: no error", bad)
+        }
+    }
+}
+
+// A pipe that looks like it comes from the given address.
+type addrConn struct {
+    net.Conn
+    remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func acceptProxiedFrom(t *testing.T, from string, data string) (net.Conn, error) {
+    ours, theirs := net.Pipe()
+    t.Cleanup(func() {
+        ours.Close()
+        theirs.Close()
+    })
+    go func() {
+        theirs.Write([]byte(data))
+    }()
+
+    trusted, _ := ParseTrustedProxies("10.0.0.1")
+    conn := &addrConn{ours, &net.TCPAddr{IP: net.ParseIP(from), Port: 5000}}
+    return acceptProxied(conn, trusted)
+}
+
+func TestAcceptProxied(t *testing.T) {
+    header := "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\n"
+
+    conn, err := acceptProxiedFrom(t, "10.0.0.1", header+"x")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if conn.RemoteAddr().String() != "192.0.2.1:1234" {
+        t.Errorf("proxied connection is from %s", conn.RemoteAddr())
+    }
+    var b [1]byte
+    if _, err := conn.Read(b[:]); err != nil || b[0] != 'x' {
+        t.Errorf("read %q, %v after the header", b, err)
+    }
+
+    // Anyone else can't claim an address, and their data is left alone.
+    conn, err = acceptProxiedFrom(t, "10.0.0.2", header)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if conn.RemoteAddr().String() != "10.0.0.2:5000" {
+        t.Errorf("untrusted connection is from %s", conn.RemoteAddr())
+    }
+    if _, err := conn.Read(b[:]); err != nil || b[0] != 'P' {
+        t.Errorf("read %q, %v from an untrusted connection", b, err)
+    }
+
+    // Health checks keep the proxy's address.
+    conn, err = acceptProxiedFrom(t, "10.0.0.1", string(proxyV2(0x20, 0x00, nil)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if conn.RemoteAddr().String() != "10.0.0.1:5000" {
+        t.Errorf("LOCAL connection is from %s", conn.RemoteAddr())
+    }
+
+    // A trusted proxy must send a header.
+    if _, err = acceptProxiedFrom(t, "10.0.0.1", "GET / HTTP/1.1\r\n\r\n"); err == nil {
+        t.Error("accepted a connection from a proxy without a header")
+    }
+}
@@ -0,0 +1,303 @@
+package transports
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "time"
+)
+
+// This file implements the parent side of the Tor pluggable transport (PT)
+// managed proxy protocol, version 1.  This lets us use any existing pluggable
+// transport (obfs4proxy, meek, snowflake...) as an outer layer: we start the
+// transport's binary, and it tells us where its SOCKS5 proxy (client) or
+// listener (server) is.  On the client, we connect to the server through the
+// SOCKS5 proxy, and then speak our normal TCP framing over the connection.
+// On the server, the transport forwards connections to our TCP listener.
+//
+// See: https://gitweb.torproject.org/torspec.git/tree/pt-spec.txt
+
+// The default port that the server asks its pluggable transport to listen on.
+const PT_PORT = 44465
+
+// How long the transport has to start up.
+const ptStartTimeout = 30 * time.Second
+
+type ManagedPT struct {
+    cmd   *exec.Cmd
+    stdin io.WriteCloser
+    name  string
+
+    // The address of the transport's SOCKS proxy (client), or the address
+    // it's listening on (server).
+    Addr string
+
+    // Server only: the arguments that clients need to connect, e.g. obfs4's
+    // certificate.  These are in the same "k=v,k=v" format as a bridge line.
+    Args string
+}
+
+// Starts a pluggable transport binary in client mode.
+func StartPTClient(bin, name, state_dir string) (*ManagedPT, error) {
+    env := []string{"TOR_PT_CLIENT_TRANSPORTS=" + name}
+    return startPT(bin, name, state_dir, env, "CMETHOD")
+}
+
+// Starts a pluggable transport binary in server mode.  It will listen on bind,
+// and forward connections to orport.
+func StartPTServer(bin, name, bind, orport, state_dir string) (*ManagedPT, error) {
+    env := []string{
+        "TOR_PT_SERVER_TRANSPORTS=" + name,
+        "TOR_PT_SERVER_BINDADDR=" + name + "-" + bind,
+        "TOR_PT_ORPORT=" + orport,
+    }
+    return startPT(bin, name, state_dir, env, "SMETHOD")
+}
+
+func startPT(bin, name, state_dir string, env []string, method string) (*ManagedPT, error) {
+    if len(state_dir) == 0 {
+        return nil, fmt.Errorf("no state directory for the pluggable transport")
+    }
+    if err := os.MkdirAll(state_dir, 0700); err != nil {
+        return nil, err
+    }
+
+    // The transport keeps its private keys here, so nobody else should be
+    // able to read them, or swap in their own.
+    info, err := os.Lstat(state_dir)
+    if err != nil {
+        return nil, err
+    }
+    if !info.IsDir() {
+        return nil, fmt.Errorf("pluggable transport state %s is not a directory", state_dir)
+    }
+    if info.Mode().Perm()&0077 != 0 {
+        return nil, fmt.Errorf("permissions %#o for %s are too open", info.Mode().Perm(), state_dir)
+    }
+
+    cmd := exec.Command(bin)
+    cmd.Env = append(os.Environ(), env...)
+    cmd.Env = append(cmd.Env,
+        "TOR_PT_MANAGED_TRANSPORT_VER=1",
+        "TOR_PT_STATE_LOCATION="+state_dir,
+        "TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+    )
+    cmd.Stderr = os.Stderr
+
+    // We never write anything to stdin, but closing it tells the transport
+    // to exit.
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err = cmd.Start(); err != nil {
+        return nil, err
+    }
+
+    pt := &ManagedPT{cmd: cmd, stdin: stdin, name: name}
+
+    done := make(chan error, 1)
+    go pt.readOutput(stdout, method, done)
+
+    select {
+    case err = <-done:
+    case <-time.After(ptStartTimeout):
+        err = fmt.Errorf("timed out waiting for transport to start")
+    }
+    if err != nil {
+        pt.Close()
+        return nil, fmt.Errorf("pluggable transport %s: %s", bin, err)
+    }
+
+    log.Printf("Pluggable transport %s is ready on %s\n", name, pt.Addr)
+    return pt, nil
+}
+
+// Reads the transport's output.  We report the result of starting up on done,
+// and then carry on logging anything else it has to say.
+func (pt *ManagedPT) readOutput(stdout io.Reader, method string, done chan error) {
+    scanner := bufio.NewScanner(stdout)
+    started := false
+    finish := func(err error) {
+        if !started {
+            started = true
+            done <- err
+        }
+    }
+
+    for scanner.Scan() {
+        line := scanner.Text()
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+
+        switch fields[0] {
+        case "VERSION":
+            if len(fields) < 2 || fields[1] != "1" {
+                finish(fmt.Errorf("unsupported version: %s", line))
+            }
+
+        case "VERSION-ERROR", "ENV-ERROR", method + "-ERROR":
+            finish(fmt.Errorf("%s", line))
+
+        case method:
+            // CMETHOD <name> socks5 <addr>
+            // SMETHOD <name> <addr> [ARGS:k=v,k=v]
+            if len(fields) < 3 || fields[1] != pt.name {
+                continue
+            }
+
+            if method == "CMETHOD" {
+                if len(fields) < 4 || fields[2] != "socks5" {
+                    finish(fmt.Errorf("unsupported proxy type: %s", line))
+                    continue
+                }
+                pt.Addr = fields[3]
+            } else {
+                pt.Addr = fields[2]
+                for _, opt := range fields[3:] {
+                    if strings.HasPrefix(opt, "ARGS:") {
+                        pt.Args = strings.TrimPrefix(opt, "ARGS:")
+                    }
+                }
+            }
+
+        case method + "S":
+            // CMETHODS DONE / SMETHODS DONE
+            if len(pt.Addr) == 0 {
+                finish(fmt.Errorf("transport %s was not started", pt.name))
+            }
+            finish(nil)
+
+        default:
+            log.Printf("[%s] %s\n", pt.name, line)
+        }
+    }
+
+    finish(fmt.Errorf("transport exited"))
+}
+
+// Connects to target through the transport, passing the given arguments
+// (e.g. "cert=...;iat-mode=0"), and returns a client that speaks our normal
+// TCP framing over the connection.  opts can be nil.
+func (pt *ManagedPT) Dial(target, args string, opts *TCPOptions) (*TCPPacketClient, error) {
+    conn, err := DialSOCKS5(pt.Addr, target, args)
+    if err != nil {
+        return nil, err
+    }
+    return startTcpClient(target, conn, opts)
+}
+
+// Stops the transport.
+func (pt *ManagedPT) Close() {
+    // Closing stdin asks it to exit; if it doesn't, we make it.
+    pt.stdin.Close()
+
+    exited := make(chan bool, 1)
+    go func() {
+        pt.cmd.Wait()
+        exited <- true
+    }()
+
+    select {
+    case <-exited:
+    case <-time.After(5 * time.Second):
+        pt.cmd.Process.Kill()
+    }
+}
+
+// --------------------------------------------------------------------------------
+
+// Parses pluggable transport arguments, which look like "k=v;k=v" (with
+// backslash escapes).  sep is the seperator between pairs.
+func ParsePTArgs(s string, sep byte) map[string]string {
+    ret := make(map[string]string)
+
+    var key, cur []byte
+    in_value := false
+    for i := 0; i <= len(s); i++ {
+        if i == len(s) || s[i] == sep {
+            if in_value {
+                ret[string(key)] = string(cur)
+            } else if len(cur) > 0 {
+                ret[string(cur)] = ""
+            }
+            key, cur, in_value = nil, nil, false
+            continue
+        }
+
+        switch {
+        case s[i] == '\\' && i+1 < len(s):
+            i++
+            cur = append(cur, s[i])
+        case s[i] == '=' && !in_value:
+            key, cur, in_value = cur, nil, true
+        default:
+            cur = append(cur, s[i])
+        }
+    }
+
+    return ret
+}
+
+// Copies data between a stream and a reliable packet client, until either
+// side closes.
+func SpliceStream(conn net.Conn, client PacketClient) {
+    var once sync.Once
+    done := make(chan bool)
+    finish := func() {
+        once.Do(func() { close(done) })
+    }
+
+    go func() {
+        // Packets need to fit in a uint16 length, so stay well under that.
+        buf := make([]byte, 16*1024)
+        for {
+            n, err := conn.Read(buf)
+            if n > 0 {
+                select {
+                case client.SendChannel() <- append([]byte{}, buf[:n]...):
+                case <-done:
+                    return
+                }
+            }
+            if err != nil {
+                finish()
+                return
+            }
+        }
+    }()
+
+    go func() {
+        for {
+            select {
+            case pkt, ok := <-client.RecvChannel():
+                if !ok {
+                    finish()
+                    return
+                }
+                if _, err := conn.Write(pkt); err != nil {
+                    finish()
+                    return
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    <-done
+    conn.Close()
+    client.Close()
+}
@@ -0,0 +1,353 @@
+package transports
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "log"
+    "time"
+
+    "github.com/flynn/noise"
+)
+
+// Rekeying.  So that no one key is used for too long (or for too much data),
+// the client asks for new keys every so often, by doing a fresh
+// Diffie-Hellman exchange inside the encrypted connection:
+//
+//          Client                          Server
+//      [rekey init] [ephemeral key]  -->
+//                                    <--   [rekey ack] [ephemeral key]
+//      [rekey done]                  -->
+//
+// The new keys come from the result of that exchange, mixed with the hash of
+// the handshake (or, after the first rekey, with a value derived from the
+// last one).  The exchange is sent over the encrypted connection, so it's as
+// well authenticated as the keys it replaces, and since the ephemeral keys
+// are thrown away, getting hold of the new keys doesn't help with traffic
+// that was sent under the old ones.
+//
+// The server starts accepting the new key as soon as it gets the init, and
+// sends the ack under the old key.  It keeps sending under the old key until
+// the first packet under the new one arrives from the client, since until
+// then, it can't know that the client has the ack.  The client switches both
+// ways when it gets the ack, and sends "rekey done" under the new key so
+// that the server switches straight away, even if there's no other traffic.
+//
+// Each side keeps the old receive key until the other end starts using the
+// new one, and for a little while after that, so that packets which were
+// already on their way (or were reordered) still get through, and nothing
+// has to wait for the exchange to finish.
+//
+// If the ack goes missing, the client sends the same init again; the server
+// answers it with the same ack, under the old key.
+//
+// If the layer above pads its packets (see shaping.go), it tells us how, and
+// these messages are padded the same way, so that they look like any other
+// packet.  Anything after the key is padding.
+
+const (
+    msgData      = 0x00
+    msgRekeyInit = 0x01
+    msgRekeyAck  = 0x02
+    msgRekeyDone = 0x03
+)
+
+const (
+    DefaultRekeyInterval = 2 * time.Minute
+    DefaultRekeyBytes    = 1 << 30
+)
+
+// The length of the ephemeral keys in rekey messages.
+const rekeyKeyLen = 32
+
+// How long to keep accepting the old key after the other end has switched to
+// the new one.
+const rekeyOverlap = 30 * time.Second
+
+// How long to wait for an ack before sending the init again.
+const rekeyRetry = 5 * time.Second
+
+// How often the client checks whether it's time to rekey.
+const rekeyCheckInterval = time.Second
+
+// A control message for doSend: kind and payload are encrypted as usual (with
+// the previous send key, if use_prev is set).  Raw messages are sent as they
+// are, without encryption.
+type ctrlMessage struct {
+    kind     byte
+    payload  []byte
+    use_prev bool
+    raw      bool
+}
+
+type rekeyState struct {
+    // What the next keys are derived from.
+    base []byte
+
+    // When we got the current keys, and how much we've sent and received
+    // with them.
+    keyed_at time.Time
+    bytes    uint64
+
+    // Client only: the exchange we're waiting on, if any.
+    pending *noise.DHKey
+    sent_at time.Time
+
+    // Server only: the last exchange, and the send key from before it, in
+    // case the client asks again.
+    last_init []byte
+    last_ack  []byte
+    prev_send encryptionMode
+
+    // Server only: the new send key, until the client starts using the new
+    // keys.
+    next_send encryptionMode
+}
+
+func (r *rekeyState) reset(base []byte) {
+    r.base = base
+    r.keyed_at = time.Now()
+    r.bytes = 0
+    r.pending = nil
+}
+
+func (o *EncryptionOptions) rekeyInterval() time.Duration {
+    if o.RekeyInterval > 0 {
+        return o.RekeyInterval
+    }
+    return DefaultRekeyInterval
+}
+
+func (o *EncryptionOptions) rekeyBytes() uint64 {
+    if o.RekeyBytes > 0 {
+        return o.RekeyBytes
+    }
+    return DefaultRekeyBytes
+}
+
+// HKDF with HMAC-SHA256, as in RFC 5869.
+func hkdf(salt, secret, info []byte, length int) []byte {
+    extract := hmac.New(sha256.New, salt)
+    extract.Write(secret)
+    prk := extract.Sum(nil)
+
+    var out, block []byte
+    for i := byte(1); len(out) < length; i++ {
+        expand := hmac.New(sha256.New, prk)
+        expand.Write(block)
+        expand.Write(info)
+        expand.Write([]byte{i})
+        block = expand.Sum(nil)
+        out = append(out, block...)
+    }
+    return out[:length]
+}
+
+// Works out the next keys from an exchange.
+func deriveRekey(base []byte, local noise.DHKey, remote []byte, is_client bool) (*sessionKeys, error) {
+    shared, err := noise.DH25519.DH(local.Private, remote)
+    if err != nil {
+        return nil, err
+    }
+
+    client_pub, server_pub := local.Public, remote
+    if !is_client {
+        client_pub, server_pub = remote, local.Public
+    }
+    info := append([]byte("holepunch rekey"), client_pub...)
+    info = append(info, server_pub...)
+
+    out := hkdf(base, shared, info, 96)
+    keys := &sessionKeys{base: out[64:]}
+    if is_client {
+        copy(keys.send[:], out[:32])
+        copy(keys.recv[:], out[32:64])
+    } else {
+        copy(keys.send[:], out[32:64])
+        copy(keys.recv[:], out[:32])
+    }
+    return keys, nil
+}
+
+// Sets how to pad control messages: pad returns how long a payload of the
+// given size should be.  The layer above calls this with the padding it uses
+// for its own packets.
+func (c *EncryptedPacketClient) SetControlPadding(pad func(size int) int) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.ctrl_pad = pad
+}
+
+func (c *EncryptedPacketClient) padControl(payload []byte) []byte {
+    c.lock.Lock()
+    pad := c.ctrl_pad
+    c.lock.Unlock()
+
+    if pad == nil {
+        return payload
+    }
+    size := pad(len(payload))
+    if size <= len(payload) {
+        return payload
+    }
+    padded := make([]byte, size)
+    copy(padded, payload)
+    return padded
+}
+
+// Strips any padding from a rekey message's key.
+func rekeyKey(payload []byte) []byte {
+    if len(payload) > rekeyKeyLen {
+        return payload[:rekeyKeyLen]
+    }
+    return payload
+}
+
+// Client only: returns an init to send, if it's time to rekey (or time to
+// ask again).
+func (c *EncryptedPacketClient) checkRekey() []byte {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    now := time.Now()
+    if c.rekey.pending != nil {
+        if now.Sub(c.rekey.sent_at) < rekeyRetry {
+            return nil
+        }
+        log.Printf("No reply to rekey, trying again\n")
+        c.rekey.sent_at = now
+        return c.rekey.pending.Public
+    }
+
+    if now.Sub(c.rekey.keyed_at) < c.opts.rekeyInterval() && c.rekey.bytes < c.opts.rekeyBytes() {
+        return nil
+    }
+
+    kp, err := noise.DH25519.GenerateKeypair(rand.Reader)
+    if err != nil {
+        log.Printf("Error generating rekey keypair: %s\n", err)
+        return nil
+    }
+    c.rekey.pending = &kp
+    c.rekey.sent_at = now
+    return kp.Public
+}
+
+// Switches to new receive keys.  The old ones are kept until the other end
+// starts using the new ones (see newEpochSeen), and for a while after that.
+func (c *EncryptedPacketClient) installRecv(mode encryptionMode) {
+    c.prev_recv = c.recv_mode
+    c.prev_epoch = c.recv_epoch
+    c.prev_open = true
+    c.recv_mode = mode
+    c.recv_epoch++
+}
+
+// Called with the lock held when a genuine packet arrives under the current
+// receive key.  If the other end has only just started using it, the old
+// key's time is now limited, and (on the server) it's safe to start sending
+// under the new key.
+func (c *EncryptedPacketClient) newEpochSeen() {
+    if c.prev_open {
+        c.prev_open = false
+        c.prev_until = time.Now().Add(rekeyOverlap)
+    }
+
+    if c.rekey.next_send != nil {
+        c.rekey.prev_send = c.send_mode
+        c.send_mode = c.rekey.next_send
+        c.send_epoch++
+        c.rekey.next_send = nil
+    }
+}
+
+// Server only.
+func (c *EncryptedPacketClient) handleRekeyInit(payload []byte, epoch byte) {
+    if c.opts.IsClient {
+        log.Printf("Got rekey init from the server, ignoring\n")
+        return
+    }
+
+    c.lock.Lock()
+    if epoch != c.recv_epoch {
+        // The client didn't get our ack.  If we haven't switched our send
+        // key yet, the old key is still the current one.
+        var ack []byte
+        use_prev := c.rekey.next_send == nil
+        if epoch == c.prev_epoch && bytes.Equal(payload, c.rekey.last_init) {
+            ack = c.rekey.last_ack
+            c.prev_until = time.Now().Add(rekeyOverlap)
+        }
+        c.lock.Unlock()
+
+        if ack != nil {
+            c.ctrl_ch <- ctrlMessage{msgRekeyAck, ack, use_prev, false}
+        }
+        return
+    }
+
+    kp, err := noise.DH25519.GenerateKeypair(rand.Reader)
+    if err != nil {
+        c.lock.Unlock()
+        log.Printf("Error generating rekey keypair: %s\n", err)
+        return
+    }
+    keys, err := deriveRekey(c.rekey.base, kp, payload, false)
+    if err != nil {
+        c.lock.Unlock()
+        log.Printf("Invalid rekey from client: %s\n", err)
+        return
+    }
+    send_mode, recv_mode, err := makeModes(c.underlying.IsReliable(), keys)
+    if err != nil {
+        c.lock.Unlock()
+        log.Printf("Error rekeying: %s\n", err)
+        return
+    }
+
+    c.installRecv(recv_mode)
+    c.rekey.reset(keys.base)
+    c.rekey.last_init = append([]byte{}, payload...)
+    c.rekey.last_ack = kp.Public
+    c.rekey.next_send = send_mode
+    c.lock.Unlock()
+
+    // The ack goes out under the old key, and so does everything else until
+    // the client shows it has the new one.
+    c.ctrl_ch <- ctrlMessage{msgRekeyAck, kp.Public, false, false}
+    log.Printf("Rekeyed session\n")
+}
+
+// Client only.
+func (c *EncryptedPacketClient) handleRekeyAck(payload []byte, epoch byte) {
+    c.lock.Lock()
+    if !c.opts.IsClient || c.rekey.pending == nil || epoch != c.recv_epoch {
+        // Probably a repeat of one we've already had.
+        c.lock.Unlock()
+        return
+    }
+
+    keys, err := deriveRekey(c.rekey.base, *c.rekey.pending, payload, true)
+    if err != nil {
+        c.lock.Unlock()
+        log.Printf("Invalid rekey from server: %s\n", err)
+        return
+    }
+    send_mode, recv_mode, err := makeModes(c.underlying.IsReliable(), keys)
+    if err != nil {
+        c.lock.Unlock()
+        log.Printf("Error rekeying: %s\n", err)
+        return
+    }
+
+    c.send_mode = send_mode
+    c.send_epoch++
+    c.installRecv(recv_mode)
+    c.rekey.reset(keys.base)
+    c.lock.Unlock()
+
+    // Tell the server we've switched, under the new key.
+    c.ctrl_ch <- ctrlMessage{msgRekeyDone, nil, false, false}
+    log.Printf("Rekeyed session\n")
+}
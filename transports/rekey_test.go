@@ -0,0 +1,265 @@
+package transports
+
+import (
+    "bytes"
+    "crypto/rand"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/flynn/noise"
+)
+
+// One end of an in-memory link.
+type testEnd struct {
+    send_ch  chan []byte
+    recv_ch  chan []byte
+    reliable bool
+
+    closed     chan bool
+    close_once sync.Once
+}
+
+func (e *testEnd) SendChannel() chan []byte { return e.send_ch }
+func (e *testEnd) RecvChannel() chan []byte { return e.recv_ch }
+func (e *testEnd) IsReliable() bool         { return e.reliable }
+func (e *testEnd) Describe() string         { return "testEnd" }
+
+func (e *testEnd) Close() {
+    e.close_once.Do(func() { close(e.closed) })
+}
+
+// Connects two ends.  Packets in either direction can be dropped by setting
+// drop_up (client to server) or drop_down, and dropped counts them.
+type testLink struct {
+    client, server *testEnd
+    drop_up        int32
+    drop_down      int32
+    dropped        int32
+}
+
+func newTestLink(reliable bool) *testLink {
+    end := func() *testEnd {
+        return &testEnd{make(chan []byte), make(chan []byte), reliable, make(chan bool), sync.Once{}}
+    }
+    link := &testLink{client: end(), server: end()}
+    go link.forward(link.client, link.server, &link.drop_up)
+    go link.forward(link.server, link.client, &link.drop_down)
+    return link
+}
+
+func (l *testLink) forward(from, to *testEnd, drop *int32) {
+    for {
+        select {
+        case pkt := <-from.send_ch:
+            if atomic.LoadInt32(drop) != 0 {
+                atomic.AddInt32(&l.dropped, 1)
+                continue
+            }
+            select {
+            case to.recv_ch <- pkt:
+            case <-to.closed:
+                return
+            }
+        case <-from.closed:
+            return
+        }
+    }
+}
+
+func randomKey(t *testing.T) [32]byte {
+    var key [32]byte
+    if _, err := rand.Read(key[:]); err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+// Starts a client and server that share keys, as if they'd done a handshake.
+func newTestEncryptedPair(t *testing.T, link *testLink) (*EncryptedPacketClient, *EncryptedPacketClient) {
+    a, b := randomKey(t), randomKey(t)
+    base := randomKey(t)
+
+    client, err := newEncryptedClient(link.client, &EncryptionOptions{IsClient: true, RekeyInterval: time.Hour},
+        &sessionKeys{send: a, recv: b, base: base[:]}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server, err := newEncryptedClient(link.server, &EncryptionOptions{},
+        &sessionKeys{send: b, recv: a, base: base[:]}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return client, server
+}
+
+func epochs(c *EncryptedPacketClient) (byte, byte) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.send_epoch, c.recv_epoch
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func sendAndCheck(t *testing.T, from, to PacketClient, msg string) {
+    from.SendChannel() <- []byte(msg)
+    if pkt := recvWithin(t, to, 5*time.Second); string(pkt) != msg {
+        t.Fatalf("got %q, expected %q", pkt, msg)
+    }
+}
+
+// Starts a rekey from the client, as if it were time to.
+func startRekey(c *EncryptedPacketClient) []byte {
+    c.lock.Lock()
+    c.rekey.keyed_at = time.Time{}
+    c.lock.Unlock()
+
+    init := c.checkRekey()
+    c.ctrl_ch <- ctrlMessage{msgRekeyInit, init, false, false}
+    return init
+}
+
+func TestDeriveRekey(t *testing.T) {
+    base := randomKey(t)
+    client_kp, _ := noise.DH25519.GenerateKeypair(rand.Reader)
+    server_kp, _ := noise.DH25519.GenerateKeypair(rand.Reader)
+
+    client, err := deriveRekey(base[:], client_kp, server_kp.Public, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server, err := deriveRekey(base[:], server_kp, client_kp.Public, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if client.send != server.recv || client.recv != server.send {
+        t.Error("the two ends derived different keys")
+    }
+    if client.send == client.recv {
+        t.Error("both directions have the same key")
+    }
+    if !bytes.Equal(client.base, server.base) || bytes.Equal(client.base, base[:]) {
+        t.Error("the next base isn't shared, or didn't change")
+    }
+
+    other := randomKey(t)
+    different, err := deriveRekey(other[:], client_kp, server_kp.Public, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if different.send == client.send {
+        t.Error("the base made no difference")
+    }
+}
+
+func TestRekeyEpochs(t *testing.T) {
+    for _, reliable := range []bool{false, true} {
+        link := newTestLink(reliable)
+        client, server := newTestEncryptedPair(t, link)
+
+        sendAndCheck(t, client, server, "before")
+        startRekey(client)
+        waitFor(t, "the client to switch", func() bool {
+            send, recv := epochs(client)
+            return send == 1 && recv == 1
+        })
+        waitFor(t, "the server to switch", func() bool {
+            send, recv := epochs(server)
+            return send == 1 && recv == 1
+        })
+
+        sendAndCheck(t, client, server, "after, up")
+        sendAndCheck(t, server, client, "after, down")
+
+        link.client.Close()
+        link.server.Close()
+    }
+}
+
+// The server mustn't switch its send key until it knows the client has the
+// new keys, or the client couldn't read anything it sent.
+func TestRekeyServerWaitsForClient(t *testing.T) {
+    link := newTestLink(false)
+    defer link.client.Close()
+    defer link.server.Close()
+    client, server := newTestEncryptedPair(t, link)
+
+    // The ack goes missing.
+    atomic.StoreInt32(&link.drop_down, 1)
+    init := startRekey(client)
+    waitFor(t, "the ack to be dropped", func() bool {
+        return atomic.LoadInt32(&link.dropped) == 1
+    })
+    atomic.StoreInt32(&link.drop_down, 0)
+    if _, recv := epochs(server); recv != 1 {
+        t.Fatalf("server is receiving under epoch %d after the init", recv)
+    }
+
+    // The server is still sending under the old key, which the client can
+    // read.
+    sendAndCheck(t, server, client, "still the old key")
+    if send, _ := epochs(server); send != 0 {
+        t.Fatalf("server switched its send key to %d before the client had the ack", send)
+    }
+
+    // The client asks again, gets the ack this time, and tells the server.
+    client.ctrl_ch <- ctrlMessage{msgRekeyInit, init, false, false}
+    waitFor(t, "the server to switch", func() bool {
+        send, _ := epochs(server)
+        return send == 1
+    })
+
+    sendAndCheck(t, server, client, "new key, down")
+    sendAndCheck(t, client, server, "new key, up")
+
+    for _, c := range []*EncryptedPacketClient{client, server} {
+        c.lock.Lock()
+        open := c.prev_open
+        c.lock.Unlock()
+        if open {
+            t.Errorf("old key has no expiry, even though the other end has switched")
+        }
+    }
+}
+
+func TestRekeyOverlap(t *testing.T) {
+    old_mode, _ := NewSecretBoxMode(make([]byte, 32))
+    new_mode, _ := NewSecretBoxMode(make([]byte, 32))
+    c := &EncryptedPacketClient{recv_mode: old_mode}
+
+    c.installRecv(new_mode)
+    if c.recvModeFor(1) != new_mode {
+        t.Fatal("new key isn't used for the new epoch")
+    }
+
+    // Until the other end uses the new key, the old one doesn't expire.
+    c.prev_until = time.Now().Add(-time.Hour)
+    if c.recvModeFor(0) != old_mode {
+        t.Fatal("old key expired before the other end switched")
+    }
+
+    c.lock.Lock()
+    c.newEpochSeen()
+    c.lock.Unlock()
+    if c.recvModeFor(0) != old_mode {
+        t.Fatal("old key expired as soon as the other end switched")
+    }
+
+    c.prev_until = time.Now().Add(-time.Second)
+    if c.recvModeFor(0) != nil {
+        t.Fatal("old key still accepted after the overlap")
+    }
+    if c.recvModeFor(2) != nil {
+        t.Fatal("unknown epoch accepted")
+    }
+}
@@ -0,0 +1,77 @@
+package transports
+
+import (
+    "sync"
+)
+
+// A sliding window of packet counters we've already accepted, so that
+// replayed packets can be rejected on unreliable transports, where packets
+// can legitimately arrive late or out of order.  This works the same way as
+// in IPsec and WireGuard: we remember the highest counter seen so far, and
+// which of the replayWindowSize counters below it we've seen.  Anything older
+// than that is rejected outright.
+//
+// Counters start at 1, so that 0 can mean "nothing seen yet".
+
+const replayWindowWords = 32
+const replayWindowSize = replayWindowWords * 64
+
+type replayWindow struct {
+    top    uint64
+    bitmap [replayWindowWords]uint64
+    lock   sync.Mutex
+}
+
+func (w *replayWindow) bit(n uint64) (int, uint64) {
+    index := n % replayWindowSize
+    return int(index / 64), 1 << (index % 64)
+}
+
+// Returns true if a packet with the given counter would be accepted.
+func (w *replayWindow) check(n uint64) bool {
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    return w.checkLocked(n)
+}
+
+func (w *replayWindow) checkLocked(n uint64) bool {
+    if n == 0 {
+        return false
+    }
+    if n > w.top {
+        return true
+    }
+    if w.top-n >= replayWindowSize {
+        return false
+    }
+
+    word, mask := w.bit(n)
+    return w.bitmap[word]&mask == 0
+}
+
+// Like check, but also records the counter as seen.
+func (w *replayWindow) accept(n uint64) bool {
+    w.lock.Lock()
+    defer w.lock.Unlock()
+
+    if !w.checkLocked(n) {
+        return false
+    }
+
+    // Slide the window forward, forgetting everything that falls out of it.
+    if n > w.top {
+        if n-w.top >= replayWindowSize {
+            w.bitmap = [replayWindowWords]uint64{}
+        } else {
+            for i := w.top + 1; i < n; i++ {
+                word, mask := w.bit(i)
+                w.bitmap[word] &^= mask
+            }
+        }
+        w.top = n
+    }
+
+    word, mask := w.bit(n)
+    w.bitmap[word] |= mask
+    return true
+}
@@ -0,0 +1,88 @@
+package transports
+
+import (
+    "testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+    type step struct {
+        n      uint64
+        accept bool
+    }
+
+    tests := []struct {
+        name  string
+        steps []step
+    }{
+        {"in order", []step{
+            {1, true}, {2, true}, {3, true}, {4, true},
+        }},
+        {"zero", []step{
+            {0, false}, {1, true}, {0, false},
+        }},
+        {"reordered", []step{
+            {1, true}, {3, true}, {2, true}, {5, true}, {4, true},
+        }},
+        {"duplicate", []step{
+            {1, true}, {2, true}, {2, false}, {1, false}, {3, true}, {3, false},
+        }},
+        {"duplicate after reordering", []step{
+            {5, true}, {3, true}, {3, false}, {4, true}, {5, false},
+        }},
+        {"window edge", []step{
+            {replayWindowSize + 10, true},
+            // The oldest counter still in the window, and the first one
+            // that isn't.
+            {11, true},
+            {10, false},
+            {11, false},
+        }},
+        {"large jump", []step{
+            {1, true}, {2, true},
+            {1000000, true},
+            {2, false},
+            {1000000 - replayWindowSize + 1, true},
+            {999999, true},
+            {1000000, false},
+        }},
+        {"sliding forgets old bits", []step{
+            // 100 + replayWindowSize uses the same bit as 100, so that bit
+            // has to be cleared when the window slides past 100.
+            {100, true},
+            {150, true},
+            {120 + replayWindowSize, true},
+            {100 + replayWindowSize, true},
+            {100 + replayWindowSize, false},
+        }},
+        {"jumping forgets old bits", []step{
+            {100, true},
+            {101 + replayWindowSize, true},
+            {100 + replayWindowSize, true},
+        }},
+    }
+
+    for _, test := range tests {
+        var w replayWindow
+        for i, s := range test.steps {
+            if checked := w.check(s.n); checked != s.accept {
+                t.Errorf("%s: step %d: check(%d) = %v, expected %v", test.name, i, s.n, checked, s.accept)
+            }
+            if accepted := w.accept(s.n); accepted != s.accept {
+                t.Errorf("%s: step %d: accept(%d) = %v, expected %v", test.name, i, s.n, accepted, s.accept)
+            }
+        }
+    }
+}
+
+// check never changes anything.
+func TestReplayWindowCheckOnly(t *testing.T) {
+    var w replayWindow
+    for i := 0; i < 3; i++ {
+        if !w.check(7) {
+            t.Fatalf("check(7) = false on attempt %d", i)
+        }
+    }
+    if !w.accept(7) {
+        t.Fatal("accept(7) = false after checking")
+    }
+}
@@ -0,0 +1,633 @@
+package transports
+
+import (
+    "bytes"
+    "container/heap"
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "log"
+    "math"
+    "sync"
+    "time"
+)
+
+// This file implements traffic shaping on top of an existing (encrypted)
+// packet client.  Encryption hides what's in a packet, but not how big it is
+// or when it was sent, and that's often enough to tell what's going on inside
+// the tunnel.  The shaping layer can:
+//      - Pad each packet up to the next of a set of size buckets, and/or by a
+//        random amount.
+//      - Delay each packet by a random amount (jitter).  Each packet gets
+//        its own delay, so packets can be reordered, just as they can be on
+//        the internet.
+//      - Send chaff (dummy packets) at random intervals.
+//
+// Since the padding has to be removed again, both ends need to agree to use
+// shaping.  The client sends a hello with the settings it wants, and the
+// server replies with the settings that both ends will use, which are the
+// stronger of what the client asked for and what the server is configured
+// with.  Both messages start with shapeHelloMagic, which can't be the start of
+// an IP packet, so a server that doesn't shape just drops the hello.
+//
+// Once shaping is on, every packet is a frame:
+//
+//      [type (1 byte)] [length (2 bytes)] [payload] [padding]
+//
+// The shaping layer should sit above the encryption layer, so that the frame
+// header and padding are encrypted too.  The encryption layer sends a few
+// packets of its own (to rekey), and we have it pad those to the size one of
+// our frames would be, so they don't stand out.
+//
+// There's also a constant-rate cover traffic mode, in cover.go.
+
+const (
+    shapeFrameData         = 0x00
+    shapeFrameChaff        = 0x01
+    shapeFrameFragment     = 0x02
+    shapeFrameLastFragment = 0x03
+)
+
+// "\xFF" followed by "HPSH" and a version.
+var shapeHelloMagic = []byte{0xFF, 'H', 'P', 'S', 'H', 1}
+
+const (
+    shapeHello = 0x01
+    shapeAck   = 0x02
+)
+
+const shapeHeaderLen = 3
+
+// The biggest frame we'll send.  The TCP transport prefixes each packet with
+// its length as a uint16, and the encryption layer adds its overhead on top
+// of our frame, so frames have to leave room for that.
+const MaxShapeFrame = 0xFFFF - maxEncryptionOverhead
+
+// The most packets we'll hold on to while they wait out their jitter.
+const shapeMaxDelayed = 1024
+
+// How long the client waits for the server to agree to shaping, and how often
+// it resends its hello in the meantime.
+const shapeNegotiateTimeout = 10 * time.Second
+const shapeHelloInterval = 1 * time.Second
+
+type ShapingOptions struct {
+    // Pad each packet up to the smallest of these sizes that fits it.
+    // Packets bigger than the biggest bucket are padded to a multiple of it.
+    Buckets []int
+
+    // Add up to this many bytes of random padding to each packet, before
+    // rounding up to a bucket.
+    RandomPad int
+
+    // Delay each packet by a random amount up to this long.
+    Jitter time.Duration
+
+    // Send a chaff packet this often, on average (0 to disable).
+    ChaffInterval time.Duration
+
+    // If both of these are set, send CoverSize-byte packets, CoverRate times
+    // a second, whether or not there's anything to send.  This overrides
+    // the other settings.
+    CoverRate int
+    CoverSize int
+
+    // How many packets to queue up for sending in cover mode before dropping
+    // them.  This isn't negotiated.
+    CoverQueue int
+}
+
+// Returns true if any shaping is configured.
+func (o *ShapingOptions) Enabled() bool {
+    return len(o.Buckets) > 0 || o.RandomPad > 0 || o.Jitter > 0 || o.ChaffInterval > 0 ||
+        o.coverMode()
+}
+
+// Combines two sets of options, taking the stronger setting from each.  The
+// buckets from a are used if there are any.
+func mergeShapingOptions(a, b *ShapingOptions) ShapingOptions {
+    ret := *a
+    if len(ret.Buckets) == 0 {
+        ret.Buckets = b.Buckets
+    }
+    if b.RandomPad > ret.RandomPad {
+        ret.RandomPad = b.RandomPad
+    }
+    if b.Jitter > ret.Jitter {
+        ret.Jitter = b.Jitter
+    }
+    if ret.ChaffInterval == 0 || (b.ChaffInterval > 0 && b.ChaffInterval < ret.ChaffInterval) {
+        ret.ChaffInterval = b.ChaffInterval
+    }
+    if b.CoverRate > ret.CoverRate {
+        ret.CoverRate = b.CoverRate
+    }
+    if b.CoverSize > ret.CoverSize {
+        ret.CoverSize = b.CoverSize
+    }
+    ret.clamp()
+    return ret
+}
+
+// Keeps settings that came from the other end within what we can send.
+func (o *ShapingOptions) clamp() {
+    if o.CoverSize > MaxShapeFrame {
+        o.CoverSize = MaxShapeFrame
+    }
+}
+
+// Hello and ack messages are the magic, the message type, and then the
+// options:
+//      [jitter ms (4 bytes)] [chaff interval ms (4 bytes)] [random pad (2 bytes)]
+//      [number of buckets (1 byte)] [bucket sizes (2 bytes each)]
+//      [cover rate (2 bytes)] [cover size (2 bytes)]
+//
+// The cover traffic settings were added later, and may be missing.
+func encodeShapeHello(kind byte, opts *ShapingOptions) []byte {
+    buf := new(bytes.Buffer)
+    buf.Write(shapeHelloMagic)
+    buf.WriteByte(kind)
+    binary.Write(buf, binary.BigEndian, uint32(opts.Jitter/time.Millisecond))
+    binary.Write(buf, binary.BigEndian, uint32(opts.ChaffInterval/time.Millisecond))
+    binary.Write(buf, binary.BigEndian, uint16(opts.RandomPad))
+
+    buckets := opts.Buckets
+    if len(buckets) > 255 {
+        buckets = buckets[:255]
+    }
+    buf.WriteByte(byte(len(buckets)))
+    for _, size := range buckets {
+        binary.Write(buf, binary.BigEndian, uint16(size))
+    }
+
+    binary.Write(buf, binary.BigEndian, uint16(opts.CoverRate))
+    binary.Write(buf, binary.BigEndian, uint16(opts.CoverSize))
+    return buf.Bytes()
+}
+
+func decodeShapeHello(pkt []byte) (byte, *ShapingOptions, bool) {
+    if !bytes.HasPrefix(pkt, shapeHelloMagic) {
+        return 0, nil, false
+    }
+    pkt = pkt[len(shapeHelloMagic):]
+    if len(pkt) < 12 {
+        return 0, nil, false
+    }
+
+    kind := pkt[0]
+    opts := &ShapingOptions{
+        Jitter:        time.Duration(binary.BigEndian.Uint32(pkt[1:])) * time.Millisecond,
+        ChaffInterval: time.Duration(binary.BigEndian.Uint32(pkt[5:])) * time.Millisecond,
+        RandomPad:     int(binary.BigEndian.Uint16(pkt[9:])),
+    }
+
+    count := int(pkt[11])
+    pkt = pkt[12:]
+    if len(pkt) < count*2 {
+        return 0, nil, false
+    }
+    for i := 0; i < count; i++ {
+        size := int(binary.BigEndian.Uint16(pkt[i*2:]))
+        if size > 0 {
+            opts.Buckets = append(opts.Buckets, size)
+        }
+    }
+
+    pkt = pkt[count*2:]
+    if len(pkt) >= 4 {
+        opts.CoverRate = int(binary.BigEndian.Uint16(pkt))
+        opts.CoverSize = int(binary.BigEndian.Uint16(pkt[2:]))
+    }
+
+    return kind, opts, true
+}
+
+// Returns a random integer in [0, n).
+func randInt(n int) int {
+    if n <= 0 {
+        return 0
+    }
+
+    var buf [8]byte
+    if _, err := rand.Read(buf[:]); err != nil {
+        panic("could not read from random number generator")
+    }
+    return int(binary.BigEndian.Uint64(buf[:]) % uint64(n))
+}
+
+// Returns a random duration in [0, d).
+func randDuration(d time.Duration) time.Duration {
+    return time.Duration(randInt(int(d)))
+}
+
+// --------------------------------------------------------------------------------
+
+type ShapedPacketClient struct {
+    // Cover traffic accounting - see cover.go.  This is updated atomically,
+    // so it has to come first: on 32-bit platforms, only the start of an
+    // allocated struct is guaranteed to be 64-bit aligned.
+    stats CoverStats
+
+    underlying PacketClient
+    send_ch    chan []byte
+    recv_ch    chan []byte
+
+    // Our own settings, and once negotiated, the ones in use.  Until then,
+    // packets are passed through untouched.
+    local   ShapingOptions
+    opts    ShapingOptions
+    shaping bool
+    lock    sync.Mutex
+
+    // Cover traffic state - see cover.go.
+    cover_queue chan []byte
+    recv_frag   fragmentState
+
+    // The client asks for shaping, and is told about the server's ack on
+    // this channel.
+    initiator bool
+    acked     chan bool
+
+    closed     chan bool
+    close_once sync.Once
+}
+
+// Wraps a client in the shaping layer, and asks the other end to agree to
+// shaping.  Fails if it doesn't.
+func NewShapedPacketClient(underlying PacketClient, opts *ShapingOptions) (*ShapedPacketClient, error) {
+    c := newShapedClient(underlying, opts)
+    c.initiator = true
+    c.start()
+
+    // Since the hello might get lost, we keep sending it until we hear back.
+    hello := encodeShapeHello(shapeHello, opts)
+    timeout := time.After(shapeNegotiateTimeout)
+    for {
+        select {
+        case c.underlying.SendChannel() <- hello:
+        case <-c.closed:
+            return nil, fmt.Errorf("connection closed while negotiating shaping")
+        }
+
+        select {
+        case <-c.acked:
+            log.Printf("Traffic shaping enabled: %s\n", c.describeOptions())
+            return c, nil
+
+        case <-time.After(shapeHelloInterval):
+
+        case <-timeout:
+            c.Close()
+            return nil, fmt.Errorf("the server did not agree to traffic shaping")
+        }
+    }
+}
+
+// Wraps a client in the shaping layer, on the server side.  Packets are passed
+// through untouched, unless the other end asks for shaping.
+func AcceptShapedPacketClient(underlying PacketClient, opts *ShapingOptions) *ShapedPacketClient {
+    c := newShapedClient(underlying, opts)
+    c.start()
+    return c
+}
+
+func newShapedClient(underlying PacketClient, opts *ShapingOptions) *ShapedPacketClient {
+    return &ShapedPacketClient{
+        underlying:  underlying,
+        send_ch:     make(chan []byte),
+        recv_ch:     make(chan []byte),
+        local:       *opts,
+        cover_queue: make(chan []byte, coverQueueLen(opts)),
+        acked:       make(chan bool, 1),
+        closed:      make(chan bool),
+    }
+}
+
+func (c *ShapedPacketClient) start() {
+    go c.doSend()
+    go c.doRecv()
+    go c.doChaff()
+}
+
+// Returns the settings in use, and whether shaping is on at all.
+func (c *ShapedPacketClient) current() (ShapingOptions, bool) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.opts, c.shaping
+}
+
+func (c *ShapedPacketClient) enable(opts *ShapingOptions) {
+    c.lock.Lock()
+    c.opts = *opts
+    c.shaping = true
+    c.lock.Unlock()
+
+    if padder, ok := c.underlying.(controlPadder); ok {
+        padding := *opts
+        padder.SetControlPadding(func(size int) int {
+            return shapedSize(size, &padding)
+        })
+    }
+    if opts.coverMode() {
+        go c.doCover()
+    }
+}
+
+func (c *ShapedPacketClient) describeOptions() string {
+    opts, _ := c.current()
+    if opts.coverMode() {
+        return fmt.Sprintf("cover traffic of %d-byte packets, %d per second",
+            opts.CoverSize, opts.CoverRate)
+    }
+    return fmt.Sprintf("buckets=%v, random pad=%d, jitter=%s, chaff every %s",
+        opts.Buckets, opts.RandomPad, opts.Jitter, opts.ChaffInterval)
+}
+
+// Implemented by layers below us that send packets of their own, so that
+// they can be padded like ours.
+type controlPadder interface {
+    SetControlPadding(pad func(size int) int)
+}
+
+// Returns how big a frame with a payload of the given size should be.  This
+// is random if there's random padding.
+func shapedSize(payload int, opts *ShapingOptions) int {
+    if opts.coverMode() {
+        return opts.CoverSize
+    }
+
+    size := shapeHeaderLen + payload + randInt(opts.RandomPad+1)
+    if len(opts.Buckets) > 0 {
+        size = padToBucket(size, opts.Buckets)
+    }
+    if size > MaxShapeFrame {
+        size = MaxShapeFrame
+    }
+    return size
+}
+
+// Wraps a payload in a frame, padded according to the options.  The payload
+// must fit in MaxShapeFrame; the padding is cut short if it doesn't.
+func makeShapeFrame(kind byte, payload []byte, opts *ShapingOptions) []byte {
+    frame := make([]byte, shapedSize(len(payload), opts))
+    frame[0] = kind
+    binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+    copy(frame[shapeHeaderLen:], payload)
+    return frame
+}
+
+func padToBucket(size int, buckets []int) int {
+    largest := 0
+    best := math.MaxInt32
+    for _, bucket := range buckets {
+        if bucket >= size && bucket < best {
+            best = bucket
+        }
+        if bucket > largest {
+            largest = bucket
+        }
+    }
+
+    if best != math.MaxInt32 {
+        return best
+    }
+    return (size + largest - 1) / largest * largest
+}
+
+// Packets waiting out their jitter, soonest first.
+type delayedPacket struct {
+    pkt     []byte
+    send_at time.Time
+}
+
+type delayQueue []delayedPacket
+
+func (q delayQueue) Len() int            { return len(q) }
+func (q delayQueue) Less(i, j int) bool  { return q[i].send_at.Before(q[j].send_at) }
+func (q delayQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *delayQueue) Push(x interface{}) { *q = append(*q, x.(delayedPacket)) }
+
+func (q *delayQueue) Pop() interface{} {
+    old := *q
+    item := old[len(old)-1]
+    *q = old[:len(old)-1]
+    return item
+}
+
+func (c *ShapedPacketClient) doSend() {
+    underlying := c.underlying.SendChannel()
+
+    // Each packet is sent at its own random time, up to the jitter after it
+    // arrives.  We keep accepting packets while others are waiting.
+    var delayed delayQueue
+
+    for {
+        // The next packet to go out, if it's due, or else when it will be.
+        var out chan []byte
+        var next []byte
+        var wake <-chan time.Time
+        if len(delayed) > 0 {
+            if wait := delayed[0].send_at.Sub(time.Now()); wait > 0 {
+                wake = time.After(wait)
+            } else {
+                out = underlying
+                next = delayed[0].pkt
+            }
+        }
+
+        var pkt []byte
+        select {
+        case pkt = <-c.send_ch:
+        case out <- next:
+            heap.Pop(&delayed)
+            continue
+        case <-wake:
+            continue
+        case <-c.closed:
+            drainPackets(c.send_ch)
+            return
+        }
+
+        opts, shaping := c.current()
+        if shaping && opts.coverMode() {
+            // The cover traffic goroutine does the sending.
+            c.queueCover(pkt, &opts)
+            continue
+        }
+
+        if shaping {
+            if len(pkt) > MaxShapeFrame-shapeHeaderLen {
+                log.Printf("Packet too large to shape (%d bytes), dropping\n", len(pkt))
+                continue
+            }
+            pkt = makeShapeFrame(shapeFrameData, pkt, &opts)
+
+            if opts.Jitter > 0 {
+                if len(delayed) >= shapeMaxDelayed {
+                    log.Printf("Too many packets waiting out their jitter, dropping\n")
+                    continue
+                }
+                heap.Push(&delayed, delayedPacket{pkt, time.Now().Add(randDuration(opts.Jitter))})
+                continue
+            }
+        }
+
+        select {
+        case underlying <- pkt:
+        case <-c.closed:
+        }
+    }
+}
+
+func (c *ShapedPacketClient) doChaff() {
+    for {
+        opts, shaping := c.current()
+
+        // Until shaping is on, we just check every so often.
+        wait := shapeHelloInterval
+        if shaping && opts.ChaffInterval > 0 {
+            // Exponentially distributed, so the chaff looks like random
+            // traffic rather than a heartbeat.
+            f := float64(randInt(1<<30)+1) / float64(1<<30)
+            wait = time.Duration(-math.Log(f) * float64(opts.ChaffInterval))
+        }
+
+        select {
+        case <-time.After(wait):
+        case <-c.closed:
+            return
+        }
+
+        if !shaping || opts.ChaffInterval == 0 || opts.coverMode() {
+            continue
+        }
+
+        // Chaff goes straight out, rather than waiting behind real packets.
+        chaff := makeShapeFrame(shapeFrameChaff, nil, &opts)
+        select {
+        case c.underlying.SendChannel() <- chaff:
+        case <-c.closed:
+            return
+        }
+    }
+}
+
+func (c *ShapedPacketClient) doRecv() {
+    defer close(c.recv_ch)
+    underlying := c.underlying.RecvChannel()
+
+    for {
+        pkt, ok := <-underlying
+        if !ok {
+            c.Close()
+            return
+        }
+
+        if kind, opts, ok := decodeShapeHello(pkt); ok {
+            c.handleHello(kind, opts)
+            continue
+        }
+
+        _, shaping := c.current()
+        if shaping {
+            var good bool
+            pkt, good = c.unframe(pkt)
+            if !good {
+                continue
+            }
+        } else if c.initiator {
+            // We've asked for shaping, so we don't know how to read anything
+            // until the server agrees.
+            continue
+        }
+
+        select {
+        case c.recv_ch <- pkt:
+        case <-c.closed:
+            return
+        }
+    }
+}
+
+func (c *ShapedPacketClient) handleHello(kind byte, opts *ShapingOptions) {
+    switch kind {
+    case shapeHello:
+        // The client might resend its hello if our ack got lost, so we
+        // always reply - but we only pick the settings once.
+        current, shaping := c.current()
+        if !shaping {
+            current = mergeShapingOptions(opts, &c.local)
+            c.enable(&current)
+            log.Printf("Traffic shaping enabled: %s\n", c.describeOptions())
+        }
+
+        select {
+        case c.underlying.SendChannel() <- encodeShapeHello(shapeAck, &current):
+        case <-c.closed:
+        }
+
+    case shapeAck:
+        if _, shaping := c.current(); shaping {
+            return
+        }
+        opts.clamp()
+        c.enable(opts)
+
+        select {
+        case c.acked <- true:
+        default:
+        }
+
+    default:
+        log.Printf("Unknown shaping message type %d\n", kind)
+    }
+}
+
+// Strips the frame and padding from a packet, dropping chaff.
+func (c *ShapedPacketClient) unframe(pkt []byte) ([]byte, bool) {
+    if len(pkt) < shapeHeaderLen {
+        log.Printf("Shaped packet too short (%d bytes), dropping\n", len(pkt))
+        return nil, false
+    }
+
+    length := int(binary.BigEndian.Uint16(pkt[1:]))
+    if len(pkt) < shapeHeaderLen+length {
+        log.Printf("Shaped packet truncated, dropping\n")
+        return nil, false
+    }
+
+    switch pkt[0] {
+    case shapeFrameData:
+        return pkt[shapeHeaderLen : shapeHeaderLen+length], true
+    case shapeFrameChaff:
+        return nil, false
+    case shapeFrameFragment, shapeFrameLastFragment:
+        return c.recv_frag.add(pkt[0], pkt[shapeHeaderLen:shapeHeaderLen+length])
+    }
+
+    log.Printf("Unknown shaped frame type %d, dropping\n", pkt[0])
+    return nil, false
+}
+
+func (c *ShapedPacketClient) SendChannel() chan []byte {
+    return c.send_ch
+}
+
+func (c *ShapedPacketClient) RecvChannel() chan []byte {
+    return c.recv_ch
+}
+
+func (c *ShapedPacketClient) Close() {
+    c.close_once.Do(func() {
+        close(c.closed)
+        c.underlying.Close()
+    })
+}
+
+func (c *ShapedPacketClient) IsReliable() bool {
+    return c.underlying.IsReliable()
+}
+
+func (c *ShapedPacketClient) Describe() string {
+    return fmt.Sprintf("ShapedPacketClient(%s)", c.underlying.Describe())
+}
@@ -0,0 +1,346 @@
+package transports
+
+import (
+    "bytes"
+    "encoding/binary"
+    "reflect"
+    "sync"
+    "testing"
+    "time"
+)
+
+// A shaping client with shaping already on, whose frames we read and write by
+// hand.
+func newShapedEnd(t *testing.T, opts *ShapingOptions) (*ShapedPacketClient, *testEnd) {
+    end := &testEnd{make(chan []byte), make(chan []byte), false, make(chan bool), sync.Once{}}
+    c := newShapedClient(end, opts)
+    c.start()
+    c.enable(opts)
+    t.Cleanup(c.Close)
+    return c, end
+}
+
+func nextFrame(t *testing.T, end *testEnd) []byte {
+    select {
+    case frame := <-end.send_ch:
+        return frame
+    case <-time.After(5 * time.Second):
+        t.Fatal("nothing was sent")
+    }
+    return nil
+}
+
+func checkFrame(t *testing.T, frame []byte, kind byte, payload []byte) {
+    if len(frame) < shapeHeaderLen {
+        t.Fatalf("frame too short (%d bytes)", len(frame))
+    }
+    length := int(binary.BigEndian.Uint16(frame[1:]))
+    if frame[0] != kind || length != len(payload) || len(frame) < shapeHeaderLen+length {
+        t.Fatalf("got frame type %d with %d bytes, expected type %d with %d", frame[0], length, kind, len(payload))
+    }
+    if !bytes.Equal(frame[shapeHeaderLen:shapeHeaderLen+length], payload) {
+        t.Errorf("frame has the wrong payload")
+    }
+}
+
+func TestShapeHello(t *testing.T) {
+    tests := []ShapingOptions{
+        {},
+        {Buckets: []int{256, 512, 1500}, RandomPad: 100, Jitter: 20 * time.Millisecond, ChaffInterval: 500 * time.Millisecond},
+        {CoverRate: 50, CoverSize: 1024},
+    }
+    for _, opts := range tests {
+        kind, decoded, ok := decodeShapeHello(encodeShapeHello(shapeAck, &opts))
+        if !ok || kind != shapeAck {
+            t.Errorf("%+v: didn't decode", opts)
+            continue
+        }
+        if !reflect.DeepEqual(*decoded, opts) {
+            t.Errorf("got %+v, expected %+v", *decoded, opts)
+        }
+    }
+
+    // Hellos from before cover traffic don't have its settings.
+    opts := &ShapingOptions{Buckets: []int{512}, RandomPad: 7}
+    hello := encodeShapeHello(shapeHello, opts)
+    kind, decoded, ok := decodeShapeHello(hello[:len(hello)-4])
+    if !ok || kind != shapeHello || !reflect.DeepEqual(decoded, opts) {
+        t.Errorf("old hello: got %d, %+v, %v", kind, decoded, ok)
+    }
+
+    bad := [][]byte{
+        nil,
+        []byte{0x45, 0, 0, 20},
+        hello[:len(shapeHelloMagic)+11],
+        hello[:len(shapeHelloMagic)+13], // claims a bucket that isn't there
+    }
+    for _, pkt := range bad {
+        if _, _, ok := decodeShapeHello(pkt); ok {
+            t.Errorf("decoded %x", pkt)
+        }
+    }
+}
+
+func TestMergeShapingOptions(t *testing.T) {
+    tests := []struct {
+        name     string
+        a, b     ShapingOptions
+        expected ShapingOptions
+    }{
+        {"empty", ShapingOptions{}, ShapingOptions{}, ShapingOptions{}},
+        {"buckets from a", ShapingOptions{Buckets: []int{256}}, ShapingOptions{Buckets: []int{512}},
+            ShapingOptions{Buckets: []int{256}}},
+        {"buckets from b", ShapingOptions{}, ShapingOptions{Buckets: []int{512}},
+            ShapingOptions{Buckets: []int{512}}},
+        {"larger padding and jitter", ShapingOptions{RandomPad: 10, Jitter: time.Second},
+            ShapingOptions{RandomPad: 20, Jitter: time.Millisecond},
+            ShapingOptions{RandomPad: 20, Jitter: time.Second}},
+        {"more frequent chaff", ShapingOptions{ChaffInterval: time.Second}, ShapingOptions{ChaffInterval: time.Millisecond},
+            ShapingOptions{ChaffInterval: time.Millisecond}},
+        {"chaff from one end", ShapingOptions{ChaffInterval: time.Second}, ShapingOptions{},
+            ShapingOptions{ChaffInterval: time.Second}},
+        {"chaff from the other end", ShapingOptions{}, ShapingOptions{ChaffInterval: time.Second},
+            ShapingOptions{ChaffInterval: time.Second}},
+        {"cover traffic", ShapingOptions{CoverRate: 10, CoverSize: 2048}, ShapingOptions{CoverRate: 50, CoverSize: 1024},
+            ShapingOptions{CoverRate: 50, CoverSize: 2048}},
+        {"cover size clamped", ShapingOptions{CoverRate: 10}, ShapingOptions{CoverSize: 0xFFFF},
+            ShapingOptions{CoverRate: 10, CoverSize: MaxShapeFrame}},
+    }
+    for _, test := range tests {
+        if got := mergeShapingOptions(&test.a, &test.b); !reflect.DeepEqual(got, test.expected) {
+            t.Errorf("%s: got %+v, expected %+v", test.name, got, test.expected)
+        }
+    }
+}
+
+func TestPadToBucket(t *testing.T) {
+    buckets := []int{1500, 256, 512}
+    tests := []struct {
+        size, expected int
+    }{
+        {1, 256},
+        {256, 256},
+        {257, 512},
+        {1000, 1500},
+        {1500, 1500},
+        {1501, 3000},
+        {4000, 4500},
+    }
+    for _, test := range tests {
+        if got := padToBucket(test.size, buckets); got != test.expected {
+            t.Errorf("%d: got %d, expected %d", test.size, got, test.expected)
+        }
+    }
+}
+
+func TestMakeShapeFrame(t *testing.T) {
+    payload := []byte("hello")
+    tests := []struct {
+        name     string
+        opts     ShapingOptions
+        min, max int
+    }{
+        {"no padding", ShapingOptions{}, 8, 8},
+        {"bucket", ShapingOptions{Buckets: []int{64, 128}}, 64, 64},
+        {"random", ShapingOptions{RandomPad: 10}, 8, 18},
+        {"random then bucket", ShapingOptions{Buckets: []int{64}, RandomPad: 100}, 64, 128},
+    }
+    for _, test := range tests {
+        for i := 0; i < 20; i++ {
+            frame := makeShapeFrame(shapeFrameData, payload, &test.opts)
+            if len(frame) < test.min || len(frame) > test.max {
+                t.Errorf("%s: %d-byte frame", test.name, len(frame))
+            }
+            checkFrame(t, frame, shapeFrameData, payload)
+        }
+    }
+}
+
+// Padding must never push a frame past what the TCP transport's length
+// prefix can carry once it's encrypted.
+func TestShapeFrameFitsLengthPrefix(t *testing.T) {
+    big := make([]byte, MaxShapeFrame-shapeHeaderLen)
+    for _, opts := range []ShapingOptions{
+        {RandomPad: 0xFFFF},
+        {Buckets: []int{0xFFFF}},
+        {Buckets: []int{40000}},
+    } {
+        frame := makeShapeFrame(shapeFrameData, big, &opts)
+        if len(frame)+maxEncryptionOverhead > 0xFFFF {
+            t.Errorf("%+v: %d-byte frame", opts, len(frame))
+        }
+        checkFrame(t, frame, shapeFrameData, big)
+    }
+
+    // Packets that can't fit are dropped, rather than sent with a length
+    // that wraps around.
+    c, end := newShapedEnd(t, &ShapingOptions{Buckets: []int{256}})
+    c.SendChannel() <- make([]byte, MaxShapeFrame-shapeHeaderLen+1)
+    c.SendChannel() <- []byte("small")
+    checkFrame(t, nextFrame(t, end), shapeFrameData, []byte("small"))
+}
+
+func TestShapedSend(t *testing.T) {
+    c, end := newShapedEnd(t, &ShapingOptions{Buckets: []int{128, 256}})
+    for _, size := range []int{0, 1, 125, 126, 253, 300} {
+        payload := bytes.Repeat([]byte{'x'}, size)
+        c.SendChannel() <- payload
+        frame := nextFrame(t, end)
+        checkFrame(t, frame, shapeFrameData, payload)
+        if expected := padToBucket(size+shapeHeaderLen, []int{128, 256}); len(frame) != expected {
+            t.Errorf("%d bytes: got a %d-byte frame, expected %d", size, len(frame), expected)
+        }
+    }
+}
+
+func TestShapedRecv(t *testing.T) {
+    c, end := newShapedEnd(t, &ShapingOptions{})
+    chaff := makeShapeFrame(shapeFrameChaff, nil, &ShapingOptions{Buckets: []int{256}})
+    truncated := makeShapeFrame(shapeFrameData, []byte("truncated"), &ShapingOptions{})
+    unknown := makeShapeFrame(0x7F, []byte("unknown"), &ShapingOptions{})
+
+    // Only the real packet gets through.
+    for _, pkt := range [][]byte{{0}, chaff, truncated[:8], unknown} {
+        end.recv_ch <- pkt
+    }
+    end.recv_ch <- makeShapeFrame(shapeFrameData, []byte("real"), &ShapingOptions{Buckets: []int{256}})
+    if pkt := recvWithin(t, c, 5*time.Second); string(pkt) != "real" {
+        t.Errorf("got %q, expected real", pkt)
+    }
+}
+
+func TestShapedChaff(t *testing.T) {
+    _, end := newShapedEnd(t, &ShapingOptions{Buckets: []int{200}, ChaffInterval: time.Millisecond})
+    frame := nextFrame(t, end)
+    checkFrame(t, frame, shapeFrameChaff, nil)
+    if len(frame) != 200 {
+        t.Errorf("%d-byte chaff", len(frame))
+    }
+}
+
+// Each packet is delayed on its own, so a burst goes out over the jitter
+// rather than all at once.
+func TestShapedJitter(t *testing.T) {
+    c, end := newShapedEnd(t, &ShapingOptions{Jitter: 200 * time.Millisecond})
+    start := time.Now()
+    for i := 0; i < 20; i++ {
+        c.SendChannel() <- []byte{byte(i)}
+    }
+    if time.Since(start) > 100*time.Millisecond {
+        t.Error("sending blocked while packets waited out their jitter")
+    }
+
+    seen := make(map[byte]bool)
+    for i := 0; i < 20; i++ {
+        frame := nextFrame(t, end)
+        seen[frame[shapeHeaderLen]] = true
+    }
+    if len(seen) != 20 {
+        t.Errorf("only %d different packets arrived", len(seen))
+    }
+}
+
+func TestShapingNegotiation(t *testing.T) {
+    link := newTestLink(false)
+    defer link.client.Close()
+    defer link.server.Close()
+
+    accepted := make(chan *ShapedPacketClient, 1)
+    go func() {
+        accepted <- AcceptShapedPacketClient(link.server, &ShapingOptions{RandomPad: 50, Buckets: []int{512}})
+    }()
+    server := <-accepted
+
+    client, err := NewShapedPacketClient(link.client, &ShapingOptions{Buckets: []int{256}, Jitter: time.Millisecond})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Both ends use the stronger settings, with the client's buckets.
+    expected := ShapingOptions{Buckets: []int{256}, RandomPad: 50, Jitter: time.Millisecond}
+    for _, c := range []*ShapedPacketClient{client, server} {
+        if opts, shaping := c.current(); !shaping || !reflect.DeepEqual(opts, expected) {
+            t.Errorf("%v: got %+v, expected %+v", shaping, opts, expected)
+        }
+    }
+
+    sendAndCheck(t, client, server, "up")
+    sendAndCheck(t, server, client, "down")
+}
+
+// A link that records the size of every packet that crosses it.
+func newSizedLink() (*testLink, func() []int) {
+    end := func() *testEnd {
+        return &testEnd{make(chan []byte), make(chan []byte), false, make(chan bool), sync.Once{}}
+    }
+    link := &testLink{client: end(), server: end()}
+
+    var sizes []int
+    var lock sync.Mutex
+    forward := func(from, to *testEnd) {
+        for {
+            select {
+            case pkt := <-from.send_ch:
+                lock.Lock()
+                sizes = append(sizes, len(pkt))
+                lock.Unlock()
+                select {
+                case to.recv_ch <- pkt:
+                case <-to.closed:
+                    return
+                }
+            case <-from.closed:
+                return
+            }
+        }
+    }
+    go forward(link.client, link.server)
+    go forward(link.server, link.client)
+
+    // Returns the sizes so far, and starts again.
+    return link, func() []int {
+        lock.Lock()
+        defer lock.Unlock()
+        ret := sizes
+        sizes = nil
+        return ret
+    }
+}
+
+// Rekeying messages come from the encryption layer, below us, but are padded
+// just like our frames.
+func TestShapedRekey(t *testing.T) {
+    link, sizes := newSizedLink()
+    defer link.client.Close()
+    defer link.server.Close()
+    enc_client, enc_server := newTestEncryptedPair(t, link)
+
+    opts := &ShapingOptions{Buckets: []int{256}}
+    server := AcceptShapedPacketClient(enc_server, opts)
+    client, err := NewShapedPacketClient(enc_client, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sendAndCheck(t, client, server, "before")
+    sizes()
+
+    startRekey(enc_client)
+    waitFor(t, "the rekey", func() bool {
+        send, recv := epochs(enc_server)
+        return send == 1 && recv == 1
+    })
+    sendAndCheck(t, client, server, "up")
+    sendAndCheck(t, server, client, "down")
+
+    // The init, ack and done, and then the two data packets.
+    got := sizes()
+    if len(got) != 5 {
+        t.Fatalf("got %d packets, expected 5", len(got))
+    }
+    for _, size := range got {
+        if size != got[0] {
+            t.Errorf("packets of different sizes: %v", got)
+            break
+        }
+    }
+}
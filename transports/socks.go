@@ -0,0 +1,266 @@
+package transports
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+)
+
+// A minimal SOCKS5 implementation (RFC 1928), just enough to talk to Tor
+// pluggable transports and to act as one.  Pluggable transports pass
+// per-connection arguments (e.g. "cert=...;iat-mode=0") in the username and
+// password fields of username/password authentication (RFC 1929).
+
+const (
+    socksVersion = 5
+
+    socksAuthNone         = 0x00
+    socksAuthPassword     = 0x02
+    socksAuthNoAcceptable = 0xFF
+
+    socksCmdConnect = 0x01
+
+    socksAddrIPv4   = 0x01
+    socksAddrDomain = 0x03
+    socksAddrIPv6   = 0x04
+
+    socksReplyOK      = 0x00
+    socksReplyFailure = 0x01
+)
+
+// Connects to target through the SOCKS5 proxy at proxy, passing the given
+// pluggable transport arguments (if any).
+func DialSOCKS5(proxy, target, args string) (net.Conn, error) {
+    host, port_str, err := net.SplitHostPort(target)
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.ParseUint(port_str, 10, 16)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, err := net.Dial("tcp", proxy)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = socksClientHandshake(conn, host, uint16(port), args); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("SOCKS5 proxy %s: %s", proxy, err)
+    }
+    return conn, nil
+}
+
+func socksClientHandshake(conn net.Conn, host string, port uint16, args string) error {
+    // Greeting - we only offer username/password auth if we've got arguments
+    // to pass.
+    method := byte(socksAuthNone)
+    if len(args) > 0 {
+        method = socksAuthPassword
+    }
+    if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+        return err
+    }
+
+    var resp [2]byte
+    if _, err := io.ReadFull(conn, resp[:]); err != nil {
+        return err
+    }
+    if resp[0] != socksVersion || resp[1] != method {
+        return fmt.Errorf("authentication method not accepted")
+    }
+
+    if method == socksAuthPassword {
+        // The arguments are split across the username and password fields,
+        // each of which can be at most 255 bytes.  The password can't be
+        // empty, so we use a NUL if there's nothing to put in it.
+        if len(args) > 255*2 {
+            return fmt.Errorf("transport arguments are too long")
+        }
+        user := args
+        pass := "\x00"
+        if len(args) > 255 {
+            user, pass = args[:255], args[255:]
+        }
+
+        req := []byte{1, byte(len(user))}
+        req = append(req, user...)
+        req = append(req, byte(len(pass)))
+        req = append(req, pass...)
+        if _, err := conn.Write(req); err != nil {
+            return err
+        }
+
+        if _, err := io.ReadFull(conn, resp[:]); err != nil {
+            return err
+        }
+        if resp[1] != 0 {
+            return fmt.Errorf("transport arguments rejected")
+        }
+    }
+
+    // Connect request.
+    req := []byte{socksVersion, socksCmdConnect, 0}
+    if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+        req = append(req, socksAddrIPv4)
+        req = append(req, ip.To4()...)
+    } else if ip != nil {
+        req = append(req, socksAddrIPv6)
+        req = append(req, ip.To16()...)
+    } else {
+        if len(host) > 255 {
+            return fmt.Errorf("host name is too long")
+        }
+        req = append(req, socksAddrDomain, byte(len(host)))
+        req = append(req, host...)
+    }
+    req = append(req, byte(port>>8), byte(port))
+    if _, err := conn.Write(req); err != nil {
+        return err
+    }
+
+    // Reply - we don't care about the bound address, but we have to read it.
+    var hdr [4]byte
+    if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+        return err
+    }
+    if hdr[1] != socksReplyOK {
+        return fmt.Errorf("connect failed with code %d", hdr[1])
+    }
+    _, _, err := readSocksAddr(conn, hdr[3])
+    return err
+}
+
+// Reads an address and port, of the given type.
+func readSocksAddr(r io.Reader, addr_type byte) (string, uint16, error) {
+    var addr []byte
+    switch addr_type {
+    case socksAddrIPv4:
+        addr = make([]byte, 4)
+    case socksAddrIPv6:
+        addr = make([]byte, 16)
+    case socksAddrDomain:
+        var length [1]byte
+        if _, err := io.ReadFull(r, length[:]); err != nil {
+            return "", 0, err
+        }
+        addr = make([]byte, length[0])
+    default:
+        return "", 0, fmt.Errorf("unknown address type %d", addr_type)
+    }
+
+    var port [2]byte
+    if _, err := io.ReadFull(r, addr); err != nil {
+        return "", 0, err
+    }
+    if _, err := io.ReadFull(r, port[:]); err != nil {
+        return "", 0, err
+    }
+
+    host := string(addr)
+    if addr_type != socksAddrDomain {
+        host = net.IP(addr).String()
+    }
+    return host, binary.BigEndian.Uint16(port[:]), nil
+}
+
+// Handles the server side of a SOCKS5 handshake, up to (but not including)
+// the reply to the connect request.  Returns the target address and any
+// pluggable transport arguments.
+func AcceptSOCKS5(conn net.Conn) (string, string, error) {
+    var hdr [2]byte
+    if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+        return "", "", err
+    }
+    if hdr[0] != socksVersion {
+        return "", "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+    }
+
+    methods := make([]byte, hdr[1])
+    if _, err := io.ReadFull(conn, methods); err != nil {
+        return "", "", err
+    }
+
+    // Prefer username/password, since that's how we get arguments.
+    method := byte(socksAuthNoAcceptable)
+    for _, m := range methods {
+        if m == socksAuthPassword {
+            method = m
+            break
+        } else if m == socksAuthNone {
+            method = m
+        }
+    }
+    if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+        return "", "", err
+    }
+    if method == socksAuthNoAcceptable {
+        return "", "", fmt.Errorf("no acceptable authentication method")
+    }
+
+    args := ""
+    if method == socksAuthPassword {
+        var err error
+        if args, err = readSocksCredentials(conn); err != nil {
+            return "", "", err
+        }
+        if _, err = conn.Write([]byte{1, 0}); err != nil {
+            return "", "", err
+        }
+    }
+
+    var req [4]byte
+    if _, err := io.ReadFull(conn, req[:]); err != nil {
+        return "", "", err
+    }
+    host, port, err := readSocksAddr(conn, req[3])
+    if err != nil {
+        return "", "", err
+    }
+    if req[1] != socksCmdConnect {
+        SOCKS5Reply(conn, false)
+        return "", "", fmt.Errorf("unsupported SOCKS command %d", req[1])
+    }
+
+    return net.JoinHostPort(host, strconv.Itoa(int(port))), args, nil
+}
+
+// Reads the username and password, and joins them back together.
+func readSocksCredentials(conn net.Conn) (string, error) {
+    var ver [1]byte
+    if _, err := io.ReadFull(conn, ver[:]); err != nil {
+        return "", err
+    }
+
+    var fields [2][]byte
+    for i := range fields {
+        var length [1]byte
+        if _, err := io.ReadFull(conn, length[:]); err != nil {
+            return "", err
+        }
+        fields[i] = make([]byte, length[0])
+        if _, err := io.ReadFull(conn, fields[i]); err != nil {
+            return "", err
+        }
+    }
+
+    // A lone NUL password means "no password".
+    if len(fields[1]) == 1 && fields[1][0] == 0 {
+        fields[1] = nil
+    }
+    return string(fields[0]) + string(fields[1]), nil
+}
+
+// Sends the reply to a connect request.
+func SOCKS5Reply(conn net.Conn, ok bool) error {
+    code := byte(socksReplyOK)
+    if !ok {
+        code = socksReplyFailure
+    }
+
+    _, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+    return err
+}
@@ -3,6 +3,7 @@ package transports
 import (
     "encoding/binary"
     "fmt"
+    "io"
     "log"
     "net"
 )
@@ -16,15 +17,35 @@ type TCPPacketClient struct {
 
 const TCP_PORT = 44461
 
-func NewTCPPacketClient(server string) (*TCPPacketClient, error) {
-    host := fmt.Sprintf("%s:%d", server, TCP_PORT)
+// Only the Mimic option applies to clients.  opts can be nil.
+func NewTCPPacketClient(server string, opts *TCPOptions) (*TCPPacketClient, error) {
+    return DialTCPPacketClient(fmt.Sprintf("%s:%d", server, TCP_PORT), opts)
+}
 
+// Like NewTCPPacketClient, but connects to the given "host:port" rather than
+// the default port.
+func DialTCPPacketClient(host string, opts *TCPOptions) (*TCPPacketClient, error) {
     conn, err := net.Dial("tcp", host)
     if err != nil {
         log.Printf("Error connecting with TCP: %s", err)
         return nil, err
     }
 
+    return startTcpClient(host, conn, opts)
+}
+
+// Starts a client on an existing connection to the server, doing the TLS
+// mimicry handshake first if needed.
+func startTcpClient(host string, conn net.Conn, opts *TCPOptions) (*TCPPacketClient, error) {
+    if opts != nil && opts.Mimic != nil {
+        tls_conn, err := opts.Mimic.clientHandshake(conn)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        conn = tls_conn
+    }
+
     return newTcpClientFromConn(host, conn), nil
 }
 
@@ -43,25 +64,26 @@ func newTcpClientFromConn(host string, conn net.Conn) *TCPPacketClient {
 func (c *TCPPacketClient) doSend() {
     var pkt []byte
     var err error
-    var length = make([]byte, 2)
 
     for {
         // TODO: select on "stop" channel
         pkt = <-c.send_ch
 
-        binary.LittleEndian.PutUint16(length, uint16(len(pkt)))
-        _, err = c.conn.Write(length)
-        if err != nil {
-            log.Printf("Error writing length: %s\n", err)
-            break
-        }
-
-        _, err = c.conn.Write(pkt)
+        // The length and packet go in a single write, so that each packet
+        // ends up in one TLS record if we're mimicking TLS.
+        buf := make([]byte, 2, 2+len(pkt))
+        binary.LittleEndian.PutUint16(buf, uint16(len(pkt)))
+        _, err = c.conn.Write(append(buf, pkt...))
         if err != nil {
             log.Printf("Error writing packet: %s\n", err)
             break
         }
     }
+
+    // Closing the connection will cause the receive loop to stop, which
+    // signals to our user that we're done.
+    c.conn.Close()
+    drainPackets(c.send_ch)
 }
 
 func (c *TCPPacketClient) doRecv() {
@@ -71,7 +93,7 @@ func (c *TCPPacketClient) doRecv() {
     var length = make([]byte, 2)
 
     for {
-        _, err = c.conn.Read(length)
+        _, err = io.ReadFull(c.conn, length)
         if err != nil {
             log.Printf("Error reading length: %s\n", err)
             break
@@ -80,7 +102,7 @@ func (c *TCPPacketClient) doRecv() {
 
         pkt = make([]byte, ilen)
 
-        _, err = c.conn.Read(pkt)
+        _, err = io.ReadFull(c.conn, pkt)
         if err != nil {
             log.Printf("Error reading packet: %s\n", err)
             break
@@ -89,6 +111,8 @@ func (c *TCPPacketClient) doRecv() {
         // TODO: select on "stop" channel
         c.recv_ch <- pkt
     }
+
+    close(c.recv_ch)
 }
 
 func (c *TCPPacketClient) SendChannel() chan []byte {
@@ -108,24 +132,46 @@ func (c *TCPPacketClient) IsReliable() bool {
 }
 
 func (c *TCPPacketClient) Describe() string {
-    return "TCPPacketClient"
+    return fmt.Sprintf("TCPPacketClient(%s)", c.host)
+}
+
+// Options for the TCP transport.
+type TCPOptions struct {
+    // If set, connections from addresses for which this returns false are
+    // dropped immediately.
+    Filter func(addr net.Addr) bool
+
+    // Connections from these addresses are expected to start with a PROXY
+    // protocol header, which gives the real client's address.
+    TrustedProxies []*net.IPNet
+
+    // If set, frame everything as TLS records - see tlsmimic.go.
+    Mimic *TLSMimicry
 }
 
 type TCPTransport struct {
     listen    net.Listener
     accept_ch chan PacketClient
+    opts      TCPOptions
 }
 
-func NewTCPTransport(bindTo string) (*TCPTransport, error) {
-    host := fmt.Sprintf("%s:%d", bindTo, TCP_PORT)
+func NewTCPTransport(bindTo string, opts *TCPOptions) (*TCPTransport, error) {
+    return NewTCPTransportOn(fmt.Sprintf("%s:%d", bindTo, TCP_PORT), opts)
+}
 
+// Like NewTCPTransport, but listens on the given "host:port" rather than the
+// default port.
+func NewTCPTransportOn(host string, opts *TCPOptions) (*TCPTransport, error) {
     listener, err := net.Listen("tcp", host)
     if err != nil {
         return nil, err
     }
 
     client_ch := make(chan PacketClient)
-    trans := &TCPTransport{listener, client_ch}
+    trans := &TCPTransport{listen: listener, accept_ch: client_ch}
+    if opts != nil {
+        trans.opts = *opts
+    }
 
     go trans.acceptConnections()
 
@@ -142,11 +188,43 @@ func (t *TCPTransport) acceptConnections() {
             continue
         }
 
-        client := newTcpClientFromConn("host", conn)
-        t.accept_ch <- client
+        // Reading the PROXY header can take a while, so we don't do it here.
+        go t.handleConnection(conn)
     }
 }
 
+func (t *TCPTransport) handleConnection(raw_conn net.Conn) {
+    conn, err := acceptProxied(raw_conn, t.opts.TrustedProxies)
+    if err != nil {
+        log.Printf("Error accepting client: %s\n", err)
+        raw_conn.Close()
+        return
+    }
+
+    if t.opts.Filter != nil && !t.opts.Filter(conn.RemoteAddr()) {
+        log.Printf("Dropping connection from %s\n", conn.RemoteAddr())
+        conn.Close()
+        return
+    }
+
+    if t.opts.Mimic != nil {
+        tls_conn, err := t.opts.Mimic.serverHandshake(conn)
+        if err != nil {
+            log.Printf("Bad TLS handshake from %s: %s\n", conn.RemoteAddr(), err)
+            conn.Close()
+            return
+        }
+        conn = tls_conn
+    }
+
+    client := newTcpClientFromConn(conn.RemoteAddr().String(), conn)
+    t.accept_ch <- client
+}
+
+func (t *TCPTransport) Addr() net.Addr {
+    return t.listen.Addr()
+}
+
 func (t *TCPTransport) AcceptChannel() chan PacketClient {
     return t.accept_ch
 }
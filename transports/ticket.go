@@ -0,0 +1,207 @@
+package transports
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "sync"
+    "time"
+
+    "code.google.com/p/go.crypto/nacl/secretbox"
+)
+
+// Session resumption.  Once a client is connected, the server can give it a
+// ticket: the session's state, sealed with a key that only the server knows,
+// along with a fresh secret for the client to keep.  When the client comes
+// back (e.g. after its network drops out), it sends the ticket in the clear
+// at the start of the handshake, and both sides use the secret as the
+// pre-shared key instead of the one derived from the password:
+//
+//      [pattern] [ticket length (2 bytes)] [ticket] [-> psk, e]
+//
+// with noiseHasTicket set in the pattern byte.  This is still a full Noise
+// handshake (so the new session has its own keys), but it skips the
+// password KDF and the user lookup on both sides, and the server gets back
+// whatever it knew about the client.
+//
+// Tickets expire, and each one can only be used once: the server remembers
+// the tickets that have been used until they would have expired anyway.  A
+// ticket only counts as used once the client's handshake message checks out,
+// so someone replaying the ticket without the secret can't use it up.  If
+// the server can't use a ticket (e.g. because it has restarted since, and
+// has a new key), it says so, and the client does a normal handshake
+// instead.  Anyone could send that answer, so over unreliable transports,
+// the client only believes it if no real reply arrives before it would send
+// its message again.  (Someone who can drop the real reply can still make
+// the client do a normal handshake, but that's no worse than not having a
+// ticket.)
+//
+// A ticket is:
+//
+//      [nonce (24 bytes)] [sealed state]
+//
+// and the state is the times it was issued and expires (8 bytes each), the
+// generation (8 bytes), the secret (32 bytes), and then the identity, peer
+// key, hostname, tunnel IP and lease, each as a 2-byte length followed by its
+// bytes.
+
+const DefaultTicketLifetime = time.Hour
+
+const ticketSecretLen = 32
+
+// What the server remembers about a session.
+type SessionState struct {
+    // Who the client authenticated as (see EncryptedPacketClient.Identity),
+    // and their key, if they used one.
+    Identity string
+    PeerKey  []byte
+
+    // Anything else the server wants back.
+    Hostname string
+    TunnelIP string
+    Lease    []byte
+
+    // Which version of the password (or the user's secret) the client used,
+    // so the server can refuse sessions from before it changed.
+    Generation uint64
+}
+
+type TicketIssuer struct {
+    key      [32]byte
+    lifetime time.Duration
+
+    // Tickets that have been used, by nonce, with when they expire.
+    used map[string]time.Time
+    lock sync.Mutex
+}
+
+var errTicketRejected = fmt.Errorf("server rejected our session ticket")
+
+// Tickets are sealed with a random key, so they only work until the server
+// restarts.
+func NewTicketIssuer(lifetime time.Duration) (*TicketIssuer, error) {
+    t := &TicketIssuer{lifetime: lifetime, used: make(map[string]time.Time)}
+    if _, err := rand.Read(t.key[:]); err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+func (t *TicketIssuer) Lifetime() time.Duration {
+    return t.lifetime
+}
+
+// Returns a new ticket for the given state, and the secret that goes with it.
+func (t *TicketIssuer) Issue(state *SessionState) ([]byte, []byte, error) {
+    secret := make([]byte, ticketSecretLen)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, nil, err
+    }
+
+    var nonce [24]byte
+    if _, err := rand.Read(nonce[:]); err != nil {
+        return nil, nil, err
+    }
+
+    now := time.Now()
+    plain := make([]byte, 24, 24+ticketSecretLen)
+    binary.BigEndian.PutUint64(plain, uint64(now.Unix()))
+    binary.BigEndian.PutUint64(plain[8:], uint64(now.Add(t.lifetime).Unix()))
+    binary.BigEndian.PutUint64(plain[16:], state.Generation)
+    plain = append(plain, secret...)
+    for _, s := range []string{state.Identity, string(state.PeerKey), state.Hostname, state.TunnelIP, string(state.Lease)} {
+        var l [2]byte
+        binary.BigEndian.PutUint16(l[:], uint16(len(s)))
+        plain = append(plain, l[:]...)
+        plain = append(plain, s...)
+    }
+
+    ticket := secretbox.Seal(nonce[:], plain, &nonce, &t.key)
+    if len(ticket) > 0xFFFF {
+        return nil, nil, fmt.Errorf("session state too large for a ticket")
+    }
+    return ticket, secret, nil
+}
+
+// Opens a ticket, and gives its secret to verify, which checks that the
+// client has it too.  If it does, the ticket is marked as used, and its state
+// is returned.
+func (t *TicketIssuer) redeem(ticket []byte, verify func(secret []byte) error) (*SessionState, error) {
+    if len(ticket) < 24+secretbox.Overhead {
+        return nil, errTicketRejected
+    }
+
+    var nonce [24]byte
+    copy(nonce[:], ticket)
+    plain, ok := secretbox.Open(nil, ticket[24:], &nonce, &t.key)
+    if !ok || len(plain) < 24+ticketSecretLen {
+        return nil, errTicketRejected
+    }
+
+    now := time.Now()
+    expires := time.Unix(int64(binary.BigEndian.Uint64(plain[8:])), 0)
+    if now.After(expires) {
+        return nil, errTicketRejected
+    }
+
+    secret := plain[24 : 24+ticketSecretLen]
+    rest := plain[24+ticketSecretLen:]
+    var fields []string
+    for len(rest) >= 2 {
+        l := int(binary.BigEndian.Uint16(rest))
+        if len(rest) < 2+l {
+            break
+        }
+        fields = append(fields, string(rest[2:2+l]))
+        rest = rest[2+l:]
+    }
+    if len(fields) != 5 {
+        return nil, errTicketRejected
+    }
+
+    if t.isUsed(nonce[:]) {
+        return nil, errTicketRejected
+    }
+    if err := verify(secret); err != nil {
+        return nil, err
+    }
+
+    // Someone else may have used it in the meantime.
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if _, found := t.used[string(nonce[:])]; found {
+        return nil, errTicketRejected
+    }
+    t.used[string(nonce[:])] = expires
+
+    state := &SessionState{
+        Identity:   fields[0],
+        Hostname:   fields[2],
+        TunnelIP:   fields[3],
+        Generation: binary.BigEndian.Uint64(plain[16:]),
+    }
+    if len(fields[1]) > 0 {
+        state.PeerKey = []byte(fields[1])
+    }
+    if len(fields[4]) > 0 {
+        state.Lease = []byte(fields[4])
+    }
+    return state, nil
+}
+
+func (t *TicketIssuer) isUsed(nonce []byte) bool {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    // Forget about tickets that would have expired by now anyway.
+    now := time.Now()
+    for id, until := range t.used {
+        if now.After(until) {
+            delete(t.used, id)
+        }
+    }
+
+    _, found := t.used[string(nonce)]
+    return found
+}
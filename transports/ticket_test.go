@@ -0,0 +1,134 @@
+package transports
+
+import (
+    "bytes"
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func newTestIssuer(t *testing.T, lifetime time.Duration) *TicketIssuer {
+    issuer, err := NewTicketIssuer(lifetime)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return issuer
+}
+
+// A verify function that checks the secret is the one we were given.
+func expectSecret(secret []byte) func([]byte) error {
+    return func(got []byte) error {
+        if !bytes.Equal(got, secret) {
+            return fmt.Errorf("wrong secret")
+        }
+        return nil
+    }
+}
+
+func TestTicketRedeem(t *testing.T) {
+    issuer := newTestIssuer(t, time.Hour)
+    state := &SessionState{Identity: "laptop", PeerKey: []byte{1, 2, 3}, Hostname: "host", TunnelIP: "10.0.0.2",
+        Lease: []byte("lease"), Generation: 3}
+
+    ticket, secret, err := issuer.Issue(state)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(secret) != ticketSecretLen {
+        t.Fatalf("secret is %d bytes", len(secret))
+    }
+
+    got, err := issuer.redeem(ticket, expectSecret(secret))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(got, state) {
+        t.Fatalf("got %+v, expected %+v", got, state)
+    }
+
+    // No key means no key, rather than an empty one.
+    ticket, secret, _ = issuer.Issue(&SessionState{Identity: "phone"})
+    got, err = issuer.redeem(ticket, expectSecret(secret))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.PeerKey != nil {
+        t.Errorf("got peer key %v", got.PeerKey)
+    }
+}
+
+func TestTicketReplay(t *testing.T) {
+    issuer := newTestIssuer(t, time.Hour)
+    ticket, secret, _ := issuer.Issue(&SessionState{})
+
+    // Someone without the secret can't use the ticket up.
+    if _, err := issuer.redeem(ticket, func([]byte) error { return fmt.Errorf("bad handshake") }); err == nil {
+        t.Fatal("redeemed a ticket that failed verification")
+    }
+
+    if _, err := issuer.redeem(ticket, expectSecret(secret)); err != nil {
+        t.Fatalf("ticket was used up by a failed attempt: %s", err)
+    }
+    if _, err := issuer.redeem(ticket, expectSecret(secret)); err != errTicketRejected {
+        t.Fatalf("ticket was accepted twice (%v)", err)
+    }
+}
+
+func TestTicketRejected(t *testing.T) {
+    issuer := newTestIssuer(t, time.Hour)
+    ticket, secret, _ := issuer.Issue(&SessionState{Identity: "laptop"})
+
+    expired, expired_secret, _ := newTestIssuer(t, -time.Second).Issue(&SessionState{})
+    tampered := append([]byte{}, ticket...)
+    tampered[len(tampered)-1] ^= 1
+    other, other_secret, _ := newTestIssuer(t, time.Hour).Issue(&SessionState{})
+
+    tests := []struct {
+        name   string
+        ticket []byte
+        secret []byte
+    }{
+        {"expired", expired, expired_secret},
+        {"tampered", tampered, secret},
+        {"another server's", other, other_secret},
+        {"truncated", ticket[:30], secret},
+        {"empty", nil, secret},
+    }
+    for _, test := range tests {
+        verified := false
+        _, err := issuer.redeem(test.ticket, func([]byte) error {
+            verified = true
+            return nil
+        })
+        if err != errTicketRejected {
+            t.Errorf("%s: got %v", test.name, err)
+        }
+        if verified {
+            t.Errorf("%s: verified a ticket that should have been rejected", test.name)
+        }
+    }
+}
+
+// Used tickets are forgotten once they would have expired anyway.
+func TestTicketUsedForgotten(t *testing.T) {
+    issuer := newTestIssuer(t, time.Hour)
+    ticket, secret, _ := issuer.Issue(&SessionState{})
+    if _, err := issuer.redeem(ticket, expectSecret(secret)); err != nil {
+        t.Fatal(err)
+    }
+
+    issuer.lock.Lock()
+    for id := range issuer.used {
+        issuer.used[id] = time.Now().Add(-time.Second)
+    }
+    issuer.lock.Unlock()
+
+    issuer.isUsed(nil)
+    issuer.lock.Lock()
+    remaining := len(issuer.used)
+    issuer.lock.Unlock()
+    if remaining != 0 {
+        t.Errorf("%d used tickets remembered after expiring", remaining)
+    }
+}
@@ -0,0 +1,402 @@
+package transports
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+// This file makes the TCP framing look like TLS to anything that only looks
+// at record headers.  It's much lighter than running real TLS (and doesn't
+// need certificates), but won't fool anything that actually tries to follow
+// the TLS handshake.
+//
+// The connection starts with a ClientHello and ServerHello that look like a
+// TLS 1.3 handshake from a browser, followed by a ChangeCipherSpec from each
+// side (as TLS 1.3 does for middlebox compatibility).  After that, everything
+// is sent as application data records:
+//
+//      0x17 0x03 0x03 [length (2 bytes, big-endian)] [data]
+//
+// The "random" fields in the hellos are authenticated with a key derived from
+// the shared secret (with the server's KDF parameters, see kdf.go), so the
+// server can tell a real client from a prober (it just closes the connection
+// on anyone else), and the client can tell that it's talking to the real
+// server:
+//
+//      client random:  [timestamp (4 bytes)] [nonce (12 bytes)] [mac (16 bytes)]
+//      server random:  [nonce (16 bytes)] [mac (16 bytes)]
+//
+// where the client's MAC covers its timestamp and nonce, and the server's MAC
+// covers the client random and its own nonce.  Client hellos must be recent,
+// and each one is only accepted once.
+
+const (
+    tlsRecordChangeCipherSpec = 0x14
+    tlsRecordHandshake        = 0x16
+    tlsRecordApplicationData  = 0x17
+
+    tlsHandshakeClientHello = 0x01
+    tlsHandshakeServerHello = 0x02
+)
+
+// Biggest record body allowed by the spec.
+const tlsMaxRecord = 1 << 14
+
+const tlsHandshakeTimeout = 10 * time.Second
+const tlsMaxSkew = 2 * time.Minute
+
+type TLSMimicry struct {
+    // Server name to put in the ClientHello.
+    ServerName string
+
+    key *outerKey
+
+    // Client randoms we've seen --> when they can be forgotten.
+    seen      map[string]time.Time
+    seen_lock sync.Mutex
+}
+
+// The key comes from the secret and the server's KDF parameters.
+func NewTLSMimicry(secret string, params *KDFParams, server_name string) (*TLSMimicry, error) {
+    key, err := newOuterKey(secret, params, "tls")
+    if err != nil {
+        return nil, err
+    }
+
+    return &TLSMimicry{
+        ServerName: server_name,
+        key:        key,
+        seen:       make(map[string]time.Time),
+    }, nil
+}
+
+// Derives the key from a new secret.  Clients that are in the middle of a
+// handshake with the old one will fail, and try again.
+func (m *TLSMimicry) SetSecret(secret string) error {
+    return m.key.set(secret)
+}
+
+func (m *TLSMimicry) mac(parts ...[]byte) []byte {
+    h := hmac.New(sha256.New, m.key.get())
+    for _, part := range parts {
+        h.Write(part)
+    }
+    return h.Sum(nil)[:16]
+}
+
+// Does the client side of the handshake, and returns a connection that frames
+// everything as application data.
+func (m *TLSMimicry) clientHandshake(conn net.Conn) (net.Conn, error) {
+    conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+    defer conn.SetDeadline(time.Time{})
+
+    client_random := make([]byte, 32)
+    binary.BigEndian.PutUint32(client_random, uint32(time.Now().Unix()))
+    if _, err := io.ReadFull(rand.Reader, client_random[4:16]); err != nil {
+        return nil, err
+    }
+    copy(client_random[16:], m.mac([]byte("client"), client_random[:16]))
+
+    hello, err := makeClientHello(client_random, m.ServerName)
+    if err != nil {
+        return nil, err
+    }
+    if err = writeTLSRecord(conn, tlsRecordHandshake, 0x0301, hello); err != nil {
+        return nil, err
+    }
+
+    kind, body, err := readTLSRecord(conn)
+    if err != nil {
+        return nil, err
+    }
+    if kind != tlsRecordHandshake || len(body) < 38 || body[0] != tlsHandshakeServerHello {
+        return nil, fmt.Errorf("invalid ServerHello")
+    }
+
+    server_random := body[6:38]
+    expected := m.mac([]byte("server"), client_random, server_random[:16])
+    if subtle.ConstantTimeCompare(expected, server_random[16:]) != 1 {
+        return nil, fmt.Errorf("ServerHello is not from the real server")
+    }
+
+    // The server's ChangeCipherSpec.
+    if kind, _, err = readTLSRecord(conn); err != nil {
+        return nil, err
+    }
+    if kind != tlsRecordChangeCipherSpec {
+        return nil, fmt.Errorf("expected ChangeCipherSpec, got record type %d", kind)
+    }
+
+    if err = writeTLSRecord(conn, tlsRecordChangeCipherSpec, 0x0303, []byte{1}); err != nil {
+        return nil, err
+    }
+
+    return &tlsRecordConn{Conn: conn}, nil
+}
+
+// Does the server side of the handshake.
+func (m *TLSMimicry) serverHandshake(conn net.Conn) (net.Conn, error) {
+    conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+    defer conn.SetDeadline(time.Time{})
+
+    kind, body, err := readTLSRecord(conn)
+    if err != nil {
+        return nil, err
+    }
+
+    // Type, length (3 bytes), version (2 bytes), random (32 bytes), and then
+    // the session ID, which we echo.
+    if kind != tlsRecordHandshake || len(body) < 39 || body[0] != tlsHandshakeClientHello {
+        return nil, fmt.Errorf("invalid ClientHello")
+    }
+    client_random := append([]byte{}, body[6:38]...)
+    session_len := int(body[38])
+    if len(body) < 39+session_len {
+        return nil, fmt.Errorf("invalid ClientHello")
+    }
+    session_id := body[39 : 39+session_len]
+
+    if err = m.checkClientRandom(client_random); err != nil {
+        return nil, err
+    }
+
+    server_random := make([]byte, 32)
+    if _, err = io.ReadFull(rand.Reader, server_random[:16]); err != nil {
+        return nil, err
+    }
+    copy(server_random[16:], m.mac([]byte("server"), client_random, server_random[:16]))
+
+    hello, err := makeServerHello(server_random, session_id)
+    if err != nil {
+        return nil, err
+    }
+    if err = writeTLSRecord(conn, tlsRecordHandshake, 0x0303, hello); err != nil {
+        return nil, err
+    }
+    if err = writeTLSRecord(conn, tlsRecordChangeCipherSpec, 0x0303, []byte{1}); err != nil {
+        return nil, err
+    }
+
+    // The client's ChangeCipherSpec.
+    if kind, _, err = readTLSRecord(conn); err != nil {
+        return nil, err
+    }
+    if kind != tlsRecordChangeCipherSpec {
+        return nil, fmt.Errorf("expected ChangeCipherSpec, got record type %d", kind)
+    }
+
+    return &tlsRecordConn{Conn: conn}, nil
+}
+
+func (m *TLSMimicry) checkClientRandom(client_random []byte) error {
+    expected := m.mac([]byte("client"), client_random[:16])
+    if subtle.ConstantTimeCompare(expected, client_random[16:]) != 1 {
+        return fmt.Errorf("ClientHello is not from a real client")
+    }
+
+    sent := time.Unix(int64(binary.BigEndian.Uint32(client_random)), 0)
+    skew := time.Since(sent)
+    if skew < -tlsMaxSkew || skew > tlsMaxSkew {
+        return fmt.Errorf("ClientHello is too old (%s)", skew)
+    }
+
+    m.seen_lock.Lock()
+    defer m.seen_lock.Unlock()
+
+    now := time.Now()
+    for nonce, expires := range m.seen {
+        if now.After(expires) {
+            delete(m.seen, nonce)
+        }
+    }
+
+    if _, found := m.seen[string(client_random)]; found {
+        return fmt.Errorf("ClientHello has been replayed")
+    }
+    m.seen[string(client_random)] = now.Add(2 * tlsMaxSkew)
+    return nil
+}
+
+// --------------------------------------------------------------------------------
+
+// Builds a ClientHello that looks like one from a browser, offering TLS 1.3.
+func makeClientHello(random []byte, server_name string) ([]byte, error) {
+    session_id := make([]byte, 32)
+    key_share := make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, session_id); err != nil {
+        return nil, err
+    }
+    if _, err := io.ReadFull(rand.Reader, key_share); err != nil {
+        return nil, err
+    }
+
+    body := new(bytes.Buffer)
+    body.Write([]byte{0x03, 0x03})
+    body.Write(random)
+    body.WriteByte(byte(len(session_id)))
+    body.Write(session_id)
+
+    suites := []uint16{
+        0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+        0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+    }
+    binary.Write(body, binary.BigEndian, uint16(len(suites)*2))
+    for _, suite := range suites {
+        binary.Write(body, binary.BigEndian, suite)
+    }
+
+    // Compression methods: just "null".
+    body.Write([]byte{0x01, 0x00})
+
+    exts := new(bytes.Buffer)
+    if len(server_name) > 0 {
+        name := new(bytes.Buffer)
+        binary.Write(name, binary.BigEndian, uint16(len(server_name)+3))
+        name.WriteByte(0)
+        binary.Write(name, binary.BigEndian, uint16(len(server_name)))
+        name.WriteString(server_name)
+        writeTLSExtension(exts, 0x0000, name.Bytes())
+    }
+    // extended_master_secret, renegotiation_info, supported_groups (x25519,
+    // P-256, P-384), ec_point_formats, session_ticket, ALPN (h2, http/1.1).
+    writeTLSExtension(exts, 0x0017, nil)
+    writeTLSExtension(exts, 0xff01, []byte{0x00})
+    writeTLSExtension(exts, 0x000a, []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18})
+    writeTLSExtension(exts, 0x000b, []byte{0x01, 0x00})
+    writeTLSExtension(exts, 0x0023, nil)
+    writeTLSExtension(exts, 0x0010, []byte{
+        0x00, 0x0c, 0x02, 'h', '2', 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+
+    // signature_algorithms, supported_versions (TLS 1.3, 1.2),
+    // psk_key_exchange_modes, and a key_share for x25519.
+    writeTLSExtension(exts, 0x000d, []byte{
+        0x00, 0x10, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03,
+        0x08, 0x05, 0x05, 0x01, 0x08, 0x06, 0x06, 0x01})
+    writeTLSExtension(exts, 0x002b, []byte{0x04, 0x03, 0x04, 0x03, 0x03})
+    writeTLSExtension(exts, 0x002d, []byte{0x01, 0x01})
+
+    share := []byte{0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}
+    writeTLSExtension(exts, 0x0033, append(share, key_share...))
+
+    binary.Write(body, binary.BigEndian, uint16(exts.Len()))
+    body.Write(exts.Bytes())
+
+    return makeHandshakeMessage(tlsHandshakeClientHello, body.Bytes()), nil
+}
+
+// Builds a TLS 1.3 ServerHello.
+func makeServerHello(random, session_id []byte) ([]byte, error) {
+    key_share := make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, key_share); err != nil {
+        return nil, err
+    }
+
+    body := new(bytes.Buffer)
+    body.Write([]byte{0x03, 0x03})
+    body.Write(random)
+    body.WriteByte(byte(len(session_id)))
+    body.Write(session_id)
+    body.Write([]byte{0x13, 0x01}) // TLS_AES_128_GCM_SHA256
+    body.WriteByte(0x00)           // no compression
+
+    exts := new(bytes.Buffer)
+    writeTLSExtension(exts, 0x002b, []byte{0x03, 0x04}) // supported_versions: TLS 1.3
+    writeTLSExtension(exts, 0x0033, append([]byte{0x00, 0x1d, 0x00, 0x20}, key_share...))
+
+    binary.Write(body, binary.BigEndian, uint16(exts.Len()))
+    body.Write(exts.Bytes())
+
+    return makeHandshakeMessage(tlsHandshakeServerHello, body.Bytes()), nil
+}
+
+func writeTLSExtension(buf *bytes.Buffer, kind uint16, data []byte) {
+    binary.Write(buf, binary.BigEndian, kind)
+    binary.Write(buf, binary.BigEndian, uint16(len(data)))
+    buf.Write(data)
+}
+
+func makeHandshakeMessage(kind byte, body []byte) []byte {
+    msg := []byte{kind, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+    return append(msg, body...)
+}
+
+func writeTLSRecord(w io.Writer, kind byte, version uint16, body []byte) error {
+    record := make([]byte, 5, 5+len(body))
+    record[0] = kind
+    binary.BigEndian.PutUint16(record[1:], version)
+    binary.BigEndian.PutUint16(record[3:], uint16(len(body)))
+    _, err := w.Write(append(record, body...))
+    return err
+}
+
+func readTLSRecord(r io.Reader) (byte, []byte, error) {
+    var hdr [5]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return 0, nil, err
+    }
+    if hdr[1] != 0x03 {
+        return 0, nil, fmt.Errorf("not a TLS record")
+    }
+
+    // Allow a little over the maximum, since encrypted records can be.
+    length := int(binary.BigEndian.Uint16(hdr[3:]))
+    if length > tlsMaxRecord+256 {
+        return 0, nil, fmt.Errorf("TLS record too long (%d bytes)", length)
+    }
+
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return 0, nil, err
+    }
+    return hdr[0], body, nil
+}
+
+// --------------------------------------------------------------------------------
+
+// A connection that sends everything as TLS application data records.
+type tlsRecordConn struct {
+    net.Conn
+    read_buf []byte
+}
+
+func (c *tlsRecordConn) Write(data []byte) (int, error) {
+    written := 0
+    for written < len(data) {
+        chunk := data[written:]
+        if len(chunk) > tlsMaxRecord {
+            chunk = chunk[:tlsMaxRecord]
+        }
+
+        if err := writeTLSRecord(c.Conn, tlsRecordApplicationData, 0x0303, chunk); err != nil {
+            return written, err
+        }
+        written += len(chunk)
+    }
+    return written, nil
+}
+
+func (c *tlsRecordConn) Read(buf []byte) (int, error) {
+    for len(c.read_buf) == 0 {
+        kind, body, err := readTLSRecord(c.Conn)
+        if err != nil {
+            return 0, err
+        }
+        if kind != tlsRecordApplicationData {
+            return 0, fmt.Errorf("unexpected TLS record type %d", kind)
+        }
+        c.read_buf = body
+    }
+
+    n := copy(buf, c.read_buf)
+    c.read_buf = c.read_buf[n:]
+    return n, nil
+}
@@ -0,0 +1,234 @@
+package transports
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func newTestMimicry(t *testing.T, secret string) *TLSMimicry {
+    params := &KDFParams{KDFPBKDF2, minPBKDF2Iterations, 0, 0, []byte("salt")}
+    m, err := NewTLSMimicry(secret, params, "www.example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return m
+}
+
+// A client random as a client sent it at the given time.
+func mimicClientRandom(t *testing.T, m *TLSMimicry, sent time.Time) []byte {
+    random := make([]byte, 32)
+    nonce := randomKey(t)
+    binary.BigEndian.PutUint32(random, uint32(sent.Unix()))
+    copy(random[4:16], nonce[:12])
+    copy(random[16:], m.mac([]byte("client"), random[:16]))
+    return random
+}
+
+// Runs both sides of the handshake over a pipe.
+func mimicHandshake(client, server *TLSMimicry) (net.Conn, net.Conn, error, error) {
+    client_end, server_end := net.Pipe()
+
+    type result struct {
+        conn net.Conn
+        err  error
+    }
+    done := make(chan result)
+    go func() {
+        conn, err := server.serverHandshake(server_end)
+        if err != nil {
+            server_end.Close()
+        }
+        done <- result{conn, err}
+    }()
+
+    client_conn, client_err := client.clientHandshake(client_end)
+    if client_err != nil {
+        client_end.Close()
+    }
+    server_result := <-done
+    return client_conn, server_result.conn, client_err, server_result.err
+}
+
+// Offers the server a ClientHello with the given random, and finishes the
+// handshake if the server goes along with it.
+func offerClientHello(t *testing.T, m *TLSMimicry, random []byte) error {
+    client_end, server_end := net.Pipe()
+    defer client_end.Close()
+
+    done := make(chan error)
+    go func() {
+        _, err := m.serverHandshake(server_end)
+        server_end.Close()
+        done <- err
+    }()
+
+    hello, err := makeClientHello(random, "www.example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if writeTLSRecord(client_end, tlsRecordHandshake, 0x0301, hello) == nil {
+        if _, _, err := readTLSRecord(client_end); err == nil {
+            readTLSRecord(client_end)
+            writeTLSRecord(client_end, tlsRecordChangeCipherSpec, 0x0303, []byte{1})
+        }
+    }
+    return <-done
+}
+
+func TestTLSMimicryHandshake(t *testing.T) {
+    m := newTestMimicry(t, "secret")
+    client, server, client_err, server_err := mimicHandshake(m, m)
+    if client_err != nil || server_err != nil {
+        t.Fatalf("client: %v, server: %v", client_err, server_err)
+    }
+    defer client.Close()
+    defer server.Close()
+
+    // Bigger than a record, so it's split.
+    data := bytes.Repeat([]byte("0123456789abcdef"), tlsMaxRecord/8)
+    go client.Write(data)
+    got := make([]byte, len(data))
+    if _, err := io.ReadFull(server, got); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Error("data was corrupted")
+    }
+
+    go server.Write([]byte("reply"))
+    got = make([]byte, 5)
+    if _, err := io.ReadFull(client, got); err != nil || string(got) != "reply" {
+        t.Errorf("got %q, %v", got, err)
+    }
+}
+
+func TestTLSMimicryWrongSecret(t *testing.T) {
+    _, _, client_err, server_err := mimicHandshake(newTestMimicry(t, "secret"), newTestMimicry(t, "other"))
+    if client_err == nil || server_err == nil {
+        t.Errorf("handshake with the wrong secret: client: %v, server: %v", client_err, server_err)
+    }
+
+    // A server that doesn't know the secret can't pass itself off as the
+    // real one.
+    m := newTestMimicry(t, "secret")
+    client_end, server_end := net.Pipe()
+    defer server_end.Close()
+    server_random := randomKey(t)
+    go func() {
+        kind, body, err := readTLSRecord(server_end)
+        if err != nil || kind != tlsRecordHandshake || len(body) < 39 {
+            return
+        }
+        hello, _ := makeServerHello(server_random[:], body[39:39+int(body[38])])
+        writeTLSRecord(server_end, tlsRecordHandshake, 0x0303, hello)
+        writeTLSRecord(server_end, tlsRecordChangeCipherSpec, 0x0303, []byte{1})
+    }()
+    if _, err := m.clientHandshake(client_end); err == nil {
+        t.Error("client accepted a forged ServerHello")
+    }
+}
+
+// When the server's password changes, only clients with the new one get in.
+func TestTLSMimicrySetSecret(t *testing.T) {
+    server := newTestMimicry(t, "secret")
+    if err := server.SetSecret("new"); err != nil {
+        t.Fatal(err)
+    }
+
+    _, _, client_err, server_err := mimicHandshake(newTestMimicry(t, "secret"), server)
+    if client_err == nil || server_err == nil {
+        t.Errorf("handshake with the old secret: client: %v, server: %v", client_err, server_err)
+    }
+
+    client, conn, client_err, server_err := mimicHandshake(newTestMimicry(t, "new"), server)
+    if client_err != nil || server_err != nil {
+        t.Fatalf("handshake with the new secret: client: %v, server: %v", client_err, server_err)
+    }
+    client.Close()
+    conn.Close()
+}
+
+func TestTLSMimicryReplay(t *testing.T) {
+    m := newTestMimicry(t, "secret")
+    random := mimicClientRandom(t, m, time.Now())
+    if err := offerClientHello(t, m, random); err != nil {
+        t.Fatal(err)
+    }
+    if err := offerClientHello(t, m, random); err == nil {
+        t.Error("server accepted a replayed ClientHello")
+    }
+}
+
+func TestTLSMimicryClientRandom(t *testing.T) {
+    m := newTestMimicry(t, "secret")
+    other := newTestMimicry(t, "other")
+    tampered := mimicClientRandom(t, m, time.Now())
+    tampered[5] ^= 1
+    junk := randomKey(t)
+
+    tests := []struct {
+        name   string
+        random []byte
+        ok     bool
+    }{
+        {"fresh", mimicClientRandom(t, m, time.Now()), true},
+        {"slightly behind", mimicClientRandom(t, m, time.Now().Add(-time.Minute)), true},
+        {"slightly ahead", mimicClientRandom(t, m, time.Now().Add(time.Minute)), true},
+        {"too old", mimicClientRandom(t, m, time.Now().Add(-tlsMaxSkew-time.Minute)), false},
+        {"too far ahead", mimicClientRandom(t, m, time.Now().Add(tlsMaxSkew+time.Minute)), false},
+        {"wrong key", mimicClientRandom(t, other, time.Now()), false},
+        {"tampered", tampered, false},
+        {"random", junk[:], false},
+    }
+    for _, test := range tests {
+        if err := m.checkClientRandom(test.random); (err == nil) != test.ok {
+            t.Errorf("%s: got %v", test.name, err)
+        }
+    }
+}
+
+func TestTLSRecordConn(t *testing.T) {
+    buf := new(bytes.Buffer)
+    conn := &tlsRecordConn{Conn: &bufferConn{buf}}
+    if _, err := conn.Write(make([]byte, tlsMaxRecord+1)); err != nil {
+        t.Fatal(err)
+    }
+
+    // Two application data records that look like TLS 1.2.
+    for _, length := range []int{tlsMaxRecord, 1} {
+        hdr := buf.Next(5)
+        if len(hdr) != 5 || hdr[0] != tlsRecordApplicationData || hdr[1] != 3 || hdr[2] != 3 ||
+            int(binary.BigEndian.Uint16(hdr[3:])) != length {
+            t.Fatalf("got record header %x", hdr)
+        }
+        buf.Next(length)
+    }
+
+    // Anything other than application data is refused.
+    writeTLSRecord(buf, tlsRecordHandshake, 0x0303, []byte("hello"))
+    if _, err := conn.Read(make([]byte, 16)); err == nil {
+        t.Error("read a handshake record as data")
+    }
+
+    buf.Reset()
+    buf.Write([]byte{tlsRecordApplicationData, 3, 3, 0xFF, 0xFF})
+    if _, err := conn.Read(make([]byte, 16)); err == nil {
+        t.Error("read an oversized record")
+    }
+}
+
+// A net.Conn that reads and writes a buffer.
+type bufferConn struct {
+    *bytes.Buffer
+}
+
+func (c *bufferConn) Close() error                       { return nil }
+func (c *bufferConn) LocalAddr() net.Addr                { return nil }
+func (c *bufferConn) RemoteAddr() net.Addr               { return nil }
+func (c *bufferConn) SetDeadline(t time.Time) error      { return nil }
+func (c *bufferConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *bufferConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,125 @@
+package transports
+
+import (
+    "crypto/tls"
+    "fmt"
+    "log"
+    "net"
+
+    "github.com/pion/turn/v2"
+)
+
+// This transport reaches the server through a TURN relay.  Networks that
+// block everything else often still allow TURN (on 3478, or on 443 over TLS),
+// since video calls need it.  We allocate a relay address on the TURN server,
+// and then send our packets from there to the server's normal UDP port - so
+// as far as the server is concerned, this is just another UDP client (and it
+// uses session IDs the same way).
+//
+// The connection to the TURN server itself can be over UDP, TCP or TLS, and
+// is authenticated with the TURN server's long-term credentials.
+
+const TURN_PORT = 3478
+
+type TURNOptions struct {
+    // Address of the TURN server, as "host" or "host:port".
+    Server string
+
+    // How to talk to the TURN server: "udp", "tcp" or "tls".
+    Protocol string
+
+    // Long-term credentials for the TURN server.
+    Username string
+    Password string
+    Realm    string
+}
+
+// Connects to the TURN server and returns a net.PacketConn for talking to it.
+func dialTURNServer(opts *TURNOptions) (net.PacketConn, string, error) {
+    host := opts.Server
+    if _, _, err := net.SplitHostPort(host); err != nil {
+        host = fmt.Sprintf("%s:%d", host, TURN_PORT)
+    }
+
+    switch opts.Protocol {
+    case "", "udp":
+        conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+        return conn, host, err
+
+    case "tcp":
+        conn, err := net.Dial("tcp", host)
+        if err != nil {
+            return nil, "", err
+        }
+        return turn.NewSTUNConn(conn), host, nil
+
+    case "tls":
+        server_name, _, _ := net.SplitHostPort(host)
+        conn, err := tls.Dial("tcp", host, &tls.Config{ServerName: server_name})
+        if err != nil {
+            return nil, "", err
+        }
+        return turn.NewSTUNConn(conn), host, nil
+    }
+
+    return nil, "", fmt.Errorf("unknown TURN protocol: %s", opts.Protocol)
+}
+
+func NewTURNPacketClient(server string, opts *TURNOptions) (*genericPacketClient, error) {
+    peer, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", server, UDP_PORT))
+    if err != nil {
+        return nil, err
+    }
+    return newTURNPacketClient(peer, opts)
+}
+
+// Relays packets to the given address.
+func newTURNPacketClient(peer *net.UDPAddr, opts *TURNOptions) (*genericPacketClient, error) {
+    conn, turn_host, err := dialTURNServer(opts)
+    if err != nil {
+        return nil, err
+    }
+
+    client, err := turn.NewClient(&turn.ClientConfig{
+        STUNServerAddr: turn_host,
+        TURNServerAddr: turn_host,
+        Conn:           conn,
+        Username:       opts.Username,
+        Password:       opts.Password,
+        Realm:          opts.Realm,
+    })
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    if err = client.Listen(); err != nil {
+        client.Close()
+        conn.Close()
+        return nil, err
+    }
+
+    relay, err := client.Allocate()
+    if err != nil {
+        client.Close()
+        conn.Close()
+        return nil, err
+    }
+    log.Printf("Allocated TURN relay address %s on %s\n", relay.LocalAddr(), turn_host)
+
+    // Closing the client closes the relay (which releases the allocation),
+    // so we just need to tidy up the rest.
+    onClose := func() {
+        client.Close()
+        conn.Close()
+    }
+
+    ret, err := newGenericPacketClientFromConn(&packetConnTo{relay, peer},
+        "turn", peer.String(), true, onClose)
+    if err != nil {
+        relay.Close()
+        onClose()
+        return nil, err
+    }
+    return ret, nil
+}
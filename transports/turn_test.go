@@ -0,0 +1,138 @@
+package transports
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "github.com/pion/turn/v2"
+)
+
+// Starts a TURN server on localhost, listening on UDP and TCP, which also
+// answers STUN requests.  Returns its UDP and TCP addresses.
+func startTestTURNServer(t *testing.T, username, password string) (string, string) {
+    conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    listener, err := net.Listen("tcp4", "127.0.0.1:0")
+    if err != nil {
+        conn.Close()
+        t.Fatal(err)
+    }
+
+    relay := func() turn.RelayAddressGenerator {
+        return &turn.RelayAddressGeneratorStatic{
+            RelayAddress: net.ParseIP("127.0.0.1"),
+            Address:      "127.0.0.1",
+        }
+    }
+
+    key := turn.GenerateAuthKey(username, "holepunch", password)
+    server, err := turn.NewServer(turn.ServerConfig{
+        Realm: "holepunch",
+        AuthHandler: func(user, realm string, addr net.Addr) ([]byte, bool) {
+            return key, user == username
+        },
+        PacketConnConfigs: []turn.PacketConnConfig{{
+            PacketConn:            conn,
+            RelayAddressGenerator: relay(),
+        }},
+        ListenerConfigs: []turn.ListenerConfig{{
+            Listener:              listener,
+            RelayAddressGenerator: relay(),
+        }},
+    })
+    if err != nil {
+        conn.Close()
+        listener.Close()
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { server.Close() })
+
+    return conn.LocalAddr().String(), listener.Addr().String()
+}
+
+// Starts a UDP server that echoes packets back, standing in for holepunch's
+// UDP transport.
+func startEchoServer(t *testing.T) *net.UDPAddr {
+    conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    go func() {
+        var buf [65535]byte
+        for {
+            n, addr, err := conn.ReadFrom(buf[:])
+            if err != nil {
+                return
+            }
+            conn.WriteTo(buf[:n], addr)
+        }
+    }()
+
+    return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestTURNRelay(t *testing.T) {
+    udp_addr, tcp_addr := startTestTURNServer(t, "user", "pass")
+    echo := startEchoServer(t)
+
+    tests := []struct {
+        protocol string
+        server   string
+    }{
+        {"udp", udp_addr},
+        {"tcp", tcp_addr},
+    }
+    for _, test := range tests {
+        client, err := newTURNPacketClient(echo, &TURNOptions{
+            Server:   test.server,
+            Protocol: test.protocol,
+            Username: "user",
+            Password: "pass",
+            Realm:    "holepunch",
+        })
+        if err != nil {
+            t.Fatalf("%s: %s", test.protocol, err)
+        }
+
+        // Packets go through the relay, so the echo server sees them coming
+        // from the relay address, and sends them back the same way.
+        client.SendChannel() <- []byte("hello " + test.protocol)
+        select {
+        case pkt := <-client.RecvChannel():
+            if string(pkt) != "hello "+test.protocol {
+                t.Errorf("%s: got %q", test.protocol, pkt)
+            }
+        case <-time.After(5 * time.Second):
+            t.Errorf("%s: no reply through the relay", test.protocol)
+        }
+        client.Close()
+    }
+}
+
+func TestTURNBadCredentials(t *testing.T) {
+    udp_addr, _ := startTestTURNServer(t, "user", "pass")
+    echo := startEchoServer(t)
+
+    _, err := newTURNPacketClient(echo, &TURNOptions{
+        Server:   udp_addr,
+        Username: "user",
+        Password: "wrong",
+        Realm:    "holepunch",
+    })
+    if err == nil {
+        t.Fatal("allocation succeeded with the wrong password")
+    }
+}
+
+func TestTURNUnknownProtocol(t *testing.T) {
+    _, err := newTURNPacketClient(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+        &TURNOptions{Server: "127.0.0.1", Protocol: "carrier-pigeon"})
+    if err == nil {
+        t.Fatal("unknown protocol was accepted")
+    }
+}
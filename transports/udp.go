@@ -1,6 +1,7 @@
 package transports
 
 import (
+    "net"
     "sync"
 )
 
@@ -8,8 +9,12 @@ import (
 // UDP packets here can be spoofed, so it is necessary to have the encryption/
 // authentication layer working too.  There's no point in using a sequence
 // number or something similar, since we don't make any guarantees about the
-// delivery of packets (similar to the internet as a whole).
-// TODO: protect against replay attacks somehow
+// delivery of packets (similar to the internet as a whole).  Replayed packets
+// are rejected by the encryption layer, which keeps a window of the packet
+// counters it has seen.
+//
+// UDP clients use session IDs, so that a session survives the client's
+// address changing.
 
 const UDP_PORT = 44461
 
@@ -17,9 +22,10 @@ var udpClientMap = make(map[string]*genericPacketClient)
 var udpClientMapLock sync.RWMutex
 
 func NewUDPPacketClient(server string) (*genericPacketClient, error) {
-    return newGenericPacketClient("udp", server, UDP_PORT, nil)
+    return newGenericPacketClient("udp", server, UDP_PORT, true, nil)
 }
 
-func NewUDPTransport(bindTo string) (*genericPacketTransport, error) {
-    return newGenericPacketTransport("udp", bindTo, UDP_PORT, udpClientMap, udpClientMapLock)
+// If filter is set, packets from addresses it rejects are dropped.
+func NewUDPTransport(bindTo string, filter func(addr net.Addr) bool) (*genericPacketTransport, error) {
+    return newGenericPacketTransport("udp", bindTo, UDP_PORT, true, filter, udpClientMap, &udpClientMapLock)
 }
@@ -0,0 +1,565 @@
+package transports
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// This transport tunnels packets over a WebRTC data channel, which looks just
+// like a video call.  The data channel is unordered and unreliable, so it
+// behaves like UDP.
+//
+// Before the peer connection can be set up, the client and server need to
+// swap session descriptions.  We do this with a single HTTP request to the
+// server's signaling endpoint: the client POSTs its offer, and gets the
+// server's answer back.  We don't do trickle ICE - both sides wait until
+// they've gathered all their candidates - which is slower, but means the
+// exchange is a single round trip.  The request is authenticated with an HMAC
+// of the offer, keyed from the shared secret, so that random people can't
+// make us set up peer connections.  The header looks like:
+//
+//      X-Holepunch-Auth: [timestamp]:[nonce]:[HMAC of timestamp, nonce and offer]
+//
+// The server rejects requests whose timestamp is too far from its own clock,
+// and remembers the nonces it has seen until then, so a request that was
+// captured can't be replayed.  It also limits how many peer connections can
+// be waiting for their data channel to open at once.
+//
+// NAT traversal uses ICE, with whatever STUN servers are configured.  There
+// are none by default, since asking a public STUN server tells whoever runs
+// it that we're here; without one, only host candidates are used, which is
+// enough when the server has a public address.
+
+const WEBRTC_SIGNAL_PORT = 44464
+
+const webrtcSignalPath = "/signal"
+const webrtcAuthHeader = "X-Holepunch-Auth"
+
+// How long we wait for the data channel to open.
+const webrtcConnectTimeout = 15 * time.Second
+
+// How far a signaling request's timestamp can be from the server's clock.
+const webrtcSignalSkew = 30 * time.Second
+
+// The most peer connections that can be waiting for their data channel.
+const webrtcMaxPending = 16
+
+// Messages that arrive before the client is started are kept, up to this
+// many.
+const webrtcIncomingBuffer = 64
+
+type WebRTCOptions struct {
+    // Shared secret, used to authenticate signaling requests.
+    Secret string
+
+    // STUN (or TURN) server URLs to use for ICE.
+    STUNServers []string
+
+    // Client only: the URL of the signaling endpoint.  If this is empty, we
+    // use the server's address and the default signaling port.
+    SignalURL string
+
+    // Server only: if set, connections to the signaling endpoint from
+    // addresses this rejects are dropped (e.g. because they haven't knocked).
+    Filter func(addr net.Addr) bool
+}
+
+type WebRTCPacketClient struct {
+    pc      *webrtc.PeerConnection
+    dc      *webrtc.DataChannel
+    send_ch  chan []byte
+    recv_ch  chan []byte
+    incoming chan []byte
+    desc     string
+
+    closed     chan bool
+    close_once sync.Once
+}
+
+func webrtcConfig(opts *WebRTCOptions) webrtc.Configuration {
+    var config webrtc.Configuration
+    if len(opts.STUNServers) > 0 {
+        config.ICEServers = []webrtc.ICEServer{{URLs: opts.STUNServers}}
+    }
+    return config
+}
+
+func signalMAC(secret, timestamp, nonce, sdp string) string {
+    mac := hmac.New(sha256.New, []byte("holepunch-webrtc:"+secret))
+    mac.Write([]byte(timestamp + ":" + nonce + ":"))
+    mac.Write([]byte(sdp))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the value of the auth header for an offer.
+func signalAuth(secret string, sdp string) (string, error) {
+    var nonce [16]byte
+    if _, err := rand.Read(nonce[:]); err != nil {
+        return "", err
+    }
+
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    nonce_hex := hex.EncodeToString(nonce[:])
+    return timestamp + ":" + nonce_hex + ":" + signalMAC(secret, timestamp, nonce_hex, sdp), nil
+}
+
+func NewWebRTCPacketClient(server string, opts *WebRTCOptions) (*WebRTCPacketClient, error) {
+    pc, err := webrtc.NewPeerConnection(webrtcConfig(opts))
+    if err != nil {
+        return nil, err
+    }
+
+    // Unordered, with no retransmissions - i.e. just like UDP.
+    ordered := false
+    retransmits := uint16(0)
+    dc, err := pc.CreateDataChannel("holepunch", &webrtc.DataChannelInit{
+        Ordered:        &ordered,
+        MaxRetransmits: &retransmits,
+    })
+    if err != nil {
+        pc.Close()
+        return nil, err
+    }
+
+    client := newWebRTCClient(pc, dc, server)
+    opened := make(chan bool, 1)
+    dc.OnOpen(func() {
+        opened <- true
+    })
+
+    // Create our offer, and wait until we've gathered all our candidates.
+    offer, err := pc.CreateOffer(nil)
+    if err == nil {
+        gathered := webrtc.GatheringCompletePromise(pc)
+        if err = pc.SetLocalDescription(offer); err == nil {
+            <-gathered
+        }
+    }
+    if err != nil {
+        pc.Close()
+        return nil, err
+    }
+
+    signal_url := opts.SignalURL
+    if len(signal_url) == 0 {
+        signal_url = fmt.Sprintf("http://%s%s", net.JoinHostPort(server,
+            fmt.Sprint(WEBRTC_SIGNAL_PORT)), webrtcSignalPath)
+    }
+
+    answer, err := exchangeOffer(signal_url, opts.Secret, *pc.LocalDescription())
+    if err == nil {
+        err = pc.SetRemoteDescription(answer)
+    }
+    if err != nil {
+        pc.Close()
+        return nil, err
+    }
+
+    select {
+    case <-opened:
+    case <-client.closed:
+        return nil, fmt.Errorf("peer connection failed")
+    case <-time.After(webrtcConnectTimeout):
+        pc.Close()
+        return nil, fmt.Errorf("timed out waiting for data channel")
+    }
+
+    client.start()
+    return client, nil
+}
+
+// Sends our offer to the signaling endpoint, and returns the answer.
+func exchangeOffer(url, secret string, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+    var answer webrtc.SessionDescription
+
+    body, err := json.Marshal(offer)
+    if err != nil {
+        return answer, err
+    }
+
+    req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+    if err != nil {
+        return answer, err
+    }
+    auth, err := signalAuth(secret, offer.SDP)
+    if err != nil {
+        return answer, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(webrtcAuthHeader, auth)
+
+    http_client := &http.Client{Timeout: webrtcConnectTimeout}
+    resp, err := http_client.Do(req)
+    if err != nil {
+        return answer, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return answer, fmt.Errorf("signaling failed: %s", resp.Status)
+    }
+
+    err = json.NewDecoder(resp.Body).Decode(&answer)
+    return answer, err
+}
+
+func newWebRTCClient(pc *webrtc.PeerConnection, dc *webrtc.DataChannel, desc string) *WebRTCPacketClient {
+    client := &WebRTCPacketClient{
+        pc: pc, dc: dc,
+        send_ch:  make(chan []byte),
+        recv_ch:  make(chan []byte),
+        incoming: make(chan []byte, webrtcIncomingBuffer),
+        desc:     desc,
+        closed:   make(chan bool),
+    }
+
+    // The other side can send as soon as the channel opens, which may be
+    // before we've started, so messages are queued until then.  This is
+    // called from pion's read loop, so it mustn't block: if the queue is
+    // full, the message is dropped, just as it would be on the wire.
+    dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+        select {
+        case client.incoming <- msg.Data:
+        default:
+        }
+    })
+
+    pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+        log.Printf("WebRTC connection to %s is now %s\n", desc, state)
+        if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+            client.Close()
+        }
+    })
+
+    return client
+}
+
+func (c *WebRTCPacketClient) start() {
+    go c.doSend()
+    go c.doRecv()
+}
+
+func (c *WebRTCPacketClient) doRecv() {
+    for {
+        select {
+        case pkt := <-c.incoming:
+            select {
+            case c.recv_ch <- pkt:
+            case <-c.closed:
+                close(c.recv_ch)
+                return
+            }
+
+        case <-c.closed:
+            close(c.recv_ch)
+            return
+        }
+    }
+}
+
+func (c *WebRTCPacketClient) doSend() {
+    for {
+        select {
+        case pkt := <-c.send_ch:
+            if err := c.dc.Send(pkt); err != nil {
+                log.Printf("Error sending on data channel: %s\n", err)
+            }
+
+        case <-c.closed:
+            drainPackets(c.send_ch)
+            return
+        }
+    }
+}
+
+func (c *WebRTCPacketClient) SendChannel() chan []byte {
+    return c.send_ch
+}
+
+func (c *WebRTCPacketClient) RecvChannel() chan []byte {
+    return c.recv_ch
+}
+
+func (c *WebRTCPacketClient) Close() {
+    c.close_once.Do(func() {
+        close(c.closed)
+        c.pc.Close()
+    })
+}
+
+func (c *WebRTCPacketClient) IsReliable() bool {
+    return false
+}
+
+func (c *WebRTCPacketClient) Describe() string {
+    return fmt.Sprintf("WebRTCPacketClient(%s)", c.desc)
+}
+
+// --------------------------------------------------------------------------------
+
+type WebRTCTransport struct {
+    accept_ch chan PacketClient
+    opts      WebRTCOptions
+
+    // The nonces of recent signaling requests, and when we can forget them.
+    nonces  map[string]time.Time
+    pending int
+    lock    sync.Mutex
+}
+
+// Starts the signaling endpoint, which listens on the given address.
+func NewWebRTCTransport(bindTo string, opts *WebRTCOptions) (*WebRTCTransport, error) {
+    host := net.JoinHostPort(bindTo, strconv.Itoa(WEBRTC_SIGNAL_PORT))
+
+    listener, err := net.Listen("tcp", host)
+    if err != nil {
+        return nil, err
+    }
+    if opts.Filter != nil {
+        listener = &filteredListener{listener, opts.Filter}
+    }
+
+    trans := newWebRTCTransport(opts)
+
+    mux := http.NewServeMux()
+    mux.HandleFunc(webrtcSignalPath, trans.handleSignal)
+
+    go func() {
+        err := http.Serve(listener, mux)
+        log.Printf("WebRTC signaling stopped: %s\n", err)
+    }()
+
+    return trans, nil
+}
+
+// Hangs up on connections from addresses the filter rejects, before the HTTP
+// server sees them.
+type filteredListener struct {
+    net.Listener
+    filter func(addr net.Addr) bool
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+    for {
+        conn, err := l.Listener.Accept()
+        if err != nil {
+            return nil, err
+        }
+        if l.filter(conn.RemoteAddr()) {
+            return conn, nil
+        }
+        log.Printf("Dropping signaling connection from %s\n", conn.RemoteAddr())
+        conn.Close()
+    }
+}
+
+func newWebRTCTransport(opts *WebRTCOptions) *WebRTCTransport {
+    return &WebRTCTransport{
+        accept_ch: make(chan PacketClient),
+        opts:      *opts,
+        nonces:    make(map[string]time.Time),
+    }
+}
+
+// Signaling requests have to be signed with the new secret from now on.
+func (t *WebRTCTransport) SetSecret(secret string) error {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    t.opts.Secret = secret
+    return nil
+}
+
+// Checks a signaling request's auth header, and that it hasn't been seen
+// before.
+func (t *WebRTCTransport) checkAuth(header, sdp string) bool {
+    parts := strings.SplitN(header, ":", 3)
+    if len(parts) != 3 || len(parts[1]) == 0 {
+        return false
+    }
+
+    t.lock.Lock()
+    secret := t.opts.Secret
+    t.lock.Unlock()
+
+    expected := signalMAC(secret, parts[0], parts[1], sdp)
+    if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+        return false
+    }
+
+    timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return false
+    }
+    now := time.Now()
+    sent := time.Unix(timestamp, 0)
+    if sent.Before(now.Add(-webrtcSignalSkew)) || sent.After(now.Add(webrtcSignalSkew)) {
+        return false
+    }
+
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    for nonce, expiry := range t.nonces {
+        if now.After(expiry) {
+            delete(t.nonces, nonce)
+        }
+    }
+    if _, found := t.nonces[parts[1]]; found {
+        return false
+    }
+    t.nonces[parts[1]] = sent.Add(webrtcSignalSkew)
+    return true
+}
+
+// Reserves a slot for a new peer connection.  The returned function frees it
+// again, and can be called more than once.
+func (t *WebRTCTransport) reservePending() (func(), bool) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if t.pending >= webrtcMaxPending {
+        return nil, false
+    }
+    t.pending++
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            t.lock.Lock()
+            t.pending--
+            t.lock.Unlock()
+        })
+    }, true
+}
+
+func (t *WebRTCTransport) handleSignal(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+    if err != nil {
+        http.Error(w, "bad request", http.StatusBadRequest)
+        return
+    }
+
+    var offer webrtc.SessionDescription
+    if err = json.Unmarshal(body, &offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+        http.Error(w, "bad request", http.StatusBadRequest)
+        return
+    }
+
+    if !t.checkAuth(r.Header.Get(webrtcAuthHeader), offer.SDP) {
+        log.Printf("Unauthenticated or replayed signaling request from %s\n", r.RemoteAddr)
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+
+    release, ok := t.reservePending()
+    if !ok {
+        log.Printf("Too many pending WebRTC connections, rejecting %s\n", r.RemoteAddr)
+        http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+        return
+    }
+
+    answer, err := t.answer(offer, r.RemoteAddr, release)
+    if err != nil {
+        release()
+        log.Printf("Error answering offer from %s: %s\n", r.RemoteAddr, err)
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(answer)
+}
+
+// Sets up a peer connection for the given offer, and returns our answer.  The
+// client is accepted once its data channel opens; release is called then, or
+// when we give up on it.
+func (t *WebRTCTransport) answer(offer webrtc.SessionDescription, from string, release func()) (*webrtc.SessionDescription, error) {
+    pc, err := webrtc.NewPeerConnection(webrtcConfig(&t.opts))
+    if err != nil {
+        return nil, err
+    }
+
+    // If the client never gets as far as opening a data channel, we still
+    // need to clean up.  Once it does, the client takes over this callback.
+    pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+        if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+            pc.Close()
+            release()
+        }
+    })
+
+    // Whichever happens first: the data channel opens, or we time out.
+    var decided sync.Once
+    decide := func() bool {
+        first := false
+        decided.Do(func() { first = true })
+        return first
+    }
+
+    timeout := time.AfterFunc(webrtcConnectTimeout, func() {
+        if decide() {
+            log.Printf("Timed out waiting for data channel from %s\n", from)
+            pc.Close()
+            release()
+        }
+    })
+
+    pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+        client := newWebRTCClient(pc, dc, from)
+        dc.OnOpen(func() {
+            if !decide() {
+                return
+            }
+            timeout.Stop()
+            release()
+            client.start()
+            t.accept_ch <- client
+        })
+    })
+
+    err = pc.SetRemoteDescription(offer)
+    if err != nil {
+        timeout.Stop()
+        pc.Close()
+        return nil, err
+    }
+
+    answer, err := pc.CreateAnswer(nil)
+    if err == nil {
+        gathered := webrtc.GatheringCompletePromise(pc)
+        if err = pc.SetLocalDescription(answer); err == nil {
+            <-gathered
+        }
+    }
+    if err != nil {
+        timeout.Stop()
+        pc.Close()
+        return nil, err
+    }
+
+    return pc.LocalDescription(), nil
+}
+
+func (t *WebRTCTransport) AcceptChannel() chan PacketClient {
+    return t.accept_ch
+}
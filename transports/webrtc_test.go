@@ -0,0 +1,199 @@
+package transports
+
+import (
+    "bytes"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+func postOffer(t *testing.T, url, auth, sdp string) int {
+    body, _ := json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp})
+    req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set(webrtcAuthHeader, auth)
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+}
+
+func TestWebRTCSignalAuth(t *testing.T) {
+    trans := newWebRTCTransport(&WebRTCOptions{Secret: "secret"})
+    server := httptest.NewServer(http.HandlerFunc(trans.handleSignal))
+    defer server.Close()
+
+    // Not a real offer, so a request that gets past the checks fails when we
+    // try to answer it.
+    sdp := "v=0\r\n"
+    stamp := func(offset time.Duration, nonce string) string {
+        timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+        return timestamp + ":" + nonce + ":" + signalMAC("secret", timestamp, nonce, sdp)
+    }
+
+    auth, err := signalAuth("secret", sdp)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if status := postOffer(t, server.URL, auth, sdp); status == http.StatusNotFound {
+        t.Errorf("valid request was rejected")
+    }
+    if status := postOffer(t, server.URL, auth, sdp); status != http.StatusNotFound {
+        t.Errorf("replayed request got %d", status)
+    }
+
+    bad, _ := signalAuth("wrong", sdp)
+    tests := []struct {
+        name string
+        auth string
+        sdp  string
+    }{
+        {"wrong secret", bad, sdp},
+        {"different offer", stamp(0, "a"), "v=1\r\n"},
+        {"old", stamp(-2*webrtcSignalSkew, "b"), sdp},
+        {"future", stamp(2*webrtcSignalSkew, "c"), sdp},
+        {"no nonce", stamp(0, ""), sdp},
+        {"malformed", "nonsense", sdp},
+        {"empty", "", sdp},
+    }
+    for _, test := range tests {
+        if status := postOffer(t, server.URL, test.auth, test.sdp); status != http.StatusNotFound {
+            t.Errorf("%s: got %d", test.name, status)
+        }
+    }
+}
+
+func TestWebRTCSetSecret(t *testing.T) {
+    trans := newWebRTCTransport(&WebRTCOptions{Secret: "secret"})
+    trans.SetSecret("new")
+
+    sdp := "v=0\r\n"
+    old, _ := signalAuth("secret", sdp)
+    if trans.checkAuth(old, sdp) {
+        t.Error("accepted the old secret")
+    }
+    auth, _ := signalAuth("new", sdp)
+    if !trans.checkAuth(auth, sdp) {
+        t.Error("rejected the new secret")
+    }
+}
+
+func TestWebRTCPendingLimit(t *testing.T) {
+    trans := newWebRTCTransport(&WebRTCOptions{Secret: "secret"})
+
+    var releases []func()
+    for i := 0; i < webrtcMaxPending; i++ {
+        release, ok := trans.reservePending()
+        if !ok {
+            t.Fatalf("reservation %d failed", i)
+        }
+        releases = append(releases, release)
+    }
+    if _, ok := trans.reservePending(); ok {
+        t.Fatalf("reserved more than %d", webrtcMaxPending)
+    }
+
+    // Releasing twice only frees one slot.
+    releases[0]()
+    releases[0]()
+    if _, ok := trans.reservePending(); !ok {
+        t.Fatalf("released slot wasn't freed")
+    }
+    if _, ok := trans.reservePending(); ok {
+        t.Fatalf("double release freed two slots")
+    }
+}
+
+// Connects a client and server over loopback, using a local STUN server.
+func TestWebRTCConnect(t *testing.T) {
+    if pc, err := webrtc.NewPeerConnection(webrtc.Configuration{}); err != nil {
+        t.Skipf("can't create peer connections: %s", err)
+    } else {
+        pc.Close()
+    }
+
+    stun_addr, _ := startTestTURNServer(t, "user", "pass")
+    opts := &WebRTCOptions{
+        Secret:      "secret",
+        STUNServers: []string{"stun:" + stun_addr},
+    }
+
+    trans := newWebRTCTransport(opts)
+    signal := httptest.NewServer(http.HandlerFunc(trans.handleSignal))
+    defer signal.Close()
+
+    client_opts := *opts
+    client_opts.SignalURL = signal.URL
+    client, err := NewWebRTCPacketClient("127.0.0.1", &client_opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    var server_client PacketClient
+    select {
+    case server_client = <-trans.AcceptChannel():
+    case <-time.After(webrtcConnectTimeout):
+        t.Fatal("server didn't accept the client")
+    }
+    defer server_client.Close()
+
+    // The data channel is unreliable, so keep sending until something
+    // arrives.
+    exchange := func(from, to PacketClient, msg string) {
+        for i := 0; i < 50; i++ {
+            from.SendChannel() <- []byte(msg)
+            select {
+            case pkt := <-to.RecvChannel():
+                if string(pkt) != msg {
+                    t.Fatalf("got %q, expected %q", pkt, msg)
+                }
+                return
+            case <-time.After(100 * time.Millisecond):
+            }
+        }
+        t.Fatalf("%q never arrived", msg)
+    }
+    exchange(client, server_client, "ping")
+    exchange(server_client, client, "pong")
+}
+
+// Addresses that haven't knocked don't even get an HTTP response.
+func TestWebRTCSignalFiltered(t *testing.T) {
+    inner, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var allow int32
+    listener := &filteredListener{inner, func(addr net.Addr) bool { return atomic.LoadInt32(&allow) != 0 }}
+    defer listener.Close()
+
+    trans := newWebRTCTransport(&WebRTCOptions{Secret: "secret"})
+    server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(trans.handleSignal)}}
+    server.Start()
+    defer server.Close()
+
+    if resp, err := http.Get(server.URL); err == nil {
+        resp.Body.Close()
+        t.Fatalf("got %s from a filtered address", resp.Status)
+    }
+
+    atomic.StoreInt32(&allow, 1)
+    resp, err := http.Get(server.URL)
+    if err != nil {
+        t.Fatalf("allowed address can't connect: %s", err)
+    }
+    resp.Body.Close()
+}